@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// sumCharges returns the total amount of charges, taxes included
+func sumCharges(charges []Charge) (total int64) {
+	for _, c := range charges {
+		total += c.Amount + c.Tax
+	}
+	return
+}
+
+// setInvoiceAmount sets the amount of an invoice to the total of its
+// charges, unless the amount is overridden. An amount set by the client
+// without overriding it must match that total.
+func setInvoiceAmount(i *Invoice, amountSet bool, total int64) validationErrors {
+	if i.AmountOverride {
+		return nil
+	}
+	if amountSet && i.Amount != total {
+		var errs validationErrors
+		errs.add("amount", "must equal the total of the charges and their taxes, %s %s, unless amount_override is set",
+			formatMinorUnits(total, i.Currency), i.Currency)
+		return errs
+	}
+	i.Amount = total
+	return nil
+}
+
+// amountDrift is an invoice whose amount differs from the total of its
+// charges without being overridden, usually because it was stored before
+// amounts were computed by the invoicer
+type amountDrift struct {
+	InvoiceID uint   `json:"invoice_id"`
+	Currency  string `json:"currency"`
+	Amount    int64  `json:"amount"`
+	Total     int64  `json:"total"`
+}
+
+type amountDriftReport struct {
+	Drifts []amountDrift `json:"drifts"`
+	Fixed  int           `json:"fixed"`
+}
+
+// getAmountDrift lists the invoices whose amount differs from the total of
+// their charges
+func (iv *invoicer) getAmountDrift(w http.ResponseWriter, r *http.Request) {
+	drifts, err := iv.invoicesFor(r).AmountDrift()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to check invoice amounts: %s", err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, amountDriftReport{Drifts: drifts})
+	al := appLog{Message: fmt.Sprintf("found %d invoices with amounts drifting from their charges", len(drifts)), Action: "get-amount-drift"}
+	al.log(r)
+}
+
+// postAmountDriftFix sets the amount of drifting invoices to the total of
+// their charges, and lists the invoices it fixed. Invoices modified while
+// being fixed are left for a later run.
+func (iv *invoicer) postAmountDriftFix(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	drifts, err := iv.invoicesFor(r).AmountDrift()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to check invoice amounts: %s", err)
+		return
+	}
+	report := amountDriftReport{Drifts: []amountDrift{}}
+	for _, d := range drifts {
+		i1, err := iv.invoicesFor(r).Get(d.InvoiceID, false)
+		if err != nil || i1.Amount != d.Amount || i1.AmountOverride {
+			continue
+		}
+		current, before := i1, iv.invoiceSnapshot(i1.ID)
+		i1.Amount = d.Total
+		err = iv.invoicesFor(r).Update(&i1, false)
+		if err != nil {
+			al := appLog{Message: fmt.Sprintf("failed to fix the amount of invoice %d: %s", i1.ID, err)}
+			al.log(r)
+			continue
+		}
+		report.Drifts = append(report.Drifts, d)
+		report.Fixed++
+		iv.audit(r, "fix-amount", i1.ID, before, iv.invoiceSnapshot(i1.ID))
+		iv.fireInvoiceUpdated(current, i1)
+	}
+	writeJSON(w, r, http.StatusOK, report)
+	al := appLog{Message: fmt.Sprintf("fixed the amount of %d invoices out of %d", report.Fixed, len(drifts)), Action: "post-amount-drift-fix"}
+	al.log(r)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/auth"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+
+	// apiKeyPrefix marks the bearer tokens that are API keys, leaving the
+	// other bearer tokens to the OpenID Connect provider
+	apiKeyPrefix = "inv_"
+
+	// apiKeyIDLength is the length of the public part of a key, used to
+	// look it up without revealing its secret
+	apiKeyIDLength = 8
+
+	ctxAPIKeyID     = "apiKeyID"
+	ctxAPIKeyScopes = "apiKeyScopes"
+)
+
+var apiKeyScopes = []string{scopeRead, scopeWrite, scopeDelete}
+
+// APIKey authenticates a machine client. Only the hash of the secret part
+// of the key is stored, the key itself is returned once when it is issued.
+type APIKey struct {
+	gorm.Model
+	Name       string     `json:"name"`
+	Lookup     string     `gorm:"unique_index" json:"prefix"`
+	Hash       string     `json:"-"`
+	Scopes     string     `json:"scopes"`
+	CreatedBy  string     `json:"created_by"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+func (k APIKey) scopes() []string {
+	var scopes []string
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// newAPIKey generates a key of the form inv_<lookup>_<secret>
+func newAPIKey() (key, lookup, hash string, err error) {
+	lookup, err = randomString(6)
+	if err != nil {
+		return
+	}
+	lookup = strings.NewReplacer("-", "a", "_", "b").Replace(lookup)[:apiKeyIDLength]
+	secret, err := randomString(32)
+	if err != nil {
+		return
+	}
+	return apiKeyPrefix + lookup + "_" + secret, lookup, hashAPIKeySecret(secret), nil
+}
+
+// apiKeyFromContext returns the ID of the API key that authenticated a
+// request, if any
+func apiKeyFromContext(r *http.Request) (uint, bool) {
+	id, ok := r.Context().Value(ctxAPIKeyID).(uint)
+	return id, ok
+}
+
+// authenticateAPIKey checks an API key and returns it if it is valid
+func (iv *invoicer) authenticateAPIKey(token string) (k APIKey, err error) {
+	token = strings.TrimPrefix(token, apiKeyPrefix)
+	if len(token) < apiKeyIDLength+2 || token[apiKeyIDLength] != '_' {
+		return k, auth.ErrInvalidCredentials
+	}
+	iv.db.Where("lookup = ?", token[:apiKeyIDLength]).First(&k)
+	hash := hashAPIKeySecret(token[apiKeyIDLength+1:])
+	if k.ID == 0 || subtle.ConstantTimeCompare([]byte(hash), []byte(k.Hash)) != 1 {
+		return k, auth.ErrInvalidCredentials
+	}
+	if k.RevokedAt != nil {
+		return k, fmt.Errorf("%v: key %d was revoked", auth.ErrInvalidCredentials, k.ID)
+	}
+	// record usage at most once a minute to avoid a write per request
+	now := time.Now().UTC()
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > time.Minute {
+		iv.db.Model(&k).UpdateColumn("last_used_at", now)
+	}
+	return k, nil
+}
+
+// authenticateAPIKeys authenticates requests carrying an API key as a
+// bearer token, or in the token parameter of the feeds that calendar
+// clients subscribe to, which cannot send headers. The user of the request
+// is set to apikey:<id> and the key ID and scopes are stored in the request
+// context, for authorize to check. Other requests are left to the
+// authenticator.
+func (iv *invoicer) authenticateAPIKeys(exempt []string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authz := r.Header.Get("Authorization")
+			if authz == "" && r.URL.Path == dueCalendarPath && r.URL.Query().Get("token") != "" {
+				authz = "Bearer " + r.URL.Query().Get("token")
+			}
+			if len(authz) < 7 || !strings.EqualFold(authz[:7], "Bearer ") ||
+				!strings.HasPrefix(strings.TrimSpace(authz[7:]), apiKeyPrefix) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			for _, p := range exempt {
+				if r.URL.Path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p)) {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+			k, err := iv.authenticateAPIKey(strings.TrimSpace(authz[7:]))
+			if err != nil {
+				al := appLog{ErrorCode: http.StatusUnauthorized, Message: fmt.Sprintf("authentication failed: %s", err)}
+				al.log(r)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="invoicer"`)
+				writeError(w, r, http.StatusUnauthorized, apiError{Code: errUnauthorized, Message: "invalid API key"})
+				return
+			}
+			r = r.WithContext(auth.NewContext(r.Context(), fmt.Sprintf("apikey:%d", k.ID)))
+			r = addtoContext(r, ctxAPIKeyID, k.ID)
+			r = addtoContext(r, ctxAPIKeyScopes, k.scopes())
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func escapeAPIKey(k *APIKey) {
+	k.Name = html.EscapeString(k.Name)
+	k.CreatedBy = html.EscapeString(k.CreatedBy)
+}
+
+func (iv *invoicer) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var keys []APIKey
+	err := iv.dbFor(r).Order("id asc").Find(&keys).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve API keys: %s", err)
+		return
+	}
+	for i := range keys {
+		escapeAPIKey(&keys[i])
+	}
+	writeJSON(w, r, http.StatusOK, keys)
+}
+
+type issuedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// postAPIKey issues a new key. The response is the only time the key is
+// disclosed, it cannot be recovered afterwards.
+func (iv *invoicer) postAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if !readJSONBody(w, r, &req) {
+		return
+	}
+	var errs validationErrors
+	if strings.TrimSpace(req.Name) == "" {
+		errs.add("name", "must not be empty")
+	}
+	if len(req.Scopes) == 0 {
+		errs.add("scopes", "must contain at least one of %s", strings.Join(apiKeyScopes, ", "))
+	}
+	for n, s := range req.Scopes {
+		known := false
+		for _, scope := range apiKeyScopes {
+			known = known || s == scope
+		}
+		if !known {
+			errs.add(fmt.Sprintf("scopes[%d]", n), "unknown scope %q", s)
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	key, lookup, hash, err := newAPIKey()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to generate API key: %s", err)
+		return
+	}
+	admin, _ := auth.UserFromContext(r.Context())
+	k := APIKey{Name: req.Name, Lookup: lookup, Hash: hash, Scopes: strings.Join(req.Scopes, ","), CreatedBy: admin}
+	err = iv.dbFor(r).Create(&k).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to store API key: %s", err)
+		return
+	}
+	escapeAPIKey(&k)
+	writeJSON(w, r, http.StatusCreated, issuedAPIKey{APIKey: k, Key: key})
+	al := appLog{Message: fmt.Sprintf("issued API key %d with scopes %s", k.ID, k.Scopes), Action: "post-api-key"}
+	al.log(r)
+}
+
+// deleteAPIKey revokes a key. Revoked keys are kept so the audit trail of
+// what they did still resolves.
+func (iv *invoicer) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	var k APIKey
+	iv.dbFor(r).First(&k, vars["id"])
+	if k.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No API key id %s", vars["id"])
+		return
+	}
+	if k.RevokedAt == nil {
+		now := time.Now().UTC()
+		iv.dbFor(r).Model(&k).Update("revoked_at", &now)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("revoked API key %d", k.ID)))
+	al := appLog{Message: fmt.Sprintf("revoked API key %d", k.ID), Action: "delete-api-key"}
+	al.log(r)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// maxAttachmentsPerUpload bounds the files of a single upload, and so
+	// the size of its body
+	maxAttachmentsPerUpload = 10
+)
+
+// Attachment describes a file attached to an invoice, such as a receipt or
+// a contract, or the receipt of an expense, which has no invoice. Its
+// content is kept in the blob store under StorageKey.
+type Attachment struct {
+	ID          uint      `gorm:"primary_key" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	InvoiceID   uint      `gorm:"index" json:"invoice_id"`
+	ExpenseID   uint      `gorm:"index" json:"expense_id,omitempty"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `gorm:"column:sha256" json:"sha256"`
+	StorageKey  string    `json:"-"`
+	UploadedBy  string    `json:"uploaded_by"`
+}
+
+func escapeAttachment(a *Attachment) {
+	a.Filename = html.EscapeString(a.Filename)
+	a.UploadedBy = html.EscapeString(a.UploadedBy)
+}
+
+// attachmentStore validates attachments and keeps their content in a blob
+// store
+type attachmentStore struct {
+	blobs   blobStore
+	maxSize int64
+	types   map[string]bool
+}
+
+// newAttachmentStore configures the blob store of attachments and the
+// size and media types of the files accepted
+func newAttachmentStore(cfg config.Attachments) *attachmentStore {
+	s := &attachmentStore{blobs: newBlobStore(cfg), maxSize: int64(cfg.MaxSize), types: make(map[string]bool)}
+	for _, t := range cfg.Types {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			s.types[t] = true
+		}
+	}
+	return s
+}
+
+// contentType returns the media type of an uploaded file, sniffed from its
+// content so clients can't store executable content under an innocuous
+// type. The declared type is kept when it refines a sniffed text/plain,
+// such as text/csv, which sniffing can't tell apart.
+func (s *attachmentStore) contentType(declared string, data []byte) (string, error) {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	declared, _, _ = mime.ParseMediaType(declared)
+	contentType := sniffed
+	if sniffed == "text/plain" && strings.HasPrefix(declared, "text/") {
+		contentType = declared
+	}
+	if !s.types[contentType] {
+		var allowed []string
+		for t := range s.types {
+			allowed = append(allowed, t)
+		}
+		sort.Strings(allowed)
+		return "", fmt.Errorf("files of type %s are not accepted, must be one of %s", contentType, strings.Join(allowed, ", "))
+	}
+	return contentType, nil
+}
+
+// attachmentUpload is a validated file of an upload, before it is stored
+type attachmentUpload struct {
+	a    Attachment
+	data []byte
+}
+
+// readUploads reads and validates the files of a multipart/form-data upload
+// of at most max files, answering the request with an error if any of them
+// is invalid
+func (iv *invoicer) readUploads(w http.ResponseWriter, r *http.Request, max int) ([]attachmentUpload, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(max)*iv.attachments.maxSize+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "attachments must be uploaded as multipart/form-data: %s", err)
+		return nil, false
+	}
+	var (
+		uploads []attachmentUpload
+		errs    validationErrors
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			httpError(w, r, uploadErrorStatus(err), "failed to read upload: %s", err)
+			return nil, false
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		if len(uploads) == max {
+			httpError(w, r, http.StatusRequestEntityTooLarge, "at most %d files can be uploaded at once", max)
+			return nil, false
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(part, iv.attachments.maxSize+1))
+		if err != nil {
+			httpError(w, r, uploadErrorStatus(err), "failed to read upload: %s", err)
+			return nil, false
+		}
+		field := fmt.Sprintf("files[%d]", len(uploads))
+		if int64(len(data)) > iv.attachments.maxSize {
+			httpError(w, r, http.StatusRequestEntityTooLarge, "%s is larger than %d bytes", part.FileName(), iv.attachments.maxSize)
+			return nil, false
+		}
+		if len(data) == 0 {
+			errs.add(field, "%s is empty", part.FileName())
+		}
+		contentType, err := iv.attachments.contentType(part.Header.Get("Content-Type"), data)
+		if err != nil {
+			errs.add(field, "%s", err)
+		}
+		sum := sha256.Sum256(data)
+		uploads = append(uploads, attachmentUpload{Attachment{
+			Filename:    part.FileName(),
+			ContentType: contentType,
+			Size:        int64(len(data)),
+			SHA256:      hex.EncodeToString(sum[:]),
+			UploadedBy:  actorOf(r),
+		}, data})
+	}
+	if len(uploads) == 0 {
+		errs.add("files", "no file was uploaded")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return nil, false
+	}
+	return uploads, true
+}
+
+// storeAttachment puts the content of an attachment in the blob store,
+// under a random key below prefix, and records it in db. The content is
+// deleted again if it can't be recorded.
+func (iv *invoicer) storeAttachment(db *gorm.DB, a *Attachment, data []byte, prefix string) error {
+	key, err := randomString(18)
+	if err == nil {
+		a.StorageKey = prefix + key
+		err = iv.attachments.blobs.Put(a.StorageKey, a.ContentType, data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store %s: %s", a.Filename, err)
+	}
+	err = db.Create(a).Error
+	if err != nil {
+		iv.attachments.blobs.Delete(a.StorageKey)
+		return fmt.Errorf("failed to record %s: %s", a.Filename, err)
+	}
+	return nil
+}
+
+// postInvoiceAttachments stores the files of a multipart/form-data upload
+// as attachments of an invoice. Every file must be valid for any to be
+// stored.
+func (iv *invoicer) postInvoiceAttachments(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	uploads, ok := iv.readUploads(w, r, maxAttachmentsPerUpload)
+	if !ok {
+		return
+	}
+	attachments := []Attachment{}
+	for _, u := range uploads {
+		u.a.InvoiceID = i1.ID
+		err := iv.storeAttachment(iv.dbFor(r), &u.a, u.data, fmt.Sprintf("invoices/%d/", i1.ID))
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		al := appLog{Message: fmt.Sprintf("attached %s to invoice %d as attachment %d", u.a.Filename, i1.ID, u.a.ID), Action: "post-invoice-attachments"}
+		al.log(r)
+		iv.audit(r, "attach", i1.ID, nil, map[string]interface{}{"attachment": u.a.Filename, "attachment_id": u.a.ID})
+		escapeAttachment(&u.a)
+		attachments = append(attachments, u.a)
+	}
+	writeJSON(w, r, http.StatusCreated, attachments)
+}
+
+// uploadErrorStatus tells uploads exceeding the size of their body from
+// malformed ones
+func uploadErrorStatus(err error) int {
+	if strings.Contains(err.Error(), "request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func (iv *invoicer) getInvoiceAttachments(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	attachments := []Attachment{}
+	err := iv.dbFor(r).Where("invoice_id = ?", i1.ID).Order("id asc").Find(&attachments).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve attachments of invoice %d: %s", i1.ID, err)
+		return
+	}
+	for n := range attachments {
+		escapeAttachment(&attachments[n])
+	}
+	writeJSON(w, r, http.StatusOK, attachments)
+}
+
+// loadAttachment retrieves the attachment of a request, unless its invoice
+// was deleted
+func (iv *invoicer) loadAttachment(w http.ResponseWriter, r *http.Request) (Attachment, bool) {
+	vars := mux.Vars(r)
+	var a Attachment
+	res := iv.dbFor(r).First(&a, vars["id"])
+	if res.RecordNotFound() {
+		httpError(w, r, http.StatusNotFound, "No attachment id %s", vars["id"])
+		return a, false
+	}
+	if res.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve attachment id %s: %s", vars["id"], res.Error)
+		return a, false
+	}
+	_, err := iv.invoicesFor(r).Get(a.InvoiceID, false)
+	if err == errInvoiceNotFound {
+		httpError(w, r, http.StatusNotFound, "No attachment id %s", vars["id"])
+		return a, false
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve invoice %d: %s", a.InvoiceID, err)
+		return a, false
+	}
+	return a, true
+}
+
+func (iv *invoicer) getAttachment(w http.ResponseWriter, r *http.Request) {
+	a, ok := iv.loadAttachment(w, r)
+	if !ok {
+		return
+	}
+	iv.serveAttachment(w, r, a)
+}
+
+// serveAttachment downloads an attachment with the content type it was
+// validated as. Browsers are told to save it rather than render it.
+func (iv *invoicer) serveAttachment(w http.ResponseWriter, r *http.Request, a Attachment) {
+	etag := `"` + a.SHA256 + `"`
+	w.Header().Set("ETag", etag)
+	if notModified(r, etag, a.CreatedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	content, err := iv.attachments.blobs.Get(a.StorageKey)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve content of attachment %d: %s", a.ID, err)
+		return
+	}
+	defer content.Close()
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Last-Modified", a.CreatedAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, content)
+}
+
+func (iv *invoicer) deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	a, ok := iv.loadAttachment(w, r)
+	if !ok {
+		return
+	}
+	err := iv.dbFor(r).Delete(&a).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to delete attachment %d: %s", a.ID, err)
+		return
+	}
+	// a blob left behind is only wasted space, the attachment is gone
+	if err = iv.attachments.blobs.Delete(a.StorageKey); err != nil {
+		requestLogger(r).errorf("failed to delete content of attachment %d: %s", a.ID, err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted attachment %d", a.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted attachment %d of invoice %d", a.ID, a.InvoiceID), Action: "delete-attachment"}
+	al.log(r)
+	iv.audit(r, "detach", a.InvoiceID, map[string]interface{}{"attachment": a.Filename, "attachment_id": a.ID}, nil)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/auth"
+	"github.com/gorilla/mux"
+)
+
+// AuditEvent records a mutation of an invoice: who made it, through which
+// request, and the state of the invoice before and after it. Events are
+// kept when invoices are deleted.
+type AuditEvent struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+	Actor     string
+	APIKeyID  uint
+	RequestID string
+	Action    string
+	InvoiceID uint   `gorm:"index"`
+	Before    string `gorm:"type:text"`
+	After     string `gorm:"type:text"`
+	Changes   string `gorm:"type:text"`
+}
+
+type auditEventView struct {
+	ID        uint            `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Actor     string          `json:"actor"`
+	APIKeyID  uint            `json:"api_key_id,omitempty"`
+	RequestID string          `json:"request_id"`
+	Action    string          `json:"action"`
+	InvoiceID uint            `json:"invoice_id"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	Changes   json.RawMessage `json:"changes"`
+}
+
+type fieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type chargeSnapshot struct {
+	Type        string `json:"type"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	Description string `json:"description"`
+	CategoryID  uint   `json:"category_id,omitempty"`
+	TaxRateID   uint   `json:"tax_rate_id,omitempty"`
+	Tax         int64  `json:"tax,omitempty"`
+}
+
+// invoiceSnapshot returns the stored state of an invoice as a JSON object,
+// or nil if it doesn't exist. Charges are included without their ids, which
+// change whenever they are replaced, unless there are too many of them, in
+// which case only their summary is.
+func (iv *invoicer) invoiceSnapshot(id uint) map[string]interface{} {
+	i, err := iv.invoices.Get(id, false)
+	if err != nil {
+		return nil
+	}
+	snapshot := map[string]interface{}{
+		"customer_id":  i.CustomerID,
+		"status":       i.Status,
+		"is_paid":      i.IsPaid,
+		"amount":       i.Amount,
+		"currency":     i.Currency,
+		"payment_date": i.PaymentDate,
+		"due_date":     i.DueDate,
+	}
+	if credited, err := creditedAmount(iv.db, i.ID); err == nil {
+		snapshot["credited"] = credited
+	}
+	summary, err := iv.invoices.SummarizeCharges(i.ID)
+	if err == nil && summary.Count > maxInlineCharges {
+		snapshot["charges_summary"] = map[string]interface{}{"count": summary.Count, "total": summary.Total}
+	} else {
+		charges, _ := iv.invoices.Charges(i, 0, 0)
+		list := make([]chargeSnapshot, len(charges))
+		for n, c := range charges {
+			list[n] = chargeSnapshot{
+				Type:        html.EscapeString(c.Type),
+				Amount:      c.Amount,
+				Currency:    c.Currency,
+				Description: html.EscapeString(c.Description),
+				CategoryID:  c.CategoryID,
+				TaxRateID:   c.TaxRateID,
+				Tax:         c.Tax,
+			}
+		}
+		snapshot["charges"] = list
+	}
+	// normalize the values to what they look like once decoded from JSON,
+	// so snapshots can be compared field by field
+	data, _ := json.Marshal(snapshot)
+	var normalized map[string]interface{}
+	json.Unmarshal(data, &normalized)
+	return normalized
+}
+
+// diffSnapshots returns the fields that differ between two snapshots
+func diffSnapshots(before, after map[string]interface{}) map[string]fieldChange {
+	changes := make(map[string]fieldChange)
+	for k, v := range before {
+		if !reflect.DeepEqual(v, after[k]) {
+			changes[k] = fieldChange{Before: v, After: after[k]}
+		}
+	}
+	for k, v := range after {
+		if _, ok := before[k]; !ok {
+			changes[k] = fieldChange{Before: nil, After: v}
+		}
+	}
+	return changes
+}
+
+// audit records a mutation of an invoice by the user of a request, or by
+// the invoicer itself if r is nil. Audit failures are logged but don't fail
+// the request, the mutation is already committed by then.
+func (iv *invoicer) audit(r *http.Request, action string, invoiceID uint, before, after map[string]interface{}) {
+	changes := diffSnapshots(before, after)
+	if len(changes) == 0 && before != nil && after != nil {
+		return
+	}
+	e := AuditEvent{Actor: "system", Action: action, InvoiceID: invoiceID}
+	if r != nil {
+		e.Actor, e.RequestID = "anonymous", requestID(r)
+		if user, ok := auth.UserFromContext(r.Context()); ok {
+			e.Actor = user
+		}
+		if id, ok := apiKeyFromContext(r); ok {
+			e.APIKeyID = id
+		}
+	}
+	data, _ := json.Marshal(before)
+	e.Before = string(data)
+	data, _ = json.Marshal(after)
+	e.After = string(data)
+	data, _ = json.Marshal(changes)
+	e.Changes = string(data)
+	err := iv.dbFor(r).Create(&e).Error
+	if err != nil {
+		requestLogger(r).errorf("failed to record audit event %s of invoice %d: %s", action, invoiceID, err)
+	}
+}
+
+// getInvoiceHistory lists the audit events of an invoice, oldest first. The
+// history of deleted invoices remains available.
+func (iv *invoicer) getInvoiceHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var events []AuditEvent
+	err := iv.dbFor(r).Where("invoice_id = ?", vars["id"]).Order("id asc").Find(&events).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve history of invoice %s: %s", vars["id"], err)
+		return
+	}
+	if len(events) == 0 {
+		var i1 Invoice
+		iv.dbFor(r).First(&i1, vars["id"])
+		if i1.ID == 0 {
+			httpError(w, r, http.StatusNotFound, "No invoice id %s", vars["id"])
+			return
+		}
+	}
+	history := make([]auditEventView, len(events))
+	for n, e := range events {
+		history[n] = auditEventView{
+			ID:        e.ID,
+			CreatedAt: e.CreatedAt,
+			Actor:     html.EscapeString(e.Actor),
+			APIKeyID:  e.APIKeyID,
+			RequestID: e.RequestID,
+			Action:    e.Action,
+			InvoiceID: e.InvoiceID,
+			Before:    json.RawMessage(e.Before),
+			After:     json.RawMessage(e.After),
+			Changes:   json.RawMessage(e.Changes),
+		}
+	}
+	writeJSON(w, r, http.StatusOK, history)
+	al := appLog{Message: fmt.Sprintf("retrieved %d audit events of invoice %s", len(history), vars["id"]), Action: "get-invoice-history"}
+	al.log(r)
+}
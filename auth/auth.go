@@ -0,0 +1,165 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package auth authenticates the requests made to the invoicer. Credentials
+// are checked by a list of providers, such as static users, htpasswd files
+// or OpenID Connect bearer tokens, applied to every route as a middleware.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNoCredentials is returned by providers when a request does not
+	// carry credentials they know how to verify
+	ErrNoCredentials = errors.New("no credentials provided")
+
+	// ErrInvalidCredentials is returned by providers when a request carries
+	// credentials that they reject
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Provider verifies the credentials carried by a request
+type Provider interface {
+	// Authenticate returns the name of the user making the request, or
+	// ErrNoCredentials if the request has no credentials for this provider
+	Authenticate(r *http.Request) (string, error)
+
+	// Challenge returns the value of the WWW-Authenticate header sent to
+	// clients that need to authenticate with this provider, or an empty
+	// string for providers that have no challenge, such as sessions
+	Challenge(realm string) string
+}
+
+// PasswordChecker is implemented by the providers that verify passwords,
+// which can then be used to log in and open a session
+type PasswordChecker interface {
+	// CheckPassword returns ErrInvalidCredentials unless password is the
+	// password of user
+	CheckPassword(user, password string) error
+}
+
+type contextKey int
+
+const userKey contextKey = 0
+
+// NewContext returns a copy of ctx carrying the name of the authenticated user
+func NewContext(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// UserFromContext returns the name of the user authenticated on a request
+// context, if any
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey).(string)
+	return user, ok
+}
+
+// Authenticator checks every request against a list of providers, and only
+// lets through requests that at least one provider authenticates
+type Authenticator struct {
+	// Realm is sent to clients in authentication challenges
+	Realm string
+
+	Providers []Provider
+
+	// PublicPaths lists the paths that do not require authentication. Paths
+	// ending with a slash match every path below them.
+	PublicPaths []string
+
+	// OnFailure, if set, is called when a request fails authentication
+	OnFailure func(r *http.Request, err error)
+
+	// Unauthorized, if set, writes the body of 401 responses once the
+	// challenges are set. A plain text message is sent otherwise.
+	Unauthorized http.HandlerFunc
+}
+
+func (a *Authenticator) isPublic(path string) bool {
+	for _, p := range a.PublicPaths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate tries each provider in turn and returns the first user
+// they authenticate
+func (a *Authenticator) authenticate(r *http.Request) (string, error) {
+	err := ErrNoCredentials
+	for _, p := range a.Providers {
+		user, perr := p.Authenticate(r)
+		if perr == nil {
+			return user, nil
+		}
+		if perr != ErrNoCredentials {
+			err = perr
+		}
+	}
+	return "", err
+}
+
+// Login checks the password of a user against the providers verifying
+// passwords. It returns ErrNoCredentials if none of them does.
+func (a *Authenticator) Login(user, password string) error {
+	err := ErrNoCredentials
+	for _, p := range a.Providers {
+		checker, ok := p.(PasswordChecker)
+		if !ok {
+			continue
+		}
+		err = checker.CheckPassword(user, password)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Middleware returns an http middleware that rejects unauthenticated requests
+// with a 401 and stores the authenticated user in the request context
+func (a *Authenticator) Middleware() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// let through requests already authenticated by an earlier
+			// middleware, such as API keys
+			if _, ok := UserFromContext(r.Context()); ok || a.isPublic(r.URL.Path) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			user, err := a.authenticate(r)
+			if err != nil {
+				if a.OnFailure != nil {
+					a.OnFailure(r, err)
+				}
+				challenges := make(map[string]bool)
+				for _, p := range a.Providers {
+					challenge := p.Challenge(a.Realm)
+					if challenge != "" && !challenges[challenge] {
+						w.Header().Add("WWW-Authenticate", challenge)
+						challenges[challenge] = true
+					}
+				}
+				if a.Unauthorized != nil {
+					a.Unauthorized(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`please authenticate`))
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(NewContext(r.Context(), user)))
+		})
+	}
+}
+
+func basicChallenge(realm string) string {
+	return fmt.Sprintf(`Basic realm=%q`, realm)
+}
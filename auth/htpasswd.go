@@ -0,0 +1,124 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd authenticates http basic auth credentials against an Apache
+// htpasswd file. Only bcrypt and {SHA} hashes are supported. The file is
+// reloaded when its modification time changes.
+type Htpasswd struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	hashes  map[string]string
+}
+
+// NewHtpasswd loads the htpasswd file at path and returns a provider for it
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	err := h.reload()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload parses the htpasswd file again if it changed since the last load
+func (h *Htpasswd) reload() error {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if fi.ModTime().Equal(h.modTime) && h.hashes != nil {
+		return nil
+	}
+	fd, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return fmt.Errorf("%s:%d: invalid htpasswd entry", h.path, n)
+		}
+		hash := line[i+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("%s:%d: unsupported hash for user %q, use bcrypt or {SHA}", h.path, n, line[:i])
+		}
+		hashes[line[:i]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	h.hashes = hashes
+	h.modTime = fi.ModTime()
+	return nil
+}
+
+func (h *Htpasswd) hash(user string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hash, ok := h.hashes[user]
+	return hash, ok
+}
+
+// Authenticate implements Provider
+func (h *Htpasswd) Authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	return user, h.CheckPassword(user, password)
+}
+
+// CheckPassword implements PasswordChecker
+func (h *Htpasswd) CheckPassword(user, password string) error {
+	// keep serving the previous version of the file if it can't be reloaded
+	h.reload()
+	hash, ok := h.hash(user)
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		if subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(hash[5:])) != 1 {
+			return ErrInvalidCredentials
+		}
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// Challenge implements Provider
+func (h *Htpasswd) Challenge(realm string) string {
+	return basicChallenge(realm)
+}
@@ -0,0 +1,255 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256" // register SHA-256 and SHA-384
+	_ "crypto/sha512" // register SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is how often the signing keys of the issuer
+	// are fetched again
+	jwksRefreshInterval = time.Hour
+
+	// jwksMinRefreshInterval limits how often an unknown key ID can
+	// trigger a refresh of the signing keys
+	jwksMinRefreshInterval = time.Minute
+
+	// clockSkew is the leeway given when checking token expiration
+	clockSkew = time.Minute
+)
+
+var rsaAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// OIDC authenticates OAuth2 bearer tokens issued as RSA signed JWTs by an
+// OpenID Connect provider. Signing keys are discovered from the issuer and
+// cached. The user is identified by the email claim of the token, or by
+// its subject if it has no email.
+type OIDC struct {
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewOIDC returns a provider that accepts tokens issued by issuer for the
+// given audience, usually the client ID of the invoicer
+func NewOIDC(issuer, audience string) *OIDC {
+	return &OIDC{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	Expiry    int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	Email     string          `json:"email"`
+}
+
+// hasAudience returns true if the aud claim, a string or a list of
+// strings, contains audience
+func (c jwtClaims) hasAudience(audience string) bool {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(c.Audience, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticate implements Provider
+func (o *OIDC) Authenticate(r *http.Request) (string, error) {
+	authz := r.Header.Get("Authorization")
+	if len(authz) < 7 || !strings.EqualFold(authz[:7], "Bearer ") {
+		return "", ErrNoCredentials
+	}
+	claims, err := o.verify(strings.TrimSpace(authz[7:]))
+	if err != nil {
+		return "", err
+	}
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+	return claims.Subject, nil
+}
+
+// Challenge implements Provider
+func (o *OIDC) Challenge(realm string) string {
+	return fmt.Sprintf(`Bearer realm=%q`, realm)
+}
+
+// verify checks the signature and claims of a token and returns its claims
+func (o *OIDC) verify(token string) (claims jwtClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrNoCredentials
+	}
+	var header jwtHeader
+	err = decodeSegment(parts[0], &header)
+	if err != nil {
+		return claims, ErrInvalidCredentials
+	}
+	hash, ok := rsaAlgorithms[header.Alg]
+	if !ok {
+		return claims, fmt.Errorf("%v: unsupported signing algorithm %q", ErrInvalidCredentials, header.Alg)
+	}
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidCredentials
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig) != nil {
+		return claims, ErrInvalidCredentials
+	}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return claims, ErrInvalidCredentials
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != o.issuer:
+		return claims, fmt.Errorf("%v: unexpected issuer %q", ErrInvalidCredentials, claims.Issuer)
+	case !claims.hasAudience(o.audience):
+		return claims, fmt.Errorf("%v: token not issued for audience %q", ErrInvalidCredentials, o.audience)
+	case claims.Expiry == 0 || now.Add(-clockSkew).After(time.Unix(claims.Expiry, 0)):
+		return claims, fmt.Errorf("%v: token expired", ErrInvalidCredentials)
+	case claims.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(claims.NotBefore, 0)):
+		return claims, fmt.Errorf("%v: token not yet valid", ErrInvalidCredentials)
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the signing key identified by kid, fetching the keys of the
+// issuer when they are missing, stale or don't contain kid
+func (o *OIDC) key(kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key, ok := o.keys[kid]
+	age := time.Since(o.fetchedAt)
+	if ok && age < jwksRefreshInterval {
+		return key, nil
+	}
+	if !ok && o.keys != nil && age < jwksMinRefreshInterval {
+		return nil, fmt.Errorf("%v: unknown signing key %q", ErrInvalidCredentials, kid)
+	}
+	keys, err := o.fetchKeys()
+	if err != nil {
+		// keep using cached keys while the issuer is unreachable
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve signing keys of %s: %v", o.issuer, err)
+	}
+	o.keys, o.fetchedAt = keys, time.Now()
+	key, ok = o.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%v: unknown signing key %q", ErrInvalidCredentials, kid)
+	}
+	return key, nil
+}
+
+// fetchKeys retrieves the RSA signing keys of the issuer from the jwks_uri
+// advertised in its discovery document
+func (o *OIDC) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	err := o.getJSON(o.issuer+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err = o.getJSON(discovery.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func (o *OIDC) getJSON(url string, v interface{}) error {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// StaticUsers authenticates http basic auth credentials against a fixed
+// list of users and passwords
+type StaticUsers struct {
+	passwords map[string][sha256.Size]byte
+}
+
+// NewStaticUsers returns a provider for the given map of user names to
+// passwords
+func NewStaticUsers(users map[string]string) *StaticUsers {
+	s := &StaticUsers{passwords: make(map[string][sha256.Size]byte, len(users))}
+	for user, password := range users {
+		s.passwords[user] = sha256.Sum256([]byte(password))
+	}
+	return s
+}
+
+// ParseStaticUsers parses a comma separated list of user:password pairs,
+// as found in the INVOICER_AUTH_USERS environment variable
+func ParseStaticUsers(list string) (*StaticUsers, error) {
+	users := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, ":")
+		if i < 1 || i == len(pair)-1 {
+			return nil, fmt.Errorf("invalid user definition %q, expected user:password", pair)
+		}
+		users[pair[:i]] = pair[i+1:]
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no users defined")
+	}
+	return NewStaticUsers(users), nil
+}
+
+// Authenticate implements Provider
+func (s *StaticUsers) Authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	return user, s.CheckPassword(user, password)
+}
+
+// CheckPassword implements PasswordChecker
+func (s *StaticUsers) CheckPassword(user, password string) error {
+	expected, known := s.passwords[user]
+	// hash the password even for unknown users so the time taken to
+	// reject them doesn't reveal which users exist
+	sum := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(sum[:], expected[:]) != 1 || !known {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// Challenge implements Provider
+func (s *StaticUsers) Challenge(realm string) string {
+	return basicChallenge(realm)
+}
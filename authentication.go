@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Wolverinever1/invoicer-chapter2/auth"
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+)
+
+// publicPaths can be reached without authentication or rate limits, for
+// health checks of load balancers and monitoring, for the webhooks of
+// payment providers, which sign their events instead, and for the CSRF
+// tokens browsers need to log in
+var publicPaths = []string{"/__heartbeat__", "/__lbheartbeat__", "/__version__", "/__api__/", "/statics/", "/webhooks/stripe", "/csrf-token"}
+
+// newAuthenticator configures the authentication providers enabled in the
+// auth section of the configuration:
+//   - users: user:password pairs
+//   - htpasswd_file: path to an htpasswd file of bcrypt or {SHA} hashes
+//   - oidc_issuer and oidc_audience: OpenID Connect issuer whose bearer
+//     tokens are accepted for the given audience
+//
+// It returns a nil authenticator if no provider is configured and
+// auth.allow_anonymous is set, and fails otherwise, so a missing setting
+// cannot leave the API public.
+func newAuthenticator(cfg config.Auth) (*auth.Authenticator, error) {
+	a := &auth.Authenticator{
+		Realm: "invoicer",
+		// customers open share links without credentials, the links being
+		// signed, but not without rate limits
+		PublicPaths: append(append([]string{}, publicPaths...), sharedPathPrefix),
+		OnFailure: func(r *http.Request, err error) {
+			al := appLog{ErrorCode: http.StatusUnauthorized, Message: fmt.Sprintf("authentication failed: %s", err)}
+			al.log(r)
+		},
+		Unauthorized: func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, r, http.StatusUnauthorized, apiError{Code: errUnauthorized, Message: "please authenticate"})
+		},
+	}
+	if len(cfg.Users) > 0 {
+		users, err := auth.ParseStaticUsers(strings.Join(cfg.Users, ","))
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth.users: %s", err)
+		}
+		a.Providers = append(a.Providers, users)
+	}
+	if cfg.HtpasswdFile != "" {
+		htpasswd, err := auth.NewHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth.htpasswd_file: %s", err)
+		}
+		a.Providers = append(a.Providers, htpasswd)
+	}
+	if cfg.OIDCIssuer != "" {
+		a.Providers = append(a.Providers, auth.NewOIDC(cfg.OIDCIssuer, cfg.OIDCAudience))
+	}
+	if len(a.Providers) == 0 {
+		if !cfg.AllowAnonymous {
+			return nil, fmt.Errorf("no authentication provider configured, set auth.users, auth.htpasswd_file or auth.oidc_issuer, or auth.allow_anonymous to serve the API without authentication")
+		}
+		applog.warnf("no authentication provider configured and auth.allow_anonymous is set, all routes are public")
+		return nil, nil
+	}
+	return a, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	batchAllOrNothing = "all_or_nothing"
+	batchBestEffort   = "best_effort"
+
+	batchMarkPaid  = "mark_paid"
+	batchSetStatus = "set_status"
+	batchDelete    = "delete"
+
+	// maxBatchItems is the number of invoices a batch can change, over
+	// all of its operations
+	maxBatchItems = 500
+)
+
+// batchOperation applies an operation to invoices. Invoices marked as paid
+// without a payment date are considered paid now.
+type batchOperation struct {
+	Op          string    `json:"op"`
+	InvoiceIDs  []uint    `json:"invoice_ids"`
+	Status      string    `json:"status,omitempty"`
+	PaymentDate time.Time `json:"payment_date"`
+}
+
+type batchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchResult is the outcome of an operation on one invoice: applied,
+// failed, rolled_back when another invoice of an all or nothing batch
+// failed, or skipped when the batch stopped before reaching it
+type batchResult struct {
+	Op        string    `json:"op"`
+	InvoiceID uint      `json:"invoice_id"`
+	Result    string    `json:"result"`
+	Error     *apiError `json:"error,omitempty"`
+
+	before, after Invoice
+	snapshot      map[string]interface{}
+}
+
+type batchReport struct {
+	Mode    string        `json:"mode"`
+	Applied int           `json:"applied"`
+	Failed  int           `json:"failed"`
+	Results []batchResult `json:"results"`
+}
+
+func validateBatch(req batchRequest) validationErrors {
+	var errs validationErrors
+	if req.Mode != batchAllOrNothing && req.Mode != batchBestEffort {
+		errs.add("mode", "must be %s or %s", batchAllOrNothing, batchBestEffort)
+	}
+	if len(req.Operations) == 0 {
+		errs.add("operations", "must contain at least one operation")
+	}
+	items := 0
+	for n, op := range req.Operations {
+		field := fmt.Sprintf("operations[%d]", n)
+		switch op.Op {
+		case batchMarkPaid, batchDelete:
+			if op.Status != "" {
+				errs.add(field+".status", "must not be set for %s", op.Op)
+			}
+		case batchSetStatus:
+			if !validInvoiceStatus(op.Status) {
+				errs.add(field+".status", "unknown status %q", op.Status)
+			}
+		default:
+			errs.add(field+".op", "must be %s, %s or %s", batchMarkPaid, batchSetStatus, batchDelete)
+		}
+		if len(op.InvoiceIDs) == 0 {
+			errs.add(field+".invoice_ids", "must contain at least one invoice id")
+		}
+		items += len(op.InvoiceIDs)
+	}
+	if items > maxBatchItems {
+		errs.add("operations", "must not change more than %d invoices", maxBatchItems)
+	}
+	return errs
+}
+
+// applyBatchItem applies an operation to an invoice through a store. The
+// status of the invoice must be allowed to move to the one of the
+// operation, like it is for a single invoice.
+func applyBatchItem(store InvoiceStore, op batchOperation, res *batchResult) error {
+	i1, err := store.Get(res.InvoiceID, false)
+	if err == errInvoiceNotFound {
+		return newServiceError(http.StatusNotFound, "No invoice id %d", res.InvoiceID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve invoice %d: %s", res.InvoiceID, err)
+	}
+	res.before = i1
+	if op.Op == batchDelete {
+		err = store.Delete(i1.ID)
+		if err != nil {
+			return fmt.Errorf("failed to delete invoice %d: %s", i1.ID, err)
+		}
+		res.after = i1
+		return nil
+	}
+	status := op.Status
+	if op.Op == batchMarkPaid {
+		status = statusPaid
+	}
+	if !canTransition(i1.Status, status) {
+		return newServiceError(http.StatusConflict, "invoice %d cannot go from %s to %s", i1.ID, i1.Status, status)
+	}
+	i1.Status, i1.IsPaid = status, status == statusPaid
+	if status == statusPaid {
+		i1.PaymentDate = op.PaymentDate
+		if i1.PaymentDate.IsZero() {
+			i1.PaymentDate = time.Now().UTC()
+		}
+	}
+	err = store.Update(&i1, false)
+	if err == errVersionConflict {
+		return newServiceError(http.StatusConflict, "invoice %d was modified while changing its status", i1.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update status of invoice %d: %s", i1.ID, err)
+	}
+	res.after = i1
+	return nil
+}
+
+// failBatchItem records the error of an operation on an invoice, and
+// returns true if it is an error of the database rather than of the
+// operation
+func failBatchItem(res *batchResult, err error) bool {
+	res.Result = "failed"
+	se, ok := err.(serviceError)
+	if !ok {
+		res.Error = &apiError{Code: errInternal, Message: err.Error()}
+		return true
+	}
+	res.Error = &apiError{Code: errorCodeForStatus(se.Status), Message: se.Message, Fields: se.Fields}
+	return false
+}
+
+// postInvoicesBatch applies operations to many invoices at once. In
+// all_or_nothing mode they run in one transaction which is rolled back if
+// any of them fails, in best_effort mode every invoice is changed on its
+// own and failures don't prevent the others from being applied. Changes
+// are recorded in the history of invoices and fire webhooks once they are
+// committed.
+func (iv *invoicer) postInvoicesBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if !readJSONBody(w, r, &req) {
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = batchAllOrNothing
+	}
+	if errs := validateBatch(req); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	for _, op := range req.Operations {
+		if op.Op == batchDelete && !hasPermission(r, permDelete) {
+			denyPermission(w, r, permDelete)
+			return
+		}
+	}
+	report := batchReport{Mode: req.Mode, Results: []batchResult{}}
+	for _, op := range req.Operations {
+		for _, id := range op.InvoiceIDs {
+			report.Results = append(report.Results, batchResult{Op: op.Op, InvoiceID: id, snapshot: iv.invoiceSnapshot(id)})
+		}
+	}
+
+	if req.Mode == batchBestEffort {
+		n := 0
+		for _, op := range req.Operations {
+			for range op.InvoiceIDs {
+				res := &report.Results[n]
+				n++
+				if err := applyBatchItem(iv.invoicesFor(r), op, res); err != nil {
+					failBatchItem(res, err)
+					continue
+				}
+				res.Result = "applied"
+			}
+		}
+	} else if !iv.applyBatchTransaction(w, r, req, report.Results) {
+		return
+	}
+
+	for n := range report.Results {
+		res := &report.Results[n]
+		if res.Result != "applied" {
+			if res.Result == "failed" {
+				report.Failed++
+			}
+			continue
+		}
+		report.Applied++
+		if res.Op == batchDelete {
+			iv.audit(r, "delete", res.InvoiceID, res.snapshot, nil)
+			iv.fireWebhooks(eventInvoiceDeleted, res.after)
+			continue
+		}
+		iv.audit(r, "status", res.InvoiceID, res.snapshot, iv.invoiceSnapshot(res.InvoiceID))
+		iv.fireInvoiceUpdated(res.before, res.after)
+	}
+	status := http.StatusOK
+	if report.Applied == 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, r, status, report)
+	al := appLog{Message: fmt.Sprintf("applied %d batch operations on invoices, %d failed", report.Applied, report.Failed),
+		Action: "post-invoices-batch"}
+	al.log(r)
+}
+
+// applyBatchTransaction applies the operations of an all or nothing batch in
+// a transaction, which is only committed if every one of them succeeds.
+// Errors of the database stop the batch, the invoices after the failing one
+// are skipped. It returns false if it sent an error response instead.
+func (iv *invoicer) applyBatchTransaction(w http.ResponseWriter, r *http.Request, req batchRequest, results []batchResult) bool {
+	tx := iv.dbFor(r).Begin()
+	if tx.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to apply batch: %s", tx.Error)
+		return false
+	}
+	store := newGormInvoiceStore(tx)
+	n, failed, aborted := 0, false, false
+	for _, op := range req.Operations {
+		for range op.InvoiceIDs {
+			res := &results[n]
+			n++
+			if aborted {
+				res.Result = "skipped"
+				continue
+			}
+			if err := applyBatchItem(store, op, res); err != nil {
+				failed = true
+				aborted = failBatchItem(res, err)
+				continue
+			}
+			res.Result = "applied"
+		}
+	}
+	if failed {
+		tx.Rollback()
+		for n := range results {
+			if results[n].Result == "applied" {
+				results[n].Result = "rolled_back"
+			}
+		}
+		return true
+	}
+	err := tx.Commit().Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to apply batch: %s", err)
+		return false
+	}
+	return true
+}
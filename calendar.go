@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// dueCalendarPath is the iCalendar feed of due dates, which accepts API
+// keys in its token parameter
+const dueCalendarPath = "/invoices/due.ics"
+
+// calendarRefresh is how often calendar clients are asked to refresh feeds
+const calendarRefresh = "PT1H"
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icsWriter writes the content lines of an iCalendar document, ending them
+// with CRLF and folding them at 75 octets as RFC 5545 requires
+type icsWriter struct {
+	w *bufio.Writer
+}
+
+func (c icsWriter) line(name, value string) {
+	line := name + ":" + value
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		c.w.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// the space starting continuation lines counts in their 75 octets
+		limit = 74
+	}
+	c.w.WriteString(line + "\r\n")
+}
+
+func (c icsWriter) text(name, value string) {
+	c.line(name, icsEscaper.Replace(value))
+}
+
+// getInvoicesDueCalendar serves the due dates of the invoices awaiting
+// payment as an iCalendar feed, optionally of a single customer. Each
+// invoice is an all day event whose UID only depends on the invoice, and
+// whose SEQUENCE is the version of the invoice, so calendar clients
+// refreshing the feed update events in place instead of duplicating them.
+func (iv *invoicer) getInvoicesDueCalendar(w http.ResponseWriter, r *http.Request) {
+	var filters invoiceFilters
+	if r.FormValue("customer_id") != "" {
+		customerID, err := strconv.ParseUint(r.FormValue("customer_id"), 10, 32)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "invalid customer id %q in parameter customer_id", r.FormValue("customer_id"))
+			return
+		}
+		filters.CustomerID = uint(customerID)
+	}
+	receivable, statusArgs := statusCondition(receivableStatuses...)
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="due.ics"`)
+	bw := bufio.NewWriter(w)
+	c := icsWriter{bw}
+	c.line("BEGIN", "VCALENDAR")
+	c.line("VERSION", "2.0")
+	c.line("PRODID", "-//invoicer//invoice due dates//EN")
+	c.line("CALSCALE", "GREGORIAN")
+	c.line("METHOD", "PUBLISH")
+	c.text("X-WR-CALNAME", "Invoices due")
+	c.line("REFRESH-INTERVAL;VALUE=DURATION", calendarRefresh)
+	c.line("X-PUBLISHED-TTL", calendarRefresh)
+
+	// invoices are read in batches ordered by id, like exports
+	var lastID uint
+	var events int
+	for {
+		var invoices []Invoice
+		err := filters.apply(iv.dbFor(r)).Where(receivable, statusArgs...).Where("id > ?", lastID).
+			Order("id asc").Limit(exportBatchSize).Find(&invoices).Error
+		if err != nil {
+			// headers are already sent, the truncated feed is all we can do
+			al := appLog{ErrorCode: http.StatusInternalServerError, Message: fmt.Sprintf("failed to list invoices due: %s", err)}
+			al.log(r)
+			break
+		}
+		if len(invoices) == 0 {
+			break
+		}
+		var customerIDs []uint
+		for _, i := range invoices {
+			if i.CustomerID != 0 {
+				customerIDs = append(customerIDs, i.CustomerID)
+			}
+		}
+		customers := make(map[uint]string)
+		if len(customerIDs) > 0 {
+			var batch []Customer
+			iv.dbFor(r).Unscoped().Where("id IN (?)", customerIDs).Find(&batch)
+			for _, cu := range batch {
+				customers[cu.ID] = cu.Name
+			}
+		}
+		for _, i := range invoices {
+			if i.DueDate.IsZero() {
+				continue
+			}
+			amount := formatAmount(i.Amount, i.Currency)
+			summary := fmt.Sprintf("Invoice %s due, %s", i.InvoiceNumber, amount)
+			if name := customers[i.CustomerID]; name != "" {
+				summary += " from " + name
+			}
+			due := i.DueDate.UTC()
+			c.line("BEGIN", "VEVENT")
+			c.text("UID", fmt.Sprintf("invoice-%d-due@invoicer", i.ID))
+			c.line("DTSTAMP", i.UpdatedAt.UTC().Format("20060102T150405Z"))
+			c.line("SEQUENCE", fmt.Sprint(i.Version))
+			c.line("DTSTART;VALUE=DATE", due.Format("20060102"))
+			c.line("DTEND;VALUE=DATE", due.AddDate(0, 0, 1).Format("20060102"))
+			c.text("SUMMARY", summary)
+			c.text("DESCRIPTION", fmt.Sprintf("Invoice %s of %s is %s, due on %s.",
+				i.InvoiceNumber, amount, strings.Replace(i.Status, "_", " ", -1), due.Format("2006-01-02")))
+			c.line("TRANSP", "TRANSPARENT")
+			c.line("END", "VEVENT")
+			events++
+		}
+		lastID = invoices[len(invoices)-1].ID
+	}
+	c.line("END", "VCALENDAR")
+	err := bw.Flush()
+	if err != nil {
+		al := appLog{ErrorCode: http.StatusInternalServerError, Message: fmt.Sprintf("failed to write calendar: %s", err)}
+		al.log(r)
+		return
+	}
+	al := appLog{Message: fmt.Sprintf("sent calendar of %d invoices due", events), Action: "get-invoices-due-calendar"}
+	al.log(r)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// categoryPathSeparator joins the names of a category and its ancestors,
+// as in "Services > Consulting"
+const categoryPathSeparator = " > "
+
+// Category classifies charges. Categories form a hierarchy through their
+// ParentID, root categories having a ParentID of zero.
+type Category struct {
+	gorm.Model
+	Name     string `json:"name"`
+	ParentID uint   `gorm:"index" json:"parent_id"`
+	Path     string `gorm:"-" json:"path"`
+}
+
+// loadCategories returns all categories indexed by ID, with their path computed
+func (iv *invoicer) loadCategories() (map[uint]*Category, error) {
+	var categories []Category
+	err := iv.db.Find(&categories).Error
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*Category, len(categories))
+	for i := range categories {
+		byID[categories[i].ID] = &categories[i]
+	}
+	for _, c := range byID {
+		c.Path = categoryPath(byID, c.ID)
+	}
+	return byID, nil
+}
+
+// categoryPath walks up the hierarchy from a category to its root and joins
+// the names encountered along the way. Walking stops if a loop is detected.
+func categoryPath(byID map[uint]*Category, id uint) string {
+	var names []string
+	seen := make(map[uint]bool)
+	for id != 0 && !seen[id] {
+		c, ok := byID[id]
+		if !ok {
+			break
+		}
+		seen[id] = true
+		names = append([]string{c.Name}, names...)
+		id = c.ParentID
+	}
+	return strings.Join(names, categoryPathSeparator)
+}
+
+// categoryTotal sums the charges of a category in a currency, and in a
+// period of the revenue report. Amount and Tax sum the charges of the
+// category itself, RollupAmount and RollupTax those of its subcategories
+// as well. Uncategorized charges have a CategoryID of zero and no path.
+type categoryTotal struct {
+	Period       string `json:"period,omitempty"`
+	Currency     string `json:"currency"`
+	CategoryID   uint   `json:"category_id"`
+	Path         string `json:"path"`
+	Amount       int64  `json:"amount"`
+	Tax          int64  `json:"tax"`
+	RollupAmount int64  `json:"rollup_amount"`
+	RollupTax    int64  `json:"rollup_tax"`
+}
+
+// rollupCategories adds the sums of the charges of each category, per
+// period and currency, to those of its ancestors, which are listed even if
+// none of their own charges were summed. Totals are sorted by period,
+// currency and path, whose names are html-escaped.
+func rollupCategories(byID map[uint]*Category, rows []categoryTotal) []categoryTotal {
+	type key struct {
+		period, currency string
+		id               uint
+	}
+	totals := make(map[key]*categoryTotal)
+	total := func(row categoryTotal, id uint) *categoryTotal {
+		k := key{row.Period, row.Currency, id}
+		t, ok := totals[k]
+		if !ok {
+			t = &categoryTotal{Period: row.Period, Currency: row.Currency, CategoryID: id}
+			if c, ok := byID[id]; ok {
+				t.Path = c.Path
+			}
+			totals[k] = t
+		}
+		return t
+	}
+	for _, row := range rows {
+		t := total(row, row.CategoryID)
+		t.Amount += row.Amount
+		t.Tax += row.Tax
+		seen := make(map[uint]bool)
+		for id := row.CategoryID; !seen[id]; {
+			seen[id] = true
+			t = total(row, id)
+			t.RollupAmount += row.Amount
+			t.RollupTax += row.Tax
+			c, ok := byID[id]
+			if !ok || c.ParentID == 0 {
+				break
+			}
+			id = c.ParentID
+		}
+	}
+	result := make([]categoryTotal, 0, len(totals))
+	for _, t := range totals {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		ta, tb := result[a], result[b]
+		if ta.Period != tb.Period {
+			return ta.Period < tb.Period
+		}
+		if ta.Currency != tb.Currency {
+			return ta.Currency < tb.Currency
+		}
+		if ta.Path != tb.Path {
+			return ta.Path < tb.Path
+		}
+		return ta.CategoryID < tb.CategoryID
+	})
+	for n := range result {
+		result[n].Path = escapeCategoryPath(result[n].Path)
+	}
+	return result
+}
+
+// categoryTotals runs a query summing charges per category and rolls them
+// up the hierarchy of categories
+func (iv *invoicer) categoryTotals(q *gorm.DB) ([]categoryTotal, error) {
+	var rows []categoryTotal
+	err := q.Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	byID, err := iv.loadCategories()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve categories: %s", err)
+	}
+	return rollupCategories(byID, rows), nil
+}
+
+// parseGroupBy reads the `group_by` parameter of the reports that can roll
+// charges up by category
+func parseGroupBy(r *http.Request) (bool, error) {
+	switch r.FormValue("group_by") {
+	case "":
+		return false, nil
+	case "category":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid group_by %q, must be category", r.FormValue("group_by"))
+}
+
+// validateCategory checks that a category has a name, and that its parent
+// exists and is not the category itself or one of its descendants
+func validateCategory(byID map[uint]*Category, c Category) error {
+	if strings.TrimSpace(c.Name) == "" {
+		return fmt.Errorf("category name must not be empty")
+	}
+	seen := make(map[uint]bool)
+	for parent := c.ParentID; parent != 0 && !seen[parent]; {
+		if c.ID != 0 && parent == c.ID {
+			return fmt.Errorf("category %d cannot be its own ancestor", c.ID)
+		}
+		p, ok := byID[parent]
+		if !ok {
+			return fmt.Errorf("parent category %d does not exist", parent)
+		}
+		seen[parent] = true
+		parent = p.ParentID
+	}
+	return nil
+}
+
+// sortCategories orders categories by path, so children follow their parent
+func sortCategories(categories []Category) {
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Path < categories[j].Path
+	})
+}
+
+// escapeCategory html-escapes the names that make up a category and its path
+func escapeCategory(c *Category) {
+	c.Name = html.EscapeString(c.Name)
+	c.Path = escapeCategoryPath(c.Path)
+}
+
+// escapeCategoryPath html-escapes the names that make up a category path
+func escapeCategoryPath(path string) string {
+	names := strings.Split(path, categoryPathSeparator)
+	for i := range names {
+		names[i] = html.EscapeString(names[i])
+	}
+	return strings.Join(names, categoryPathSeparator)
+}
+
+func (iv *invoicer) getCategories(w http.ResponseWriter, r *http.Request) {
+	byID, err := iv.loadCategories()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve categories: %s", err)
+		return
+	}
+	categories := make([]Category, 0, len(byID))
+	for _, c := range byID {
+		escapeCategory(c)
+		categories = append(categories, *c)
+	}
+	sortCategories(categories)
+	writeJSON(w, r, http.StatusOK, categories)
+}
+
+func (iv *invoicer) getCategory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	byID, err := iv.loadCategories()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve categories: %s", err)
+		return
+	}
+	var c Category
+	iv.dbFor(r).First(&c, vars["id"])
+	if c.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No category id %s", vars["id"])
+		return
+	}
+	c.Path = categoryPath(byID, c.ID)
+	escapeCategory(&c)
+	writeJSON(w, r, http.StatusOK, c)
+}
+
+func (iv *invoicer) postCategory(w http.ResponseWriter, r *http.Request) {
+	var c Category
+	if !readJSONBody(w, r, &c) {
+		return
+	}
+	c.ID = 0
+	byID, err := iv.loadCategories()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve categories: %s", err)
+		return
+	}
+	err = validateCategory(byID, c)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid category: %s", err)
+		return
+	}
+	iv.dbFor(r).Create(&c)
+	byID[c.ID] = &c
+	c.Path = categoryPath(byID, c.ID)
+	escapeCategory(&c)
+	writeJSON(w, r, http.StatusCreated, c)
+	al := appLog{Message: fmt.Sprintf("created category %d", c.ID), Action: "post-category"}
+	al.log(r)
+}
+
+func (iv *invoicer) putCategory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var c Category
+	iv.dbFor(r).First(&c, vars["id"])
+	if c.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No category id %s", vars["id"])
+		return
+	}
+	id := c.ID
+	if !readJSONBody(w, r, &c) {
+		return
+	}
+	c.ID = id
+	byID, err := iv.loadCategories()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve categories: %s", err)
+		return
+	}
+	err = validateCategory(byID, c)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid category: %s", err)
+		return
+	}
+	iv.dbFor(r).Save(&c)
+	byID[c.ID] = &c
+	c.Path = categoryPath(byID, c.ID)
+	escapeCategory(&c)
+	writeJSON(w, r, http.StatusAccepted, c)
+	al := appLog{Message: fmt.Sprintf("updated category %d", c.ID), Action: "put-category"}
+	al.log(r)
+}
+
+// deleteCategory removes a category that has no subcategories and is not
+// used by any charge
+func (iv *invoicer) deleteCategory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var c Category
+	iv.dbFor(r).First(&c, vars["id"])
+	if c.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No category id %s", vars["id"])
+		return
+	}
+	var children, charges int
+	iv.dbFor(r).Model(&Category{}).Where("parent_id = ?", c.ID).Count(&children)
+	iv.dbFor(r).Model(&Charge{}).Where("category_id = ?", c.ID).Count(&charges)
+	if children > 0 || charges > 0 {
+		httpError(w, r, http.StatusConflict, "category %d is used by %d subcategories and %d charges", c.ID, children, charges)
+		return
+	}
+	iv.dbFor(r).Delete(&c)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted category %d", c.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted category %d", c.ID), Action: "delete-category"}
+	al.log(r)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// maxInlineCharges is the number of charges above which an invoice
+	// is returned with a summary instead of its full list of charges
+	maxInlineCharges = 500
+
+	defaultChargesPageSize = 100
+	maxChargesPageSize     = 1000
+
+	// maxBulkCharges is the number of lines accepted by a single bulk append,
+	// which are inserted bulkInsertBatchSize rows at a time
+	maxBulkCharges      = 10000
+	bulkInsertBatchSize = 100
+)
+
+type chargesSummary struct {
+	Count int    `json:"count"`
+	Total int64  `json:"total"`
+	Link  string `json:"link"`
+}
+
+type chargesPage struct {
+	Charges []Charge `json:"charges"`
+	Next    string   `json:"next,omitempty"`
+}
+
+// escapeCharges html-escapes the free text fields of charges before
+// they are returned to clients
+func escapeCharges(charges []Charge) {
+	for i := 0; i < len(charges); i++ {
+		charges[i].Type = html.EscapeString(charges[i].Type)
+		charges[i].Description = html.EscapeString(charges[i].Description)
+	}
+}
+
+// getInvoiceCharges returns the charges of an invoice ordered by id, one page
+// at a time. Clients follow the `next` link, which carries the id of the last
+// charge returned in the `after` parameter.
+func (iv *invoicer) getInvoiceCharges(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	after, limit := 0, defaultChargesPageSize
+	if r.FormValue("after") != "" {
+		after, err = strconv.Atoi(r.FormValue("after"))
+		if err != nil || after < 0 {
+			httpError(w, r, http.StatusBadRequest, "invalid after parameter %q", r.FormValue("after"))
+			return
+		}
+	}
+	if r.FormValue("limit") != "" {
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 1 || limit > maxChargesPageSize {
+			httpError(w, r, http.StatusBadRequest, "limit must be between 1 and %d", maxChargesPageSize)
+			return
+		}
+	}
+	var page chargesPage
+	page.Charges, err = iv.invoicesFor(r).Charges(i1, uint(after), limit)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve charges of invoice id %s: %s", vars["id"], err)
+		return
+	}
+	escapeCharges(page.Charges)
+	if len(page.Charges) == limit {
+		page.Next = fmt.Sprintf("/invoice/%d/charges?after=%d&limit=%d",
+			i1.ID, page.Charges[len(page.Charges)-1].ID, limit)
+	}
+	jsonPage, err := json.Marshal(page)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to marshal charges of invoice id %s: %s", vars["id"], err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonPage)
+	al := appLog{Message: fmt.Sprintf("retrieved %d charges of invoice %d", len(page.Charges), i1.ID), Action: "get-invoice-charges"}
+	al.log(r)
+}
+
+type bulkChargeResult struct {
+	Line   int              `json:"line"`
+	Errors validationErrors `json:"errors,omitempty"`
+}
+
+type bulkChargesReport struct {
+	Inserted int                `json:"inserted"`
+	Rejected int                `json:"rejected"`
+	Results  []bulkChargeResult `json:"results"`
+}
+
+// postBulkCharges appends a list of charges to an existing invoice. Every line
+// is validated first and, if any of them is invalid, nothing is inserted and
+// the per-line results are returned with a 422. Otherwise, all lines are
+// inserted in batches inside a single transaction.
+func (iv *invoicer) postBulkCharges(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	var charges []Charge
+	if !readJSONBody(w, r, &charges) {
+		return
+	}
+	if len(charges) == 0 || len(charges) > maxBulkCharges {
+		httpError(w, r, http.StatusBadRequest, "bulk append requires between 1 and %d charges", maxBulkCharges)
+		return
+	}
+	err := iv.checkChargesQuota(r, i1, len(charges))
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	categories, err := iv.loadCategories()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve categories: %s", err)
+		return
+	}
+	taxRates, err := iv.loadTaxRates()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve tax rates: %s", err)
+		return
+	}
+	report := bulkChargesReport{Results: make([]bulkChargeResult, len(charges))}
+	for i, c := range charges {
+		if c.Currency == "" {
+			charges[i].Currency, c.Currency = i1.Currency, i1.Currency
+		}
+		report.Results[i].Line = i
+		validateCharge(&report.Results[i].Errors, "", c, i1.Currency, categories, taxRates)
+		if len(report.Results[i].Errors) > 0 {
+			report.Rejected++
+		}
+	}
+	status := http.StatusUnprocessableEntity
+	if report.Rejected == 0 {
+		applyTaxes(charges, taxRates)
+		before := iv.invoiceSnapshot(i1.ID)
+		current := i1
+		err = iv.invoicesFor(r).AddCharges(&i1, charges)
+		if err == errVersionConflict {
+			httpError(w, r, http.StatusPreconditionFailed, "invoice %d was modified while appending charges", i1.ID)
+			return
+		}
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "failed to append charges to invoice %d: %s", i1.ID, err)
+			return
+		}
+		report.Inserted = len(charges)
+		status = http.StatusCreated
+		iv.audit(r, "bulk-charges", i1.ID, before, iv.invoiceSnapshot(i1.ID))
+		iv.fireInvoiceUpdated(current, i1)
+	}
+	jsonReport, err := json.Marshal(report)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to marshal bulk report: %s", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonReport)
+	al := appLog{Message: fmt.Sprintf("appended %d charges to invoice %d, rejected %d",
+		report.Inserted, i1.ID, report.Rejected), Action: "post-bulk-charges"}
+	al.log(r)
+}
+
+// checkChargesQuota refuses to add charges to an invoice past the number of
+// charges an invoice can have
+func (iv *invoicer) checkChargesQuota(r *http.Request, i Invoice, adding int) error {
+	summary, err := iv.invoicesFor(r).SummarizeCharges(i.ID)
+	if err != nil {
+		return fmt.Errorf("failed to count charges of invoice %d: %s", i.ID, err)
+	}
+	if summary.Count+adding > iv.maxCharges {
+		var errs validationErrors
+		errs.add("charges", "invoice %d has %d charges, adding %d would exceed the limit of %d", i.ID, summary.Count, adding, iv.maxCharges)
+		return newValidationError(errs)
+	}
+	return nil
+}
+
+// readCharge reads a charge of an invoice from the request body, validates
+// it and computes its tax, or responds with an error and returns false. The currency
+// of the invoice is used if the charge doesn't have one.
+func (iv *invoicer) readCharge(w http.ResponseWriter, r *http.Request, i1 Invoice, c *Charge) bool {
+	if !readJSONBody(w, r, c) {
+		return false
+	}
+	err := iv.checkCharge(i1, c)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// checkCharge validates a charge of an invoice and computes its tax,
+// defaulting its currency to that of the invoice
+func (iv *invoicer) checkCharge(i1 Invoice, c *Charge) error {
+	if c.Currency == "" {
+		c.Currency = i1.Currency
+	}
+	categories, err := iv.loadCategories()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve categories: %s", err)
+	}
+	taxRates, err := iv.loadTaxRates()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve tax rates: %s", err)
+	}
+	var errs validationErrors
+	validateCharge(&errs, "", *c, i1.Currency, categories, taxRates)
+	if len(errs) > 0 {
+		return newValidationError(errs)
+	}
+	applyTax(c, taxRates)
+	return nil
+}
+
+// loadCharge retrieves the charge of the `id` route variable and its
+// invoice, or responds with an error and returns false
+func (iv *invoicer) loadCharge(w http.ResponseWriter, r *http.Request) (Charge, Invoice, bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	c, i1, err := iv.findCharge(r, uint(id))
+	if err != nil {
+		writeServiceError(w, r, err)
+		return c, i1, false
+	}
+	return c, i1, true
+}
+
+// findCharge retrieves a charge and its invoice
+func (iv *invoicer) findCharge(r *http.Request, id uint) (Charge, Invoice, error) {
+	c, err := iv.invoicesFor(r).GetCharge(id)
+	if err == errChargeNotFound {
+		return c, Invoice{}, newServiceError(http.StatusNotFound, "No charge id %d", id)
+	}
+	if err != nil {
+		return c, Invoice{}, fmt.Errorf("failed to retrieve charge id %d: %s", id, err)
+	}
+	i1, err := iv.invoicesFor(r).Get(uint(c.InvoiceID), false)
+	if err == errInvoiceNotFound {
+		return c, i1, newServiceError(http.StatusNotFound, "No charge id %d", id)
+	}
+	if err != nil {
+		return c, i1, fmt.Errorf("failed to retrieve invoice of charge id %d: %s", id, err)
+	}
+	return c, i1, nil
+}
+
+// postInvoiceCharge adds a charge to an invoice and sets the amount of the
+// invoice to the total of its charges
+func (iv *invoicer) postInvoiceCharge(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	var c Charge
+	if !iv.readCharge(w, r, i1, &c) {
+		return
+	}
+	c.Model = gorm.Model{}
+	err := iv.checkChargesQuota(r, i1, 1)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	i1, err = iv.changeCharge(r, i1, r.Header.Get("If-Match"), "add-charge", func(i *Invoice) error {
+		return iv.invoicesFor(r).SaveCharge(i, &c)
+	})
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", invoiceETag(i1))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("added charge %d to invoice %d", c.ID, i1.ID)))
+	al := appLog{Message: fmt.Sprintf("added charge %d to invoice %d", c.ID, i1.ID), Action: "post-invoice-charge"}
+	al.log(r)
+}
+
+// putCharge replaces a charge and sets the amount of its invoice to the
+// total of its charges
+func (iv *invoicer) putCharge(w http.ResponseWriter, r *http.Request) {
+	stored, i1, ok := iv.loadCharge(w, r)
+	if !ok {
+		return
+	}
+	var c Charge
+	if !iv.readCharge(w, r, i1, &c) {
+		return
+	}
+	c.Model = stored.Model
+	i1, err := iv.changeCharge(r, i1, r.Header.Get("If-Match"), "update-charge", func(i *Invoice) error {
+		return iv.invoicesFor(r).SaveCharge(i, &c)
+	})
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", invoiceETag(i1))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("updated charge %d", c.ID)))
+	al := appLog{Message: fmt.Sprintf("updated charge %d of invoice %d", c.ID, i1.ID), Action: "put-charge"}
+	al.log(r)
+}
+
+// deleteCharge removes a charge and sets the amount of its invoice to the
+// total of its remaining charges
+func (iv *invoicer) deleteCharge(w http.ResponseWriter, r *http.Request) {
+	c, i1, ok := iv.loadCharge(w, r)
+	if !ok {
+		return
+	}
+	i1, err := iv.changeCharge(r, i1, r.Header.Get("If-Match"), "delete-charge", func(i *Invoice) error {
+		return iv.invoicesFor(r).DeleteCharge(i, c.ID)
+	})
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", invoiceETag(i1))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted charge %d", c.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted charge %d of invoice %d", c.ID, i1.ID), Action: "delete-charge"}
+	al.log(r)
+}
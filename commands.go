@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/gorilla/securecookie"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// adminCommand is a command of the binary run against the database and
+// the configuration of the invoicer, so operators can administer it without
+// calling the API of a live server. Commands log to stderr and write their
+// output to stdout.
+type adminCommand struct {
+	name    string
+	args    string
+	summary string
+	run     func(c adminCommand, args []string) error
+}
+
+// adminCommands are the commands of the binary besides serve, which runs
+// when no command is given
+var adminCommands = []adminCommand{
+	{"create-user", "[-role role] [-password-stdin] user",
+		"add a user to auth.htpasswd_file and give them a role", createUserCommand},
+	{"rotate-csrf-key", "[-keep n]",
+		"print csrf.keys with a new signing key first", rotateCSRFKeyCommand},
+	{"export", "[-format json] [-output file] [-status status]",
+		"write the invoices and their charges", exportCommand},
+	{"migrate", "[up|down|status]",
+		"migrate the database up, down by one migration, or show the migration status", migrateCommand},
+}
+
+// commandOf splits the arguments of the binary into the name of its command
+// and the arguments of the command. The arguments of older versions, which
+// only served the API, start with a flag or are empty.
+func commandOf(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "serve", args
+	}
+	return args[0], args[1:]
+}
+
+// writeCommandList lists the commands of the binary
+func writeCommandList(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "commands:")
+	fmt.Fprintln(tw, "  serve\tserve the API, the default command")
+	for _, c := range adminCommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(tw, "\nrun `invoicer <command> -h` for the flags of a command")
+	tw.Flush()
+}
+
+// runAdminCommand runs a command and exits if it fails
+func runAdminCommand(name string, args []string) {
+	applog = newLogger(os.Stderr, logFormatJSON, levelInfo)
+	for _, c := range adminCommands {
+		if c.name == name {
+			err := c.run(c, args)
+			if err != nil {
+				applog.fatalf("%s", err)
+			}
+			return
+		}
+	}
+	if name == "help" {
+		writeCommandList(os.Stdout)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	writeCommandList(os.Stderr)
+	os.Exit(2)
+}
+
+// flags returns the flag set of a command, whose usage describes it
+func (c adminCommand) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: invoicer %s %s\n\n%s\n\nflags:\n", c.name, c.args, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// loadCommandConfig parses the flags of a command, along with -config, and
+// loads the configuration it names
+func loadCommandConfig(fs *flag.FlagSet, args []string) (config.Config, error) {
+	configFile := configFlag(fs)
+	fs.Parse(args)
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, configureLogging(cfg.Logging, os.Stderr)
+}
+
+// openCommandStore connects a command to the database of the invoicer, which
+// must be migrated unless the command migrates it. Encrypted columns are
+// read and written like the server does.
+func openCommandStore(cfg config.Config, migrated bool) (*invoicer, error) {
+	db, err := openStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if fieldKeys != nil {
+		encryptColumns(gorm.DefaultCallback, fieldKeys)
+	}
+	iv := &invoicer{
+		db:         db,
+		invoices:   newGormInvoiceStore(db),
+		maxCharges: cfg.Limits.MaxChargesPerInvoice,
+	}
+	if !migrated {
+		return iv, nil
+	}
+	err = prepareMigrations(db)
+	if err == nil {
+		var pending []migration
+		pending, err = pendingMigrations(db)
+		if err == nil && len(pending) > 0 {
+			err = fmt.Errorf("the database has %d pending migrations, run `invoicer migrate` first", len(pending))
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return iv, nil
+}
+
+// createUserCommand adds a user to the htpasswd file of the configuration,
+// with a password read from stdin or generated and printed, and gives them
+// a role. Users of the other authentication providers are only given a
+// role.
+func createUserCommand(c adminCommand, args []string) error {
+	fs := c.flags()
+	role := fs.String("role", "", "role of the user: viewer, editor or admin, auth.default_role if not set")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin instead of generating one")
+	cfg, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	user := fs.Arg(0)
+	if user == "" || strings.ContainsAny(user, ": \t\r\n") {
+		return fmt.Errorf("invalid user name %q, must not be empty or contain colons or spaces", user)
+	}
+	if *role != "" {
+		if _, ok := rolePermissions[*role]; !ok {
+			return fmt.Errorf("unknown role %q, must be one of %s", *role, strings.Join(roles, ", "))
+		}
+	}
+	if cfg.Auth.HtpasswdFile == "" && *role == "" {
+		return fmt.Errorf("auth.htpasswd_file is not set, users of other providers can only be given a role with -role")
+	}
+	iv, err := openCommandStore(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer iv.db.Close()
+	if cfg.Auth.HtpasswdFile != "" {
+		password, err := readPassword(*passwordStdin)
+		if err != nil {
+			return err
+		}
+		err = appendHtpasswd(cfg.Auth.HtpasswdFile, user, password)
+		if err != nil {
+			return err
+		}
+		if !*passwordStdin {
+			fmt.Printf("password: %s\n", password)
+		}
+		applog.infof("added %s to %s", user, cfg.Auth.HtpasswdFile)
+	}
+	if *role == "" {
+		return nil
+	}
+	if isAdminUser(user) {
+		applog.warnf("%s is listed in auth.admins, and is an administrator whatever their role", user)
+	}
+	ur := UserRole{Username: user}
+	err = iv.db.Where(UserRole{Username: user}).FirstOrInit(&ur).Error
+	if err == nil {
+		ur.Role, ur.UpdatedBy = *role, "cli"
+		err = iv.db.Save(&ur).Error
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store role of %s: %s", user, err)
+	}
+	applog.infof("gave role %s to %s", ur.Role, user)
+	return nil
+}
+
+// readPassword reads a password from the first line of stdin, or generates
+// a random one
+func readPassword(stdin bool) (string, error) {
+	if !stdin {
+		return randomString(18)
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read password: %s", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("the password read from stdin is empty")
+	}
+	return password, nil
+}
+
+// appendHtpasswd adds a user and the bcrypt hash of their password to an
+// htpasswd file, which the server reloads when it changes
+func appendHtpasswd(path, user, password string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, user+":") {
+			return fmt.Errorf("%s is already in %s", user, path)
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	entry := user + ":" + string(hash) + "\n"
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		entry = "\n" + entry
+	}
+	_, err = f.WriteString(entry)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return f.Close()
+}
+
+// rotateCSRFKeyCommand prints the keys to set in csrf.keys: a new key,
+// which signs tokens once the instances are restarted with it, followed by
+// the most recent keys, which keep accepting the tokens they signed
+func rotateCSRFKeyCommand(c adminCommand, args []string) error {
+	fs := c.flags()
+	keep := fs.Int("keep", 1, "number of current keys kept after the new one, so their tokens stay valid until csrf.token_ttl")
+	cfg, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return fmt.Errorf("invalid -keep %d, must not be negative", *keep)
+	}
+	keys := []string{base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))}
+	for n, key := range cfg.CSRF.Keys {
+		if n == *keep {
+			break
+		}
+		keys = append(keys, key)
+	}
+	fmt.Println(strings.Join(keys, ","))
+	applog.infof("set these keys in csrf.keys or INVOICER_CSRF_KEYS and restart the invoicer, tokens signed by dropped keys are rejected")
+	return nil
+}
+
+// exportCommand writes the invoices, along with their charges, in the
+// order they were created
+func exportCommand(c adminCommand, args []string) error {
+	fs := c.flags()
+	format := fs.String("format", "json", "format of the export, json")
+	output := fs.String("output", "-", "file to write the export to, - for stdout")
+	status := fs.String("status", "", "only export the invoices with this status")
+	cfg, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if *format != "json" {
+		return fmt.Errorf("invalid format %q, use json", *format)
+	}
+	iv, err := openCommandStore(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer iv.db.Close()
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	w.WriteString("[")
+	var count int
+	for offset := 0; ; offset += exportBatchSize {
+		invoices, _, err := iv.invoices.List(invoiceFilters{Status: *status}, offset, exportBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to export invoices: %s", err)
+		}
+		for _, i := range invoices {
+			i.Charges, err = iv.invoices.Charges(i, 0, 0)
+			if err != nil {
+				return fmt.Errorf("failed to export charges of invoice %d: %s", i.ID, err)
+			}
+			row, err := json.Marshal(i)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString("\n")
+			w.Write(row)
+			count++
+		}
+		if len(invoices) < exportBatchSize {
+			break
+		}
+	}
+	w.WriteString("\n]\n")
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write export: %s", err)
+	}
+	if *output != "-" {
+		err = out.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write export: %s", err)
+		}
+	}
+	applog.infof("exported %d invoices as %s", count, *format)
+	return nil
+}
+
+// migrateCommand migrates the database up, which is the default, down by
+// one migration, or writes the migration status
+func migrateCommand(c adminCommand, args []string) error {
+	fs := c.flags()
+	cfg, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	command := "up"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		command = fs.Arg(0)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	iv, err := openCommandStore(cfg, false)
+	if err != nil {
+		return err
+	}
+	defer iv.db.Close()
+	return runMigrateCommand(iv.db, command)
+}
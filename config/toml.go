@@ -0,0 +1,198 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tomlValue is a value of the configuration file, a string, an integer, a
+// boolean or an array of strings
+type tomlValue struct {
+	raw  interface{}
+	line int
+}
+
+// parseTOML parses the subset of TOML used by configuration files: tables
+// and key value pairs of basic strings, integers, booleans and arrays of
+// strings on a single line. It returns the values by `table.key`.
+func parseTOML(data string) (map[string]tomlValue, error) {
+	values := make(map[string]tomlValue)
+	table := ""
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", n+1)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if table == "" {
+				return nil, fmt.Errorf("line %d: empty table name", n+1)
+			}
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 1 {
+			return nil, fmt.Errorf("line %d: expected key = value", n+1)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: %s is set twice", n+1, key)
+		}
+		raw, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n+1, err)
+		}
+		values[key] = tomlValue{raw: raw, line: n + 1}
+	}
+	return values, nil
+}
+
+// stripComment removes a comment from a line, ignoring # within strings
+func stripComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && inString:
+			i++
+		case line[i] == '"':
+			inString = !inString
+		case line[i] == '#' && !inString:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s == "true" || s == "false":
+		return s == "true", nil
+	case strings.HasPrefix(s, `"`):
+		return parseTOMLString(s)
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated array, arrays must fit on one line")
+		}
+		list := []string{}
+		rest := strings.TrimSpace(s[1 : len(s)-1])
+		for rest != "" {
+			end := closingQuote(rest)
+			if !strings.HasPrefix(rest, `"`) || end < 0 {
+				return nil, fmt.Errorf("arrays may only contain strings")
+			}
+			item, err := parseTOMLString(rest[:end+1])
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+			rest = strings.TrimSpace(rest[end+1:])
+			if rest != "" {
+				if !strings.HasPrefix(rest, ",") {
+					return nil, fmt.Errorf("expected , between array items")
+				}
+				rest = strings.TrimSpace(rest[1:])
+			}
+		}
+		return list, nil
+	default:
+		n, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s, strings must be quoted", s)
+		}
+		return n, nil
+	}
+}
+
+// closingQuote returns the index of the quote closing the string s starts
+// with, or -1
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func parseTOMLString(s string) (string, error) {
+	if closingQuote(s) != len(s)-1 {
+		return "", fmt.Errorf("invalid string %s", s)
+	}
+	unquoted, err := strconv.Unquote(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", s)
+	}
+	return unquoted, nil
+}
+
+// assign sets a setting to the value, which must be of its type. Durations
+// are given as strings, such as "30s", or as a number of seconds.
+func (val tomlValue) assign(v reflect.Value) error {
+	switch raw := val.raw.(type) {
+	case string:
+		switch v.Interface().(type) {
+		case string:
+			v.SetString(raw)
+			return nil
+		case time.Duration:
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return fmt.Errorf("line %d: %q is not a duration", val.line, raw)
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+	case bool:
+		if v.Kind() == reflect.Bool {
+			v.SetBool(raw)
+			return nil
+		}
+	case int64:
+		switch v.Interface().(type) {
+		case time.Duration:
+			v.SetInt(raw * int64(time.Second))
+			return nil
+		case int:
+			v.SetInt(raw)
+			return nil
+		}
+	case []string:
+		if _, ok := v.Interface().([]string); ok {
+			v.Set(reflect.ValueOf(raw))
+			return nil
+		}
+	}
+	return fmt.Errorf("line %d: expected %s", val.line, typeName(v))
+}
+
+func typeName(v reflect.Value) string {
+	switch v.Interface().(type) {
+	case time.Duration:
+		return `a duration such as "30s"`
+	case []string:
+		return "an array of strings"
+	case bool:
+		return "true or false"
+	case int:
+		return "an integer"
+	}
+	return "a string"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+)
+
+// corsExposedHeaders are the response headers browsers let scripts read
+var corsExposedHeaders = []string{"ETag", "Location", "Retry-After", "Warning", "X-Request-ID"}
+
+// corsPolicy decides which origins may call the API from a browser
+type corsPolicy struct {
+	origins     map[string]bool
+	anyOrigin   bool
+	methods     []string
+	headers     []string
+	credentials bool
+	maxAge      time.Duration
+}
+
+func newCORSPolicy(cfg config.CORS) corsPolicy {
+	p := corsPolicy{
+		origins:     make(map[string]bool),
+		methods:     cfg.AllowedMethods,
+		headers:     cfg.AllowedHeaders,
+		credentials: cfg.AllowCredentials,
+		maxAge:      cfg.MaxAge,
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			p.anyOrigin = true
+		}
+		p.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return p
+}
+
+func (p corsPolicy) allowOrigin(origin string) bool {
+	return p.anyOrigin || p.origins[strings.ToLower(origin)]
+}
+
+func (p corsPolicy) allowMethod(method string) bool {
+	for _, m := range p.methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders returns true if all the comma separated headers a preflight
+// asks for are allowed. Headers are compared case insensitively.
+func (p corsPolicy) allowHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		allowed := false
+		for _, a := range p.headers {
+			if strings.EqualFold(a, h) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// setAllowOrigin sets the headers allowing origin to read the response.
+// The origin is echoed rather than answering * unless any origin is allowed
+// without credentials, so caches must vary on it.
+func (p corsPolicy) setAllowOrigin(w http.ResponseWriter, origin string) {
+	if p.anyOrigin && !p.credentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if p.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// cors lets the origins allowed by the configuration call every route from
+// a browser. It answers preflight requests itself, before authentication
+// since browsers send them without credentials, and rejects preflights of
+// origins, methods or headers that aren't allowed with a 403. Requests from
+// other origins are served without CORS headers, which keeps browsers from
+// reading the responses. CORS is disabled when no origin is allowed.
+func cors(cfg config.CORS) Middleware {
+	p := newCORSPolicy(cfg)
+	return func(h http.Handler) http.Handler {
+		if len(p.origins) == 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if !p.anyOrigin || p.credentials {
+				w.Header().Add("Vary", "Origin")
+			}
+			if origin == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			preflightMethod := r.Header.Get("Access-Control-Request-Method")
+			if r.Method != http.MethodOptions || preflightMethod == "" {
+				if p.allowOrigin(origin) {
+					p.setAllowOrigin(w, origin)
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+			switch {
+			case !p.allowOrigin(origin):
+				httpError(w, r, http.StatusForbidden, "origin %s is not allowed", origin)
+				return
+			case !p.allowMethod(preflightMethod):
+				httpError(w, r, http.StatusForbidden, "method %s is not allowed from %s", preflightMethod, origin)
+				return
+			case !p.allowHeaders(requestedHeaders):
+				httpError(w, r, http.StatusForbidden, "headers %s are not all allowed from %s", requestedHeaders, origin)
+				return
+			}
+			p.setAllowOrigin(w, origin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+			if len(p.headers) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.headers, ", "))
+			}
+			if p.maxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
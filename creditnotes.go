@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	creditNoteIssued = "issued"
+	creditNoteVoid   = "void"
+)
+
+// CreditNote reduces what a customer owes on an invoice, to correct it or
+// to refund part of it once paid. Its amount is the total of its lines, in
+// minor units of the currency of the invoice. Credit notes are never
+// edited, a mistaken one is voided and issued again.
+type CreditNote struct {
+	gorm.Model
+	InvoiceID uint             `gorm:"index" json:"invoice_id"`
+	Status    string           `json:"status"`
+	Reason    string           `json:"reason"`
+	Amount    int64            `json:"amount"`
+	Currency  string           `json:"currency"`
+	IssuedAt  time.Time        `json:"issued_at"`
+	VoidedAt  *time.Time       `json:"voided_at,omitempty"`
+	Lines     []CreditNoteLine `json:"lines"`
+}
+
+// CreditNoteLine is an amount credited on an invoice and what it is for
+type CreditNoteLine struct {
+	ID           uint   `gorm:"primary_key" json:"id"`
+	CreditNoteID uint   `gorm:"index" json:"credit_note_id"`
+	Description  string `json:"description"`
+	Amount       int64  `json:"amount"`
+}
+
+func escapeCreditNotes(notes []CreditNote) {
+	for i := range notes {
+		notes[i].Reason = html.EscapeString(notes[i].Reason)
+		for n := range notes[i].Lines {
+			notes[i].Lines[n].Description = html.EscapeString(notes[i].Lines[n].Description)
+		}
+	}
+}
+
+// creditedAmount returns the sum of the credit notes issued on an invoice
+// and not voided
+func creditedAmount(db *gorm.DB, invoiceID uint) (int64, error) {
+	var credited struct{ Total int64 }
+	err := db.Model(&CreditNote{}).Select("COALESCE(SUM(amount), 0) AS total").
+		Where("invoice_id = ? AND status = ?", invoiceID, creditNoteIssued).Scan(&credited).Error
+	return credited.Total, err
+}
+
+// settledAmount returns what was paid and credited on an invoice, which
+// leaves its balance to pay
+func settledAmount(db *gorm.DB, invoiceID uint) (int64, error) {
+	paid, err := paidAmount(db, invoiceID)
+	if err != nil {
+		return 0, err
+	}
+	credited, err := creditedAmount(db, invoiceID)
+	return paid + credited, err
+}
+
+// invoiceCreditNotes returns the credit notes of an invoice and their
+// lines, oldest first
+func invoiceCreditNotes(db *gorm.DB, invoiceID uint) ([]CreditNote, error) {
+	notes := []CreditNote{}
+	err := db.Preload("Lines", func(db *gorm.DB) *gorm.DB { return db.Order("id asc") }).
+		Where("invoice_id = ?", invoiceID).Order("id asc").Find(&notes).Error
+	return notes, err
+}
+
+// validateCreditNote checks the lines of a credit note, which can't bring
+// the credits of its invoice above the invoice amount
+func validateCreditNote(cn CreditNote, i Invoice, credited int64) validationErrors {
+	var errs validationErrors
+	if len(cn.Lines) == 0 {
+		errs.add("lines", "must contain at least one line")
+	}
+	for n, l := range cn.Lines {
+		if strings.TrimSpace(l.Description) == "" {
+			errs.add(fmt.Sprintf("lines[%d].description", n), "must not be empty")
+		}
+		if l.Amount <= 0 {
+			errs.add(fmt.Sprintf("lines[%d].amount", n), "must be a positive number")
+		}
+	}
+	if cn.Currency != i.Currency {
+		errs.add("currency", "must match the currency of the invoice, %s", i.Currency)
+	}
+	if len(errs) == 0 && cn.Amount > i.Amount-credited {
+		errs.add("lines", "must not credit more than the %s %s left to credit on invoice %d",
+			formatMinorUnits(i.Amount-credited, i.Currency), i.Currency, i.ID)
+	}
+	return errs
+}
+
+// canCredit returns true if credit notes can be issued on an invoice of a
+// status. Drafts are edited instead and cancelled invoices are owed nothing.
+func canCredit(status string) bool {
+	return status != statusDraft && status != statusCancelled
+}
+
+func (iv *invoicer) getInvoiceCreditNotes(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	notes, err := invoiceCreditNotes(iv.dbFor(r), i1.ID)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve credit notes of invoice %d: %s", i1.ID, err)
+		return
+	}
+	escapeCreditNotes(notes)
+	writeJSON(w, r, http.StatusOK, notes)
+}
+
+// postInvoiceCreditNote issues a credit note on an invoice. A credit note
+// that settles the balance of an invoice awaiting payment moves it to paid,
+// one issued on a paid invoice is owed back to the customer.
+func (iv *invoicer) postInvoiceCreditNote(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	if !canCredit(i1.Status) {
+		httpError(w, r, http.StatusConflict, "invoice %d is %s and cannot be credited", i1.ID, i1.Status)
+		return
+	}
+	snapshot := iv.invoiceSnapshot(i1.ID)
+	var cn CreditNote
+	if !readJSONBody(w, r, &cn) {
+		return
+	}
+	cn.ID, cn.InvoiceID, cn.Status, cn.Amount, cn.VoidedAt = 0, i1.ID, creditNoteIssued, 0, nil
+	if cn.Currency == "" {
+		cn.Currency = i1.Currency
+	}
+	if cn.IssuedAt.IsZero() {
+		cn.IssuedAt = time.Now().UTC()
+	}
+	for n := range cn.Lines {
+		cn.Lines[n].ID, cn.Lines[n].CreditNoteID = 0, 0
+		cn.Amount += cn.Lines[n].Amount
+	}
+
+	tx := iv.dbFor(r).Begin()
+	if tx.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to issue credit note: %s", tx.Error)
+		return
+	}
+	// concurrent credit notes and payments are validated one after the other
+	// against the invoice as it is now
+	i1, ok = lockRequestInvoice(w, r, tx, i1.ID)
+	if !ok {
+		return
+	}
+	if !canCredit(i1.Status) {
+		tx.Rollback()
+		httpError(w, r, http.StatusConflict, "invoice %d is %s and cannot be credited", i1.ID, i1.Status)
+		return
+	}
+	paid, err := paidAmount(tx, i1.ID)
+	if err != nil {
+		tx.Rollback()
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve payments of invoice %d: %s", i1.ID, err)
+		return
+	}
+	credited, err := creditedAmount(tx, i1.ID)
+	if err != nil {
+		tx.Rollback()
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve credit notes of invoice %d: %s", i1.ID, err)
+		return
+	}
+	if errs := validateCreditNote(cn, i1, credited); len(errs) > 0 {
+		tx.Rollback()
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	before := i1
+	err = tx.Create(&cn).Error
+	if err == nil && canTransition(i1.Status, statusPaid) && paid+credited+cn.Amount >= i1.Amount {
+		err = tx.Model(&i1).Updates(map[string]interface{}{
+			"status": statusPaid, "is_paid": true, "payment_date": cn.IssuedAt, "version": nextVersion()}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		httpError(w, r, http.StatusInternalServerError, "failed to issue credit note on invoice %d: %s", i1.ID, err)
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to issue credit note: %s", err)
+		return
+	}
+	al := appLog{Message: fmt.Sprintf("issued credit note %d of %s %s on invoice %d, now %s",
+		cn.ID, formatMinorUnits(cn.Amount, cn.Currency), cn.Currency, i1.ID, i1.Status), Action: "post-credit-note"}
+	al.log(r)
+	iv.audit(r, "credit", i1.ID, snapshot, iv.invoiceSnapshot(i1.ID))
+	iv.fireInvoiceUpdated(before, i1)
+	notes := []CreditNote{cn}
+	escapeCreditNotes(notes)
+	writeJSON(w, r, http.StatusCreated, notes[0])
+}
+
+// loadCreditNote retrieves the credit note of a request and its invoice,
+// unless the invoice was deleted
+func (iv *invoicer) loadCreditNote(w http.ResponseWriter, r *http.Request) (CreditNote, Invoice, bool) {
+	vars := mux.Vars(r)
+	var cn CreditNote
+	res := iv.dbFor(r).Preload("Lines", func(db *gorm.DB) *gorm.DB { return db.Order("id asc") }).First(&cn, vars["id"])
+	if res.RecordNotFound() {
+		httpError(w, r, http.StatusNotFound, "No credit note id %s", vars["id"])
+		return cn, Invoice{}, false
+	}
+	if res.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve credit note id %s: %s", vars["id"], res.Error)
+		return cn, Invoice{}, false
+	}
+	i1, err := iv.invoicesFor(r).Get(cn.InvoiceID, false)
+	if err == errInvoiceNotFound {
+		httpError(w, r, http.StatusNotFound, "No credit note id %s", vars["id"])
+		return cn, i1, false
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve invoice %d: %s", cn.InvoiceID, err)
+		return cn, i1, false
+	}
+	return cn, i1, true
+}
+
+func (iv *invoicer) getCreditNote(w http.ResponseWriter, r *http.Request) {
+	cn, _, ok := iv.loadCreditNote(w, r)
+	if !ok {
+		return
+	}
+	notes := []CreditNote{cn}
+	escapeCreditNotes(notes)
+	writeJSON(w, r, http.StatusOK, notes[0])
+}
+
+// postCreditNoteVoid voids a credit note, which no longer reduces the
+// balance of its invoice. Paid invoices stay paid, so a credit note that
+// settled an invoice can't be voided.
+func (iv *invoicer) postCreditNoteVoid(w http.ResponseWriter, r *http.Request) {
+	cn, i1, ok := iv.loadCreditNote(w, r)
+	if !ok {
+		return
+	}
+	if cn.Status == creditNoteVoid {
+		httpError(w, r, http.StatusConflict, "credit note %d is already void", cn.ID)
+		return
+	}
+	snapshot := iv.invoiceSnapshot(i1.ID)
+	tx := iv.dbFor(r).Begin()
+	if tx.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to void credit note: %s", tx.Error)
+		return
+	}
+	i1, ok = lockRequestInvoice(w, r, tx, i1.ID)
+	if !ok {
+		return
+	}
+	settled, err := settledAmount(tx, i1.ID)
+	if err != nil {
+		tx.Rollback()
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve balance of invoice %d: %s", i1.ID, err)
+		return
+	}
+	if i1.Status == statusPaid && settled-cn.Amount < i1.Amount {
+		tx.Rollback()
+		httpError(w, r, http.StatusConflict, "credit note %d settles paid invoice %d and cannot be voided", cn.ID, i1.ID)
+		return
+	}
+	now := time.Now().UTC()
+	res := tx.Model(&cn).Where("status = ?", creditNoteIssued).
+		Updates(map[string]interface{}{"status": creditNoteVoid, "voided_at": now})
+	if res.Error != nil {
+		tx.Rollback()
+		httpError(w, r, http.StatusInternalServerError, "failed to void credit note %d: %s", cn.ID, res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		httpError(w, r, http.StatusConflict, "credit note %d is already void", cn.ID)
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to void credit note: %s", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("voided credit note %d", cn.ID)))
+	al := appLog{Message: fmt.Sprintf("voided credit note %d of %s %s on invoice %d",
+		cn.ID, formatMinorUnits(cn.Amount, cn.Currency), cn.Currency, i1.ID), Action: "post-credit-note-void"}
+	al.log(r)
+	iv.audit(r, "void-credit", i1.ID, snapshot, iv.invoiceSnapshot(i1.ID))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/gorilla/securecookie"
+)
+
+const csrfNonceSize = 24
+
+var (
+	// csrfKeys sign and check CSRF tokens, the first one signing new
+	// tokens, set from csrf.keys at startup
+	csrfKeys [][]byte
+	// csrfTokenTTL is how long CSRF tokens are accepted, set from
+	// csrf.token_ttl at startup
+	csrfTokenTTL = 12 * time.Hour
+)
+
+// setCSRFKeys configures the keys and lifetime of CSRF tokens. A random key
+// is used when none is set, which invalidates the tokens of pages loaded
+// before a restart, and the tokens of other instances.
+func setCSRFKeys(cfg config.CSRF) {
+	csrfKeys = nil
+	for _, key := range cfg.Keys {
+		csrfKeys = append(csrfKeys, []byte(key))
+	}
+	if len(csrfKeys) == 0 {
+		applog.warnf("csrf.keys is not set, using a random key that invalidates CSRF tokens on restarts")
+		csrfKeys = [][]byte{securecookie.GenerateRandomKey(32)}
+	}
+	csrfTokenTTL = cfg.TokenTTL
+}
+
+func csrfMAC(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// signCSRFToken returns a token accepted until expires. Its payload is the
+// expiration time followed by a random nonce, and is signed with the first
+// key.
+func signCSRFToken(expires time.Time) string {
+	payload := make([]byte, 8+csrfNonceSize)
+	binary.BigEndian.PutUint64(payload, uint64(expires.Unix()))
+	rand.Read(payload[8:])
+	return base64.StdEncoding.EncodeToString(payload) + `$` + base64.StdEncoding.EncodeToString(csrfMAC(csrfKeys[0], payload))
+}
+
+func createCSRFToken() string {
+	return signCSRFToken(time.Now().Add(csrfTokenTTL))
+}
+
+// checkCSRFToken returns true if a token was signed by any of the keys and
+// hasn't expired, so tokens signed before a key rotation remain valid as
+// long as the old key is listed
+func checkCSRFToken(token string) bool {
+	tokenParts := strings.Split(token, "$")
+	if len(tokenParts) != 2 {
+		return false
+	}
+	payload, err := base64.StdEncoding.DecodeString(tokenParts[0])
+	if err != nil || len(payload) != 8+csrfNonceSize {
+		return false
+	}
+	messageMAC, err := base64.StdEncoding.DecodeString(tokenParts[1])
+	if err != nil {
+		return false
+	}
+	if time.Now().Unix() >= int64(binary.BigEndian.Uint64(payload)) {
+		return false
+	}
+	for _, key := range csrfKeys {
+		if hmac.Equal(messageMAC, csrfMAC(key, payload)) {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfExposed returns true if a request changes state and could have been
+// forged by another site: it comes from a browser, which attaches cookies
+// and basic auth credentials on its own, and isn't authenticated with a
+// bearer token, which browsers never attach on their own. Browsers are told
+// from other clients by the headers they send along.
+func csrfExposed(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	if strings.HasPrefix(strings.ToLower(r.Header.Get("Authorization")), "bearer ") {
+		return false
+	}
+	for _, h := range []string{"Cookie", "Origin", "Referer", "Sec-Fetch-Site"} {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfProtect rejects the state changing requests of browsers that don't
+// carry a valid CSRF token, either in the X-CSRF-Token header or in the
+// CSRFToken field of a url encoded form. It runs after the authentication
+// middlewares.
+func csrfProtect() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !csrfExposed(r) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			token := r.Header.Get("X-CSRF-Token")
+			if token == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+				token = r.PostFormValue("CSRFToken")
+			}
+			if !checkCSRFToken(token) {
+				httpError(w, r, http.StatusNotAcceptable, "Invalid CSRF Token: %s %s from a browser requires a valid token, from GET /csrf-token", r.Method, r.URL.Path)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+type csrfTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// getCSRFToken issues a CSRF token to browser applications. Other origins
+// can't read it unless CORS allows them to.
+func getCSRFToken(w http.ResponseWriter, r *http.Request) {
+	expires := time.Now().Add(csrfTokenTTL).Truncate(time.Second).UTC()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, http.StatusOK, csrfTokenResponse{signCSRFToken(expires), expires})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Customer is the client billed by invoices
+type Customer struct {
+	gorm.Model
+	Name           string `json:"name"`
+	Email          string `json:"email"`
+	BillingAddress string `json:"billing_address"`
+	TaxID          string `json:"tax_id" encrypted:"true"`
+}
+
+func validateCustomer(c Customer) error {
+	if strings.TrimSpace(c.Name) == "" {
+		return fmt.Errorf("customer name must not be empty")
+	}
+	if c.Email != "" {
+		if _, err := mail.ParseAddress(c.Email); err != nil {
+			return fmt.Errorf("invalid email address %q", c.Email)
+		}
+	}
+	return nil
+}
+
+func escapeCustomer(c *Customer) {
+	c.Name = html.EscapeString(c.Name)
+	c.Email = html.EscapeString(c.Email)
+	c.BillingAddress = html.EscapeString(c.BillingAddress)
+	c.TaxID = html.EscapeString(c.TaxID)
+}
+
+// customerExists returns false if an invoice references a customer that
+// does not exist. Invoices without a customer are accepted.
+func (iv *invoicer) customerExists(customerID uint) (bool, error) {
+	if customerID == 0 {
+		return true, nil
+	}
+	var count int
+	err := iv.db.Model(&Customer{}).Where("id = ?", customerID).Count(&count).Error
+	return count > 0, err
+}
+
+func (iv *invoicer) getCustomers(w http.ResponseWriter, r *http.Request) {
+	var customers []Customer
+	err := iv.dbFor(r).Order("id asc").Find(&customers).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve customers: %s", err)
+		return
+	}
+	for i := range customers {
+		escapeCustomer(&customers[i])
+	}
+	writeJSON(w, r, http.StatusOK, customers)
+}
+
+func (iv *invoicer) getCustomer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var c Customer
+	iv.dbFor(r).First(&c, vars["id"])
+	if c.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No customer id %s", vars["id"])
+		return
+	}
+	escapeCustomer(&c)
+	writeJSON(w, r, http.StatusOK, c)
+}
+
+func (iv *invoicer) postCustomer(w http.ResponseWriter, r *http.Request) {
+	var c Customer
+	if !readJSONBody(w, r, &c) {
+		return
+	}
+	c.ID = 0
+	err := validateCustomer(c)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid customer: %s", err)
+		return
+	}
+	iv.dbFor(r).Create(&c)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("created customer %d", c.ID)))
+	al := appLog{Message: fmt.Sprintf("created customer %d", c.ID), Action: "post-customer"}
+	al.log(r)
+}
+
+func (iv *invoicer) putCustomer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var c Customer
+	iv.dbFor(r).First(&c, vars["id"])
+	if c.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No customer id %s", vars["id"])
+		return
+	}
+	id := c.ID
+	if !readJSONBody(w, r, &c) {
+		return
+	}
+	c.ID = id
+	err := validateCustomer(c)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid customer: %s", err)
+		return
+	}
+	iv.dbFor(r).Save(&c)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("updated customer %d", c.ID)))
+	al := appLog{Message: fmt.Sprintf("updated customer %d", c.ID), Action: "put-customer"}
+	al.log(r)
+}
+
+// deleteCustomer removes a customer that is not billed by any invoice
+func (iv *invoicer) deleteCustomer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var c Customer
+	iv.dbFor(r).First(&c, vars["id"])
+	if c.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No customer id %s", vars["id"])
+		return
+	}
+	var invoices int
+	iv.dbFor(r).Model(&Invoice{}).Where("customer_id = ?", c.ID).Count(&invoices)
+	if invoices > 0 {
+		httpError(w, r, http.StatusConflict, "customer %d is billed by %d invoices", c.ID, invoices)
+		return
+	}
+	iv.dbFor(r).Delete(&c)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted customer %d", c.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted customer %d", c.ID), Action: "delete-customer"}
+	al.log(r)
+}
+
+// getCustomerInvoices lists the invoices of a customer, with the same
+// pagination and filters as the invoices listing
+func (iv *invoicer) getCustomerInvoices(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var c Customer
+	iv.dbFor(r).First(&c, vars["id"])
+	if c.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No customer id %s", vars["id"])
+		return
+	}
+	filters, err := parseInvoiceFilters(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	filters.CustomerID = c.ID
+	iv.listInvoices(w, r, filters)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// parseIncludeDeleted reads the `include_deleted` query parameter, which
+// makes reads return soft deleted invoices
+func parseIncludeDeleted(r *http.Request) (bool, error) {
+	if r.FormValue("include_deleted") == "" {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(r.FormValue("include_deleted"))
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean %q in parameter include_deleted", r.FormValue("include_deleted"))
+	}
+	return include, nil
+}
+
+// getDeletedInvoices lists soft deleted invoices, with the same filters and
+// pagination as the list of invoices
+func (iv *invoicer) getDeletedInvoices(w http.ResponseWriter, r *http.Request) {
+	filters, err := parseInvoiceFilters(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	filters.OnlyDeleted = true
+	iv.listInvoices(w, r, filters)
+}
+
+// postInvoiceRestore undeletes an invoice and the charges deleted with it
+func (iv *invoicer) postInvoiceRestore(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	i1, err := iv.invoicesFor(r).Get(uint(id), true)
+	if err == errInvoiceNotFound {
+		httpError(w, r, http.StatusNotFound, "No invoice id %s", vars["id"])
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve invoice id %s: %s", vars["id"], err)
+		return
+	}
+	if i1.DeletedAt == nil {
+		httpError(w, r, http.StatusConflict, "invoice %d is not deleted", i1.ID)
+		return
+	}
+	err = iv.invoicesFor(r).Restore(i1)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to restore invoice %d: %s", i1.ID, err)
+		return
+	}
+	i1.DeletedAt = nil
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("restored invoice %d", i1.ID)))
+	al := appLog{Message: fmt.Sprintf("restored invoice %d", i1.ID), Action: "post-invoice-restore"}
+	al.log(r)
+	iv.audit(r, "restore", i1.ID, nil, iv.invoiceSnapshot(i1.ID))
+	iv.fireWebhooks(eventInvoiceRestored, i1)
+}
+
+// purgeInvoice erases an invoice and the records attached to it in one
+// transaction, then the contents of its attachments if deleteBlobs is set.
+// r is nil when the retention policy purges the invoice.
+func (iv *invoicer) purgeInvoice(r *http.Request, i1 Invoice, deleteBlobs bool) error {
+	var attachments []Attachment
+	err := iv.dbFor(r).Where("invoice_id = ?", i1.ID).Find(&attachments).Error
+	if err != nil {
+		return fmt.Errorf("failed to retrieve attachments: %s", err)
+	}
+	tx := iv.dbFor(r).Unscoped().Begin()
+	err = tx.Where("credit_note_id IN (SELECT id FROM credit_notes WHERE invoice_id = ?)", i1.ID).Delete(&CreditNoteLine{}).Error
+	for _, model := range []interface{}{&Charge{}, &Payment{}, &Delivery{}, &Attachment{}, &Note{}, &CreditNote{}, &ShareLink{}, &AuditEvent{}} {
+		if err != nil {
+			break
+		}
+		err = tx.Where("invoice_id = ?", i1.ID).Delete(model).Error
+	}
+	if err == nil {
+		err = tx.Delete(&i1).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit().Error
+	if err != nil || !deleteBlobs {
+		return err
+	}
+	for _, a := range attachments {
+		if err = iv.attachments.blobs.Delete(a.StorageKey); err != nil {
+			requestLogger(r).errorf("failed to delete content of attachment %d: %s", a.ID, err)
+		}
+	}
+	return nil
+}
+
+// deleteInvoicePurge permanently erases an invoice, deleted or not, along
+// with its charges, payments, email deliveries, attachments, notes and
+// history. Only the fact that it was purged, and by whom, is kept in its
+// history.
+func (iv *invoicer) deleteInvoicePurge(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	var i1 Invoice
+	iv.dbFor(r).Unscoped().First(&i1, vars["id"])
+	if i1.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No invoice id %s", vars["id"])
+		return
+	}
+	err := iv.purgeInvoice(r, i1, true)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to purge invoice %d: %s", i1.ID, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("purged invoice %d", i1.ID)))
+	al := appLog{Message: fmt.Sprintf("purged invoice %d", i1.ID), Action: "delete-invoice-purge"}
+	al.log(r)
+	iv.audit(r, "purge", i1.ID, nil, nil)
+	if i1.DeletedAt == nil {
+		iv.fireWebhooks(eventInvoiceDeleted, i1)
+	}
+}
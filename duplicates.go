@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+)
+
+const (
+	// defaultDuplicateWindowDays is the window of duplicates listed when
+	// invoices.duplicate_window_days is off
+	defaultDuplicateWindowDays = 7
+	maxDuplicateWindowDays     = config.MaxDuplicateWindowDays
+	maxDuplicates              = 10
+)
+
+type duplicatesReport struct {
+	InvoiceID  uint      `json:"invoice_id"`
+	Days       int       `json:"days"`
+	Duplicates []Invoice `json:"duplicates"`
+}
+
+// duplicateWarning warns that a created invoice is likely to duplicate
+// another one
+type duplicateWarning struct {
+	Code          string    `json:"code"`
+	Message       string    `json:"message"`
+	InvoiceID     uint      `json:"invoice_id"`
+	InvoiceNumber string    `json:"invoice_number"`
+	DueDate       time.Time `json:"due_date"`
+}
+
+// createdInvoice is the response to creating an invoice
+type createdInvoice struct {
+	ID            uint               `json:"id"`
+	InvoiceNumber string             `json:"invoice_number"`
+	Message       string             `json:"message"`
+	Warnings      []duplicateWarning `json:"warnings"`
+}
+
+// findDuplicates returns the invoices likely to duplicate i: billing the
+// same customer the same amount, due within days of it. Invoices without a
+// customer are matched against invoices of any customer on their amount,
+// currency and due date.
+func (iv *invoicer) findDuplicates(r *http.Request, i Invoice, days int) ([]Invoice, error) {
+	return iv.invoicesFor(r).Duplicates(i, time.Duration(days)*24*time.Hour, maxDuplicates)
+}
+
+// duplicateWarnings warns of the likely duplicates of a created invoice, so
+// clerks notice them before billing a customer twice. The warnings are also
+// added as Warning headers for older clients. Failing to look for them
+// doesn't fail the creation.
+func (iv *invoicer) duplicateWarnings(w http.ResponseWriter, r *http.Request, i Invoice) []duplicateWarning {
+	warnings := []duplicateWarning{}
+	if iv.duplicateWindowDays == 0 {
+		return warnings
+	}
+	duplicates, err := iv.findDuplicates(r, i, iv.duplicateWindowDays)
+	if err != nil {
+		applog.warnf("failed to look for duplicates of invoice %d: %s", i.ID, err)
+		return warnings
+	}
+	for _, d := range duplicates {
+		message := fmt.Sprintf("possible duplicate of invoice %d (%s) due %s", d.ID, d.InvoiceNumber, d.DueDate.Format("2006-01-02"))
+		warnings = append(warnings, duplicateWarning{Code: "possible_duplicate", Message: message,
+			InvoiceID: d.ID, InvoiceNumber: d.InvoiceNumber, DueDate: d.DueDate})
+		w.Header().Add("Warning", fmt.Sprintf(`299 invoicer "%s"`, message))
+	}
+	return warnings
+}
+
+// getInvoiceDuplicates lists the invoices likely to duplicate an invoice,
+// due within the `days` parameter of it or the configured window
+func (iv *invoicer) getInvoiceDuplicates(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	days := iv.duplicateWindowDays
+	if days == 0 {
+		days = defaultDuplicateWindowDays
+	}
+	if r.FormValue("days") != "" {
+		var err error
+		days, err = strconv.Atoi(r.FormValue("days"))
+		if err != nil || days < 0 || days > maxDuplicateWindowDays {
+			httpError(w, r, http.StatusBadRequest, "invalid days parameter %q, must be between 0 and %d", r.FormValue("days"), maxDuplicateWindowDays)
+			return
+		}
+	}
+	duplicates, err := iv.findDuplicates(r, i1, days)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to look for duplicates of invoice %d: %s", i1.ID, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, duplicatesReport{InvoiceID: i1.ID, Days: days, Duplicates: duplicates})
+	al := appLog{Message: fmt.Sprintf("found %d likely duplicates of invoice %d", len(duplicates), i1.ID), Action: "get-invoice-duplicates"}
+	al.log(r)
+}
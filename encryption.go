@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/jinzhu/gorm"
+)
+
+// encryptedPrefix starts the values of encrypted columns, followed by the
+// id of their key and the base64 encoded nonce and ciphertext. Values
+// without it are plaintext stored before encryption was enabled.
+const encryptedPrefix = "enc:v1:"
+
+// encryptedModels are the models with columns tagged `encrypted:"true"`,
+// re-encrypted by -reencrypt
+var encryptedModels = []interface{}{&Customer{}, &Payment{}}
+
+// fieldKeys encrypt the tagged columns, nil if encryption is disabled
+var fieldKeys *keyring
+
+// keyring holds the AES-256-GCM keys of encrypted columns. The first key
+// encrypts and every key decrypts.
+type keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// setEncryptionKeys configures the keys of encrypted columns, leaving them
+// in plaintext if none is set
+func setEncryptionKeys(cfg config.Encryption) error {
+	fieldKeys = nil
+	if len(cfg.Keys) == 0 {
+		return nil
+	}
+	kr := &keyring{aeads: make(map[string]cipher.AEAD)}
+	for _, pair := range cfg.Keys {
+		id, key, err := config.EncryptionKey(pair)
+		if err != nil {
+			return fmt.Errorf("invalid encryption.keys: %s", err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		kr.aeads[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		if kr.primary == "" {
+			kr.primary = id
+		}
+	}
+	fieldKeys = kr
+	return nil
+}
+
+// encrypt seals a value with the primary key. The column is authenticated
+// along with it, so values cannot be moved to other columns.
+func (kr *keyring) encrypt(column, plaintext string) (string, error) {
+	aead := kr.aeads[kr.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(column))
+	return encryptedPrefix + kr.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens a value sealed by encrypt, and returns plaintext values as is
+func (kr *keyring) decrypt(column, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed encrypted value in %s", column)
+	}
+	aead, ok := kr.aeads[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("%s is encrypted with unknown key %q", column, parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value in %s", column)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %s", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptedField is a string field of a model tagged `encrypted:"true"`
+type encryptedField struct {
+	name   string
+	dbName string
+}
+
+// encryptedFields returns the encrypted fields of the model of a scope
+func encryptedFields(scope *gorm.Scope) []encryptedField {
+	var fields []encryptedField
+	for _, f := range scope.GetModelStruct().StructFields {
+		if f.Tag.Get("encrypted") == "true" && f.Struct.Type.Kind() == reflect.String {
+			fields = append(fields, encryptedField{name: f.Name, dbName: f.DBName})
+		}
+	}
+	return fields
+}
+
+// eachRecord calls fn with the addressable structs a scope reads or writes
+func eachRecord(scope *gorm.Scope, fn func(record reflect.Value) error) error {
+	v := scope.IndirectValue()
+	switch v.Kind() {
+	case reflect.Struct:
+		return fn(v)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			record := reflect.Indirect(v.Index(i))
+			if record.Kind() != reflect.Struct {
+				continue
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encryptColumns registers the gorm callbacks that encrypt the tagged
+// columns when rows are written and decrypt them when rows are read, so
+// the rest of the invoicer only handles plaintext
+func encryptColumns(callbacks *gorm.Callback, kr *keyring) {
+	callbacks.Create().Before("gorm:create").Register("encryption:encrypt_create", kr.encryptScope)
+	callbacks.Create().After("gorm:create").Register("encryption:restore_create", kr.restoreScope)
+	callbacks.Update().Before("gorm:update").Register("encryption:encrypt_update", kr.encryptScope)
+	callbacks.Update().After("gorm:update").Register("encryption:restore_update", kr.restoreScope)
+	callbacks.Query().After("gorm:query").Register("encryption:decrypt_query", kr.decryptScope)
+}
+
+const (
+	encryptionPlaintextKey = "encryption:plaintext"
+	// encryptionCiphertextKey is set on queries that read the tagged
+	// columns as stored, see withCiphertext
+	encryptionCiphertextKey = "encryption:ciphertext"
+)
+
+// withCiphertext returns a db whose queries leave the tagged columns as
+// stored, for copies of rows that must stay encrypted at rest
+func withCiphertext(db *gorm.DB) *gorm.DB {
+	return db.Set(encryptionCiphertextKey, true)
+}
+
+// encryptScope encrypts the tagged fields of the records written, and the
+// tagged columns of updates, keeping their plaintext for restoreScope
+func (kr *keyring) encryptScope(scope *gorm.Scope) {
+	fields := encryptedFields(scope)
+	if len(fields) == 0 || scope.HasError() {
+		return
+	}
+	table := scope.TableName()
+	var plaintext []func()
+	err := eachRecord(scope, func(record reflect.Value) error {
+		for _, f := range fields {
+			field := record.FieldByName(f.name)
+			value := field.String()
+			if value == "" || !field.CanSet() {
+				continue
+			}
+			sealed, err := kr.encrypt(table+"."+f.dbName, value)
+			if err != nil {
+				return err
+			}
+			field.SetString(sealed)
+			plaintext = append(plaintext, func() { field.SetString(value) })
+		}
+		return nil
+	})
+	scope.InstanceSet(encryptionPlaintextKey, plaintext)
+	if err != nil {
+		scope.Err(fmt.Errorf("failed to encrypt %s: %s", table, err))
+		return
+	}
+	if attrs, ok := scope.InstanceGet("gorm:update_attrs"); ok {
+		updates := attrs.(map[string]interface{})
+		for _, f := range fields {
+			value, ok := updates[f.dbName].(string)
+			if !ok || value == "" {
+				continue
+			}
+			updates[f.dbName], err = kr.encrypt(table+"."+f.dbName, value)
+			if err != nil {
+				scope.Err(fmt.Errorf("failed to encrypt %s: %s", table, err))
+				return
+			}
+		}
+	}
+}
+
+// restoreScope puts back the plaintext of the records encrypted by
+// encryptScope once they are written
+func (kr *keyring) restoreScope(scope *gorm.Scope) {
+	if plaintext, ok := scope.InstanceGet(encryptionPlaintextKey); ok {
+		for _, restore := range plaintext.([]func()) {
+			restore()
+		}
+	}
+}
+
+// decryptScope decrypts the tagged fields of the records read, unless the
+// query is made withCiphertext
+func (kr *keyring) decryptScope(scope *gorm.Scope) {
+	fields := encryptedFields(scope)
+	if len(fields) == 0 || scope.HasError() {
+		return
+	}
+	if _, ok := scope.Get(encryptionCiphertextKey); ok {
+		return
+	}
+	table := scope.TableName()
+	err := eachRecord(scope, func(record reflect.Value) error {
+		for _, f := range fields {
+			field := record.FieldByName(f.name)
+			value, err := kr.decrypt(table+"."+f.dbName, field.String())
+			if err != nil {
+				return err
+			}
+			field.SetString(value)
+		}
+		return nil
+	})
+	if err != nil {
+		scope.Err(err)
+	}
+}
+
+// reencryptColumns encrypts the tagged columns of every row, soft deleted
+// or not, with the primary key: values encrypted with older keys, and
+// plaintext stored before encryption was enabled. It runs once keys are
+// rotated, before the older keys are removed.
+func reencryptColumns(db *gorm.DB) error {
+	if fieldKeys == nil {
+		return fmt.Errorf("encryption.keys must be set to re-encrypt the database")
+	}
+	for _, model := range encryptedModels {
+		scope := db.NewScope(model)
+		table := scope.TableName()
+		for _, f := range encryptedFields(scope) {
+			column := table + "." + f.dbName
+			n, err := reencryptColumn(db, table, f.dbName)
+			if err != nil {
+				return fmt.Errorf("failed to re-encrypt %s: %s", column, err)
+			}
+			applog.infof("re-encrypted %d values of %s with key %q", n, column, fieldKeys.primary)
+		}
+	}
+	return nil
+}
+
+// reencryptColumn re-encrypts the values of a column not encrypted with the
+// primary key, in one transaction
+func reencryptColumn(db *gorm.DB, table, column string) (int, error) {
+	type row struct {
+		ID    uint
+		Value string
+	}
+	var rows []row
+	err := db.Table(table).Select("id, "+column+" AS value").
+		Where(column+" <> '' AND "+column+" NOT LIKE ?", encryptedPrefix+fieldKeys.primary+":%").
+		Scan(&rows).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	tx := db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	for _, r := range rows {
+		plaintext, err := fieldKeys.decrypt(table+"."+column, r.Value)
+		if err == nil {
+			r.Value, err = fieldKeys.encrypt(table+"."+column, plaintext)
+		}
+		if err == nil {
+			err = tx.Exec("UPDATE "+table+" SET "+column+" = ? WHERE id = ?", r.Value, r.ID).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("row %d: %s", r.ID, err)
+		}
+	}
+	return len(rows), tx.Commit().Error
+}
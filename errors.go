@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// errorCode is a stable, machine readable identifier of the kind of error
+// returned by the API, which clients can rely on rather than on messages
+type errorCode string
+
+const (
+	errBadRequest       errorCode = "bad_request"
+	errUnauthorized     errorCode = "unauthorized"
+	errForbidden        errorCode = "forbidden"
+	errNotFound         errorCode = "not_found"
+	errMethodNotAllowed errorCode = "method_not_allowed"
+	errInvalidCSRFToken errorCode = "invalid_csrf_token"
+	errConflict         errorCode = "conflict"
+	errPrecondition     errorCode = "precondition_failed"
+	errValidation       errorCode = "validation_failed"
+	errPayloadTooLarge  errorCode = "payload_too_large"
+	errTooManyRequests  errorCode = "too_many_requests"
+	errInternal         errorCode = "internal_error"
+	errUnavailable      errorCode = "service_unavailable"
+	errTimeout          errorCode = "timeout"
+)
+
+// errorCodeForStatus returns the default error code of an http status
+func errorCodeForStatus(status int) errorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return errBadRequest
+	case http.StatusUnauthorized:
+		return errUnauthorized
+	case http.StatusForbidden:
+		return errForbidden
+	case http.StatusNotFound:
+		return errNotFound
+	case http.StatusMethodNotAllowed:
+		return errMethodNotAllowed
+	case http.StatusNotAcceptable:
+		return errInvalidCSRFToken
+	case http.StatusConflict:
+		return errConflict
+	case http.StatusPreconditionFailed:
+		return errPrecondition
+	case http.StatusRequestEntityTooLarge:
+		return errPayloadTooLarge
+	case http.StatusUnprocessableEntity:
+		return errValidation
+	case http.StatusTooManyRequests:
+		return errTooManyRequests
+	case http.StatusServiceUnavailable:
+		return errUnavailable
+	case http.StatusGatewayTimeout:
+		return errTimeout
+	}
+	if status >= 500 {
+		return errInternal
+	}
+	return errBadRequest
+}
+
+// apiError is the body of every error response, wrapped in an `error` key.
+// The request ID lets support correlate a response with the logs.
+type apiError struct {
+	Code      errorCode        `json:"code"`
+	Message   string           `json:"message"`
+	RequestID string           `json:"request_id,omitempty"`
+	Fields    validationErrors `json:"fields,omitempty"`
+	// Permission is the permission missing from forbidden requests
+	Permission string `json:"permission,omitempty"`
+}
+
+func requestID(r *http.Request) string {
+	if val, ok := r.Context().Value(ctxReqID).(string); ok {
+		return val
+	}
+	return ""
+}
+
+// writeError sends an error envelope to the client without logging it
+func writeError(w http.ResponseWriter, r *http.Request, status int, e apiError) {
+	e.RequestID = requestID(r)
+	body, _ := json.Marshal(struct {
+		Error apiError `json:"error"`
+	}{e})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// httpError logs an error and sends it to the client with the default
+// error code of its status. Server errors of requests past their deadline,
+// such as cancelled queries, are reported as timeouts.
+func httpError(w http.ResponseWriter, r *http.Request, errorCode int, errorMessage string, args ...interface{}) {
+	if errorCode >= http.StatusInternalServerError && timedOut(r) {
+		errorCode, errorMessage = http.StatusGatewayTimeout, "request timed out: "+errorMessage
+	}
+	al := appLog{ErrorCode: errorCode, Message: fmt.Sprintf(errorMessage, args...)}
+	al.log(r)
+	writeError(w, r, errorCode, apiError{Code: errorCodeForStatus(errorCode), Message: al.Message})
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	httpError(w, r, http.StatusNotFound, "no route matches %s %s", r.Method, r.URL.Path)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	httpError(w, r, http.StatusMethodNotAllowed, "method %s is not allowed on %s", r.Method, r.URL.Path)
+}
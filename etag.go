@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// errVersionConflict is returned when an invoice was modified between the
+// time it was read and the time it was saved
+var errVersionConflict = errors.New("invoice was modified concurrently")
+
+// nextVersion increments the version of the invoices an update applies to,
+// to be included in the columns of updates that don't go through
+// saveInvoice
+func nextVersion() interface{} {
+	return gorm.Expr("version + 1")
+}
+
+// invoiceETag returns the entity tag of the current version of an invoice
+func invoiceETag(i Invoice) string {
+	return fmt.Sprintf(`"%d"`, i.Version)
+}
+
+// matchETag returns true if an If-Match header is empty or lists etag or
+// "*". Weak tags never match, as If-Match requires a strong comparison.
+func matchETag(header, etag string) bool {
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInvoicePrecondition returns a 412 service error if an If-Match
+// header conditions a change on another version of the invoice
+func checkInvoicePrecondition(i Invoice, header string) error {
+	if i.ID == 0 && header != "" {
+		return newServiceError(http.StatusPreconditionFailed, "invoice does not exist")
+	}
+	if i.ID != 0 && !matchETag(header, invoiceETag(i)) {
+		return newServiceError(http.StatusPreconditionFailed, "invoice %d is at version %s, not %s",
+			i.ID, invoiceETag(i), header)
+	}
+	return nil
+}
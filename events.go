@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// events are buffered for each stream, a client that falls further
+	// behind is disconnected and reconnects
+	eventStreamBuffer    = 64
+	eventStreamHeartbeat = 15 * time.Second
+	eventStreamRetry     = 3 * time.Second
+
+	// eventReplaySize is the number of recent events kept for clients
+	// reconnecting with the Last-Event-ID header
+	eventReplaySize = 256
+)
+
+// streamEvent is an invoice event numbered in the order it was published
+type streamEvent struct {
+	id      uint64
+	payload webhookPayload
+}
+
+// eventFilter selects the events of a stream by the status and customer of
+// their invoice. Empty fields match every invoice.
+type eventFilter struct {
+	statuses   []string
+	customerID uint
+}
+
+func (f eventFilter) match(i Invoice) bool {
+	if f.customerID != 0 && i.CustomerID != f.customerID {
+		return false
+	}
+	if len(f.statuses) == 0 {
+		return true
+	}
+	for _, s := range f.statuses {
+		if s == i.Status {
+			return true
+		}
+	}
+	return false
+}
+
+type eventSubscriber struct {
+	filter eventFilter
+	events chan streamEvent
+}
+
+// eventHub fans the invoice events published by handlers out to the
+// streams of connected clients. Events are not stored in the database, the
+// most recent ones are kept in memory for clients reconnecting after a
+// short break.
+type eventHub struct {
+	sync.Mutex
+	lastID      uint64
+	recent      []streamEvent
+	subscribers map[*eventSubscriber]struct{}
+	closed      bool
+
+	// streams end after streamDuration, before the write timeout of the
+	// server cuts them, and clients reconnect
+	streamDuration time.Duration
+}
+
+// newEventHub returns a hub for a server writing responses within
+// writeTimeout, or without time limit if it is zero
+func newEventHub(writeTimeout time.Duration) *eventHub {
+	return &eventHub{
+		subscribers:    make(map[*eventSubscriber]struct{}),
+		streamDuration: writeTimeout - writeTimeout/10,
+	}
+}
+
+// subscribe registers a stream receiving the events matching filter, until
+// it is unsubscribed or its channel is closed by the hub. The recent events
+// published after lastID are sent first.
+func (h *eventHub) subscribe(filter eventFilter, lastID uint64) *eventSubscriber {
+	s := &eventSubscriber{filter: filter, events: make(chan streamEvent, eventStreamBuffer+eventReplaySize)}
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		close(s.events)
+		return s
+	}
+	// IDs above the last one were given before a restart of the invoicer
+	if lastID > 0 && lastID <= h.lastID {
+		for _, e := range h.recent {
+			if e.id > lastID && filter.match(e.payload.Invoice) {
+				s.events <- e
+			}
+		}
+	}
+	h.subscribers[s] = struct{}{}
+	return s
+}
+
+func (h *eventHub) unsubscribe(s *eventSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+// publish sends an event to the streams it matches without blocking.
+// Streams whose buffer is full are closed.
+func (h *eventHub) publish(p webhookPayload) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.lastID++
+	e := streamEvent{id: h.lastID, payload: p}
+	h.recent = append(h.recent, e)
+	if len(h.recent) > eventReplaySize {
+		h.recent = h.recent[len(h.recent)-eventReplaySize:]
+	}
+	for s := range h.subscribers {
+		if !s.filter.match(p.Invoice) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			applog.warnf("closing event stream lagging behind by %d events", cap(s.events))
+			delete(h.subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+// close ends every stream, so they don't hold up the shutdown of the server
+func (h *eventHub) close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	for s := range h.subscribers {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+// parseEventFilter reads the status and customer_id parameters of a stream
+func parseEventFilter(r *http.Request) (eventFilter, error) {
+	var f eventFilter
+	if r.FormValue("status") != "" {
+		for _, s := range strings.Split(r.FormValue("status"), ",") {
+			s = strings.TrimSpace(s)
+			if !validInvoiceStatus(s) {
+				return f, fmt.Errorf("invalid status %q, must be one of %s", s, strings.Join(invoiceStatuses, ", "))
+			}
+			f.statuses = append(f.statuses, s)
+		}
+	}
+	if r.FormValue("customer_id") != "" {
+		id, err := strconv.ParseUint(r.FormValue("customer_id"), 10, 32)
+		if err != nil || id == 0 {
+			return f, fmt.Errorf("invalid customer_id %q", r.FormValue("customer_id"))
+		}
+		f.customerID = uint(id)
+	}
+	return f, nil
+}
+
+// getEventStream streams invoice events as server-sent events, optionally
+// filtered by the status and customer of their invoice. The stream stays
+// open until the client disconnects or the hub ends it, with a comment
+// sent periodically to keep proxies from closing it.
+func (iv *invoicer) getEventStream(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	var lastID uint64
+	if r.Header.Get("Last-Event-ID") != "" {
+		lastID, err = strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "invalid Last-Event-ID header %q", r.Header.Get("Last-Event-ID"))
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, http.StatusInternalServerError, "streaming is not supported by the connection")
+		return
+	}
+	s := iv.events.subscribe(filter, lastID)
+	defer iv.events.unsubscribe(s)
+	var end <-chan time.Time
+	if iv.events.streamDuration > 0 {
+		timer := time.NewTimer(iv.events.streamDuration)
+		defer timer.Stop()
+		end = timer.C
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetry/time.Millisecond)
+	flusher.Flush()
+	al := appLog{Message: "opened event stream", Action: "get-event-stream"}
+	al.log(r)
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-end:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e, ok := <-s.events:
+			if !ok {
+				return
+			}
+			e.payload.Invoice.Charges = nil
+			e.payload.Invoice.ChargesSummary = nil
+			data, err := json.Marshal(e.payload)
+			if err != nil {
+				applog.errorf("failed to marshal %s of invoice %d: %s", e.payload.Event, e.payload.Invoice.ID, err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.payload.Event, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	expenseSubmitted = "submitted"
+	expenseApproved  = "approved"
+	expenseRejected  = "rejected"
+)
+
+// Expense is a cost incurred on behalf of a client, the customer it is
+// rebilled to. Once approved, it is rebilled with its markup the next time
+// its project is invoiced, and its receipt, an attachment without invoice,
+// is copied to the attachments of the invoice.
+type Expense struct {
+	gorm.Model
+	ProjectID     uint      `gorm:"index" json:"project_id"`
+	CustomerID    uint      `gorm:"index" json:"customer_id"`
+	User          string    `gorm:"column:user_name;index" json:"user"`
+	IncurredAt    time.Time `json:"incurred_at"`
+	Amount        float64   `json:"amount"`
+	MarkupPercent float64   `json:"markup_percent"`
+	Description   string    `json:"description"`
+	Status        string    `json:"status"`
+	InvoiceID     uint      `gorm:"index" json:"invoice_id"`
+	ReceiptID     uint      `json:"receipt_id"`
+}
+
+// rebilledAmount returns the amount of the expense with its markup applied,
+// in minor units of currency. Expenses are recorded in major units.
+func (e Expense) rebilledAmount(currency string) int64 {
+	return toMinorUnits(e.Amount*(100+e.MarkupPercent)/100, currency)
+}
+
+func validateExpense(e Expense) error {
+	switch {
+	case strings.TrimSpace(e.User) == "":
+		return fmt.Errorf("user must not be empty")
+	case e.IncurredAt.IsZero():
+		return fmt.Errorf("incurred_at must be set")
+	case e.Amount <= 0:
+		return fmt.Errorf("amount must be positive")
+	case e.MarkupPercent < 0:
+		return fmt.Errorf("markup must not be negative")
+	}
+	return nil
+}
+
+// checkExpenseCustomer checks that the customer of an expense exists
+func (iv *invoicer) checkExpenseCustomer(r *http.Request, e Expense) error {
+	if e.CustomerID == 0 {
+		return nil
+	}
+	var c Customer
+	res := iv.dbFor(r).First(&c, e.CustomerID)
+	if res.RecordNotFound() {
+		return fmt.Errorf("customer %d does not exist", e.CustomerID)
+	}
+	return res.Error
+}
+
+func escapeExpenses(expenses []Expense) {
+	for i := range expenses {
+		expenses[i].User = html.EscapeString(expenses[i].User)
+		expenses[i].Description = html.EscapeString(expenses[i].Description)
+	}
+}
+
+func (iv *invoicer) getProjectExpenses(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var p Project
+	iv.dbFor(r).First(&p, vars["id"])
+	if p.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No project id %s", vars["id"])
+		return
+	}
+	q := iv.dbFor(r).Where("project_id = ?", p.ID)
+	if r.FormValue("status") != "" {
+		q = q.Where("status = ?", r.FormValue("status"))
+	}
+	var expenses []Expense
+	err := q.Order("incurred_at asc").Find(&expenses).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve expenses of project %d: %s", p.ID, err)
+		return
+	}
+	escapeExpenses(expenses)
+	writeJSON(w, r, http.StatusOK, expenses)
+}
+
+func (iv *invoicer) getExpense(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var e Expense
+	iv.dbFor(r).First(&e, vars["id"])
+	if e.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No expense id %s", vars["id"])
+		return
+	}
+	expenses := []Expense{e}
+	escapeExpenses(expenses)
+	writeJSON(w, r, http.StatusOK, expenses[0])
+}
+
+// postExpense records an expense on a project. New expenses are always
+// submitted and must be approved before they can be rebilled.
+func (iv *invoicer) postExpense(w http.ResponseWriter, r *http.Request) {
+	var e Expense
+	if !readJSONBody(w, r, &e) {
+		return
+	}
+	e.ID = 0
+	e.InvoiceID = 0
+	e.ReceiptID = 0
+	e.Status = expenseSubmitted
+	var p Project
+	iv.dbFor(r).First(&p, e.ProjectID)
+	if p.ID == 0 {
+		httpError(w, r, http.StatusBadRequest, "invalid expense: project %d does not exist", e.ProjectID)
+		return
+	}
+	err := validateExpense(e)
+	if err == nil {
+		err = iv.checkExpenseCustomer(r, e)
+	}
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid expense: %s", err)
+		return
+	}
+	iv.dbFor(r).Create(&e)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("created expense %d", e.ID)))
+	al := appLog{Message: fmt.Sprintf("created expense %d on project %d", e.ID, p.ID), Action: "post-expense"}
+	al.log(r)
+}
+
+// putExpense updates a submitted expense. Approved or rejected expenses
+// are final and cannot be modified.
+func (iv *invoicer) putExpense(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var e Expense
+	iv.dbFor(r).First(&e, vars["id"])
+	if e.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No expense id %s", vars["id"])
+		return
+	}
+	if e.Status != expenseSubmitted {
+		httpError(w, r, http.StatusConflict, "expense %d is %s and cannot be modified", e.ID, e.Status)
+		return
+	}
+	id, projectID, receiptID := e.ID, e.ProjectID, e.ReceiptID
+	if !readJSONBody(w, r, &e) {
+		return
+	}
+	e.ID, e.ProjectID, e.InvoiceID, e.ReceiptID, e.Status = id, projectID, 0, receiptID, expenseSubmitted
+	err := validateExpense(e)
+	if err == nil {
+		err = iv.checkExpenseCustomer(r, e)
+	}
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid expense: %s", err)
+		return
+	}
+	iv.dbFor(r).Save(&e)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("updated expense %d", e.ID)))
+	al := appLog{Message: fmt.Sprintf("updated expense %d", e.ID), Action: "put-expense"}
+	al.log(r)
+}
+
+func (iv *invoicer) deleteExpense(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var e Expense
+	iv.dbFor(r).First(&e, vars["id"])
+	if e.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No expense id %s", vars["id"])
+		return
+	}
+	if e.InvoiceID != 0 {
+		httpError(w, r, http.StatusConflict, "expense %d was billed on invoice %d and cannot be deleted", e.ID, e.InvoiceID)
+		return
+	}
+	iv.dbFor(r).Delete(&e)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted expense %d", e.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted expense %d", e.ID), Action: "delete-expense"}
+	al.log(r)
+}
+
+func (iv *invoicer) postExpenseApprove(w http.ResponseWriter, r *http.Request) {
+	iv.reviewExpense(w, r, expenseApproved)
+}
+
+func (iv *invoicer) postExpenseReject(w http.ResponseWriter, r *http.Request) {
+	iv.reviewExpense(w, r, expenseRejected)
+}
+
+// reviewExpense moves a submitted expense to the approved or rejected status
+func (iv *invoicer) reviewExpense(w http.ResponseWriter, r *http.Request, status string) {
+	vars := mux.Vars(r)
+	var e Expense
+	iv.dbFor(r).First(&e, vars["id"])
+	if e.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No expense id %s", vars["id"])
+		return
+	}
+	if e.Status != expenseSubmitted {
+		httpError(w, r, http.StatusConflict, "expense %d is already %s", e.ID, e.Status)
+		return
+	}
+	iv.dbFor(r).Model(&e).Update("status", status)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("%s expense %d", status, e.ID)))
+	al := appLog{Message: fmt.Sprintf("%s expense %d", status, e.ID), Action: "review-expense"}
+	al.log(r)
+}
+
+// putExpenseReceipt uploads the receipt of an expense as a
+// multipart/form-data file, replacing its previous receipt. The receipt of
+// a billed expense was copied to its invoice and can't be replaced.
+func (iv *invoicer) putExpenseReceipt(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var e Expense
+	iv.dbFor(r).First(&e, vars["id"])
+	if e.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No expense id %s", vars["id"])
+		return
+	}
+	if e.InvoiceID != 0 {
+		httpError(w, r, http.StatusConflict, "expense %d was billed on invoice %d and its receipt cannot be replaced", e.ID, e.InvoiceID)
+		return
+	}
+	uploads, ok := iv.readUploads(w, r, 1)
+	if !ok {
+		return
+	}
+	previous := e.ReceiptID
+	a := uploads[0].a
+	a.ExpenseID = e.ID
+	err := iv.storeAttachment(iv.dbFor(r), &a, uploads[0].data, fmt.Sprintf("expenses/%d/", e.ID))
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	res := iv.dbFor(r).Model(&e).Where("invoice_id = 0").Update("receipt_id", a.ID)
+	if res.Error == nil && res.RowsAffected == 0 {
+		res.Error = fmt.Errorf("expense %d was billed in the meantime", e.ID)
+	}
+	if res.Error != nil {
+		iv.dbFor(r).Delete(&a)
+		iv.attachments.blobs.Delete(a.StorageKey)
+		httpError(w, r, http.StatusInternalServerError, "failed to store receipt of expense %d: %s", e.ID, res.Error)
+		return
+	}
+	if previous != 0 {
+		var old Attachment
+		if iv.dbFor(r).First(&old, previous).Error == nil {
+			iv.dbFor(r).Delete(&old)
+			if err = iv.attachments.blobs.Delete(old.StorageKey); err != nil {
+				requestLogger(r).errorf("failed to delete content of receipt %d: %s", old.ID, err)
+			}
+		}
+	}
+	al := appLog{Message: fmt.Sprintf("attached receipt %s to expense %d as attachment %d", a.Filename, e.ID, a.ID), Action: "put-expense-receipt"}
+	al.log(r)
+	escapeAttachment(&a)
+	writeJSON(w, r, http.StatusCreated, a)
+}
+
+// getExpenseReceipt downloads the receipt of an expense
+func (iv *invoicer) getExpenseReceipt(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var e Expense
+	iv.dbFor(r).First(&e, vars["id"])
+	if e.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No expense id %s", vars["id"])
+		return
+	}
+	var a Attachment
+	res := iv.dbFor(r).Where("expense_id = ?", e.ID).First(&a, e.ReceiptID)
+	if e.ReceiptID == 0 || res.RecordNotFound() {
+		httpError(w, r, http.StatusNotFound, "expense %d has no receipt", e.ID)
+		return
+	}
+	if res.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve receipt of expense %d: %s", e.ID, res.Error)
+		return
+	}
+	iv.serveAttachment(w, r, a)
+}
+
+// copyReceipts copies the receipts of rebilled expenses to the attachments
+// of their invoice, within the transaction creating it. The content of the
+// copies is kept apart from the receipts, so deleting either leaves the
+// other. It returns the keys of the content copied, to be deleted if the
+// transaction fails.
+func (iv *invoicer) copyReceipts(tx *gorm.DB, expenses []Expense, invoiceID uint) ([]string, error) {
+	var keys []string
+	for _, e := range expenses {
+		if e.ReceiptID == 0 {
+			continue
+		}
+		var receipt Attachment
+		err := tx.First(&receipt, e.ReceiptID).Error
+		if err != nil {
+			return keys, fmt.Errorf("failed to retrieve receipt of expense %d: %s", e.ID, err)
+		}
+		content, err := iv.attachments.blobs.Get(receipt.StorageKey)
+		if err != nil {
+			return keys, fmt.Errorf("failed to retrieve content of receipt of expense %d: %s", e.ID, err)
+		}
+		data, err := ioutil.ReadAll(content)
+		content.Close()
+		if err != nil {
+			return keys, fmt.Errorf("failed to read content of receipt of expense %d: %s", e.ID, err)
+		}
+		a := Attachment{
+			InvoiceID:   invoiceID,
+			Filename:    receipt.Filename,
+			ContentType: receipt.ContentType,
+			Size:        receipt.Size,
+			SHA256:      receipt.SHA256,
+			UploadedBy:  receipt.UploadedBy,
+		}
+		err = iv.storeAttachment(tx, &a, data, fmt.Sprintf("invoices/%d/", invoiceID))
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, a.StorageKey)
+	}
+	return keys, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const exportBatchSize = 500
+
+var (
+	exportInvoiceColumns = []string{"invoice_id", "invoice_number", "created_at", "customer_id", "status", "is_paid", "amount", "currency", "due_date", "payment_date", "credited"}
+	exportChargeColumns  = []string{"charge_id", "charge_type", "charge_amount", "charge_description", "charge_category_id", "charge_tax_rate_id", "charge_tax"}
+)
+
+// exportRowWriter is implemented by the csv and xlsx encoders of exports
+type exportRowWriter interface {
+	WriteRow(cells []interface{}) error
+	Close() error
+}
+
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+// WriteRow writes a line of CSV. Text that a spreadsheet would interpret
+// as a formula is prefixed with a quote.
+func (c csvRowWriter) WriteRow(cells []interface{}) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		switch v := cell.(type) {
+		case string:
+			if v != "" && strings.ContainsRune("=+-@", rune(v[0])) {
+				v = "'" + v
+			}
+			record[i] = v
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c csvRowWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func exportDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// getInvoicesExport streams the invoices matching the filters of the list
+// endpoint and created between `from` and `to` as CSV or as an Excel
+// workbook. With `charges=true`, each charge gets its own row.
+func (iv *invoicer) getInvoicesExport(w http.ResponseWriter, r *http.Request) {
+	filters, err := parseInvoiceFilters(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	from, err := parseDateParam("from", r.FormValue("from"))
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	to, err := parseDateParam("to", r.FormValue("to"))
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	withCharges := false
+	if r.FormValue("charges") != "" {
+		withCharges, err = strconv.ParseBool(r.FormValue("charges"))
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "invalid boolean %q in parameter charges", r.FormValue("charges"))
+			return
+		}
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	filename := fmt.Sprintf("invoices-%s.%s", time.Now().UTC().Format("20060102"), format)
+	var out exportRowWriter
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		out = csvRowWriter{w: csv.NewWriter(w)}
+	case "xlsx":
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		out, err = newXLSXWriter(w, "Invoices")
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "failed to create workbook: %s", err)
+			return
+		}
+	default:
+		httpError(w, r, http.StatusBadRequest, "invalid format %q, use csv or xlsx", format)
+		return
+	}
+
+	header := []interface{}{}
+	for _, col := range exportInvoiceColumns {
+		header = append(header, col)
+	}
+	if withCharges {
+		for _, col := range exportChargeColumns {
+			header = append(header, col)
+		}
+	}
+	out.WriteRow(header)
+
+	// invoices are read in batches ordered by id so the export doesn't
+	// load the whole table at once
+	var lastID uint
+	var rows int
+	for {
+		q := filters.apply(iv.dbFor(r)).Where("id > ?", lastID)
+		if !from.IsZero() {
+			q = q.Where("created_at >= ?", from)
+		}
+		if !to.IsZero() {
+			q = q.Where("created_at < ?", to)
+		}
+		var invoices []Invoice
+		err = q.Order("id asc").Limit(exportBatchSize).Find(&invoices).Error
+		if err != nil {
+			// headers are already sent, the truncated export is all we can do
+			al := appLog{ErrorCode: http.StatusInternalServerError, Message: fmt.Sprintf("failed to export invoices: %s", err)}
+			al.log(r)
+			break
+		}
+		if len(invoices) == 0 {
+			break
+		}
+		ids := make([]uint, len(invoices))
+		for n, i := range invoices {
+			ids[n] = i.ID
+		}
+		// what was credited on each invoice, by the credit notes not voided
+		var credits []struct {
+			InvoiceID uint
+			Credited  int64
+		}
+		iv.dbFor(r).Model(&CreditNote{}).Select("invoice_id, SUM(amount) AS credited").
+			Where("invoice_id IN (?) AND status = ?", ids, creditNoteIssued).Group("invoice_id").Scan(&credits)
+		credited := make(map[uint]int64)
+		for _, c := range credits {
+			credited[c.InvoiceID] = c.Credited
+		}
+		charges := make(map[uint][]Charge)
+		if withCharges {
+			var batch []Charge
+			iv.dbFor(r).Where("invoice_id IN (?)", ids).Order("id asc").Find(&batch)
+			for _, c := range batch {
+				charges[uint(c.InvoiceID)] = append(charges[uint(c.InvoiceID)], c)
+			}
+		}
+		for _, i := range invoices {
+			row := []interface{}{i.ID, i.InvoiceNumber, exportDate(i.CreatedAt), i.CustomerID, i.Status,
+				strconv.FormatBool(i.IsPaid), toMajorUnits(i.Amount, i.Currency), i.Currency, exportDate(i.DueDate), exportDate(i.PaymentDate),
+				toMajorUnits(credited[i.ID], i.Currency)}
+			if !withCharges {
+				out.WriteRow(row)
+				rows++
+				continue
+			}
+			if len(charges[i.ID]) == 0 {
+				out.WriteRow(append(row, "", "", "", "", "", "", ""))
+				rows++
+			}
+			for _, c := range charges[i.ID] {
+				out.WriteRow(append(row, c.ID, c.Type, toMajorUnits(c.Amount, c.Currency), c.Description, c.CategoryID, c.TaxRateID, toMajorUnits(c.Tax, c.Currency)))
+				rows++
+			}
+		}
+		lastID = invoices[len(invoices)-1].ID
+	}
+	err = out.Close()
+	if err != nil {
+		al := appLog{ErrorCode: http.StatusInternalServerError, Message: fmt.Sprintf("failed to write export: %s", err)}
+		al.log(r)
+		return
+	}
+	al := appLog{Message: fmt.Sprintf("exported %d rows of invoices as %s", rows, format), Action: "get-invoices-export"}
+	al.log(r)
+}
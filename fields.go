@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// invoiceFieldKeys maps the names accepted by the fields parameter to the
+// keys of invoices in responses. The fields of gorm.Model have no json
+// tags and keep their Go names.
+var invoiceFieldKeys = map[string]string{
+	"id":              "ID",
+	"created_at":      "CreatedAt",
+	"updated_at":      "UpdatedAt",
+	"deleted_at":      "DeletedAt",
+	"invoice_number":  "invoice_number",
+	"customer_id":     "customer_id",
+	"status":          "status",
+	"is_paid":         "is_paid",
+	"amount":          "amount",
+	"amount_override": "amount_override",
+	"currency":        "currency",
+	"payment_date":    "payment_date",
+	"due_date":        "due_date",
+	"version":         "version",
+	"charges":         "charges",
+	"charges_summary": "charges_summary",
+	"taxes":           "taxes",
+}
+
+// invoiceView selects what invoice responses contain: some of the fields
+// of the invoices, and related records embedded in them. The zero view is
+// the full invoice.
+type invoiceView struct {
+	// fields are the response keys kept, every key if it is nil
+	fields  map[string]bool
+	include map[string]bool
+}
+
+// parseInvoiceView reads the comma separated `fields` of invoices and the
+// related records to `include` among those allowed
+func parseInvoiceView(r *http.Request, allowed ...string) (invoiceView, error) {
+	var v invoiceView
+	var err error
+	v.include, err = parseInclude(r, allowed...)
+	if err != nil {
+		return v, err
+	}
+	if r.FormValue("fields") == "" {
+		return v, nil
+	}
+	v.fields = make(map[string]bool)
+	for _, name := range strings.Split(r.FormValue("fields"), ",") {
+		name = strings.TrimSpace(name)
+		key, ok := invoiceFieldKeys[name]
+		if !ok {
+			names := make([]string, 0, len(invoiceFieldKeys))
+			for n := range invoiceFieldKeys {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return v, fmt.Errorf("invalid fields parameter %q, must be one of %s", name, strings.Join(names, ", "))
+		}
+		v.fields[key] = true
+	}
+	return v, nil
+}
+
+// full returns true if the view is the full invoice, without related records
+func (v invoiceView) full() bool {
+	return v.fields == nil && len(v.include) == 0
+}
+
+// wants returns true if the view keeps a field, given by its response key
+func (v invoiceView) wants(key string) bool {
+	return v.fields == nil || v.fields[key]
+}
+
+// wantsCharges returns true if the charges of invoices must be retrieved.
+// Single invoices carry their charges unless fields leaves them out, lists
+// only if they are included.
+func (v invoiceView) wantsCharges(single bool) bool {
+	if v.include["charges"] || v.fields["charges"] || v.fields["charges_summary"] {
+		return true
+	}
+	return single && v.fields == nil
+}
+
+// render marshals an invoice with the fields of the view, along with the
+// related records included
+func (v invoiceView) render(i Invoice, related map[string]interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(i)
+	if err != nil || v.full() {
+		return data, err
+	}
+	var body map[string]json.RawMessage
+	err = json.Unmarshal(data, &body)
+	if err != nil {
+		return nil, err
+	}
+	for key := range body {
+		if !v.wants(key) && !(key == "charges" && v.include["charges"]) {
+			delete(body, key)
+		}
+	}
+	for key, val := range related {
+		body[key], err = json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(body)
+}
+
+// contentETag returns an entity tag derived from a response body, for
+// views of invoices that don't change with their version only
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// invoiceRelations retrieves the payments and customers included in a view
+// of invoices, by invoice id
+func (iv *invoicer) invoiceRelations(r *http.Request, invoices []Invoice, v invoiceView) (map[uint]map[string]interface{}, error) {
+	related := make(map[uint]map[string]interface{})
+	var ids, customerIDs []uint
+	for _, i := range invoices {
+		related[i.ID] = make(map[string]interface{})
+		ids = append(ids, i.ID)
+		if i.CustomerID != 0 {
+			customerIDs = append(customerIDs, i.CustomerID)
+		}
+	}
+	if v.include["payments"] && len(ids) > 0 {
+		var payments []Payment
+		err := iv.dbFor(r).Where("invoice_id IN (?)", ids).Order("paid_at asc").Find(&payments).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve payments: %s", err)
+		}
+		escapePayments(payments)
+		for _, i := range invoices {
+			related[i.ID]["payments"] = []Payment{}
+		}
+		for _, p := range payments {
+			related[p.InvoiceID]["payments"] = append(related[p.InvoiceID]["payments"].([]Payment), p)
+		}
+	}
+	if v.include["customer"] {
+		customers := make(map[uint]Customer)
+		if len(customerIDs) > 0 {
+			var found []Customer
+			err := iv.dbFor(r).Where("id IN (?)", customerIDs).Find(&found).Error
+			if err != nil {
+				return nil, fmt.Errorf("failed to retrieve customers: %s", err)
+			}
+			for _, c := range found {
+				escapeCustomer(&c)
+				customers[c.ID] = c
+			}
+		}
+		for _, i := range invoices {
+			if c, ok := customers[i.CustomerID]; ok {
+				related[i.ID]["customer"] = c
+			} else {
+				related[i.ID]["customer"] = nil
+			}
+		}
+	}
+	return related, nil
+}
@@ -0,0 +1,1737 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The GraphQL API is served at /graphql over the same service and store as
+// the REST and gRPC APIs. Like the gRPC framing, the part of GraphQL it
+// needs is implemented here: queries and mutations with variables,
+// aliases, fragments and the @skip and @include directives, over object
+// types without interfaces or unions. The schema is served in SDL at
+// /graphql/schema in place of introspection. See
+// https://spec.graphql.org/October2021/
+
+const (
+	// maxGraphQLNesting bounds the nesting of selections and values the
+	// parser accepts, before the depth limit is checked, so a document
+	// cannot exhaust the stack
+	maxGraphQLNesting = 64
+	// graphqlListCost is the number of items assumed to be returned by
+	// lists without a limit argument when estimating complexity
+	graphqlListCost = 10
+)
+
+// gqlError is an error of a GraphQL response, with the error code of the
+// REST API in its extensions
+type gqlError struct {
+	Message    string              `json:"message"`
+	Locations  []gqlLocation       `json:"locations,omitempty"`
+	Path       []interface{}       `json:"path,omitempty"`
+	Extensions *gqlErrorExtensions `json:"extensions,omitempty"`
+
+	status int
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type gqlErrorExtensions struct {
+	Code   errorCode        `json:"code"`
+	Fields validationErrors `json:"fields,omitempty"`
+}
+
+func (e *gqlError) Error() string {
+	return e.Message
+}
+
+func newGQLError(status int, loc *gqlLocation, format string, args ...interface{}) *gqlError {
+	e := &gqlError{
+		Message:    fmt.Sprintf(format, args...),
+		Extensions: &gqlErrorExtensions{Code: errorCodeForStatus(status)},
+		status:     status,
+	}
+	if loc != nil {
+		e.Locations = []gqlLocation{*loc}
+	}
+	return e
+}
+
+// lexical tokens
+const (
+	gqlEOF = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  int
+	value string
+	loc   gqlLocation
+}
+
+// gqlTokenize splits a document into tokens, dropping whitespace, commas
+// and comments
+func gqlTokenize(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	line, lineStart := 1, 0
+	for i := 0; i < len(src); {
+		c := src[i]
+		loc := gqlLocation{Line: line, Column: utf8.RuneCountInString(src[lineStart:i]) + 1}
+		switch {
+		case c == '\n':
+			i++
+			line, lineStart = line+1, i
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			i++
+		case strings.HasPrefix(src[i:], "\ufeff"):
+			i += len("\ufeff")
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{gqlPunct, "...", loc})
+			i += 3
+		case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+			tokens = append(tokens, gqlToken{gqlPunct, string(c), loc})
+			i++
+		case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+			start := i
+			for i < len(src) && (src[i] == '_' || (src[i]|0x20 >= 'a' && src[i]|0x20 <= 'z') || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, gqlToken{gqlName, src[start:i], loc})
+		case c == '-' || (c >= '0' && c <= '9'):
+			start, kind := i, gqlInt
+			if c == '-' {
+				i++
+			}
+			digits := func() int {
+				n := 0
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i, n = i+1, n+1
+				}
+				return n
+			}
+			if n := digits(); n == 0 || (n > 1 && src[i-n] == '0') {
+				return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: invalid number %q", src[start:i])
+			}
+			if i < len(src) && src[i] == '.' {
+				i, kind = i+1, gqlFloat
+				if digits() == 0 {
+					return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: invalid number %q", src[start:i])
+				}
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i, kind = i+1, gqlFloat
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				if digits() == 0 {
+					return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: invalid number %q", src[start:i])
+				}
+			}
+			tokens = append(tokens, gqlToken{kind, src[start:i], loc})
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(strings.Replace(src[i+3:], `\"""`, "xxxx", -1), `"""`)
+			if end < 0 {
+				return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: unterminated string")
+			}
+			raw := src[i+3 : i+3+end]
+			line += strings.Count(raw, "\n")
+			if n := strings.LastIndexByte(raw, '\n'); n >= 0 {
+				lineStart = i + 3 + n + 1
+			}
+			tokens = append(tokens, gqlToken{gqlString, strings.Replace(raw, `\"""`, `"""`, -1), loc})
+			i += 3 + end + 3
+		case c == '"':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(src) || src[i] == '\n' || src[i] == '\r' {
+					return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: unterminated string")
+				}
+				if src[i] == '"' {
+					i++
+					break
+				}
+				if src[i] != '\\' {
+					b.WriteByte(src[i])
+					i++
+					continue
+				}
+				if i+1 >= len(src) {
+					return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: unterminated string")
+				}
+				switch esc := src[i+1]; esc {
+				case '"', '\\', '/':
+					b.WriteByte(esc)
+				case 'b':
+					b.WriteByte('\b')
+				case 'f':
+					b.WriteByte('\f')
+				case 'n':
+					b.WriteByte('\n')
+				case 'r':
+					b.WriteByte('\r')
+				case 't':
+					b.WriteByte('\t')
+				case 'u':
+					if i+6 > len(src) {
+						return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: invalid unicode escape")
+					}
+					code, err := strconv.ParseUint(src[i+2:i+6], 16, 32)
+					if err != nil {
+						return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: invalid unicode escape %q", src[i:i+6])
+					}
+					b.WriteRune(rune(code))
+					i += 4
+				default:
+					return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: invalid escape \\%c", esc)
+				}
+				i += 2
+			}
+			tokens = append(tokens, gqlToken{gqlString, b.String(), loc})
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, newGQLError(http.StatusBadRequest, &loc, "syntax error: unexpected character %q", r)
+		}
+	}
+	loc := gqlLocation{Line: line, Column: utf8.RuneCountInString(src[lineStart:]) + 1}
+	return append(tokens, gqlToken{gqlEOF, "", loc}), nil
+}
+
+// gqlType is a reference to a type, such as [Charge!]!
+type gqlType struct {
+	// name is empty for lists of the type of
+	name    string
+	of      *gqlType
+	nonNull bool
+}
+
+func (t *gqlType) String() string {
+	s := t.name
+	if t.of != nil {
+		s = "[" + t.of.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+// named returns the type of the items of lists
+func (t *gqlType) named() string {
+	for t.of != nil {
+		t = t.of
+	}
+	return t.name
+}
+
+// accepts returns true if the values of variables of type v can be used
+// where values of type t are expected
+func (t *gqlType) accepts(v *gqlType) bool {
+	if t.nonNull && !v.nonNull {
+		return false
+	}
+	if (t.of == nil) != (v.of == nil) {
+		return false
+	}
+	if t.of != nil {
+		return t.of.accepts(v.of)
+	}
+	return t.name == v.name
+}
+
+// values of documents
+const (
+	gqlVariableValue = iota
+	gqlIntValue
+	gqlFloatValue
+	gqlStringValue
+	gqlBooleanValue
+	gqlNullValue
+	gqlEnumValue
+	gqlListValue
+	gqlObjectValue
+)
+
+type gqlValue struct {
+	kind   int
+	raw    string
+	list   []*gqlValue
+	fields []gqlArgument
+	loc    gqlLocation
+}
+
+type gqlArgument struct {
+	name  string
+	value *gqlValue
+}
+
+type gqlDirective struct {
+	name string
+	args []gqlArgument
+	loc  gqlLocation
+}
+
+// gqlSelection is a field, a spread of the named fragment or an inline
+// fragment, which have neither a name nor a fragment
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       []gqlArgument
+	directives []gqlDirective
+	fragment   string
+	on         string
+	selections []*gqlSelection
+	loc        gqlLocation
+}
+
+func (s *gqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlVariableDef struct {
+	name string
+	typ  *gqlType
+	def  *gqlValue
+	loc  gqlLocation
+}
+
+type gqlOperation struct {
+	// kind is query or mutation
+	kind       string
+	name       string
+	variables  []gqlVariableDef
+	selections []*gqlSelection
+	loc        gqlLocation
+}
+
+type gqlFragment struct {
+	name       string
+	on         string
+	selections []*gqlSelection
+	loc        gqlLocation
+}
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlParser struct {
+	tokens  []gqlToken
+	pos     int
+	nesting int
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != gqlEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *gqlParser) unexpected(expected string) error {
+	t := p.peek()
+	found := fmt.Sprintf("%q", t.value)
+	if t.kind == gqlEOF {
+		found = "end of document"
+	}
+	return newGQLError(http.StatusBadRequest, &t.loc, "syntax error: expected %s, found %s", expected, found)
+}
+
+// punct consumes the punctuator s if it comes next
+func (p *gqlParser) punct(s string) bool {
+	if t := p.peek(); t.kind == gqlPunct && t.value == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(s string) error {
+	if !p.punct(s) {
+		return p.unexpected(fmt.Sprintf("%q", s))
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.peek().kind != gqlName {
+		return "", p.unexpected("a name")
+	}
+	return p.next().value, nil
+}
+
+// nest accounts for entering a nested selection or value
+func (p *gqlParser) nest() error {
+	p.nesting++
+	if p.nesting > maxGraphQLNesting {
+		t := p.peek()
+		return newGQLError(http.StatusBadRequest, &t.loc, "document nests more than %d levels", maxGraphQLNesting)
+	}
+	return nil
+}
+
+// parseGraphQL parses an executable document
+func parseGraphQL(src string) (*gqlDocument, error) {
+	tokens, err := gqlTokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.peek().kind != gqlEOF {
+		t := p.peek()
+		switch {
+		case t.kind == gqlPunct && t.value == "{":
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: selections, loc: t.loc})
+		case t.kind == gqlName && (t.value == "query" || t.value == "mutation"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case t.kind == gqlName && t.value == "fragment":
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if doc.fragments[f.name] != nil {
+				return nil, newGQLError(http.StatusBadRequest, &f.loc, "fragment %s is defined more than once", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected("an operation or a fragment")
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, newGQLError(http.StatusBadRequest, nil, "document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	t := p.next()
+	op := &gqlOperation{kind: t.value, loc: t.loc}
+	if p.peek().kind == gqlName {
+		op.name = p.next().value
+	}
+	if p.punct("(") {
+		for !p.punct(")") {
+			v := gqlVariableDef{loc: p.peek().loc}
+			err := p.expect("$")
+			if err != nil {
+				return nil, err
+			}
+			v.name, err = p.name()
+			if err != nil {
+				return nil, err
+			}
+			err = p.expect(":")
+			if err != nil {
+				return nil, err
+			}
+			v.typ, err = p.typeRef()
+			if err != nil {
+				return nil, err
+			}
+			if p.punct("=") {
+				v.def, err = p.value(true)
+				if err != nil {
+					return nil, err
+				}
+			}
+			op.variables = append(op.variables, v)
+		}
+	}
+	// directives of operations have no effect
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	f := &gqlFragment{loc: p.next().loc}
+	var err error
+	f.name, err = p.name()
+	if err != nil {
+		return nil, err
+	}
+	if f.name == "on" {
+		return nil, newGQLError(http.StatusBadRequest, &f.loc, "syntax error: fragments cannot be named on")
+	}
+	if t := p.next(); t.kind != gqlName || t.value != "on" {
+		p.pos--
+		return nil, p.unexpected(`"on"`)
+	}
+	f.on, err = p.name()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = p.directives(); err != nil {
+		return nil, err
+	}
+	f.selections, err = p.selectionSet()
+	return f, err
+}
+
+func (p *gqlParser) typeRef() (*gqlType, error) {
+	t := &gqlType{}
+	if p.punct("[") {
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		var err error
+		t.of, err = p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect("]"); err != nil {
+			return nil, err
+		}
+		p.nesting--
+	} else {
+		var err error
+		t.name, err = p.name()
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.nonNull = p.punct("!")
+	return t, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	var selections []*gqlSelection
+	for !p.punct("}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	if len(selections) == 0 {
+		return nil, p.unexpected("a selection")
+	}
+	p.nesting--
+	return selections, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	s := &gqlSelection{loc: p.peek().loc}
+	var err error
+	if p.punct("...") {
+		if t := p.peek(); t.kind == gqlName && t.value != "on" {
+			s.fragment = p.next().value
+			s.directives, err = p.directives()
+			return s, err
+		}
+		if t := p.peek(); t.kind == gqlName && t.value == "on" {
+			p.next()
+			s.on, err = p.name()
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.directives, err = p.directives()
+		if err != nil {
+			return nil, err
+		}
+		s.selections, err = p.selectionSet()
+		return s, err
+	}
+	s.name, err = p.name()
+	if err != nil {
+		return nil, err
+	}
+	if p.punct(":") {
+		s.alias = s.name
+		s.name, err = p.name()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.args, err = p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	s.directives, err = p.directives()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == gqlPunct && t.value == "{" {
+		s.selections, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *gqlParser) arguments() ([]gqlArgument, error) {
+	var args []gqlArgument
+	if !p.punct("(") {
+		return nil, nil
+	}
+	for !p.punct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(false)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, gqlArgument{name, v})
+	}
+	if len(args) == 0 {
+		return nil, p.unexpected("an argument")
+	}
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var directives []gqlDirective
+	for {
+		loc := p.peek().loc
+		if !p.punct("@") {
+			return directives, nil
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, gqlDirective{name, args, loc})
+	}
+}
+
+// value parses a value, which cannot use variables when it is constant
+func (p *gqlParser) value(constant bool) (*gqlValue, error) {
+	t := p.next()
+	v := &gqlValue{raw: t.value, loc: t.loc}
+	switch t.kind {
+	case gqlInt:
+		v.kind = gqlIntValue
+	case gqlFloat:
+		v.kind = gqlFloatValue
+	case gqlString:
+		v.kind = gqlStringValue
+	case gqlName:
+		switch t.value {
+		case "true", "false":
+			v.kind = gqlBooleanValue
+		case "null":
+			v.kind = gqlNullValue
+		default:
+			v.kind = gqlEnumValue
+		}
+	case gqlPunct:
+		switch {
+		case t.value == "$" && !constant:
+			v.kind = gqlVariableValue
+			var err error
+			v.raw, err = p.name()
+			return v, err
+		case t.value == "[":
+			v.kind = gqlListValue
+			if err := p.nest(); err != nil {
+				return nil, err
+			}
+			for !p.punct("]") {
+				item, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				v.list = append(v.list, item)
+			}
+			p.nesting--
+		case t.value == "{":
+			v.kind = gqlObjectValue
+			if err := p.nest(); err != nil {
+				return nil, err
+			}
+			for !p.punct("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err = p.expect(":"); err != nil {
+					return nil, err
+				}
+				field, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				v.fields = append(v.fields, gqlArgument{name, field})
+			}
+			p.nesting--
+		default:
+			p.pos--
+			return nil, p.unexpected("a value")
+		}
+	default:
+		return nil, p.unexpected("a value")
+	}
+	return v, nil
+}
+
+// gqlResolver returns the value of a field of the source object
+type gqlResolver func(p gqlParams) (interface{}, error)
+
+type gqlParams struct {
+	r      *http.Request
+	source interface{}
+	args   map[string]interface{}
+	// cache keeps what resolvers load once per request
+	cache map[string]interface{}
+}
+
+// gqlField is a field of an object type. Fields without a resolver return
+// the struct field of the source with the same name, ignoring case.
+type gqlField struct {
+	name        string
+	typ         string
+	description string
+	args        []gqlArg
+	resolve     gqlResolver
+	// permission is needed to select the field, on top of the read
+	// permission of every request
+	permission string
+
+	t *gqlType
+}
+
+// gqlArg is an argument of a field or a field of an input type, with the
+// coerced value it defaults to
+type gqlArg struct {
+	name        string
+	typ         string
+	description string
+	def         interface{}
+
+	t *gqlType
+}
+
+type gqlObject struct {
+	name        string
+	description string
+	fields      []*gqlField
+}
+
+func (o *gqlObject) field(name string) *gqlField {
+	for _, f := range o.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+type gqlInput struct {
+	name        string
+	description string
+	fields      []gqlArg
+}
+
+type gqlEnum struct {
+	name        string
+	description string
+	values      []string
+}
+
+// gqlScalars are the built in scalars and Time, an RFC3339 date
+var gqlScalars = []string{"ID", "Int", "Float", "String", "Boolean", "Time"}
+
+// gqlSchema holds the object, input and enum types of the API, in the
+// order they are listed in its SDL
+type gqlSchema struct {
+	types    []interface{}
+	objects  map[string]*gqlObject
+	inputs   map[string]*gqlInput
+	enums    map[string]*gqlEnum
+	scalars  map[string]bool
+	query    *gqlObject
+	mutation *gqlObject
+}
+
+func mustParseGQLType(s string) *gqlType {
+	p := &gqlParser{}
+	tokens, err := gqlTokenize(s)
+	if err == nil {
+		p.tokens = tokens
+		var t *gqlType
+		t, err = p.typeRef()
+		if err == nil && p.peek().kind == gqlEOF {
+			return t
+		}
+	}
+	panic(fmt.Sprintf("graphql: invalid type %q", s))
+}
+
+// newGQLSchema checks the types of a schema, whose root types are Query and
+// Mutation. It panics on invalid schemas, which are a programming error.
+func newGQLSchema(types ...interface{}) *gqlSchema {
+	s := &gqlSchema{
+		types:   types,
+		objects: make(map[string]*gqlObject),
+		inputs:  make(map[string]*gqlInput),
+		enums:   make(map[string]*gqlEnum),
+		scalars: make(map[string]bool),
+	}
+	for _, name := range gqlScalars {
+		s.scalars[name] = true
+	}
+	for _, t := range types {
+		switch t := t.(type) {
+		case *gqlObject:
+			s.objects[t.name] = t
+		case *gqlInput:
+			s.inputs[t.name] = t
+		case *gqlEnum:
+			s.enums[t.name] = t
+		}
+	}
+	s.query, s.mutation = s.objects["Query"], s.objects["Mutation"]
+	checkArgs := func(args []gqlArg, where string) {
+		for n := range args {
+			a := &args[n]
+			a.t = mustParseGQLType(a.typ)
+			name := a.t.named()
+			if !s.scalars[name] && s.enums[name] == nil && s.inputs[name] == nil {
+				panic(fmt.Sprintf("graphql: %s.%s has an unknown input type %s", where, a.name, a.typ))
+			}
+		}
+	}
+	for _, t := range types {
+		switch t := t.(type) {
+		case *gqlObject:
+			for _, f := range t.fields {
+				f.t = mustParseGQLType(f.typ)
+				name := f.t.named()
+				if !s.scalars[name] && s.enums[name] == nil && s.objects[name] == nil {
+					panic(fmt.Sprintf("graphql: %s.%s has an unknown type %s", t.name, f.name, f.typ))
+				}
+				checkArgs(f.args, t.name+"."+f.name)
+			}
+		case *gqlInput:
+			checkArgs(t.fields, t.name)
+		}
+	}
+	if s.query == nil {
+		panic("graphql: schema has no Query type")
+	}
+	return s
+}
+
+// sdl describes the schema in the GraphQL schema definition language
+func (s *gqlSchema) sdl() string {
+	var b strings.Builder
+	describe := func(indent, description string) {
+		if description != "" {
+			fmt.Fprintf(&b, "%s\"\"\"%s\"\"\"\n", indent, strings.Replace(description, `"""`, `\"""`, -1))
+		}
+	}
+	arg := func(a gqlArg) string {
+		s := a.name + ": " + a.typ
+		if a.def != nil {
+			def, _ := json.Marshal(a.def)
+			s += " = " + string(def)
+		}
+		return s
+	}
+	b.WriteString("scalar Time\n")
+	for _, t := range s.types {
+		b.WriteString("\n")
+		switch t := t.(type) {
+		case *gqlEnum:
+			describe("", t.description)
+			fmt.Fprintf(&b, "enum %s {\n", t.name)
+			for _, v := range t.values {
+				fmt.Fprintf(&b, "  %s\n", v)
+			}
+		case *gqlInput:
+			describe("", t.description)
+			fmt.Fprintf(&b, "input %s {\n", t.name)
+			for _, f := range t.fields {
+				describe("  ", f.description)
+				fmt.Fprintf(&b, "  %s\n", arg(f))
+			}
+		case *gqlObject:
+			describe("", t.description)
+			fmt.Fprintf(&b, "type %s {\n", t.name)
+			for _, f := range t.fields {
+				describe("  ", f.description)
+				args := make([]string, len(f.args))
+				for n, a := range f.args {
+					args[n] = arg(a)
+				}
+				if len(args) > 0 {
+					fmt.Fprintf(&b, "  %s(%s): %s\n", f.name, strings.Join(args, ", "), f.typ)
+				} else {
+					fmt.Fprintf(&b, "  %s: %s\n", f.name, f.typ)
+				}
+			}
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// gqlCoerced wraps the value of a variable used in a literal, which was
+// coerced against the type of the variable already
+type gqlCoerced struct {
+	v interface{}
+}
+
+// gqlEnumLiteral is an enum value of a document, which unlike the strings
+// of JSON variables can only be used for enums
+type gqlEnumLiteral string
+
+// literal converts a value of a document to the values variables are
+// decoded to from JSON. ok is false for variables that aren't set.
+func (v *gqlValue) literal(vars map[string]interface{}) (value interface{}, ok bool) {
+	switch v.kind {
+	case gqlVariableValue:
+		value, ok = vars[v.raw]
+		return gqlCoerced{value}, ok
+	case gqlIntValue, gqlFloatValue:
+		return json.Number(v.raw), true
+	case gqlStringValue:
+		return v.raw, true
+	case gqlBooleanValue:
+		return v.raw == "true", true
+	case gqlEnumValue:
+		return gqlEnumLiteral(v.raw), true
+	case gqlListValue:
+		list := make([]interface{}, len(v.list))
+		for n, item := range v.list {
+			list[n], _ = item.literal(vars)
+		}
+		return list, true
+	case gqlObjectValue:
+		fields := make(map[string]interface{}, len(v.fields))
+		for _, f := range v.fields {
+			if _, dup := fields[f.name]; dup {
+				return nil, true
+			}
+			if fv, ok := f.value.literal(vars); ok {
+				fields[f.name] = fv
+			}
+		}
+		return fields, true
+	}
+	return nil, true
+}
+
+// coerce converts a value decoded from JSON, or from a document by
+// literal, to the Go value of an input type: uint for IDs, int64 for Int,
+// time.Time for Time, string for enums and maps holding the fields set
+// for input objects. Enums are strings in JSON but names in documents.
+func (s *gqlSchema) coerce(t *gqlType, v interface{}, where string, literal bool) (interface{}, error) {
+	if c, ok := v.(gqlCoerced); ok {
+		if c.v == nil && t.nonNull {
+			return nil, fmt.Errorf("%s must not be null", where)
+		}
+		return c.v, nil
+	}
+	if v == nil {
+		if t.nonNull {
+			return nil, fmt.Errorf("%s must not be null", where)
+		}
+		return nil, nil
+	}
+	if t.of != nil {
+		list, ok := v.([]interface{})
+		if !ok {
+			list = []interface{}{v}
+		}
+		coerced := make([]interface{}, len(list))
+		for n, item := range list {
+			var err error
+			coerced[n], err = s.coerce(t.of, item, fmt.Sprintf("%s[%d]", where, n), literal)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return coerced, nil
+	}
+	if input := s.inputs[t.name]; input != nil {
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be an object of type %s", where, t.name)
+		}
+		return s.coerceArgs(input.fields, fields, where, literal)
+	}
+	if enum := s.enums[t.name]; enum != nil {
+		var value string
+		switch e := v.(type) {
+		case gqlEnumLiteral:
+			value = string(e)
+		case string:
+			if !literal {
+				value = e
+			}
+		}
+		for _, allowed := range enum.values {
+			if value != "" && value == allowed {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("%s must be one of %s", where, strings.Join(enum.values, ", "))
+	}
+	value, ok := coerceGQLScalar(t.name, v)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a valid %s", where, t.name)
+	}
+	return value, nil
+}
+
+// coerceArgs coerces the arguments of a field or the fields of an input
+// object, setting their defaults and refusing unknown ones
+func (s *gqlSchema) coerceArgs(defs []gqlArg, values map[string]interface{}, where string, literal bool) (map[string]interface{}, error) {
+	coerced := make(map[string]interface{}, len(defs))
+	for name := range values {
+		known := false
+		for _, a := range defs {
+			known = known || a.name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("%s has no field %s", where, name)
+		}
+	}
+	for _, a := range defs {
+		v, set := values[a.name]
+		if !set {
+			if a.def != nil {
+				coerced[a.name] = a.def
+			} else if a.t.nonNull {
+				return nil, fmt.Errorf("%s.%s must be set", where, a.name)
+			}
+			continue
+		}
+		var err error
+		coerced[a.name], err = s.coerce(a.t, v, where+"."+a.name, literal)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return coerced, nil
+}
+
+func coerceGQLScalar(name string, v interface{}) (interface{}, bool) {
+	switch name {
+	case "ID":
+		switch x := v.(type) {
+		case uint:
+			return x, true
+		case string:
+			id, err := strconv.ParseUint(x, 10, 32)
+			return uint(id), err == nil
+		case json.Number:
+			id, err := strconv.ParseUint(string(x), 10, 32)
+			return uint(id), err == nil
+		case float64:
+			return uint(x), x == math.Trunc(x) && x >= 0 && x <= math.MaxUint32
+		}
+	case "Int":
+		switch x := v.(type) {
+		case int64:
+			return x, true
+		case json.Number:
+			n, err := strconv.ParseInt(string(x), 10, 64)
+			return n, err == nil
+		case float64:
+			// integers decoded from JSON variables are exact up to 2^53
+			return int64(x), x == math.Trunc(x) && math.Abs(x) <= 1<<53
+		}
+	case "Float":
+		switch x := v.(type) {
+		case float64:
+			return x, true
+		case json.Number:
+			f, err := strconv.ParseFloat(string(x), 64)
+			return f, err == nil
+		}
+	case "String":
+		s, ok := v.(string)
+		return s, ok
+	case "Boolean":
+		b, ok := v.(bool)
+		return b, ok
+	case "Time":
+		switch x := v.(type) {
+		case time.Time:
+			return x, true
+		case string:
+			t, err := parseDateParam("", x)
+			return t, err == nil && x != ""
+		}
+	}
+	return nil, false
+}
+
+// gqlLimits bound the depth of selections and the estimated number of
+// fields a query resolves
+type gqlLimits struct {
+	MaxDepth      int
+	MaxComplexity int
+}
+
+// gqlCost is the depth and the complexity of a selection set
+type gqlCost struct {
+	depth      int
+	complexity int
+}
+
+// maxGQLComplexity caps complexities before they can overflow
+const maxGQLComplexity = 1 << 40
+
+// gqlExecution runs an operation of a document
+type gqlExecution struct {
+	schema *gqlSchema
+	r      *http.Request
+	doc    *gqlDocument
+	op     *gqlOperation
+	vars   map[string]interface{}
+	// args are the coerced arguments of the fields selected
+	args      map[*gqlSelection]map[string]interface{}
+	fragments map[string]gqlCost
+	cache     map[string]interface{}
+	errors    []*gqlError
+}
+
+// newGQLExecution selects the operation to run and coerces its variables
+func newGQLExecution(s *gqlSchema, r *http.Request, doc *gqlDocument, operationName string, variables map[string]interface{}) (*gqlExecution, error) {
+	e := &gqlExecution{
+		schema:    s,
+		r:         r,
+		doc:       doc,
+		vars:      make(map[string]interface{}),
+		args:      make(map[*gqlSelection]map[string]interface{}),
+		fragments: make(map[string]gqlCost),
+		cache:     make(map[string]interface{}),
+	}
+	for _, op := range doc.operations {
+		if op.name == operationName || (operationName == "" && len(doc.operations) == 1) {
+			e.op = op
+		}
+	}
+	if e.op == nil {
+		if operationName == "" {
+			return nil, newGQLError(http.StatusBadRequest, nil, "operationName must name one of the operations of the document")
+		}
+		return nil, newGQLError(http.StatusBadRequest, nil, "document has no operation named %s", operationName)
+	}
+	for _, def := range e.op.variables {
+		name := def.typ.named()
+		if !s.scalars[name] && s.enums[name] == nil && s.inputs[name] == nil {
+			return nil, newGQLError(http.StatusBadRequest, &def.loc, "variable $%s has an unknown input type %s", def.name, def.typ)
+		}
+		v, set := variables[def.name]
+		literal := false
+		if !set && def.def != nil {
+			v, _ = def.def.literal(nil)
+			set, literal = true, true
+		}
+		if !set && !def.typ.nonNull {
+			continue
+		}
+		coerced, err := s.coerce(def.typ, v, "$"+def.name, literal)
+		if err != nil {
+			return nil, newGQLError(http.StatusBadRequest, &def.loc, "%s", err)
+		}
+		e.vars[def.name] = coerced
+	}
+	for name := range variables {
+		if _, ok := e.vars[name]; !ok && !e.op.declares(name) {
+			return nil, newGQLError(http.StatusBadRequest, &e.op.loc, "variable $%s is not declared by the operation", name)
+		}
+	}
+	return e, nil
+}
+
+func (op *gqlOperation) declares(name string) bool {
+	for _, v := range op.variables {
+		if v.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (op *gqlOperation) variable(name string) *gqlVariableDef {
+	for n := range op.variables {
+		if op.variables[n].name == name {
+			return &op.variables[n]
+		}
+	}
+	return nil
+}
+
+// root returns the object type of the operation
+func (e *gqlExecution) root() *gqlObject {
+	if e.op.kind == "mutation" {
+		return e.schema.mutation
+	}
+	return e.schema.query
+}
+
+// validate checks the operation against the schema and the limits,
+// coercing the arguments of the fields it selects. It returns the errors
+// found, the first of them setting the status of the response.
+func (e *gqlExecution) validate(limits gqlLimits) []*gqlError {
+	root := e.root()
+	if root == nil {
+		return []*gqlError{newGQLError(http.StatusBadRequest, &e.op.loc, "schema has no %s type", e.op.kind)}
+	}
+	cost, err := e.validateSelections(root, e.op.selections, nil, 0)
+	if err != nil {
+		return []*gqlError{err}
+	}
+	if cost.depth > limits.MaxDepth {
+		return []*gqlError{newGQLError(http.StatusBadRequest, &e.op.loc, "query depth of %d exceeds the limit of %d", cost.depth, limits.MaxDepth)}
+	}
+	if cost.complexity > limits.MaxComplexity {
+		return []*gqlError{newGQLError(http.StatusBadRequest, &e.op.loc,
+			"query complexity of %d exceeds the limit of %d, lower the limit arguments of lists or select fewer fields", cost.complexity, limits.MaxComplexity)}
+	}
+	return nil
+}
+
+// validateSelections validates the selections of an object type, and
+// returns their depth and complexity. Each field counts once, times the
+// items its list is expected to return: its limit argument, the limit of
+// the page holding it or graphqlListCost. The cost of fragments, which
+// always apply to the same type, is computed once per page size.
+func (e *gqlExecution) validateSelections(obj *gqlObject, selections []*gqlSelection, spreading []string, pageSize int) (gqlCost, *gqlError) {
+	var total gqlCost
+	add := func(c gqlCost) {
+		if c.depth > total.depth {
+			total.depth = c.depth
+		}
+		total.complexity += c.complexity
+		if total.complexity > maxGQLComplexity {
+			total.complexity = maxGQLComplexity
+		}
+	}
+	for _, s := range selections {
+		if err := e.validateDirectives(s.directives); err != nil {
+			return total, err
+		}
+		switch {
+		case s.fragment != "":
+			f := e.doc.fragments[s.fragment]
+			if f == nil {
+				return total, newGQLError(http.StatusBadRequest, &s.loc, "unknown fragment %s", s.fragment)
+			}
+			for _, name := range spreading {
+				if name == f.name {
+					return total, newGQLError(http.StatusBadRequest, &s.loc, "fragment %s spreads itself", f.name)
+				}
+			}
+			if f.on != obj.name {
+				return total, newGQLError(http.StatusBadRequest, &s.loc, "fragment %s on %s cannot be spread on %s", f.name, f.on, obj.name)
+			}
+			key := fmt.Sprintf("%s/%d", f.name, pageSize)
+			cost, ok := e.fragments[key]
+			if !ok {
+				var err *gqlError
+				cost, err = e.validateSelections(obj, f.selections, append(spreading, f.name), pageSize)
+				if err != nil {
+					return total, err
+				}
+				e.fragments[key] = cost
+			}
+			add(cost)
+		case s.name == "":
+			if s.on != "" && s.on != obj.name {
+				return total, newGQLError(http.StatusBadRequest, &s.loc, "fragment on %s cannot be spread on %s", s.on, obj.name)
+			}
+			cost, err := e.validateSelections(obj, s.selections, spreading, pageSize)
+			if err != nil {
+				return total, err
+			}
+			add(cost)
+		case s.name == "__typename":
+			if len(s.args) > 0 || len(s.selections) > 0 {
+				return total, newGQLError(http.StatusBadRequest, &s.loc, "__typename has no arguments nor fields")
+			}
+		default:
+			cost, err := e.validateField(obj, s, spreading, pageSize)
+			if err != nil {
+				return total, err
+			}
+			add(cost)
+		}
+	}
+	return total, nil
+}
+
+func (e *gqlExecution) validateField(obj *gqlObject, s *gqlSelection, spreading []string, pageSize int) (gqlCost, *gqlError) {
+	var cost gqlCost
+	f := obj.field(s.name)
+	if f == nil {
+		return cost, newGQLError(http.StatusBadRequest, &s.loc, "type %s has no field %s", obj.name, s.name)
+	}
+	if f.permission != "" && !hasPermission(e.r, f.permission) {
+		err := newGQLError(http.StatusForbidden, &s.loc, "%s requires the %s permission", s.name, f.permission)
+		if id, ok := apiKeyFromContext(e.r); ok {
+			err.Message = fmt.Sprintf("API key %d lacks the %s scope", id, f.permission)
+		}
+		return cost, err
+	}
+	values := make(map[string]interface{}, len(s.args))
+	for _, a := range s.args {
+		if err := e.checkVariables(a.value, f, a.name); err != nil {
+			return cost, err
+		}
+		// variables that aren't set leave their arguments unset
+		if v, ok := a.value.literal(e.vars); ok {
+			values[a.name] = v
+		}
+	}
+	args, err := e.schema.coerceArgs(f.args, values, s.name, true)
+	if err != nil {
+		return cost, newGQLError(http.StatusBadRequest, &s.loc, "%s", strings.Replace(err.Error(), s.name+".", "argument ", 1))
+	}
+	e.args[s] = args
+	obj = e.schema.objects[f.t.named()]
+	if obj == nil {
+		if len(s.selections) > 0 {
+			return cost, newGQLError(http.StatusBadRequest, &s.loc, "field %s of type %s has no fields to select", s.name, f.typ)
+		}
+		return gqlCost{depth: 1, complexity: 1}, nil
+	}
+	if len(s.selections) == 0 {
+		return cost, newGQLError(http.StatusBadRequest, &s.loc, "field %s of type %s must select fields", s.name, f.typ)
+	}
+	limit, hasLimit := args["limit"].(int64)
+	childPageSize := 0
+	if hasLimit && f.t.of == nil {
+		// the limit of a page applies to the list it holds
+		childPageSize = int(limit)
+	}
+	cost, verr := e.validateSelections(obj, s.selections, spreading, childPageSize)
+	if verr != nil {
+		return cost, verr
+	}
+	items := 1
+	switch {
+	case f.t.of != nil && hasLimit:
+		items = int(limit)
+	case f.t.of != nil && pageSize > 0:
+		items = pageSize
+	case f.t.of != nil:
+		items = graphqlListCost
+	}
+	if items < 1 {
+		items = 1
+	}
+	cost.depth++
+	cost.complexity = 1 + items*cost.complexity
+	if cost.complexity > maxGQLComplexity || cost.complexity < 0 {
+		cost.complexity = maxGQLComplexity
+	}
+	return cost, nil
+}
+
+// checkVariables checks that the variables used in the value of an
+// argument are declared, with a type the argument accepts
+func (e *gqlExecution) checkVariables(v *gqlValue, f *gqlField, arg string) *gqlError {
+	if v.kind == gqlVariableValue {
+		def := e.op.variable(v.raw)
+		if def == nil {
+			return newGQLError(http.StatusBadRequest, &v.loc, "variable $%s is not declared", v.raw)
+		}
+		for _, a := range f.args {
+			if a.name == arg {
+				t := a.t
+				if def.def != nil || a.def != nil {
+					// defaults stand in for nulls
+					nullable := *t
+					nullable.nonNull = false
+					t = &nullable
+				}
+				if !t.accepts(def.typ) {
+					return newGQLError(http.StatusBadRequest, &v.loc, "variable $%s of type %s cannot be used for argument %s of type %s",
+						v.raw, def.typ, arg, a.typ)
+				}
+			}
+		}
+		return nil
+	}
+	for _, item := range v.list {
+		if item.kind == gqlVariableValue && e.op.variable(item.raw) == nil {
+			return newGQLError(http.StatusBadRequest, &item.loc, "variable $%s is not declared", item.raw)
+		}
+	}
+	for _, field := range v.fields {
+		if err := e.checkNestedVariables(field.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNestedVariables checks that the variables used within lists and
+// objects are declared, their types being checked as they are coerced
+func (e *gqlExecution) checkNestedVariables(v *gqlValue) *gqlError {
+	if v.kind == gqlVariableValue && e.op.variable(v.raw) == nil {
+		return newGQLError(http.StatusBadRequest, &v.loc, "variable $%s is not declared", v.raw)
+	}
+	for _, item := range v.list {
+		if err := e.checkNestedVariables(item); err != nil {
+			return err
+		}
+	}
+	for _, field := range v.fields {
+		if err := e.checkNestedVariables(field.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *gqlExecution) validateDirectives(directives []gqlDirective) *gqlError {
+	for _, d := range directives {
+		if d.name != "skip" && d.name != "include" {
+			return newGQLError(http.StatusBadRequest, &d.loc, "unknown directive @%s", d.name)
+		}
+		if _, err := e.directiveCondition(d); err != nil {
+			return newGQLError(http.StatusBadRequest, &d.loc, "@%s %s", d.name, err)
+		}
+	}
+	return nil
+}
+
+func (e *gqlExecution) directiveCondition(d gqlDirective) (bool, error) {
+	values := make(map[string]interface{}, len(d.args))
+	for _, a := range d.args {
+		if err := e.checkNestedVariables(a.value); err != nil {
+			return false, err
+		}
+		if v, ok := a.value.literal(e.vars); ok {
+			values[a.name] = v
+		}
+	}
+	args, err := e.schema.coerceArgs([]gqlArg{{name: "if", t: &gqlType{name: "Boolean", nonNull: true}}}, values, "argument", true)
+	if err != nil {
+		return false, err
+	}
+	return args["if"].(bool), nil
+}
+
+// included evaluates the @skip and @include directives of a selection
+func (e *gqlExecution) included(s *gqlSelection) bool {
+	for _, d := range s.directives {
+		cond, _ := e.directiveCondition(d)
+		if (d.name == "skip" && cond) || (d.name == "include" && !cond) {
+			return false
+		}
+	}
+	return true
+}
+
+// gqlResult is an object of a response, whose fields keep the order of the
+// selections
+type gqlResult []gqlResultField
+
+type gqlResultField struct {
+	key   string
+	value interface{}
+}
+
+func (res gqlResult) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for n, f := range res {
+		if n > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// collectFields gathers the fields selected on an object by response key,
+// expanding fragments and leaving out the fields skipped by directives
+func (e *gqlExecution) collectFields(selections []*gqlSelection, keys *[]string, fields map[string][]*gqlSelection) {
+	for _, s := range selections {
+		if !e.included(s) {
+			continue
+		}
+		switch {
+		case s.fragment != "":
+			e.collectFields(e.doc.fragments[s.fragment].selections, keys, fields)
+		case s.name == "":
+			e.collectFields(s.selections, keys, fields)
+		default:
+			if fields[s.key()] == nil {
+				*keys = append(*keys, s.key())
+			}
+			fields[s.key()] = append(fields[s.key()], s)
+		}
+	}
+}
+
+// execute runs the operation, the fields of mutations one after another,
+// and returns its data, nil if a non null field failed at the root
+func (e *gqlExecution) execute() interface{} {
+	data, ok := e.executeSelections(e.root(), nil, e.op.selections, nil)
+	if !ok {
+		return nil
+	}
+	return data
+}
+
+func (e *gqlExecution) executeSelections(obj *gqlObject, source interface{}, selections []*gqlSelection, path []interface{}) (gqlResult, bool) {
+	var keys []string
+	fields := make(map[string][]*gqlSelection)
+	e.collectFields(selections, &keys, fields)
+	result := make(gqlResult, 0, len(keys))
+	for _, key := range keys {
+		s := fields[key][0]
+		fieldPath := append(append([]interface{}{}, path...), key)
+		if s.name == "__typename" {
+			result = append(result, gqlResultField{key, obj.name})
+			continue
+		}
+		f := obj.field(s.name)
+		resolve := f.resolve
+		if resolve == nil {
+			resolve = gqlStructField(f.name)
+		}
+		v, err := resolve(gqlParams{r: e.r, source: source, args: e.args[s], cache: e.cache})
+		if err != nil {
+			e.fieldError(err, s, fieldPath)
+			if f.t.nonNull {
+				return nil, false
+			}
+			result = append(result, gqlResultField{key, nil})
+			continue
+		}
+		var children []*gqlSelection
+		for _, same := range fields[key] {
+			children = append(children, same.selections...)
+		}
+		value, ok := e.complete(f.t, v, s, children, fieldPath)
+		if !ok {
+			return nil, false
+		}
+		result = append(result, gqlResultField{key, value})
+	}
+	return result, true
+}
+
+// complete converts the value resolved for a field to its type. ok is false
+// when a non null value is null, which nulls the parent field.
+func (e *gqlExecution) complete(t *gqlType, v interface{}, s *gqlSelection, selections []*gqlSelection, path []interface{}) (value interface{}, ok bool) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	null := !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil())
+	if !null && t.of == nil && t.name == "Time" {
+		null = rv.Interface().(time.Time).IsZero()
+	}
+	if !null && t.name == "ID" && rv.Kind() == reflect.Uint {
+		// unset references have an ID of 0
+		null = rv.Uint() == 0
+	}
+	if null {
+		if t.nonNull {
+			e.fieldError(fmt.Errorf("%s must not be null", s.key()), s, path)
+		}
+		return nil, !t.nonNull
+	}
+	if t.of != nil {
+		list := make([]interface{}, rv.Len())
+		for n := range list {
+			item, ok := e.complete(t.of, rv.Index(n).Interface(), s, selections, append(append([]interface{}{}, path...), n))
+			if !ok {
+				return nil, !t.nonNull
+			}
+			list[n] = item
+		}
+		return list, true
+	}
+	if obj := e.schema.objects[t.name]; obj != nil {
+		result, ok := e.executeSelections(obj, rv.Interface(), selections, path)
+		if !ok {
+			return nil, !t.nonNull
+		}
+		return result, true
+	}
+	switch t.name {
+	case "ID":
+		return fmt.Sprint(rv.Interface()), true
+	case "Time":
+		return rv.Interface().(time.Time).UTC().Format(time.RFC3339), true
+	}
+	return rv.Interface(), true
+}
+
+// gqlStructField resolves a field to the struct field of the source with
+// the same name, ignoring case
+func gqlStructField(name string) gqlResolver {
+	return func(p gqlParams) (interface{}, error) {
+		rv := reflect.Indirect(reflect.ValueOf(p.source))
+		field := rv.FieldByNameFunc(func(f string) bool { return strings.EqualFold(f, name) })
+		if !field.IsValid() {
+			return nil, fmt.Errorf("%s has no field %s", rv.Type(), name)
+		}
+		return field.Interface(), nil
+	}
+}
+
+// fieldError records the error of a field, logging unexpected ones
+func (e *gqlExecution) fieldError(err error, s *gqlSelection, path []interface{}) {
+	ge := newGQLError(http.StatusInternalServerError, &s.loc, "%s", err)
+	switch se := err.(type) {
+	case serviceError:
+		ge = newGQLError(se.Status, &s.loc, "%s", se.Message)
+		ge.Extensions.Fields = se.Fields
+	case *gqlError:
+		ge = newGQLError(se.status, &s.loc, "%s", se.Message)
+	}
+	ge.Path = path
+	if ge.status >= 500 {
+		al := appLog{ErrorCode: ge.status, Message: fmt.Sprintf("graphql field %s failed: %s", s.key(), err)}
+		al.log(e.r)
+	}
+	e.errors = append(e.errors, ge)
+}
+
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	// Extensions of clients, like persisted queries, aren't supported
+	Extensions json.RawMessage `json:"extensions"`
+}
+
+type gqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []*gqlError `json:"errors,omitempty"`
+}
+
+// serveGraphQL runs the operation of a request, either a query given in the
+// parameters of a GET or any operation POSTed as JSON. Errors of the
+// request, such as invalid documents or queries past the limits, are sent
+// with a 400, or a 403 for missing permissions, while errors of fields are
+// returned along with the data of the others.
+func (iv *invoicer) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req gqlRequest
+	if r.Method == "GET" {
+		req.Query, req.OperationName = r.FormValue("query"), r.FormValue("operationName")
+		if vars := r.FormValue("variables"); vars != "" {
+			err := json.Unmarshal([]byte(vars), &req.Variables)
+			if err != nil {
+				httpError(w, r, http.StatusBadRequest, "invalid variables parameter: %s", err)
+				return
+			}
+		}
+	} else if !readJSONBody(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeGQLErrors(w, r, newGQLError(http.StatusBadRequest, nil, "query must not be empty"))
+		return
+	}
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		writeGQLErrors(w, r, err.(*gqlError))
+		return
+	}
+	e, err := newGQLExecution(iv.graphql, r, doc, req.OperationName, req.Variables)
+	if err != nil {
+		writeGQLErrors(w, r, err.(*gqlError))
+		return
+	}
+	if r.Method == "GET" && e.op.kind != "query" {
+		w.Header().Set("Allow", "POST")
+		writeGQLErrors(w, r, newGQLError(http.StatusMethodNotAllowed, &e.op.loc, "%s operations must be POSTed", e.op.kind))
+		return
+	}
+	if errs := e.validate(iv.graphqlLimits); len(errs) > 0 {
+		writeGQLErrors(w, r, errs...)
+		return
+	}
+	resp := gqlResponse{Data: json.RawMessage("null")}
+	if data := e.execute(); data != nil {
+		resp.Data = data
+	}
+	resp.Errors = e.errors
+	writeJSON(w, r, http.StatusOK, resp)
+	name := e.op.name
+	if name == "" {
+		name = "anonymous"
+	}
+	al := appLog{Message: fmt.Sprintf("ran graphql %s %s with %d errors", e.op.kind, name, len(e.errors)), Action: "graphql-" + e.op.kind}
+	al.log(r)
+}
+
+// writeGQLErrors sends the errors of a request that didn't run, with the
+// status of the first one
+func writeGQLErrors(w http.ResponseWriter, r *http.Request, errs ...*gqlError) {
+	al := appLog{ErrorCode: errs[0].status, Message: fmt.Sprintf("graphql request failed: %s", errs[0].Message)}
+	al.log(r)
+	writeJSON(w, r, errs[0].status, gqlResponse{Errors: errs})
+}
+
+// getGraphQLSchema sends the schema of the GraphQL API in SDL
+func (iv *invoicer) getGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(iv.graphql.sdl()))
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// gqlInvoicePage is a page of invoices and the number of invoices matching
+// the filters
+type gqlInvoicePage struct {
+	Total    int
+	Invoices []Invoice
+}
+
+// graphqlSchema describes the models of the invoicer to the GraphQL API.
+// Resolvers go through the service and the store like the REST handlers,
+// and html-escape free text the same way.
+func (iv *invoicer) graphqlSchema() *gqlSchema {
+	page := []gqlArg{
+		{name: "offset", typ: "Int", def: int64(0)},
+		{name: "limit", typ: "Int", def: int64(defaultInvoicesPerPage), description: fmt.Sprintf("at most %d", maxInvoicesPerPage)},
+	}
+	version := gqlArg{name: "version", typ: "Int", description: "only change the invoice if it is at this version"}
+	return newGQLSchema(
+		&gqlObject{name: "Query", fields: []*gqlField{
+			{name: "invoice", typ: "Invoice", resolve: iv.gqlInvoice,
+				args: []gqlArg{{name: "id", typ: "ID!"}, {name: "includeDeleted", typ: "Boolean", def: false}}},
+			{name: "invoiceByNumber", typ: "Invoice", resolve: iv.gqlInvoiceByNumber,
+				args: []gqlArg{{name: "number", typ: "String!"}, {name: "includeDeleted", typ: "Boolean", def: false}}},
+			{name: "invoices", typ: "InvoicePage!", resolve: iv.gqlInvoices, description: "invoices ordered by id",
+				args: append([]gqlArg{
+					{name: "customerId", typ: "ID"},
+					{name: "status", typ: "InvoiceStatus"},
+					{name: "isPaid", typ: "Boolean"},
+					{name: "dueAfter", typ: "Time"},
+					{name: "dueBefore", typ: "Time"},
+					{name: "includeDeleted", typ: "Boolean", def: false},
+				}, page...)},
+			{name: "customer", typ: "Customer", resolve: iv.gqlCustomer, args: []gqlArg{{name: "id", typ: "ID!"}}},
+			{name: "customers", typ: "[Customer!]!", resolve: iv.gqlCustomers, args: page},
+			{name: "categories", typ: "[Category!]!", resolve: iv.gqlCategories},
+			{name: "taxRates", typ: "[TaxRate!]!", resolve: iv.gqlTaxRates},
+		}},
+		&gqlObject{name: "Mutation", fields: []*gqlField{
+			{name: "createInvoice", typ: "Invoice!", resolve: iv.gqlCreateInvoice, permission: permWrite,
+				args: []gqlArg{{name: "invoice", typ: "InvoiceInput!"}}},
+			{name: "updateInvoice", typ: "Invoice!", resolve: iv.gqlUpdateInvoice, permission: permWrite,
+				description: "changes the fields set in the patch, replacing the charges if they are set",
+				args:        []gqlArg{{name: "id", typ: "ID!"}, version, {name: "invoice", typ: "InvoicePatch!"}}},
+			{name: "deleteInvoice", typ: "Boolean!", resolve: iv.gqlDeleteInvoice, permission: permDelete,
+				args: []gqlArg{{name: "id", typ: "ID!"}, version}},
+			{name: "addCharge", typ: "Charge!", resolve: iv.gqlAddCharge, permission: permWrite,
+				args: []gqlArg{{name: "invoiceId", typ: "ID!"}, version, {name: "charge", typ: "ChargeInput!"}}},
+			{name: "updateCharge", typ: "Charge!", resolve: iv.gqlUpdateCharge, permission: permWrite,
+				args: []gqlArg{{name: "id", typ: "ID!"}, version, {name: "charge", typ: "ChargeInput!"}}},
+			{name: "deleteCharge", typ: "Invoice!", resolve: iv.gqlDeleteCharge, permission: permWrite,
+				args: []gqlArg{{name: "id", typ: "ID!"}, version}},
+			{name: "addNote", typ: "Note!", resolve: iv.gqlAddNote, permission: permWrite,
+				args: []gqlArg{{name: "invoiceId", typ: "ID!"}, {name: "body", typ: "String!"}}},
+			{name: "createCustomer", typ: "Customer!", resolve: iv.gqlCreateCustomer, permission: permWrite,
+				args: []gqlArg{{name: "customer", typ: "CustomerInput!"}}},
+		}},
+		&gqlEnum{name: "InvoiceStatus", values: invoiceStatuses},
+		&gqlObject{name: "InvoicePage", fields: []*gqlField{
+			{name: "total", typ: "Int!"},
+			{name: "invoices", typ: "[Invoice!]!"},
+		}},
+		&gqlObject{name: "Invoice", description: "amounts are in minor units of the currency", fields: []*gqlField{
+			{name: "id", typ: "ID!"},
+			{name: "createdAt", typ: "Time!"},
+			{name: "updatedAt", typ: "Time!"},
+			{name: "deletedAt", typ: "Time"},
+			{name: "invoiceNumber", typ: "String!"},
+			{name: "customerId", typ: "ID"},
+			{name: "status", typ: "InvoiceStatus!"},
+			{name: "isPaid", typ: "Boolean!"},
+			{name: "amount", typ: "Int!"},
+			{name: "amountOverride", typ: "Boolean!"},
+			{name: "currency", typ: "String!"},
+			{name: "paymentDate", typ: "Time"},
+			{name: "dueDate", typ: "Time"},
+			{name: "version", typ: "Int!"},
+			{name: "balance", typ: "Int!", resolve: iv.gqlInvoiceBalance, description: "amount left to pay once payments and credit notes are deducted"},
+			{name: "customer", typ: "Customer", resolve: iv.gqlInvoiceCustomer},
+			{name: "charges", typ: "[Charge!]!", resolve: iv.gqlInvoiceCharges, description: "charges ordered by id",
+				args: []gqlArg{
+					{name: "after", typ: "ID", description: "only list the charges with a greater id"},
+					{name: "limit", typ: "Int", def: int64(defaultChargesPageSize), description: fmt.Sprintf("at most %d", maxChargesPageSize)},
+				}},
+			{name: "payments", typ: "[Payment!]!", resolve: iv.gqlInvoicePayments},
+			{name: "creditNotes", typ: "[CreditNote!]!", resolve: iv.gqlInvoiceCreditNotes},
+			{name: "notes", typ: "[Note!]!", resolve: iv.gqlInvoiceNotes},
+		}},
+		&gqlObject{name: "Charge", fields: []*gqlField{
+			{name: "id", typ: "ID!"},
+			{name: "createdAt", typ: "Time!"},
+			{name: "updatedAt", typ: "Time!"},
+			{name: "invoiceId", typ: "ID!"},
+			{name: "type", typ: "String!"},
+			{name: "amount", typ: "Int!"},
+			{name: "currency", typ: "String!"},
+			{name: "description", typ: "String!"},
+			{name: "categoryId", typ: "ID"},
+			{name: "taxRateId", typ: "ID"},
+			{name: "tax", typ: "Int!"},
+			{name: "invoice", typ: "Invoice", resolve: iv.gqlChargeInvoice},
+			{name: "category", typ: "Category", resolve: iv.gqlChargeCategory},
+			{name: "taxRate", typ: "TaxRate", resolve: iv.gqlChargeTaxRate},
+		}},
+		&gqlObject{name: "Payment", fields: []*gqlField{
+			{name: "id", typ: "ID!"},
+			{name: "createdAt", typ: "Time!"},
+			{name: "invoiceId", typ: "ID!"},
+			{name: "amount", typ: "Int!"},
+			{name: "currency", typ: "String!"},
+			{name: "method", typ: "String!"},
+			{name: "reference", typ: "String!"},
+			{name: "paidAt", typ: "Time!"},
+		}},
+		&gqlObject{name: "CreditNote", fields: []*gqlField{
+			{name: "id", typ: "ID!"},
+			{name: "createdAt", typ: "Time!"},
+			{name: "invoiceId", typ: "ID!"},
+			{name: "status", typ: "String!"},
+			{name: "reason", typ: "String!"},
+			{name: "amount", typ: "Int!"},
+			{name: "currency", typ: "String!"},
+			{name: "issuedAt", typ: "Time!"},
+			{name: "voidedAt", typ: "Time"},
+			{name: "lines", typ: "[CreditNoteLine!]!"},
+		}},
+		&gqlObject{name: "CreditNoteLine", fields: []*gqlField{
+			{name: "id", typ: "ID!"},
+			{name: "description", typ: "String!"},
+			{name: "amount", typ: "Int!"},
+		}},
+		&gqlObject{name: "Note", fields: []*gqlField{
+			{name: "id", typ: "ID!"},
+			{name: "createdAt", typ: "Time!"},
+			{name: "invoiceId", typ: "ID!"},
+			{name: "author", typ: "String!"},
+			{name: "body", typ: "String!"},
+		}},
+		&gqlObject{name: "Customer", fields: []*gqlField{
+			{name: "id", typ: "ID!"},
+			{name: "createdAt", typ: "Time!"},
+			{name: "updatedAt", typ: "Time!"},
+			{name: "name", typ: "String!"},
+			{name: "email", typ: "String!"},
+			{name: "billingAddress", typ: "String!"},
+			{name: "taxId", typ: "String!"},
+			{name: "invoices", typ: "InvoicePage!", resolve: iv.gqlCustomerInvoices,
+				args: append([]gqlArg{{name: "status", typ: "InvoiceStatus"}}, page...)},
+		}},
+		&gqlObject{name: "Category", fields: []*gqlField{
+			{name: "id", typ: "ID!"},
+			{name: "name", typ: "String!"},
+			{name: "parentId", typ: "ID"},
+			{name: "path", typ: "String!", description: "names of the category and its parents"},
+		}},
+		&gqlObject{name: "TaxRate", fields: []*gqlField{
+			{name: "id", typ: "ID!"},
+			{name: "name", typ: "String!"},
+			{name: "percentage", typ: "Float!"},
+			{name: "jurisdiction", typ: "String!"},
+		}},
+		&gqlInput{name: "InvoiceInput", fields: []gqlArg{
+			{name: "customerId", typ: "ID"},
+			{name: "status", typ: "InvoiceStatus"},
+			{name: "isPaid", typ: "Boolean"},
+			{name: "amount", typ: "Int", description: "defaults to the total of the charges"},
+			{name: "amountOverride", typ: "Boolean"},
+			{name: "currency", typ: "String"},
+			{name: "paymentDate", typ: "Time"},
+			{name: "dueDate", typ: "Time"},
+			{name: "charges", typ: "[ChargeInput!]"},
+		}},
+		&gqlInput{name: "InvoicePatch", description: "fields left out are left unchanged", fields: []gqlArg{
+			{name: "customerId", typ: "ID"},
+			{name: "status", typ: "InvoiceStatus"},
+			{name: "isPaid", typ: "Boolean"},
+			{name: "amount", typ: "Int"},
+			{name: "amountOverride", typ: "Boolean"},
+			{name: "paymentDate", typ: "Time"},
+			{name: "dueDate", typ: "Time"},
+			{name: "charges", typ: "[ChargeInput!]"},
+		}},
+		&gqlInput{name: "ChargeInput", fields: []gqlArg{
+			{name: "type", typ: "String!"},
+			{name: "amount", typ: "Int!"},
+			{name: "currency", typ: "String", description: "defaults to the currency of the invoice"},
+			{name: "description", typ: "String"},
+			{name: "categoryId", typ: "ID"},
+			{name: "taxRateId", typ: "ID"},
+		}},
+		&gqlInput{name: "CustomerInput", fields: []gqlArg{
+			{name: "name", typ: "String!"},
+			{name: "email", typ: "String"},
+			{name: "billingAddress", typ: "String"},
+			{name: "taxId", typ: "String"},
+		}},
+	)
+}
+
+// gqlIfMatch returns the If-Match header matching the version argument of
+// a mutation, if it is set
+func gqlIfMatch(args map[string]interface{}) string {
+	if v, ok := args["version"].(int64); ok {
+		return fmt.Sprintf(`"%d"`, v)
+	}
+	return ""
+}
+
+// gqlLimit returns the limit argument of a list, if it is between 1 and
+// max
+func gqlLimit(args map[string]interface{}, max int) (int, error) {
+	limit, _ := args["limit"].(int64)
+	if limit < 1 || limit > int64(max) {
+		return 0, newServiceError(http.StatusBadRequest, "limit must be between 1 and %d", max)
+	}
+	return int(limit), nil
+}
+
+func (iv *invoicer) gqlInvoice(p gqlParams) (interface{}, error) {
+	id, _ := p.args["id"].(uint)
+	return iv.findInvoice(p.r, id, p.args["includeDeleted"].(bool))
+}
+
+func (iv *invoicer) gqlInvoiceByNumber(p gqlParams) (interface{}, error) {
+	number := p.args["number"].(string)
+	i1, err := iv.invoicesFor(p.r).GetByNumber(number, p.args["includeDeleted"].(bool))
+	if err == errInvoiceNotFound {
+		return nil, newServiceError(http.StatusNotFound, "No invoice number %s", number)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve invoice %s: %s", number, err)
+	}
+	return i1, nil
+}
+
+func (iv *invoicer) gqlListInvoices(p gqlParams, filters invoiceFilters) (interface{}, error) {
+	offset, _ := p.args["offset"].(int64)
+	if offset < 0 {
+		return nil, newServiceError(http.StatusBadRequest, "offset must not be negative")
+	}
+	limit, err := gqlLimit(p.args, maxInvoicesPerPage)
+	if err != nil {
+		return nil, err
+	}
+	filters.Status, _ = p.args["status"].(string)
+	invoices, total, err := iv.findInvoices(p.r, filters, int(offset), limit)
+	if err != nil {
+		return nil, err
+	}
+	return gqlInvoicePage{Total: total, Invoices: invoices}, nil
+}
+
+func (iv *invoicer) gqlInvoices(p gqlParams) (interface{}, error) {
+	var filters invoiceFilters
+	filters.CustomerID, _ = p.args["customerId"].(uint)
+	if isPaid, ok := p.args["isPaid"].(bool); ok {
+		filters.IsPaid = &isPaid
+	}
+	filters.DueAfter, _ = p.args["dueAfter"].(time.Time)
+	filters.DueBefore, _ = p.args["dueBefore"].(time.Time)
+	filters.IncludeDeleted = p.args["includeDeleted"].(bool)
+	return iv.gqlListInvoices(p, filters)
+}
+
+func (iv *invoicer) gqlCustomerInvoices(p gqlParams) (interface{}, error) {
+	return iv.gqlListInvoices(p, invoiceFilters{CustomerID: p.source.(Customer).ID})
+}
+
+// findCustomer retrieves a customer once per request, or nil if it doesn't
+// exist
+func (iv *invoicer) findCustomer(p gqlParams, id uint) (*Customer, error) {
+	key := fmt.Sprintf("customer:%d", id)
+	if c, ok := p.cache[key]; ok {
+		return c.(*Customer), nil
+	}
+	c := new(Customer)
+	err := iv.dbFor(p.r).First(c, id).Error
+	if err == gorm.ErrRecordNotFound {
+		c = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to retrieve customer %d: %s", id, err)
+	} else {
+		escapeCustomer(c)
+	}
+	p.cache[key] = c
+	return c, nil
+}
+
+func (iv *invoicer) gqlCustomer(p gqlParams) (interface{}, error) {
+	id, _ := p.args["id"].(uint)
+	c, err := iv.findCustomer(p, id)
+	if err == nil && c == nil {
+		return nil, newServiceError(http.StatusNotFound, "No customer id %d", id)
+	}
+	return c, err
+}
+
+func (iv *invoicer) gqlCustomers(p gqlParams) (interface{}, error) {
+	offset, _ := p.args["offset"].(int64)
+	if offset < 0 {
+		return nil, newServiceError(http.StatusBadRequest, "offset must not be negative")
+	}
+	limit, err := gqlLimit(p.args, maxInvoicesPerPage)
+	if err != nil {
+		return nil, err
+	}
+	customers := []Customer{}
+	err = iv.dbFor(p.r).Order("id asc").Offset(int(offset)).Limit(limit).Find(&customers).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve customers: %s", err)
+	}
+	for n := range customers {
+		escapeCustomer(&customers[n])
+	}
+	return customers, nil
+}
+
+// loadGQLCategories loads the categories once per request
+func (iv *invoicer) loadGQLCategories(p gqlParams) (map[uint]*Category, error) {
+	if byID, ok := p.cache["categories"]; ok {
+		return byID.(map[uint]*Category), nil
+	}
+	byID, err := iv.loadCategories()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve categories: %s", err)
+	}
+	for _, c := range byID {
+		escapeCategory(c)
+	}
+	p.cache["categories"] = byID
+	return byID, nil
+}
+
+// loadGQLTaxRates loads the tax rates once per request
+func (iv *invoicer) loadGQLTaxRates(p gqlParams) (map[uint]*TaxRate, error) {
+	if byID, ok := p.cache["taxRates"]; ok {
+		return byID.(map[uint]*TaxRate), nil
+	}
+	byID, err := iv.loadTaxRates()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve tax rates: %s", err)
+	}
+	for _, t := range byID {
+		escapeTaxRate(t)
+	}
+	p.cache["taxRates"] = byID
+	return byID, nil
+}
+
+func (iv *invoicer) gqlCategories(p gqlParams) (interface{}, error) {
+	byID, err := iv.loadGQLCategories(p)
+	if err != nil {
+		return nil, err
+	}
+	categories := make([]Category, 0, len(byID))
+	for _, c := range byID {
+		categories = append(categories, *c)
+	}
+	sortCategories(categories)
+	return categories, nil
+}
+
+func (iv *invoicer) gqlTaxRates(p gqlParams) (interface{}, error) {
+	rates := []TaxRate{}
+	err := iv.dbFor(p.r).Order("jurisdiction asc, name asc").Find(&rates).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve tax rates: %s", err)
+	}
+	for n := range rates {
+		escapeTaxRate(&rates[n])
+	}
+	return rates, nil
+}
+
+func (iv *invoicer) gqlInvoiceBalance(p gqlParams) (interface{}, error) {
+	i1 := p.source.(Invoice)
+	settled, err := settledAmount(iv.dbFor(p.r), i1.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve balance of invoice %d: %s", i1.ID, err)
+	}
+	return i1.Amount - settled, nil
+}
+
+func (iv *invoicer) gqlInvoiceCustomer(p gqlParams) (interface{}, error) {
+	i1 := p.source.(Invoice)
+	if i1.CustomerID == 0 {
+		return nil, nil
+	}
+	return iv.findCustomer(p, i1.CustomerID)
+}
+
+func (iv *invoicer) gqlInvoiceCharges(p gqlParams) (interface{}, error) {
+	i1 := p.source.(Invoice)
+	limit, err := gqlLimit(p.args, maxChargesPageSize)
+	if err != nil {
+		return nil, err
+	}
+	after, _ := p.args["after"].(uint)
+	charges, err := iv.invoicesFor(p.r).Charges(i1, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve charges of invoice %d: %s", i1.ID, err)
+	}
+	escapeCharges(charges)
+	return charges, nil
+}
+
+func (iv *invoicer) gqlInvoicePayments(p gqlParams) (interface{}, error) {
+	i1 := p.source.(Invoice)
+	payments := []Payment{}
+	err := iv.dbFor(p.r).Where("invoice_id = ?", i1.ID).Order("paid_at asc").Find(&payments).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve payments of invoice %d: %s", i1.ID, err)
+	}
+	escapePayments(payments)
+	return payments, nil
+}
+
+func (iv *invoicer) gqlInvoiceCreditNotes(p gqlParams) (interface{}, error) {
+	i1 := p.source.(Invoice)
+	notes, err := invoiceCreditNotes(iv.dbFor(p.r), i1.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve credit notes of invoice %d: %s", i1.ID, err)
+	}
+	escapeCreditNotes(notes)
+	return notes, nil
+}
+
+func (iv *invoicer) gqlInvoiceNotes(p gqlParams) (interface{}, error) {
+	i1 := p.source.(Invoice)
+	notes, err := invoiceNotes(iv.dbFor(p.r), i1.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve notes of invoice %d: %s", i1.ID, err)
+	}
+	escapeNotes(notes)
+	return notes, nil
+}
+
+func (iv *invoicer) gqlChargeInvoice(p gqlParams) (interface{}, error) {
+	return iv.findInvoice(p.r, uint(p.source.(Charge).InvoiceID), true)
+}
+
+func (iv *invoicer) gqlChargeCategory(p gqlParams) (interface{}, error) {
+	byID, err := iv.loadGQLCategories(p)
+	if err != nil {
+		return nil, err
+	}
+	return byID[p.source.(Charge).CategoryID], nil
+}
+
+func (iv *invoicer) gqlChargeTaxRate(p gqlParams) (interface{}, error) {
+	byID, err := iv.loadGQLTaxRates(p)
+	if err != nil {
+		return nil, err
+	}
+	return byID[p.source.(Charge).TaxRateID], nil
+}
+
+// setGQLInvoice sets the fields of an invoice given in an input object
+func setGQLInvoice(i *Invoice, in map[string]interface{}) {
+	for name, v := range in {
+		switch name {
+		case "customerId":
+			i.CustomerID, _ = v.(uint)
+		case "status":
+			i.Status, _ = v.(string)
+		case "isPaid":
+			i.IsPaid, _ = v.(bool)
+		case "amount":
+			i.Amount, _ = v.(int64)
+		case "amountOverride":
+			i.AmountOverride, _ = v.(bool)
+		case "currency":
+			i.Currency, _ = v.(string)
+		case "paymentDate":
+			i.PaymentDate, _ = v.(time.Time)
+		case "dueDate":
+			i.DueDate, _ = v.(time.Time)
+		case "charges":
+			list, _ := v.([]interface{})
+			i.Charges = make([]Charge, len(list))
+			for n, c := range list {
+				setGQLCharge(&i.Charges[n], c.(map[string]interface{}))
+			}
+		}
+	}
+}
+
+// setGQLCharge sets the fields of a charge given in an input object
+func setGQLCharge(c *Charge, in map[string]interface{}) {
+	c.Type, _ = in["type"].(string)
+	c.Amount, _ = in["amount"].(int64)
+	c.Currency, _ = in["currency"].(string)
+	c.Description, _ = in["description"].(string)
+	c.CategoryID, _ = in["categoryId"].(uint)
+	c.TaxRateID, _ = in["taxRateId"].(uint)
+}
+
+func (iv *invoicer) gqlCreateInvoice(p gqlParams) (interface{}, error) {
+	var i1 Invoice
+	setGQLInvoice(&i1, p.args["invoice"].(map[string]interface{}))
+	i1, err := iv.createInvoice(p.r, i1)
+	if err != nil {
+		return nil, err
+	}
+	al := appLog{Message: fmt.Sprintf("created invoice %d", i1.ID), Action: "graphql-create-invoice"}
+	al.log(p.r)
+	return i1, nil
+}
+
+// gqlUpdateInvoice changes the fields of an invoice set in the patch, like
+// PATCH /invoice/{id}
+func (iv *invoicer) gqlUpdateInvoice(p gqlParams) (interface{}, error) {
+	id, _ := p.args["id"].(uint)
+	patch := p.args["invoice"].(map[string]interface{})
+	_, amountSet := patch["amount"]
+	_, replaceCharges := patch["charges"]
+	i1, err := iv.updateInvoice(p.r, id, invoiceUpdate{
+		Action:         "patch",
+		IfMatch:        gqlIfMatch(p.args),
+		ReplaceCharges: replaceCharges,
+		AmountSet:      amountSet,
+		Apply: func(i *Invoice) error {
+			setGQLInvoice(i, patch)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	al := appLog{Message: fmt.Sprintf("updated invoice %d", i1.ID), Action: "graphql-update-invoice"}
+	al.log(p.r)
+	return i1, nil
+}
+
+func (iv *invoicer) gqlDeleteInvoice(p gqlParams) (interface{}, error) {
+	id, _ := p.args["id"].(uint)
+	existed, err := iv.removeInvoice(p.r, id, gqlIfMatch(p.args))
+	if err != nil {
+		return nil, err
+	}
+	if !existed {
+		return nil, newServiceError(http.StatusNotFound, "No invoice id %d", id)
+	}
+	al := appLog{Message: fmt.Sprintf("deleted invoice %d", id), Action: "graphql-delete-invoice"}
+	al.log(p.r)
+	return true, nil
+}
+
+func (iv *invoicer) gqlAddCharge(p gqlParams) (interface{}, error) {
+	id, _ := p.args["invoiceId"].(uint)
+	i1, err := iv.findInvoice(p.r, id, false)
+	if err != nil {
+		return nil, err
+	}
+	var c Charge
+	setGQLCharge(&c, p.args["charge"].(map[string]interface{}))
+	if err = iv.checkCharge(i1, &c); err != nil {
+		return nil, err
+	}
+	if err = iv.checkChargesQuota(p.r, i1, 1); err != nil {
+		return nil, err
+	}
+	i1, err = iv.changeCharge(p.r, i1, gqlIfMatch(p.args), "add-charge", func(i *Invoice) error {
+		return iv.invoicesFor(p.r).SaveCharge(i, &c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	al := appLog{Message: fmt.Sprintf("added charge %d to invoice %d", c.ID, i1.ID), Action: "graphql-add-charge"}
+	al.log(p.r)
+	charges := []Charge{c}
+	escapeCharges(charges)
+	return charges[0], nil
+}
+
+func (iv *invoicer) gqlUpdateCharge(p gqlParams) (interface{}, error) {
+	id, _ := p.args["id"].(uint)
+	stored, i1, err := iv.findCharge(p.r, id)
+	if err != nil {
+		return nil, err
+	}
+	var c Charge
+	setGQLCharge(&c, p.args["charge"].(map[string]interface{}))
+	if err = iv.checkCharge(i1, &c); err != nil {
+		return nil, err
+	}
+	c.Model = stored.Model
+	i1, err = iv.changeCharge(p.r, i1, gqlIfMatch(p.args), "update-charge", func(i *Invoice) error {
+		return iv.invoicesFor(p.r).SaveCharge(i, &c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	al := appLog{Message: fmt.Sprintf("updated charge %d of invoice %d", c.ID, i1.ID), Action: "graphql-update-charge"}
+	al.log(p.r)
+	charges := []Charge{c}
+	escapeCharges(charges)
+	return charges[0], nil
+}
+
+func (iv *invoicer) gqlDeleteCharge(p gqlParams) (interface{}, error) {
+	id, _ := p.args["id"].(uint)
+	c, i1, err := iv.findCharge(p.r, id)
+	if err != nil {
+		return nil, err
+	}
+	i1, err = iv.changeCharge(p.r, i1, gqlIfMatch(p.args), "delete-charge", func(i *Invoice) error {
+		return iv.invoicesFor(p.r).DeleteCharge(i, c.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	al := appLog{Message: fmt.Sprintf("deleted charge %d of invoice %d", c.ID, i1.ID), Action: "graphql-delete-charge"}
+	al.log(p.r)
+	return i1, nil
+}
+
+func (iv *invoicer) gqlAddNote(p gqlParams) (interface{}, error) {
+	id, _ := p.args["invoiceId"].(uint)
+	i1, err := iv.findInvoice(p.r, id, false)
+	if err != nil {
+		return nil, err
+	}
+	body := p.args["body"].(string)
+	if errs := validateNote(body); len(errs) > 0 {
+		return nil, newValidationError(errs)
+	}
+	n := Note{InvoiceID: i1.ID, Author: actorOf(p.r), Body: body}
+	if n.Author == "" {
+		n.Author = "anonymous"
+	}
+	err = iv.dbFor(p.r).Create(&n).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to add note to invoice %d: %s", i1.ID, err)
+	}
+	al := appLog{Message: fmt.Sprintf("added note %d to invoice %d", n.ID, i1.ID), Action: "graphql-add-note"}
+	al.log(p.r)
+	notes := []Note{n}
+	escapeNotes(notes)
+	return notes[0], nil
+}
+
+func (iv *invoicer) gqlCreateCustomer(p gqlParams) (interface{}, error) {
+	in := p.args["customer"].(map[string]interface{})
+	var c Customer
+	c.Name, _ = in["name"].(string)
+	c.Email, _ = in["email"].(string)
+	c.BillingAddress, _ = in["billingAddress"].(string)
+	c.TaxID, _ = in["taxId"].(string)
+	if err := validateCustomer(c); err != nil {
+		return nil, newServiceError(http.StatusBadRequest, "invalid customer: %s", err)
+	}
+	err := iv.dbFor(p.r).Create(&c).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to create customer: %s", err)
+	}
+	al := appLog{Message: fmt.Sprintf("created customer %d", c.ID), Action: "graphql-create-customer"}
+	al.log(p.r)
+	escapeCustomer(&c)
+	return c, nil
+}
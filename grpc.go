@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// The gRPC API of invoicer.proto is served by net/http over HTTP/2, which
+// it only negotiates over TLS, so the gRPC server requires a certificate.
+// Messages are framed as described in
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+
+// maxGRPCMessageSize is the largest request message accepted, the default
+// of gRPC implementations
+const maxGRPCMessageSize = 4 << 20
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is an error reported to gRPC clients with a status code
+type grpcError struct {
+	Code    int
+	Message string
+}
+
+func (e grpcError) Error() string {
+	return e.Message
+}
+
+func newGRPCError(code int, format string, args ...interface{}) error {
+	return grpcError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// grpcCodeForStatus returns the gRPC status code of an http status
+func grpcCodeForStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return grpcFailedPrecondition
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	return grpcInternal
+}
+
+// grpcMethod is an RPC of the Invoicer service
+type grpcMethod struct {
+	request func() proto.Message
+	call    func(r *http.Request, req proto.Message) (proto.Message, error)
+}
+
+func (iv *invoicer) grpcMethods() map[string]grpcMethod {
+	return map[string]grpcMethod{
+		"/invoicer.Invoicer/CreateInvoice": {
+			request: func() proto.Message { return &pbCreateInvoiceRequest{} },
+			call:    iv.grpcCreateInvoice,
+		},
+		"/invoicer.Invoicer/GetInvoice": {
+			request: func() proto.Message { return &pbGetInvoiceRequest{} },
+			call:    iv.grpcGetInvoice,
+		},
+		"/invoicer.Invoicer/ListInvoices": {
+			request: func() proto.Message { return &pbListInvoicesRequest{} },
+			call:    iv.grpcListInvoices,
+		},
+		"/invoicer.Invoicer/UpdateInvoice": {
+			request: func() proto.Message { return &pbUpdateInvoiceRequest{} },
+			call:    iv.grpcUpdateInvoice,
+		},
+		"/invoicer.Invoicer/DeleteInvoice": {
+			request: func() proto.Message { return &pbDeleteInvoiceRequest{} },
+			call:    iv.grpcDeleteInvoice,
+		},
+	}
+}
+
+// grpcHandler serves the unary RPCs of the Invoicer service
+func (iv *invoicer) grpcHandler() http.Handler {
+	methods := iv.grpcMethods()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			httpError(w, r, http.StatusHTTPVersionNotSupported, "gRPC requires HTTP/2")
+			return
+		}
+		contentType := r.Header.Get("Content-Type")
+		if r.Method != "POST" || (contentType != "application/grpc" && contentType != "application/grpc+proto") {
+			httpError(w, r, http.StatusUnsupportedMediaType, "expected a POST of application/grpc")
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		method, ok := methods[r.URL.Path]
+		if !ok {
+			writeGRPCError(w, r, newGRPCError(grpcUnimplemented, "unknown method %s", r.URL.Path))
+			return
+		}
+		req := method.request()
+		err := readGRPCMessage(r, req)
+		if err != nil {
+			writeGRPCError(w, r, err)
+			return
+		}
+		resp, err := method.call(r, req)
+		if err != nil {
+			writeGRPCError(w, r, err)
+			return
+		}
+		body, err := proto.Marshal(resp)
+		if err != nil {
+			writeGRPCError(w, r, newGRPCError(grpcInternal, "failed to encode response: %s", err))
+			return
+		}
+		frame := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(frame, body...))
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+	})
+}
+
+// readGRPCMessage decodes the single, uncompressed message of a unary call
+func readGRPCMessage(r *http.Request, msg proto.Message) error {
+	var prefix [5]byte
+	_, err := io.ReadFull(r.Body, prefix[:])
+	if err != nil {
+		return newGRPCError(grpcInternal, "failed to read message: %s", err)
+	}
+	if prefix[0] != 0 {
+		return newGRPCError(grpcUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCMessageSize {
+		return newGRPCError(grpcResourceExhausted, "message of %d bytes exceeds the limit of %d", size, maxGRPCMessageSize)
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r.Body, body)
+	if err != nil {
+		return newGRPCError(grpcInternal, "failed to read message: %s", err)
+	}
+	err = proto.Unmarshal(body, msg)
+	if err != nil {
+		return newGRPCError(grpcInternal, "failed to decode message: %s", err)
+	}
+	return nil
+}
+
+// writeGRPCError logs an error and ends the call with its status
+func writeGRPCError(w http.ResponseWriter, r *http.Request, err error) {
+	code := grpcInternal
+	switch e := err.(type) {
+	case grpcError:
+		code = e.Code
+	case serviceError:
+		code = grpcCodeForStatus(e.Status)
+	}
+	al := appLog{Message: fmt.Sprintf("gRPC %s failed with code %d: %s", r.URL.Path, code, err)}
+	al.log(r)
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(err.Error()))
+}
+
+// encodeGRPCMessage percent-encodes the bytes of a status message that
+// cannot be sent in an HTTP/2 header
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func (iv *invoicer) grpcCreateInvoice(r *http.Request, req proto.Message) (proto.Message, error) {
+	in := req.(*pbCreateInvoiceRequest)
+	if in.Invoice == nil {
+		return nil, newGRPCError(grpcInvalidArgument, "invoice must be set")
+	}
+	i1, err := invoiceFromProto(in.Invoice)
+	if err != nil {
+		return nil, err
+	}
+	i1, err = iv.createInvoice(r, i1)
+	if err != nil {
+		return nil, err
+	}
+	al := appLog{Message: fmt.Sprintf("created invoice %d", i1.ID), Action: "grpc-create-invoice"}
+	al.log(r)
+	return invoiceToProto(i1), nil
+}
+
+func (iv *invoicer) grpcGetInvoice(r *http.Request, req proto.Message) (proto.Message, error) {
+	in := req.(*pbGetInvoiceRequest)
+	i1, err := iv.findInvoice(r, uint(in.Id), in.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	i1.Charges, err = iv.invoicesFor(r).Charges(i1, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve charges of invoice %d: %s", i1.ID, err)
+	}
+	al := appLog{Message: fmt.Sprintf("retrieved invoice %d", i1.ID), Action: "grpc-get-invoice"}
+	al.log(r)
+	return invoiceToProto(i1), nil
+}
+
+// grpcListInvoices lists invoices by id, with page tokens holding the
+// offset of the next page
+func (iv *invoicer) grpcListInvoices(r *http.Request, req proto.Message) (proto.Message, error) {
+	in := req.(*pbListInvoicesRequest)
+	filters := invoiceFilters{CustomerID: uint(in.CustomerId), IncludeDeleted: in.IncludeDeleted}
+	if in.Status != "" {
+		if !validInvoiceStatus(in.Status) {
+			return nil, newGRPCError(grpcInvalidArgument, "invalid status %q", in.Status)
+		}
+		filters.Status = in.Status
+	}
+	pageSize := int(in.PageSize)
+	if pageSize == 0 {
+		pageSize = defaultInvoicesPerPage
+	}
+	if pageSize < 0 || pageSize > maxInvoicesPerPage {
+		return nil, newGRPCError(grpcInvalidArgument, "page_size must be between 1 and %d", maxInvoicesPerPage)
+	}
+	offset := 0
+	if in.PageToken != "" {
+		var err error
+		offset, err = strconv.Atoi(in.PageToken)
+		if err != nil || offset < 0 {
+			return nil, newGRPCError(grpcInvalidArgument, "invalid page_token %q", in.PageToken)
+		}
+	}
+	invoices, total, err := iv.findInvoices(r, filters, offset, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pbListInvoicesResponse{TotalSize: int32(total)}
+	for _, i1 := range invoices {
+		resp.Invoices = append(resp.Invoices, invoiceToProto(i1))
+	}
+	if offset+pageSize < total {
+		resp.NextPageToken = strconv.Itoa(offset + pageSize)
+	}
+	al := appLog{Message: fmt.Sprintf("listed %d invoices out of %d", len(invoices), total), Action: "grpc-list-invoices"}
+	al.log(r)
+	return resp, nil
+}
+
+// grpcUpdateInvoice replaces an invoice like PUT /invoice/{id}, or only
+// changes the fields of the update mask like PATCH /invoice/{id}
+func (iv *invoicer) grpcUpdateInvoice(r *http.Request, req proto.Message) (proto.Message, error) {
+	in := req.(*pbUpdateInvoiceRequest)
+	if in.Invoice == nil {
+		return nil, newGRPCError(grpcInvalidArgument, "invoice must be set")
+	}
+	body, err := invoiceFromProto(in.Invoice)
+	if err != nil {
+		return nil, err
+	}
+	action, replaceCharges, amountSet := "update", true, body.Amount != 0
+	change := func(i *Invoice) error {
+		if body.Currency != "" && body.Currency != i.Currency {
+			var errs validationErrors
+			errs.add("currency", "cannot be changed from %s", i.Currency)
+			return newValidationError(errs)
+		}
+		*i = body
+		return nil
+	}
+	if len(in.UpdateMask) > 0 {
+		action, replaceCharges, amountSet = "patch", false, false
+		for _, field := range in.UpdateMask {
+			switch field {
+			case "status", "is_paid", "amount_override", "payment_date", "due_date", "customer_id":
+			case "amount":
+				amountSet = true
+			case "charges":
+				replaceCharges = true
+			default:
+				return nil, newGRPCError(grpcInvalidArgument, "field %q cannot be updated", field)
+			}
+		}
+		change = func(i *Invoice) error {
+			for _, field := range in.UpdateMask {
+				switch field {
+				case "status":
+					i.Status = body.Status
+				case "is_paid":
+					i.IsPaid = body.IsPaid
+				case "amount":
+					i.Amount = body.Amount
+				case "amount_override":
+					i.AmountOverride = body.AmountOverride
+				case "payment_date":
+					i.PaymentDate = body.PaymentDate
+				case "due_date":
+					i.DueDate = body.DueDate
+				case "customer_id":
+					i.CustomerID = body.CustomerID
+				case "charges":
+					i.Charges = body.Charges
+				}
+			}
+			return nil
+		}
+	}
+	ifMatch := ""
+	if in.Invoice.Version != 0 {
+		ifMatch = fmt.Sprintf(`"%d"`, in.Invoice.Version)
+	}
+	i1, err := iv.updateInvoice(r, uint(in.Invoice.Id), invoiceUpdate{
+		Action:         action,
+		IfMatch:        ifMatch,
+		ReplaceCharges: replaceCharges,
+		AmountSet:      amountSet,
+		Apply:          change,
+	})
+	if err != nil {
+		return nil, err
+	}
+	i1.Charges, err = iv.invoicesFor(r).Charges(i1, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve charges of invoice %d: %s", i1.ID, err)
+	}
+	al := appLog{Message: fmt.Sprintf("updated invoice %d", i1.ID), Action: "grpc-update-invoice"}
+	al.log(r)
+	return invoiceToProto(i1), nil
+}
+
+func (iv *invoicer) grpcDeleteInvoice(r *http.Request, req proto.Message) (proto.Message, error) {
+	in := req.(*pbDeleteInvoiceRequest)
+	ifMatch := ""
+	if in.Version != 0 {
+		ifMatch = fmt.Sprintf(`"%d"`, in.Version)
+	}
+	existed, err := iv.removeInvoice(r, uint(in.Id), ifMatch)
+	if err != nil {
+		return nil, err
+	}
+	if !existed {
+		return nil, newGRPCError(grpcNotFound, "No invoice id %d", in.Id)
+	}
+	al := appLog{Message: fmt.Sprintf("deleted invoice %d", in.Id), Action: "grpc-delete-invoice"}
+	al.log(r)
+	return &empty.Empty{}, nil
+}
+
+// timeToProto converts a time to a protobuf timestamp, leaving zero times
+// unset
+func timeToProto(t time.Time) *timestamp.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	ts, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil
+	}
+	return ts
+}
+
+func timeFromProto(field string, ts *timestamp.Timestamp) (time.Time, error) {
+	if ts == nil {
+		return time.Time{}, nil
+	}
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return t, newGRPCError(grpcInvalidArgument, "invalid %s: %s", field, err)
+	}
+	return t, nil
+}
+
+func invoiceToProto(i Invoice) *pbInvoice {
+	pb := &pbInvoice{
+		Id:             uint64(i.ID),
+		InvoiceNumber:  i.InvoiceNumber,
+		CustomerId:     uint64(i.CustomerID),
+		Status:         i.Status,
+		IsPaid:         i.IsPaid,
+		Amount:         i.Amount,
+		AmountOverride: i.AmountOverride,
+		Currency:       i.Currency,
+		PaymentDate:    timeToProto(i.PaymentDate),
+		DueDate:        timeToProto(i.DueDate),
+		Version:        int64(i.Version),
+		CreatedAt:      timeToProto(i.CreatedAt),
+		UpdatedAt:      timeToProto(i.UpdatedAt),
+	}
+	if i.DeletedAt != nil {
+		pb.DeletedAt = timeToProto(*i.DeletedAt)
+	}
+	for _, c := range i.Charges {
+		pb.Charges = append(pb.Charges, &pbCharge{
+			Id:          uint64(c.ID),
+			InvoiceId:   uint64(c.InvoiceID),
+			Type:        c.Type,
+			Amount:      c.Amount,
+			Currency:    c.Currency,
+			Description: c.Description,
+			CategoryId:  uint64(c.CategoryID),
+			CreatedAt:   timeToProto(c.CreatedAt),
+			UpdatedAt:   timeToProto(c.UpdatedAt),
+		})
+	}
+	return pb
+}
+
+// invoiceFromProto converts the writable fields of an invoice message
+func invoiceFromProto(pb *pbInvoice) (i Invoice, err error) {
+	i = Invoice{
+		CustomerID:     uint(pb.CustomerId),
+		Status:         pb.Status,
+		IsPaid:         pb.IsPaid,
+		Amount:         pb.Amount,
+		AmountOverride: pb.AmountOverride,
+		Currency:       pb.Currency,
+	}
+	i.PaymentDate, err = timeFromProto("payment_date", pb.PaymentDate)
+	if err != nil {
+		return
+	}
+	i.DueDate, err = timeFromProto("due_date", pb.DueDate)
+	if err != nil {
+		return
+	}
+	for _, c := range pb.Charges {
+		if c == nil {
+			continue
+		}
+		i.Charges = append(i.Charges, Charge{
+			Type:        c.Type,
+			Amount:      c.Amount,
+			Currency:    c.Currency,
+			Description: c.Description,
+			CategoryID:  uint(c.CategoryId),
+		})
+	}
+	return i, nil
+}
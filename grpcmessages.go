@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// The messages of invoicer.proto, written in the form protoc-gen-go would
+// generate them so they can be encoded by the protobuf package
+
+type pbCharge struct {
+	Id          uint64               `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	InvoiceId   uint64               `protobuf:"varint,2,opt,name=invoice_id,json=invoiceId" json:"invoice_id,omitempty"`
+	Type        string               `protobuf:"bytes,3,opt,name=type" json:"type,omitempty"`
+	Amount      int64                `protobuf:"varint,4,opt,name=amount" json:"amount,omitempty"`
+	Currency    string               `protobuf:"bytes,5,opt,name=currency" json:"currency,omitempty"`
+	Description string               `protobuf:"bytes,6,opt,name=description" json:"description,omitempty"`
+	CategoryId  uint64               `protobuf:"varint,7,opt,name=category_id,json=categoryId" json:"category_id,omitempty"`
+	CreatedAt   *timestamp.Timestamp `protobuf:"bytes,8,opt,name=created_at,json=createdAt" json:"created_at,omitempty"`
+	UpdatedAt   *timestamp.Timestamp `protobuf:"bytes,9,opt,name=updated_at,json=updatedAt" json:"updated_at,omitempty"`
+}
+
+func (m *pbCharge) Reset()         { *m = pbCharge{} }
+func (m *pbCharge) String() string { return proto.CompactTextString(m) }
+func (*pbCharge) ProtoMessage()    {}
+
+type pbInvoice struct {
+	Id             uint64               `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	CustomerId     uint64               `protobuf:"varint,2,opt,name=customer_id,json=customerId" json:"customer_id,omitempty"`
+	Status         string               `protobuf:"bytes,3,opt,name=status" json:"status,omitempty"`
+	IsPaid         bool                 `protobuf:"varint,4,opt,name=is_paid,json=isPaid" json:"is_paid,omitempty"`
+	Amount         int64                `protobuf:"varint,5,opt,name=amount" json:"amount,omitempty"`
+	Currency       string               `protobuf:"bytes,6,opt,name=currency" json:"currency,omitempty"`
+	PaymentDate    *timestamp.Timestamp `protobuf:"bytes,7,opt,name=payment_date,json=paymentDate" json:"payment_date,omitempty"`
+	DueDate        *timestamp.Timestamp `protobuf:"bytes,8,opt,name=due_date,json=dueDate" json:"due_date,omitempty"`
+	Version        int64                `protobuf:"varint,9,opt,name=version" json:"version,omitempty"`
+	Charges        []*pbCharge          `protobuf:"bytes,10,rep,name=charges" json:"charges,omitempty"`
+	CreatedAt      *timestamp.Timestamp `protobuf:"bytes,11,opt,name=created_at,json=createdAt" json:"created_at,omitempty"`
+	UpdatedAt      *timestamp.Timestamp `protobuf:"bytes,12,opt,name=updated_at,json=updatedAt" json:"updated_at,omitempty"`
+	DeletedAt      *timestamp.Timestamp `protobuf:"bytes,13,opt,name=deleted_at,json=deletedAt" json:"deleted_at,omitempty"`
+	AmountOverride bool                 `protobuf:"varint,14,opt,name=amount_override,json=amountOverride" json:"amount_override,omitempty"`
+	InvoiceNumber  string               `protobuf:"bytes,15,opt,name=invoice_number,json=invoiceNumber" json:"invoice_number,omitempty"`
+}
+
+func (m *pbInvoice) Reset()         { *m = pbInvoice{} }
+func (m *pbInvoice) String() string { return proto.CompactTextString(m) }
+func (*pbInvoice) ProtoMessage()    {}
+
+type pbCreateInvoiceRequest struct {
+	Invoice *pbInvoice `protobuf:"bytes,1,opt,name=invoice" json:"invoice,omitempty"`
+}
+
+func (m *pbCreateInvoiceRequest) Reset()         { *m = pbCreateInvoiceRequest{} }
+func (m *pbCreateInvoiceRequest) String() string { return proto.CompactTextString(m) }
+func (*pbCreateInvoiceRequest) ProtoMessage()    {}
+
+type pbGetInvoiceRequest struct {
+	Id             uint64 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	IncludeDeleted bool   `protobuf:"varint,2,opt,name=include_deleted,json=includeDeleted" json:"include_deleted,omitempty"`
+}
+
+func (m *pbGetInvoiceRequest) Reset()         { *m = pbGetInvoiceRequest{} }
+func (m *pbGetInvoiceRequest) String() string { return proto.CompactTextString(m) }
+func (*pbGetInvoiceRequest) ProtoMessage()    {}
+
+type pbListInvoicesRequest struct {
+	CustomerId     uint64 `protobuf:"varint,1,opt,name=customer_id,json=customerId" json:"customer_id,omitempty"`
+	Status         string `protobuf:"bytes,2,opt,name=status" json:"status,omitempty"`
+	PageSize       int32  `protobuf:"varint,3,opt,name=page_size,json=pageSize" json:"page_size,omitempty"`
+	PageToken      string `protobuf:"bytes,4,opt,name=page_token,json=pageToken" json:"page_token,omitempty"`
+	IncludeDeleted bool   `protobuf:"varint,5,opt,name=include_deleted,json=includeDeleted" json:"include_deleted,omitempty"`
+}
+
+func (m *pbListInvoicesRequest) Reset()         { *m = pbListInvoicesRequest{} }
+func (m *pbListInvoicesRequest) String() string { return proto.CompactTextString(m) }
+func (*pbListInvoicesRequest) ProtoMessage()    {}
+
+type pbListInvoicesResponse struct {
+	Invoices      []*pbInvoice `protobuf:"bytes,1,rep,name=invoices" json:"invoices,omitempty"`
+	NextPageToken string       `protobuf:"bytes,2,opt,name=next_page_token,json=nextPageToken" json:"next_page_token,omitempty"`
+	TotalSize     int32        `protobuf:"varint,3,opt,name=total_size,json=totalSize" json:"total_size,omitempty"`
+}
+
+func (m *pbListInvoicesResponse) Reset()         { *m = pbListInvoicesResponse{} }
+func (m *pbListInvoicesResponse) String() string { return proto.CompactTextString(m) }
+func (*pbListInvoicesResponse) ProtoMessage()    {}
+
+type pbUpdateInvoiceRequest struct {
+	Invoice    *pbInvoice `protobuf:"bytes,1,opt,name=invoice" json:"invoice,omitempty"`
+	UpdateMask []string   `protobuf:"bytes,2,rep,name=update_mask,json=updateMask" json:"update_mask,omitempty"`
+}
+
+func (m *pbUpdateInvoiceRequest) Reset()         { *m = pbUpdateInvoiceRequest{} }
+func (m *pbUpdateInvoiceRequest) String() string { return proto.CompactTextString(m) }
+func (*pbUpdateInvoiceRequest) ProtoMessage()    {}
+
+type pbDeleteInvoiceRequest struct {
+	Id      uint64 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	Version int64  `protobuf:"varint,2,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *pbDeleteInvoiceRequest) Reset()         { *m = pbDeleteInvoiceRequest{} }
+func (m *pbDeleteInvoiceRequest) String() string { return proto.CompactTextString(m) }
+func (*pbDeleteInvoiceRequest) ProtoMessage()    {}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthCheckTimeout bounds the time spent pinging the database
+const healthCheckTimeout = 2 * time.Second
+
+type healthCheck struct {
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+	LatencyMS int64  `json:"latency_ms,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// checkDatabase pings the database within healthCheckTimeout
+func (iv *invoicer) checkDatabase(ctx context.Context) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := iv.db.DB().PingContext(ctx)
+	if err != nil {
+		return healthCheck{Status: "unhealthy", Message: err.Error()}
+	}
+	return healthCheck{Status: "ok", LatencyMS: time.Since(start).Nanoseconds() / int64(time.Millisecond)}
+}
+
+// checkMigrations verifies that all the migrations known to the invoicer
+// are applied
+func (iv *invoicer) checkMigrations() healthCheck {
+	pending, err := pendingMigrations(iv.db)
+	if err != nil {
+		return healthCheck{Status: "unhealthy", Message: err.Error()}
+	}
+	if len(pending) > 0 {
+		var names []string
+		for _, m := range pending {
+			names = append(names, fmt.Sprintf("%d_%s", m.Version, m.Name))
+		}
+		return healthCheck{Status: "unhealthy", Message: fmt.Sprintf("pending migrations %v", names)}
+	}
+	return healthCheck{Status: "ok"}
+}
+
+// getLBHeartbeat is the readiness endpoint used by load balancers. It checks
+// that the database is reachable and migrated, and returns a 503 if not, so
+// traffic is routed away from instances that cannot serve it.
+func (iv *invoicer) getLBHeartbeat(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: "ok", Checks: make(map[string]healthCheck)}
+	report.Checks["database"] = iv.checkDatabase(r.Context())
+	if report.Checks["database"].Status == "ok" {
+		report.Checks["migrations"] = iv.checkMigrations()
+	}
+	status := http.StatusOK
+	for _, c := range report.Checks {
+		if c.Status != "ok" {
+			report.Status = "unhealthy"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, r, status, report)
+}
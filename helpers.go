@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
 	"math/rand"
 	"net/http"
 	"time"
@@ -20,9 +20,25 @@ func newRequestID() string {
 	return string(b)
 }
 
-func httpError(w http.ResponseWriter, r *http.Request, errorCode int, errorMessage string, args ...interface{}) {
-	al := appLog{ErrorCode: errorCode, Message: fmt.Sprintf(errorMessage, args...)}
-	al.log(r)
-	http.Error(w, fmt.Sprintf(errorMessage, args...), errorCode)
-	return
+// writeJSON marshals v and sends it to the client with the given status code
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	jsonBody, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to marshal response: %s", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBody)
+}
+
+// readJSONBody parses the JSON body of a request into v. If the body cannot
+// be read or parsed, an error is sent to the client and false is returned.
+func readJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := decodeJSONBody(r, v)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return false
+	}
+	return true
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// idempotencyKeyTTL is how long responses are replayed for their key
+	idempotencyKeyTTL = 24 * time.Hour
+	maxIdempotencyKey = 255
+)
+
+// IdempotencyKey records the response sent to a request carrying an
+// Idempotency-Key header, to replay it when a client retries the request.
+// Keys are scoped to the actor, method and path of the request. A key
+// without a status belongs to a request that is still being served.
+type IdempotencyKey struct {
+	ID             uint `gorm:"primary_key"`
+	CreatedAt      time.Time
+	Actor          string
+	Method         string
+	Path           string
+	IdempotencyKey string
+	RequestHash    string
+	Status         int
+	ContentType    string
+	Body           string
+	ExpiresAt      time.Time
+}
+
+// idempotencyRecorder keeps a copy of the response written by a handler
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *idempotencyRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotencyRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent lets clients safely retry a request by sending the same
+// Idempotency-Key header: the first request is served and its response
+// stored for 24 hours, and repeats get that response back without being
+// served again. The key is claimed in the database before serving, so
+// repeats reaching other replicas are answered too. Reusing a key for a
+// different body is refused with a 422, and repeats arriving while the
+// first request is served get a 409. Server errors aren't stored, so the
+// request can be retried with the same key.
+func (iv *invoicer) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			httpError(w, r, http.StatusBadRequest, "Idempotency-Key must not exceed %d characters", maxIdempotencyKey)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			writeBodyError(w, r, err)
+			return
+		}
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "failed to read request body: %s", err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+		now := time.Now().UTC()
+		err = iv.db.Where("expires_at < ?", now).Delete(IdempotencyKey{}).Error
+		if err != nil {
+			applog.warnf("failed to delete expired idempotency keys: %s", err)
+		}
+		claim := IdempotencyKey{
+			Actor:          actorOf(r),
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			IdempotencyKey: key,
+			RequestHash:    hex.EncodeToString(hash[:]),
+			ExpiresAt:      now.Add(idempotencyKeyTTL),
+		}
+		// a violation of the unique index means the key was already used,
+		// which isn't worth logging
+		err = iv.db.New().LogMode(false).Create(&claim).Error
+		if err != nil {
+			iv.replayIdempotentResponse(w, r, claim, err)
+			return
+		}
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		h(rec, r)
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			err = iv.db.Delete(&claim).Error
+		} else {
+			err = iv.db.Model(&claim).Updates(map[string]interface{}{
+				"status":       rec.status,
+				"content_type": rec.Header().Get("Content-Type"),
+				"body":         rec.body.String(),
+			}).Error
+		}
+		if err != nil {
+			applog.errorf("failed to store response of idempotency key %d: %s", claim.ID, err)
+		}
+	}
+}
+
+// replayIdempotentResponse answers a request whose idempotency key is
+// already claimed with the stored response
+func (iv *invoicer) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, claim IdempotencyKey, claimErr error) {
+	var stored IdempotencyKey
+	res := iv.dbFor(r).Where("actor = ? AND method = ? AND path = ? AND idempotency_key = ?",
+		claim.Actor, claim.Method, claim.Path, claim.IdempotencyKey).First(&stored)
+	if res.RecordNotFound() {
+		httpError(w, r, http.StatusInternalServerError, "failed to claim idempotency key: %s", claimErr)
+		return
+	}
+	if res.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve idempotency key: %s", res.Error)
+		return
+	}
+	switch {
+	case stored.RequestHash != claim.RequestHash:
+		httpError(w, r, http.StatusUnprocessableEntity, "Idempotency-Key %q was already used with a different request body", claim.IdempotencyKey)
+		return
+	case stored.Status == 0:
+		httpError(w, r, http.StatusConflict, "a request with Idempotency-Key %q is still being served", claim.IdempotencyKey)
+		return
+	}
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	w.Write([]byte(stored.Body))
+	al := appLog{Message: fmt.Sprintf("replayed response of idempotency key %d", stored.ID), Action: "idempotent-replay"}
+	al.log(r)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxImportInvoices is the number of invoices accepted by an import
+	maxImportInvoices = 10000
+	// importBatchSize is the number of invoices inserted per transaction
+	importBatchSize = 100
+)
+
+// importColumns are the columns of CSV imports, those of exports with
+// charges. Rows sharing an invoice_id, which is only used to group them,
+// are the charges of one invoice. The invoice_number, created_at, credited
+// and charge_id columns of exports are ignored, and so is charge_tax which
+// is computed from the tax rate of the charge.
+var importColumns = map[string]bool{
+	"invoice_id": true, "invoice_number": true, "created_at": true, "customer_id": true, "status": true, "is_paid": true, "amount": true,
+	"currency": true, "due_date": true, "payment_date": true, "credited": true, "charge_id": true, "charge_type": true,
+	"charge_amount": true, "charge_description": true, "charge_category_id": true,
+	"charge_tax_rate_id": true, "charge_tax": true,
+}
+
+// importRow is an invoice to import along with the row it was read from
+// and the errors found while reading it
+type importRow struct {
+	Row     int
+	Invoice Invoice
+	Errors  validationErrors
+}
+
+type importResult struct {
+	Row    int              `json:"row"`
+	ID     uint             `json:"id,omitempty"`
+	Errors validationErrors `json:"errors,omitempty"`
+}
+
+type importReport struct {
+	Created  int            `json:"created"`
+	Rejected int            `json:"rejected"`
+	Results  []importResult `json:"results"`
+}
+
+// readImportJSON reads a JSON array of invoices, numbering rows from 0
+func readImportJSON(r *http.Request) ([]importRow, error) {
+	var invoices []Invoice
+	err := decodeJSONBody(r, &invoices)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]importRow, len(invoices))
+	for n, i := range invoices {
+		rows[n] = importRow{Row: n, Invoice: i}
+	}
+	return rows, nil
+}
+
+// readImportCSV reads invoices from CSV with a header of importColumns.
+// Amounts are in major units of the currency, as in exports, and dates are
+// YYYY-MM-DD or RFC3339. Rows are numbered by line, the header being line 1,
+// and an invoice by its first line.
+func readImportCSV(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %s", err)
+	}
+	columns := make(map[string]int)
+	for n, name := range header {
+		name = strings.TrimSpace(name)
+		if !importColumns[name] {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		columns[name] = n
+	}
+	var (
+		rows      []importRow
+		lastGroup string
+	)
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %s", err)
+		}
+		get := func(col string) string {
+			if n, ok := columns[col]; ok && n < len(record) {
+				return strings.TrimSpace(record[n])
+			}
+			return ""
+		}
+		group := get("invoice_id")
+		if group == "" || group != lastGroup || len(rows) == 0 {
+			row := importRow{Row: line}
+			readImportInvoice(&row, get)
+			rows = append(rows, row)
+		}
+		lastGroup = group
+		if len(rows) > maxImportInvoices {
+			break
+		}
+		if get("charge_type") != "" || get("charge_amount") != "" {
+			readImportCharge(&rows[len(rows)-1], line, get)
+		}
+	}
+	return rows, nil
+}
+
+func readImportInvoice(row *importRow, get func(string) string) {
+	i := &row.Invoice
+	i.Status, i.Currency = get("status"), strings.ToUpper(get("currency"))
+	var err error
+	if get("customer_id") != "" {
+		var id uint64
+		id, err = strconv.ParseUint(get("customer_id"), 10, 64)
+		if err != nil {
+			row.Errors.add("customer_id", "invalid id %q", get("customer_id"))
+		}
+		i.CustomerID = uint(id)
+	}
+	if get("is_paid") != "" {
+		i.IsPaid, err = strconv.ParseBool(get("is_paid"))
+		if err != nil {
+			row.Errors.add("is_paid", "invalid boolean %q", get("is_paid"))
+		}
+	}
+	if get("amount") != "" {
+		i.Amount, err = parseImportAmount(get("amount"), i.Currency)
+		if err != nil {
+			row.Errors.add("amount", "%s", err)
+		}
+	}
+	for _, d := range []struct {
+		col string
+		dst *time.Time
+	}{{"due_date", &i.DueDate}, {"payment_date", &i.PaymentDate}} {
+		if get(d.col) != "" {
+			*d.dst, err = parseImportDate(get(d.col))
+			if err != nil {
+				row.Errors.add(d.col, "%s", err)
+			}
+		}
+	}
+}
+
+func readImportCharge(row *importRow, line int, get func(string) string) {
+	c := Charge{Type: get("charge_type"), Description: get("charge_description")}
+	prefix := fmt.Sprintf("charges[%d].", len(row.Invoice.Charges))
+	currency := row.Invoice.Currency
+	if currency == "" {
+		currency = defaultCurrency()
+	}
+	var err error
+	c.Amount, err = parseImportAmount(get("charge_amount"), currency)
+	if err != nil {
+		row.Errors.add(prefix+"amount", "line %d: %s", line, err)
+	}
+	if get("charge_category_id") != "" && get("charge_category_id") != "0" {
+		id, err := strconv.ParseUint(get("charge_category_id"), 10, 64)
+		if err != nil {
+			row.Errors.add(prefix+"category_id", "line %d: invalid id %q", line, get("charge_category_id"))
+		}
+		c.CategoryID = uint(id)
+	}
+	if get("charge_tax_rate_id") != "" && get("charge_tax_rate_id") != "0" {
+		id, err := strconv.ParseUint(get("charge_tax_rate_id"), 10, 64)
+		if err != nil {
+			row.Errors.add(prefix+"tax_rate_id", "line %d: invalid id %q", line, get("charge_tax_rate_id"))
+		}
+		c.TaxRateID = uint(id)
+	}
+	row.Invoice.Charges = append(row.Invoice.Charges, c)
+}
+
+// parseImportAmount converts an amount in major units, such as 12.50, to
+// minor units of currency
+func parseImportAmount(s, currency string) (int64, error) {
+	if currency == "" {
+		currency = defaultCurrency()
+	}
+	major, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return toMinorUnits(major, strings.ToUpper(currency)), nil
+}
+
+func parseImportDate(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC3339", s)
+	}
+	return t, nil
+}
+
+// prepareImportedInvoice validates an invoice to import like a new one,
+// except that its due date may be in the past and it may have any status
+// but partially paid, which requires payments. The error is set if the
+// invoice couldn't be validated.
+func (iv *invoicer) prepareImportedInvoice(i *Invoice) (validationErrors, error) {
+	setInvoiceCurrency(i, defaultCurrency())
+	var errs validationErrors
+	if i.Status == "" {
+		i.Status = statusDraft
+		if i.IsPaid {
+			i.Status = statusPaid
+		}
+	}
+	if i.Status == statusPartiallyPaid {
+		errs.add("status", "invoices cannot be imported as %s, import them as sent and record their payments", i.Status)
+		return errs, nil
+	}
+	i.IsPaid = i.Status == statusPaid
+	if err := iv.taxCharges(i.Charges); err != nil {
+		errs.add("charges", "%s", err)
+		return errs, nil
+	}
+	if errs := setInvoiceAmount(i, i.Amount != 0, sumCharges(i.Charges)); len(errs) > 0 {
+		return errs, nil
+	}
+	errs, err := iv.validateInvoice(*i, false)
+	i.ID = 0
+	for n := range i.Charges {
+		i.Charges[n].ID, i.Charges[n].InvoiceID = 0, 0
+	}
+	return errs, err
+}
+
+// postInvoicesImport creates invoices from a JSON array of invoices, or from
+// CSV when the request is sent as text/csv. Every invoice is validated and
+// the valid ones are inserted in batched transactions, so an import can be
+// retried with the rejected rows only. The report lists the id created for
+// every row or its validation errors. Imports record the creation of the
+// invoices in their history but don't send webhooks, since historical
+// invoices would flood subscribers.
+func (iv *invoicer) postInvoicesImport(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var (
+		rows []importRow
+		err  error
+	)
+	if mediaType == "text/csv" {
+		rows, err = readImportCSV(r.Body)
+		if err != nil && !bodyTooLarge(err) {
+			httpError(w, r, http.StatusBadRequest, "failed to parse import: %s", err)
+			return
+		}
+	} else {
+		rows, err = readImportJSON(r)
+	}
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if len(rows) == 0 || len(rows) > maxImportInvoices {
+		httpError(w, r, http.StatusBadRequest, "imports require between 1 and %d invoices", maxImportInvoices)
+		return
+	}
+	report := importReport{Results: make([]importResult, len(rows))}
+	var valid []int
+	for n := range rows {
+		report.Results[n].Row = rows[n].Row
+		if len(rows[n].Errors) == 0 {
+			rows[n].Errors, err = iv.prepareImportedInvoice(&rows[n].Invoice)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, "failed to validate row %d: %s", rows[n].Row, err)
+				return
+			}
+		}
+		if len(rows[n].Errors) > 0 {
+			report.Results[n].Errors = rows[n].Errors
+			report.Rejected++
+			continue
+		}
+		valid = append(valid, n)
+	}
+	for start := 0; start < len(valid); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+		err = iv.importBatch(r, rows, valid[start:end])
+		for _, n := range valid[start:end] {
+			if err != nil {
+				report.Results[n].Errors.add("", "failed to insert batch: %s", err)
+				report.Rejected++
+				continue
+			}
+			report.Results[n].ID = rows[n].Invoice.ID
+			report.Created++
+			iv.audit(r, "import", rows[n].Invoice.ID, nil, iv.invoiceSnapshot(rows[n].Invoice.ID))
+		}
+	}
+	status := http.StatusCreated
+	switch {
+	case report.Created == 0:
+		status = http.StatusUnprocessableEntity
+	case report.Rejected > 0:
+		status = http.StatusOK
+	}
+	writeJSON(w, r, status, report)
+	al := appLog{Message: fmt.Sprintf("imported %d invoices, rejected %d", report.Created, report.Rejected), Action: "post-invoices-import"}
+	al.log(r)
+}
+
+// importBatch inserts invoices in a transaction, setting their ids
+func (iv *invoicer) importBatch(r *http.Request, rows []importRow, batch []int) error {
+	tx := iv.dbFor(r).Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	store := newGormInvoiceStore(tx)
+	for _, n := range batch {
+		err := store.Create(&rows[n].Invoice)
+		if err != nil {
+			tx.Rollback()
+			for _, n := range batch {
+				rows[n].Invoice.ID = 0
+			}
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/jinzhu/gorm"
+)
+
+// cachedInvoice is the rendered response of GET /invoice/{id}
+type cachedInvoice struct {
+	id           uint
+	body         []byte
+	etag         string
+	lastModified time.Time
+	expires      time.Time
+}
+
+// invoiceCache keeps the responses of the most recently retrieved invoices,
+// so polling clients don't query the database. Entries are invalidated by
+// gorm callbacks whenever their invoice is written, and expire after a TTL
+// since writes made by other instances of the invoicer aren't seen. A nil
+// cache caches nothing.
+type invoiceCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[uint]*list.Element
+	lru     *list.List
+	// generation is incremented by every invalidation, so responses
+	// rendered from invoices read before an invalidation aren't cached
+	generation uint64
+}
+
+// newInvoiceCache configures the cache of invoices, returning a nil cache
+// if invoices.cache_size is 0
+func newInvoiceCache(cfg config.Invoices) *invoiceCache {
+	if cfg.CacheSize == 0 {
+		return nil
+	}
+	return &invoiceCache{
+		size:    cfg.CacheSize,
+		ttl:     cfg.CacheTTL,
+		entries: make(map[uint]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached response of an invoice unless it expired
+func (c *invoiceCache) get(id uint, now time.Time) (cachedInvoice, bool) {
+	if c == nil {
+		return cachedInvoice{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		return cachedInvoice{}, false
+	}
+	e := el.Value.(cachedInvoice)
+	if !now.Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+		return cachedInvoice{}, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+// currentGeneration is read before loading an invoice to cache
+func (c *invoiceCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// add caches the response of an invoice loaded at generation, evicting
+// the least recently used invoice when the cache is full
+func (c *invoiceCache) add(e cachedInvoice, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if expires := time.Now().Add(c.ttl); e.expires.IsZero() || expires.Before(e.expires) {
+		e.expires = expires
+	}
+	if el, ok := c.entries[e.id]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.id] = c.lru.PushFront(e)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(cachedInvoice).id)
+	}
+}
+
+// invalidate removes an invoice from the cache, or every invoice if id is 0
+func (c *invoiceCache) invalidate(id uint) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if id == 0 {
+		c.entries = make(map[uint]*list.Element)
+		c.lru.Init()
+		return
+	}
+	if el, ok := c.entries[id]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+	}
+}
+
+// invalidateOnWrites registers gorm callbacks invalidating the invoices
+// written to the database. Every change to an invoice or to its charges
+// increments the version of the invoice, so watching the invoices table is
+// enough. Writes selecting invoices with conditions rather than by their
+// model, such as the overdue check, clear the whole cache.
+func (c *invoiceCache) invalidateOnWrites(callbacks *gorm.Callback) {
+	invalidate := func(scope *gorm.Scope) {
+		if scope.TableName() != "invoices" {
+			return
+		}
+		var id uint
+		if i, ok := scope.Value.(*Invoice); ok {
+			id = i.ID
+		}
+		c.invalidate(id)
+	}
+	callbacks.Update().After("gorm:commit_or_rollback_transaction").Register("invoice_cache:invalidate", invalidate)
+	callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register("invoice_cache:invalidate", invalidate)
+}
+
+// writeInvoiceResponse sends a rendered invoice with its validators, or a
+// 304 if the conditional headers of the request show the client has it
+func writeInvoiceResponse(w http.ResponseWriter, r *http.Request, e cachedInvoice) {
+	w.Header().Set("ETag", e.etag)
+	w.Header().Set("Last-Modified", e.lastModified.UTC().Format(http.TimeFormat))
+	if notModified(r, e.etag, e.lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
+
+// notModified evaluates If-None-Match, with the weak comparison it
+// requires, or If-Modified-Since when the request has no If-None-Match
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// invoiceTemplate describes the company header and wording of rendered
+// invoices. It is loaded from the JSON file set in INVOICER_INVOICE_TEMPLATE.
+type invoiceTemplate struct {
+	CompanyName    string   `json:"company_name"`
+	CompanyAddress []string `json:"company_address"`
+	Title          string   `json:"title"`
+	DateFormat     string   `json:"date_format"`
+	Footer         []string `json:"footer"`
+}
+
+var defaultInvoiceTemplate = invoiceTemplate{
+	CompanyName: "Invoicer",
+	Title:       "INVOICE",
+	DateFormat:  "January 2, 2006",
+}
+
+// loadInvoiceTemplate reads an invoice template from a JSON file. Settings
+// missing from the file keep their default value. An empty path returns
+// the default template.
+func loadInvoiceTemplate(path string) (invoiceTemplate, error) {
+	tmpl := defaultInvoiceTemplate
+	if path == "" {
+		return tmpl, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tmpl, err
+	}
+	err = json.Unmarshal(data, &tmpl)
+	if err != nil {
+		return tmpl, fmt.Errorf("failed to parse invoice template %s: %s", path, err)
+	}
+	return tmpl, nil
+}
+
+const (
+	pdfMarginLeft   = 50.0
+	pdfMarginRight  = pdfPageWidth - 50
+	pdfMarginBottom = 90.0
+	pdfLineHeight   = 14.0
+
+	// horizontal position of the columns of the charges table
+	pdfColType        = pdfMarginLeft
+	pdfColDescription = 170.0
+	pdfColAmount      = pdfMarginRight
+)
+
+func formatAmount(amount int64, currency string) string {
+	return formatMinorUnits(amount, currency) + " " + currency
+}
+
+// renderInvoicePDF lays out an invoice, its charges and its customer, if
+// any, into a PDF document. The credit notes issued on the invoice are
+// deducted from its total.
+func renderInvoicePDF(tmpl invoiceTemplate, i Invoice, customer *Customer, creditNotes []CreditNote) []byte {
+	var doc pdfDocument
+	doc.AddPage()
+
+	// company header on the left, invoice details on the right
+	y := pdfPageHeight - 60
+	doc.Text(pdfMarginLeft, y, pdfFontBold, 18, tmpl.CompanyName)
+	doc.TextRight(pdfMarginRight, y, pdfFontBold, 20, tmpl.Title)
+	for n, line := range tmpl.CompanyAddress {
+		doc.Text(pdfMarginLeft, y-20-float64(n)*12, pdfFontRegular, 10, line)
+	}
+	details := []string{
+		fmt.Sprintf("Invoice %s", i.InvoiceNumber),
+		fmt.Sprintf("Date: %s", i.CreatedAt.Format(tmpl.DateFormat)),
+		fmt.Sprintf("Due date: %s", i.DueDate.Format(tmpl.DateFormat)),
+	}
+	if i.IsPaid {
+		details = append(details, fmt.Sprintf("Paid on %s", i.PaymentDate.Format(tmpl.DateFormat)))
+	}
+	for n, line := range details {
+		doc.TextRight(pdfMarginRight, y-24-float64(n)*12, pdfFontRegular, 10, line)
+	}
+
+	// billing address of the customer
+	y -= 130
+	if customer != nil {
+		doc.Text(pdfMarginLeft, y, pdfFontBold, 10, "Bill to")
+		lines := []string{customer.Name}
+		lines = append(lines, strings.Split(customer.BillingAddress, "\n")...)
+		if customer.Email != "" {
+			lines = append(lines, customer.Email)
+		}
+		if customer.TaxID != "" {
+			lines = append(lines, "Tax ID: "+customer.TaxID)
+		}
+		for _, line := range lines {
+			y -= 12
+			doc.Text(pdfMarginLeft, y, pdfFontRegular, 10, strings.TrimSpace(line))
+		}
+		y -= 30
+	}
+
+	// table of charges, continued on as many pages as needed
+	tableHeader := func() {
+		doc.Text(pdfColType, y, pdfFontBold, 10, "Type")
+		doc.Text(pdfColDescription, y, pdfFontBold, 10, "Description")
+		doc.TextRight(pdfColAmount, y, pdfFontBold, 10, "Amount")
+		doc.Line(pdfMarginLeft, y-4, pdfMarginRight, y-4, 0.5)
+		y -= pdfLineHeight + 4
+	}
+	tableHeader()
+	for _, c := range i.Charges {
+		if y < pdfMarginBottom {
+			doc.AddPage()
+			y = pdfPageHeight - 60
+			tableHeader()
+		}
+		doc.Text(pdfColType, y, pdfFontRegular, 10, pdfTruncate(c.Type, 10, pdfColDescription-pdfColType-10))
+		doc.Text(pdfColDescription, y, pdfFontRegular, 10, pdfTruncate(c.Description, 10, pdfColAmount-pdfColDescription-80))
+		doc.TextRight(pdfColAmount, y, pdfFontRegular, 10, formatAmount(c.Amount, c.Currency))
+		y -= pdfLineHeight
+	}
+	var credits []CreditNote
+	for _, cn := range creditNotes {
+		if cn.Status == creditNoteIssued {
+			credits = append(credits, cn)
+		}
+	}
+	totalsHeight := 30.0
+	if i.Taxes != nil {
+		totalsHeight += float64(len(i.Taxes.Lines)+1) * pdfLineHeight
+	}
+	if len(credits) > 0 {
+		totalsHeight += float64(len(credits)+1) * 16
+	}
+	if y < pdfMarginBottom+totalsHeight {
+		doc.AddPage()
+		y = pdfPageHeight - 60
+	}
+	doc.Line(pdfMarginLeft, y+4, pdfMarginRight, y+4, 0.5)
+	y -= 10
+	// taxed invoices show their subtotal and the tax of each rate
+	if i.Taxes != nil {
+		doc.TextRight(pdfColAmount-100, y, pdfFontRegular, 10, "Subtotal")
+		doc.TextRight(pdfColAmount, y, pdfFontRegular, 10, formatAmount(i.Taxes.Subtotal, i.Currency))
+		y -= pdfLineHeight
+		for _, l := range i.Taxes.Lines {
+			label := pdfTruncate(fmt.Sprintf("%s (%g%%)", l.Name, l.Percentage), 10, pdfColAmount-100-pdfColDescription)
+			doc.TextRight(pdfColAmount-100, y, pdfFontRegular, 10, label)
+			doc.TextRight(pdfColAmount, y, pdfFontRegular, 10, formatAmount(l.Tax, i.Currency))
+			y -= pdfLineHeight
+		}
+	}
+	doc.TextRight(pdfColAmount-100, y, pdfFontBold, 12, "Total")
+	doc.TextRight(pdfColAmount, y, pdfFontBold, 12, formatAmount(i.Amount, i.Currency))
+	y -= 16
+	if len(credits) > 0 {
+		due := i.Amount
+		for _, cn := range credits {
+			label := fmt.Sprintf("Credit note %d of %s", cn.ID, cn.IssuedAt.Format(tmpl.DateFormat))
+			doc.TextRight(pdfColAmount-100, y, pdfFontRegular, 10, label)
+			doc.TextRight(pdfColAmount, y, pdfFontRegular, 10, formatAmount(-cn.Amount, i.Currency))
+			y -= 16
+			due -= cn.Amount
+		}
+		doc.TextRight(pdfColAmount-100, y, pdfFontBold, 12, "Amount due")
+		doc.TextRight(pdfColAmount, y, pdfFontBold, 12, formatAmount(due, i.Currency))
+		y -= 16
+	}
+	doc.TextRight(pdfColAmount, y, pdfFontRegular, 10, fmt.Sprintf("Due by %s", i.DueDate.Format(tmpl.DateFormat)))
+
+	// footer and page numbers on every page
+	for p := 0; p < doc.PageCount(); p++ {
+		doc.SelectPage(p)
+		for n, line := range tmpl.Footer {
+			doc.Text(pdfMarginLeft, 50-float64(n)*10, pdfFontRegular, 8, line)
+		}
+		doc.TextRight(pdfMarginRight, 50, pdfFontRegular, 8, fmt.Sprintf("Page %d of %d", p+1, doc.PageCount()))
+	}
+	return doc.Bytes()
+}
+
+// getInvoicePDF renders an invoice and its charges into a PDF document
+func (iv *invoicer) getInvoicePDF(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	iv.writeInvoicePDF(w, r, i1)
+	al := appLog{Message: fmt.Sprintf("rendered invoice %d to pdf", i1.ID), Action: "get-invoice-pdf"}
+	al.log(r)
+}
+
+// writeInvoicePDF renders an invoice with its charges, taxes, credit notes
+// and customer, and sends it as PDF
+func (iv *invoicer) writeInvoicePDF(w http.ResponseWriter, r *http.Request, i1 Invoice) {
+	i1.Charges, _ = iv.invoicesFor(r).Charges(i1, 0, 0)
+	i1.Taxes, _ = iv.invoiceTaxes(r, i1)
+	creditNotes, _ := invoiceCreditNotes(iv.dbFor(r), i1.ID)
+	var customer *Customer
+	if i1.CustomerID != 0 {
+		customer = new(Customer)
+		iv.dbFor(r).First(customer, i1.CustomerID)
+	}
+	pdf := renderInvoicePDF(iv.invoiceTemplate, i1, customer, creditNotes)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="invoice-%d.pdf"`, i1.ID))
+	w.WriteHeader(http.StatusOK)
+	w.Write(pdf)
+}
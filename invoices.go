@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	defaultInvoicesPerPage = 50
+	maxInvoicesPerPage     = 500
+)
+
+// invoiceFilters holds the filters that can be applied to invoice listings
+// through query parameters
+type invoiceFilters struct {
+	CustomerID uint
+	Status     string
+	IsPaid     *bool
+	DueAfter   time.Time
+	DueBefore  time.Time
+	PaidAfter  time.Time
+	PaidBefore time.Time
+
+	// IncludeDeleted lists soft deleted invoices along with the others,
+	// OnlyDeleted lists nothing but them
+	IncludeDeleted bool
+	OnlyDeleted    bool
+}
+
+// parseDateParam parses a date given either as RFC3339 or as YYYY-MM-DD
+func parseDateParam(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q in parameter %s, use YYYY-MM-DD or RFC3339", value, name)
+	}
+	return t, nil
+}
+
+// parseInvoiceFilters reads the `customer_id`, `status`, `is_paid`, `due_after`,
+// `due_before`, `paid_after`, `paid_before` and `include_deleted` query
+// parameters of a request
+func parseInvoiceFilters(r *http.Request) (f invoiceFilters, err error) {
+	if r.FormValue("customer_id") != "" {
+		customerID, err := strconv.ParseUint(r.FormValue("customer_id"), 10, 32)
+		if err != nil {
+			return f, fmt.Errorf("invalid customer id %q in parameter customer_id", r.FormValue("customer_id"))
+		}
+		f.CustomerID = uint(customerID)
+	}
+	if r.FormValue("status") != "" {
+		if !validInvoiceStatus(r.FormValue("status")) {
+			return f, fmt.Errorf("invalid status %q in parameter status", r.FormValue("status"))
+		}
+		f.Status = r.FormValue("status")
+	}
+	if r.FormValue("is_paid") != "" {
+		isPaid, err := strconv.ParseBool(r.FormValue("is_paid"))
+		if err != nil {
+			return f, fmt.Errorf("invalid boolean %q in parameter is_paid", r.FormValue("is_paid"))
+		}
+		f.IsPaid = &isPaid
+	}
+	dates := []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"due_after", &f.DueAfter},
+		{"due_before", &f.DueBefore},
+		{"paid_after", &f.PaidAfter},
+		{"paid_before", &f.PaidBefore},
+	}
+	for _, d := range dates {
+		*d.dst, err = parseDateParam(d.name, r.FormValue(d.name))
+		if err != nil {
+			return
+		}
+	}
+	f.IncludeDeleted, err = parseIncludeDeleted(r)
+	return
+}
+
+// apply adds the conditions of the filters to a query on invoices
+func (f invoiceFilters) apply(db *gorm.DB) *gorm.DB {
+	if f.IncludeDeleted || f.OnlyDeleted {
+		db = db.Unscoped()
+	}
+	if f.OnlyDeleted {
+		db = db.Where("deleted_at IS NOT NULL")
+	}
+	if f.CustomerID != 0 {
+		db = db.Where("customer_id = ?", f.CustomerID)
+	}
+	if f.Status != "" {
+		db = db.Where("status = ?", f.Status)
+	}
+	if f.IsPaid != nil {
+		db = db.Where("is_paid = ?", *f.IsPaid)
+	}
+	if !f.DueAfter.IsZero() {
+		db = db.Where("due_date >= ?", f.DueAfter)
+	}
+	if !f.DueBefore.IsZero() {
+		db = db.Where("due_date < ?", f.DueBefore)
+	}
+	if !f.PaidAfter.IsZero() {
+		db = db.Where("payment_date >= ?", f.PaidAfter)
+	}
+	if !f.PaidBefore.IsZero() {
+		db = db.Where("payment_date < ?", f.PaidBefore)
+	}
+	return db
+}
+
+// match returns true if an invoice matches the filters, like apply does
+// in the database
+func (f invoiceFilters) match(i Invoice) bool {
+	if f.OnlyDeleted && i.DeletedAt == nil {
+		return false
+	}
+	if !f.IncludeDeleted && !f.OnlyDeleted && i.DeletedAt != nil {
+		return false
+	}
+	if f.CustomerID != 0 && i.CustomerID != f.CustomerID {
+		return false
+	}
+	if f.Status != "" && i.Status != f.Status {
+		return false
+	}
+	if f.IsPaid != nil && i.IsPaid != *f.IsPaid {
+		return false
+	}
+	if !f.DueAfter.IsZero() && i.DueDate.Before(f.DueAfter) {
+		return false
+	}
+	if !f.DueBefore.IsZero() && !i.DueDate.Before(f.DueBefore) {
+		return false
+	}
+	if !f.PaidAfter.IsZero() && i.PaymentDate.Before(f.PaidAfter) {
+		return false
+	}
+	if !f.PaidBefore.IsZero() && !i.PaymentDate.Before(f.PaidBefore) {
+		return false
+	}
+	return true
+}
+
+type invoicesPage struct {
+	Total    int       `json:"total"`
+	Page     int       `json:"page"`
+	PerPage  int       `json:"per_page"`
+	Invoices []Invoice `json:"invoices"`
+	Next     string    `json:"next,omitempty"`
+	Prev     string    `json:"prev,omitempty"`
+}
+
+// pageLink returns the URL of the given page of the current listing,
+// preserving the filters of the request
+func pageLink(r *http.Request, page, perPage int) string {
+	q := url.Values{}
+	for k, v := range r.URL.Query() {
+		q[k] = v
+	}
+	q.Set("page", strconv.Itoa(page))
+	q.Set("per_page", strconv.Itoa(perPage))
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// getInvoices lists invoices ordered by id, one page at a time. Charges are
+// not included in the listing and must be retrieved per invoice.
+func (iv *invoicer) getInvoices(w http.ResponseWriter, r *http.Request) {
+	filters, err := parseInvoiceFilters(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	iv.listInvoices(w, r, filters)
+}
+
+// listInvoices sends the page of invoices matching filters requested
+// through the `page` and `per_page` parameters
+func (iv *invoicer) listInvoices(w http.ResponseWriter, r *http.Request, filters invoiceFilters) {
+	page, perPage := 1, defaultInvoicesPerPage
+	var err error
+	if r.FormValue("page") != "" {
+		page, err = strconv.Atoi(r.FormValue("page"))
+		if err != nil || page < 1 {
+			httpError(w, r, http.StatusBadRequest, "invalid page parameter %q", r.FormValue("page"))
+			return
+		}
+	}
+	if r.FormValue("per_page") != "" {
+		perPage, err = strconv.Atoi(r.FormValue("per_page"))
+		if err != nil || perPage < 1 || perPage > maxInvoicesPerPage {
+			httpError(w, r, http.StatusBadRequest, "per_page must be between 1 and %d", maxInvoicesPerPage)
+			return
+		}
+	}
+	view, err := parseInvoiceView(r, "charges", "payments", "customer")
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	result := invoicesPage{Page: page, PerPage: perPage}
+	result.Invoices, result.Total, err = iv.findInvoices(r, filters, (page-1)*perPage, perPage)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if page*perPage < result.Total {
+		result.Next = pageLink(r, page+1, perPage)
+	}
+	if page > 1 {
+		result.Prev = pageLink(r, page-1, perPage)
+	}
+	var body interface{} = result
+	if !view.full() {
+		body, err = iv.invoicesView(r, result, view)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "%s", err)
+			return
+		}
+	}
+	writeJSON(w, r, http.StatusOK, body)
+	al := appLog{Message: fmt.Sprintf("listed %d invoices out of %d", len(result.Invoices), result.Total), Action: "get-invoices"}
+	al.log(r)
+}
+
+// invoicesView returns a page of invoices with the fields and related
+// records of a view
+func (iv *invoicer) invoicesView(r *http.Request, page invoicesPage, view invoiceView) (interface{}, error) {
+	result := struct {
+		invoicesPage
+		Invoices []json.RawMessage `json:"invoices"`
+	}{page, []json.RawMessage{}}
+	related, err := iv.invoiceRelations(r, page.Invoices, view)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range page.Invoices {
+		if view.wantsCharges(false) {
+			err = iv.attachCharges(r, &i)
+			if err != nil {
+				return nil, err
+			}
+		}
+		body, err := view.render(i, related[i.ID])
+		if err != nil {
+			return nil, fmt.Errorf("failed to render invoice %d: %s", i.ID, err)
+		}
+		result.Invoices = append(result.Invoices, body)
+	}
+	return result, nil
+}
+
+// applyInvoicePatch merges the fields of a JSON merge patch into an invoice.
+// A null value resets the field to its zero value. Unknown and read-only
+// fields are rejected.
+func applyInvoicePatch(i *Invoice, patch map[string]json.RawMessage) error {
+	for field, raw := range patch {
+		var dst interface{}
+		switch field {
+		case "status":
+			dst = &i.Status
+		case "is_paid":
+			dst = &i.IsPaid
+		case "amount":
+			dst = &i.Amount
+		case "amount_override":
+			dst = &i.AmountOverride
+		case "payment_date":
+			dst = &i.PaymentDate
+		case "due_date":
+			dst = &i.DueDate
+		case "customer_id":
+			dst = &i.CustomerID
+		case "charges":
+			dst = &i.Charges
+		default:
+			return fmt.Errorf("field %q cannot be patched", field)
+		}
+		if string(raw) == "null" {
+			// reset the field pointed to by dst to its zero value
+			switch v := dst.(type) {
+			case *string:
+				*v = ""
+			case *bool:
+				*v = false
+			case *int:
+				*v = 0
+			case *uint:
+				*v = 0
+			case *time.Time:
+				*v = time.Time{}
+			case *[]Charge:
+				*v = []Charge{}
+			}
+			continue
+		}
+		err := json.Unmarshal(raw, dst)
+		if err != nil {
+			return fmt.Errorf("invalid value for field %q: %s", field, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	jobReminderEmail   = "reminder_email"
+	jobReminderWebhook = "reminder_webhook"
+
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobSkipped = "skipped"
+	jobFailed  = "failed"
+
+	// jobs are retried with an exponential backoff starting at
+	// jobRetryDelay, and abandoned after maxJobAttempts
+	maxJobAttempts   = 5
+	jobRetryDelay    = time.Minute
+	jobPollInterval  = 5 * time.Second
+	jobBatch         = 100
+	jobStaleAfter    = 10 * time.Minute
+	defaultJobsLimit = 100
+	maxJobsLimit     = 1000
+)
+
+var jobStatuses = []string{jobPending, jobRunning, jobDone, jobSkipped, jobFailed}
+
+// Job is a task queued for the job workers. Jobs are stored so they
+// survive restarts and are shared by every instance of the invoicer, each
+// job being claimed by one of them. A job is only queued once for its
+// unique key.
+type Job struct {
+	gorm.Model
+	Kind      string    `json:"kind"`
+	InvoiceID uint      `gorm:"index" json:"invoice_id"`
+	DaysLate  int       `json:"days_late"`
+	UniqueKey string    `gorm:"unique_index" json:"-"`
+	Status    string    `gorm:"index" json:"status"`
+	Attempts  int       `json:"attempts"`
+	RunAt     time.Time `gorm:"index" json:"run_at"`
+	LastError string    `gorm:"type:text" json:"last_error"`
+}
+
+// errSkipJob ends a job that no longer needs to run, such as the reminder
+// of an invoice paid since it was queued
+type errSkipJob struct {
+	reason string
+}
+
+func (e errSkipJob) Error() string {
+	return e.reason
+}
+
+// enqueueJob queues a job unless one with the same unique key already
+// exists, and returns true if it was queued
+func (iv *invoicer) enqueueJob(j Job) (bool, error) {
+	j.Status = jobPending
+	if j.RunAt.IsZero() {
+		j.RunAt = time.Now().UTC()
+	}
+	var count int
+	err := iv.db.Model(&Job{}).Where("unique_key = ?", j.UniqueKey).Count(&count).Error
+	if err != nil || count > 0 {
+		return false, err
+	}
+	// another instance may queue the same job in the meantime, the unique
+	// index keeps only one of them and the violation isn't worth logging
+	if iv.db.New().LogMode(false).Create(&j).Error != nil {
+		return false, nil
+	}
+	select {
+	case iv.jobWakeup <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// scheduleReminders queues the reminders of overdue invoices that reached
+// one of the reminder days since their due date
+func (iv *invoicer) scheduleReminders(now time.Time, days []int) (int, error) {
+	kinds := []string{jobReminderWebhook}
+	if iv.mailer != nil {
+		kinds = append(kinds, jobReminderEmail)
+	}
+	return iv.scheduleOverdueJobs(now, days, kinds)
+}
+
+// scheduleOverdueJobs queues jobs of kinds for the overdue invoices that
+// reached one of days since their due date. Only the job of the last day
+// reached is queued, so invoices found late by many days aren't handled
+// several times at once.
+func (iv *invoicer) scheduleOverdueJobs(now time.Time, days []int, kinds []string) (int, error) {
+	if len(days) == 0 {
+		return 0, nil
+	}
+	var invoices []Invoice
+	err := iv.db.Where("status = ? AND due_date <= ?", statusOverdue, now.Add(-time.Duration(days[0])*24*time.Hour)).
+		Find(&invoices).Error
+	if err != nil {
+		return 0, err
+	}
+	queued := 0
+	for _, i := range invoices {
+		late := int(now.Sub(i.DueDate) / (24 * time.Hour))
+		step := 0
+		for _, d := range days {
+			if d <= late {
+				step = d
+			}
+		}
+		for _, kind := range kinds {
+			ok, err := iv.enqueueJob(Job{
+				Kind:      kind,
+				InvoiceID: i.ID,
+				DaysLate:  step,
+				UniqueKey: fmt.Sprintf("%s:%d:%d", kind, i.ID, step),
+			})
+			if err != nil {
+				return queued, err
+			}
+			if ok {
+				queued++
+			}
+		}
+	}
+	return queued, nil
+}
+
+// processJobs runs the jobs that are due whenever enqueueJob queues new
+// ones, and regularly to retry failed ones
+func (iv *invoicer) processJobs() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-iv.jobWakeup:
+		case <-ticker.C:
+		}
+		now := time.Now().UTC()
+		// jobs left running by an instance that stopped are run again
+		err := iv.db.Model(&Job{}).Where("status = ? AND updated_at < ?", jobRunning, now.Add(-jobStaleAfter)).
+			Update("status", jobPending).Error
+		if err != nil {
+			applog.errorf("failed to requeue stale jobs: %s", err)
+		}
+		var jobs []Job
+		err = iv.db.Where("status = ? AND run_at <= ?", jobPending, now).Order("run_at asc").Limit(jobBatch).Find(&jobs).Error
+		if err != nil {
+			applog.errorf("failed to retrieve pending jobs: %s", err)
+			continue
+		}
+		for _, j := range jobs {
+			// claiming the job fails if another instance claimed it first
+			res := iv.db.Model(&Job{}).Where("id = ? AND status = ?", j.ID, jobPending).
+				Updates(map[string]interface{}{"status": jobRunning, "updated_at": time.Now().UTC()})
+			if res.Error != nil || res.RowsAffected != 1 {
+				continue
+			}
+			iv.runJob(j)
+		}
+	}
+}
+
+// runJob runs a claimed job and records its outcome, scheduling a retry on
+// failure
+func (iv *invoicer) runJob(j Job) {
+	err := iv.executeJob(j)
+	j.Attempts++
+	updates := map[string]interface{}{"status": jobDone, "attempts": j.Attempts, "last_error": ""}
+	if skip, ok := err.(errSkipJob); ok {
+		updates["status"], updates["last_error"] = jobSkipped, skip.reason
+	} else if err != nil {
+		updates["last_error"] = err.Error()
+		if j.Attempts >= maxJobAttempts {
+			updates["status"] = jobFailed
+			applog.errorf("giving up on job %d %s of invoice %d after %d attempts: %s", j.ID, j.Kind, j.InvoiceID, j.Attempts, err)
+		} else {
+			updates["status"] = jobPending
+			updates["run_at"] = time.Now().UTC().Add(jobRetryDelay << uint(j.Attempts-1))
+		}
+	}
+	err = iv.db.Model(&j).Updates(updates).Error
+	if err != nil {
+		applog.errorf("failed to record outcome of job %d: %s", j.ID, err)
+	}
+}
+
+func (iv *invoicer) executeJob(j Job) error {
+	if j.Kind == jobRetention {
+		return iv.applyRetention(time.Now().UTC())
+	}
+	i1, err := iv.invoices.Get(j.InvoiceID, false)
+	if err == errInvoiceNotFound {
+		return errSkipJob{"invoice was deleted"}
+	}
+	if err != nil {
+		return err
+	}
+	if i1.Status != statusOverdue {
+		return errSkipJob{fmt.Sprintf("invoice is %s", i1.Status)}
+	}
+	if strings.HasPrefix(j.Kind, jobNotifyPrefix) {
+		return iv.notifyOverdue(j, i1)
+	}
+	switch j.Kind {
+	case jobReminderWebhook:
+		iv.queueWebhooks(webhookPayload{Event: eventInvoiceReminder, CreatedAt: time.Now().UTC(), Invoice: i1, DaysLate: j.DaysLate})
+		return nil
+	case jobReminderEmail:
+		if iv.mailer == nil {
+			return errSkipJob{"smtp.host is not configured"}
+		}
+		var customer Customer
+		if i1.CustomerID != 0 {
+			iv.db.First(&customer, i1.CustomerID)
+		}
+		addr, err := mail.ParseAddress(customer.Email)
+		if err != nil {
+			return errSkipJob{"invoice has no customer with a valid email address"}
+		}
+		i1.Charges, err = iv.invoices.Charges(i1, 0, 0)
+		if err != nil {
+			return err
+		}
+		d, err := iv.emailInvoice(i1, &customer, addr.Address, true, j.DaysLate)
+		if err != nil {
+			return err
+		}
+		applog.infof("reminded %s of invoice %d, %d days late, delivery %d", addr.Address, i1.ID, j.DaysLate, d.ID)
+		return nil
+	}
+	return errSkipJob{fmt.Sprintf("unknown job kind %q", j.Kind)}
+}
+
+type jobsReport struct {
+	Counts map[string]int `json:"counts"`
+	Jobs   []Job          `json:"jobs"`
+}
+
+// getAdminJobs lists the most recent jobs, filtered by the `status`, `kind`
+// and `invoice_id` parameters, along with the number of jobs in each
+// status
+func (iv *invoicer) getAdminJobs(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	query := iv.dbFor(r).Model(&Job{})
+	if status := r.FormValue("status"); status != "" {
+		known := false
+		for _, s := range jobStatuses {
+			known = known || s == status
+		}
+		if !known {
+			httpError(w, r, http.StatusBadRequest, "invalid status %q, must be one of %s", status, strings.Join(jobStatuses, ", "))
+			return
+		}
+		query = query.Where("status = ?", status)
+	}
+	if kind := r.FormValue("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	if r.FormValue("invoice_id") != "" {
+		id, err := strconv.Atoi(r.FormValue("invoice_id"))
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "invalid invoice_id %q", r.FormValue("invoice_id"))
+			return
+		}
+		query = query.Where("invoice_id = ?", id)
+	}
+	limit := defaultJobsLimit
+	if r.FormValue("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 1 || limit > maxJobsLimit {
+			httpError(w, r, http.StatusBadRequest, "limit must be between 1 and %d", maxJobsLimit)
+			return
+		}
+	}
+	report := jobsReport{Counts: make(map[string]int), Jobs: []Job{}}
+	err := query.Order("id desc").Limit(limit).Find(&report.Jobs).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve jobs: %s", err)
+		return
+	}
+	var counts []struct {
+		Status string
+		Count  int
+	}
+	err = iv.dbFor(r).Model(&Job{}).Select("status, COUNT(*) AS count").Group("status").Scan(&counts).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to count jobs: %s", err)
+		return
+	}
+	for _, s := range jobStatuses {
+		report.Counts[s] = 0
+	}
+	for _, c := range counts {
+		report.Counts[c.Status] = c.Count
+	}
+	writeJSON(w, r, http.StatusOK, report)
+}
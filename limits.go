@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+)
+
+const ctxBodyLimit = "bodyLimit"
+
+// limitBodies caps the size of request bodies, so clients cannot exhaust
+// the memory of the invoicer. Requests announcing a larger body are refused
+// with a 413 before it is read, and reading past the limit fails. Imports
+// and bulk appends of charges get the larger import limit, while uploads of
+// attachments and receipts and gRPC calls bound their own bodies.
+func limitBodies(limits config.Limits) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := int64(limits.MaxBodySize)
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/invoicer.Invoicer/"),
+				strings.HasSuffix(r.URL.Path, "/attachments"), strings.HasSuffix(r.URL.Path, "/receipt"):
+				h.ServeHTTP(w, r)
+				return
+			case r.URL.Path == "/invoices/import", strings.HasSuffix(r.URL.Path, "/charges/bulk"):
+				limit = int64(limits.MaxImportBodySize)
+			}
+			if r.ContentLength > limit {
+				httpError(w, r, http.StatusRequestEntityTooLarge, "request body of %d bytes exceeds the limit of %d bytes", r.ContentLength, limit)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			h.ServeHTTP(w, addtoContext(r, ctxBodyLimit, limit))
+		})
+	}
+}
+
+// bodyTooLarge returns true if an error comes from reading a body past its
+// limit. The error of http.MaxBytesReader has no type before Go 1.19, and
+// is wrapped in the errors of the CSV reader.
+func bodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// decodeJSONBody parses the JSON body of a request into v. Fields that v
+// doesn't have are refused instead of being silently dropped.
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	return err
+}
+
+// writeBodyError sends the error of reading or parsing a request body: a
+// 413 if it is too large, a 422 naming the field if it has an unknown
+// field, and a 400 otherwise
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if bodyTooLarge(err) {
+		limit, _ := r.Context().Value(ctxBodyLimit).(int64)
+		httpError(w, r, http.StatusRequestEntityTooLarge, "request body exceeds the limit of %d bytes", limit)
+		return
+	}
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		field, uerr := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		if uerr == nil {
+			var errs validationErrors
+			errs.add(field, "is not a known field")
+			writeValidationErrors(w, r, errs)
+			return
+		}
+	}
+	httpError(w, r, http.StatusBadRequest, "failed to parse request body: %s", err)
+}
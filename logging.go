@@ -2,45 +2,275 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/auth"
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+)
+
+// logLevel is the severity of a log entry
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for l, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return logLevel(l), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q, must be one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+const (
+	// logFormatJSON writes one JSON object per line, for log collectors
+	logFormatJSON = "json"
+	// logFormatConsole writes human readable lines, for development
+	logFormatConsole = "console"
+)
+
+// logFields are the key value pairs attached to log entries
+type logFields map[string]interface{}
+
+// logOutput is shared by a logger and the loggers derived from it
+type logOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  logLevel
+}
+
+// logger writes structured log entries at or above the level of its output.
+// Loggers derived with `with` add their fields to every entry they write.
+type logger struct {
+	out    *logOutput
+	fields logFields
+}
+
+// applog is the logger of the invoicer, configured by configureLogging.
+// Request handlers log through requestLogger instead, which carries the
+// fields of the request.
+var applog = newLogger(os.Stdout, logFormatJSON, levelInfo)
+
+func newLogger(w io.Writer, format string, level logLevel) *logger {
+	return &logger{out: &logOutput{w: w, format: format, level: level}}
+}
+
+// configureLogging sets the format and the level of applog, which writes to
+// w, and sends the output of the standard log package to it
+func configureLogging(cfg config.Logging, w io.Writer) error {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	applog = newLogger(w, cfg.Format, level)
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{applog})
+	return nil
+}
+
+// with returns a logger adding fields to those of l
+func (l *logger) with(fields logFields) *logger {
+	merged := make(logFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &logger{out: l.out, fields: merged}
+}
+
+func (l *logger) enabled(level logLevel) bool {
+	return level >= l.out.level
+}
+
+// log writes an entry with the fields of the logger and the given ones
+func (l *logger) log(level logLevel, msg string, fields logFields) {
+	if !l.enabled(level) {
+		return
+	}
+	entry := make(logFields, len(l.fields)+len(fields)+3)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	now := time.Now().UTC()
+	var line []byte
+	if l.out.format == logFormatConsole {
+		line = consoleLogLine(now, level, msg, entry)
+	} else {
+		entry["time"], entry["level"], entry["msg"] = now.Format(time.RFC3339Nano), level.String(), msg
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			line, _ = json.Marshal(logFields{"time": entry["time"], "level": entry["level"], "msg": msg,
+				"log_error": err.Error()})
+		}
+		line = append(line, '\n')
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(line)
+}
+
+// consoleLogLine formats an entry as its time, level and message followed by
+// its fields sorted by name
+func consoleLogLine(now time.Time, level logLevel, msg string, fields logFields) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", now.Format("2006-01-02T15:04:05.000Z07:00"), strings.ToUpper(level.String()), msg)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := fmt.Sprintf("%v", fields[k])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, v)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func (l *logger) debugf(format string, args ...interface{}) {
+	l.log(levelDebug, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *logger) infof(format string, args ...interface{}) {
+	l.log(levelInfo, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *logger) warnf(format string, args ...interface{}) {
+	l.log(levelWarn, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *logger) errorf(format string, args ...interface{}) {
+	l.log(levelError, fmt.Sprintf(format, args...), nil)
+}
+
+// fatalf logs an error and exits
+func (l *logger) fatalf(format string, args ...interface{}) {
+	l.errorf(format, args...)
+	os.Exit(1)
+}
+
+// stdLogWriter sends the lines written by the standard log package, used by
+// some dependencies, to a logger
+type stdLogWriter struct {
+	l *logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.l.infof("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+const (
+	ctxLogger    = "logger"
+	ctxAccessLog = "accessLog"
 )
 
+// requestLogger returns the logger of a request, which carries its id,
+// method, path and actor, or applog outside of requests
+func requestLogger(r *http.Request) *logger {
+	if r != nil {
+		if l, ok := r.Context().Value(ctxLogger).(*logger); ok {
+			return l
+		}
+	}
+	return applog
+}
+
+// accessLog collects what is only known once a request is served, to log
+// it when it completes
 type accessLog struct {
-	Type          string `json:"type"`
-	XForwardedFor string `json:"x-forwarded-for"`
-	Method        string `json:"method"`
-	Proto         string `json:"proto"`
-	URL           string `json:"url"`
-	UserAgent     string `json:"user-agent"`
-	RequestID     string `json:"rid"`
+	status int
+	actor  string
 }
 
-func (al *accessLog) String() string {
-	al.Type = "request"
-	msg, _ := json.Marshal(al)
-	return string(msg)
+// statusRecorder records the status sent by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	log *accessLog
 }
 
-type appLog struct {
-	Type      string `json:"type"`
-	RequestID string `json:"rid"`
-	Message   string `json:"msg"`
-	ErrorCode int    `json:"error-code"`
-	User      string `json:"user,omitempty"`
-	Action    string `json:"action,omitempty"`
+func (w statusRecorder) WriteHeader(status int) {
+	if w.log.status == 0 {
+		w.log.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w statusRecorder) Write(b []byte) (int, error) {
+	if w.log.status == 0 {
+		w.log.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
 }
 
-func (al *appLog) String() string {
-	msg, _ := json.Marshal(al)
-	return string(msg)
+// Flush lets handlers stream their responses, such as gRPC ones
+func (w statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// actorOf names the user or API key authenticated on a request
+func actorOf(r *http.Request) string {
+	if id, ok := apiKeyFromContext(r); ok {
+		return fmt.Sprintf("api-key:%d", id)
+	}
+	if user, ok := auth.UserFromContext(r.Context()); ok {
+		return user
+	}
+	return ""
 }
 
+type appLog struct {
+	Message   string
+	ErrorCode int
+	Action    string
+}
+
+// log writes an application event through the logger of the request, which
+// carries the actor. Events carrying an error code are logged as warnings
+// for client errors and as errors for server errors.
 func (al *appLog) log(r *http.Request) {
-	al.Type = "action"
-	val := r.Context().Value(ctxReqID)
-	if val != nil {
-		al.RequestID = val.(string)
+	fields := logFields{}
+	if al.Action != "" {
+		fields["action"] = al.Action
+	}
+	level := levelInfo
+	if al.ErrorCode != 0 {
+		fields["error_code"] = al.ErrorCode
+		level = levelWarn
+		if al.ErrorCode >= http.StatusInternalServerError {
+			level = levelError
+		}
 	}
-	log.Printf("%s", al.String())
+	requestLogger(r).log(level, al.Message, fields)
 }
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	mailSent   = "sent"
+	mailFailed = "failed"
+
+	defaultMailSubject = `{{if .DaysLate}}Reminder: {{end}}{{.Company.CompanyName}} invoice {{.Invoice.InvoiceNumber}} of {{.Total}}`
+	defaultMailBody    = `<html>
+<body>
+<p>Hello{{if .Customer}} {{.Customer.Name}}{{end}},</p>
+<p>Please find below invoice {{.Invoice.InvoiceNumber}} from {{.Company.CompanyName}}, due by {{.DueDate}}.</p>
+{{if .DaysLate}}<p>This invoice is {{.DaysLate}} days past due, please arrange its payment.</p>
+{{end}}<table>
+{{range .Charges}}<tr><td>{{.Type}}</td><td>{{.Description}}</td><td align="right">{{.Amount}}</td></tr>
+{{end}}<tr><td colspan="2"><b>Total</b></td><td align="right"><b>{{.Total}}</b></td></tr>
+</table>
+{{range .Company.Footer}}<p><small>{{.}}</small></p>
+{{end}}</body>
+</html>
+`
+)
+
+// Delivery records an attempt to email an invoice
+type Delivery struct {
+	gorm.Model
+	InvoiceID  uint   `gorm:"index" json:"invoice_id"`
+	Recipient  string `json:"recipient"`
+	Subject    string `json:"subject"`
+	Attachment bool   `json:"attachment"`
+	Status     string `json:"status"`
+	Error      string `json:"error"`
+}
+
+// mailTemplates render the subject and HTML body of invoice emails. They
+// are loaded from the subject.txt and invoice.html files of the directory
+// set in INVOICER_MAIL_TEMPLATES, the defaults being used for missing files.
+type mailTemplates struct {
+	subject *texttemplate.Template
+	body    *htmltemplate.Template
+}
+
+func loadMailTemplates(dir string) (t mailTemplates, err error) {
+	subject, body := defaultMailSubject, defaultMailBody
+	if dir != "" {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, "subject.txt")); err == nil {
+			subject = strings.TrimSpace(string(data))
+		} else if !os.IsNotExist(err) {
+			return t, err
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(dir, "invoice.html")); err == nil {
+			body = string(data)
+		} else if !os.IsNotExist(err) {
+			return t, err
+		}
+	}
+	t.subject, err = texttemplate.New("subject").Parse(subject)
+	if err != nil {
+		return t, fmt.Errorf("failed to parse mail subject template: %s", err)
+	}
+	t.body, err = htmltemplate.New("invoice").Parse(body)
+	if err != nil {
+		return t, fmt.Errorf("failed to parse mail body template: %s", err)
+	}
+	return t, nil
+}
+
+type mailCharge struct {
+	Type        string
+	Description string
+	Amount      string
+}
+
+// mailData is what mail templates are executed with
+type mailData struct {
+	Invoice  Invoice
+	Customer *Customer
+	Company  invoiceTemplate
+	Charges  []mailCharge
+	Total    string
+	DueDate  string
+	// DaysLate is set in reminders of overdue invoices
+	DaysLate int
+}
+
+func (t mailTemplates) render(data mailData) (subject, body string, err error) {
+	var buf bytes.Buffer
+	if err = t.subject.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	// headers cannot span lines
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+	buf.Reset()
+	if err = t.body.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	return subject, buf.String(), nil
+}
+
+type mailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+type mailMessage struct {
+	From        string
+	To          string
+	Subject     string
+	HTML        string
+	Attachments []mailAttachment
+}
+
+// Bytes encodes a message as MIME, with its attachments in a
+// multipart/mixed body
+func (m mailMessage) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write([]byte(m.HTML))
+	qp.Close()
+
+	for _, a := range m.Attachments {
+		part, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf(`attachment; filename="%s"`, a.Filename)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// base64 lines must not exceed 76 characters
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	err = mw.Close()
+	return buf.Bytes(), err
+}
+
+// mailer sends emails
+type mailer interface {
+	Send(m mailMessage) error
+}
+
+// smtpMailer sends emails through an SMTP relay, using STARTTLS when the
+// relay supports it
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// Send implements mailer
+func (s smtpMailer) Send(m mailMessage) error {
+	m.From = s.from
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(s.from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, from.Address, []string{m.To}, msg)
+}
+
+// newMailer sends emails through the SMTP relay of the configuration. It
+// returns a nil mailer if smtp.host is not set.
+func newMailer(cfg config.SMTP) mailer {
+	if cfg.Host == "" {
+		return nil
+	}
+	s := smtpMailer{addr: cfg.Addr(), from: cfg.From}
+	if cfg.Username != "" {
+		s.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	return s
+}
+
+// postInvoiceSend emails an invoice to its customer, or to the address in
+// `to`, with the invoice attached as a PDF unless `attach_pdf` is false.
+// Drafts are marked as sent once the email is accepted by the relay.
+func (iv *invoicer) postInvoiceSend(w http.ResponseWriter, r *http.Request) {
+	if iv.mailer == nil {
+		httpError(w, r, http.StatusServiceUnavailable, "sending invoices requires smtp.host to be configured")
+		return
+	}
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	params := struct {
+		To        string `json:"to"`
+		AttachPDF bool   `json:"attach_pdf"`
+	}{AttachPDF: true}
+	if r.ContentLength != 0 && !readJSONBody(w, r, &params) {
+		return
+	}
+	i1.Charges, _ = iv.invoicesFor(r).Charges(i1, 0, 0)
+	var customer *Customer
+	if i1.CustomerID != 0 {
+		customer = new(Customer)
+		iv.dbFor(r).First(customer, i1.CustomerID)
+	}
+	if params.To == "" && customer != nil {
+		params.To = customer.Email
+	}
+	var errs validationErrors
+	if params.To == "" {
+		errs.add("to", "must be set when the invoice has no customer with an email address")
+	} else if addr, err := mail.ParseAddress(params.To); err != nil {
+		errs.add("to", "invalid email address %q", params.To)
+	} else {
+		params.To = addr.Address
+	}
+	if i1.Status == statusCancelled {
+		errs.add("status", "cancelled invoices cannot be sent")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	d, err := iv.emailInvoice(i1, customer, params.To, params.AttachPDF, 0)
+	if err != nil {
+		httpError(w, r, http.StatusBadGateway, "failed to email invoice %d to %s: %s", i1.ID, params.To, err)
+		return
+	}
+	if i1.Status == statusDraft {
+		before := iv.invoiceSnapshot(i1.ID)
+		previous := i1
+		iv.invoicesFor(r).SetStatus(&i1, statusSent)
+		iv.audit(r, "status", i1.ID, before, iv.invoiceSnapshot(i1.ID))
+		iv.fireInvoiceUpdated(previous, i1)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("sent invoice %d to %s", i1.ID, html.EscapeString(params.To))))
+	al := appLog{Message: fmt.Sprintf("emailed invoice %d to %s, delivery %d", i1.ID, params.To, d.ID), Action: "post-invoice-send"}
+	al.log(r)
+}
+
+// emailInvoice renders an invoice with its charges into an email, sends it
+// to a recipient and records the delivery. Reminders of overdue invoices
+// set daysLate, which templates can mention.
+func (iv *invoicer) emailInvoice(i1 Invoice, customer *Customer, to string, attachPDF bool, daysLate int) (Delivery, error) {
+	data := mailData{
+		Invoice:  i1,
+		Customer: customer,
+		Company:  iv.invoiceTemplate,
+		Total:    formatAmount(i1.Amount, i1.Currency),
+		DueDate:  i1.DueDate.Format(iv.invoiceTemplate.DateFormat),
+		DaysLate: daysLate,
+	}
+	for _, c := range i1.Charges {
+		data.Charges = append(data.Charges, mailCharge{Type: c.Type, Description: c.Description, Amount: formatAmount(c.Amount, c.Currency)})
+	}
+	d := Delivery{InvoiceID: i1.ID, Recipient: to, Attachment: attachPDF}
+	subject, body, err := iv.mailTemplates.render(data)
+	if err != nil {
+		return d, fmt.Errorf("failed to render email: %s", err)
+	}
+	d.Subject = subject
+	msg := mailMessage{To: to, Subject: subject, HTML: body}
+	if attachPDF {
+		creditNotes, _ := invoiceCreditNotes(iv.db, i1.ID)
+		msg.Attachments = append(msg.Attachments, mailAttachment{
+			Filename:    fmt.Sprintf("invoice-%d.pdf", i1.ID),
+			ContentType: "application/pdf",
+			Data:        renderInvoicePDF(iv.invoiceTemplate, i1, customer, creditNotes),
+		})
+	}
+	d.Status = mailSent
+	err = iv.mailer.Send(msg)
+	if err != nil {
+		d.Status, d.Error = mailFailed, err.Error()
+	}
+	iv.db.Create(&d)
+	return d, err
+}
+
+// getInvoiceDeliveries lists the attempts to email an invoice
+func (iv *invoicer) getInvoiceDeliveries(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	var deliveries []Delivery
+	err := iv.dbFor(r).Where("invoice_id = ?", i1.ID).Order("id asc").Find(&deliveries).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve deliveries of invoice %d: %s", i1.ID, err)
+		return
+	}
+	for n := range deliveries {
+		deliveries[n].Recipient = html.EscapeString(deliveries[n].Recipient)
+		deliveries[n].Subject = html.EscapeString(deliveries[n].Subject)
+		deliveries[n].Error = html.EscapeString(deliveries[n].Error)
+	}
+	writeJSON(w, r, http.StatusOK, deliveries)
+}
@@ -8,293 +8,636 @@ package main
 //go:generate ./version.sh
 
 import (
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"html"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/Wolverinever1/invoicer-chapter2/auth"
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/wader/gormstore"
-	"go.mozilla.org/mozlog"
 )
 
-func init() {
-	// initialize the logger
-	mozlog.Logger.LoggerName = "invoicer"
-	log.SetFlags(0)
+type invoicer struct {
+	db              *gorm.DB
+	invoices        InvoiceStore
+	store           *gormstore.Store
+	authenticator   *auth.Authenticator
+	invoiceTemplate invoiceTemplate
+	webhookWakeup   chan struct{}
+	jobWakeup       chan struct{}
+	exchangeRates   exchangeRateProvider
+	mailer          mailer
+	mailTemplates   mailTemplates
+	stripe          *stripeClient
+	invoiceCache    *invoiceCache
+	attachments     *attachmentStore
+	webTemplates    webTemplates
+	events          *eventHub
+	notifyChannels  []notifyChannel
+	// maxCharges is the number of charges an invoice can have
+	maxCharges int
+	// graphql is the schema of the GraphQL API, whose queries are bounded
+	// by graphqlLimits
+	graphql       *gqlSchema
+	graphqlLimits gqlLimits
+	// retention erases and archives old invoices, when enabled
+	retention retentionPolicy
+	// duplicateWindowDays is the number of days between the due dates of
+	// likely duplicates, 0 if creating invoices doesn't warn of them
+	duplicateWindowDays int
 }
 
-type invoicer struct {
-	db    *gorm.DB
-	store *gormstore.Store
+// openDB connects to the configured database and sizes its connection pool
+func openDB(cfg config.Database) (*gorm.DB, error) {
+	driver, dsn := cfg.Source()
+	if driver == "mysql" {
+		// times are scanned into time.Time and stored in UTC, like the
+		// other drivers do
+		mycfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mysql DSN: %s", err)
+		}
+		mycfg.ParseTime, mycfg.Loc = true, time.UTC
+		dsn = mycfg.FormatDSN()
+	}
+	applog.infof("opening %s connection", driver)
+	db, err := gorm.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.DB().SetMaxOpenConns(cfg.MaxOpenConns)
+	db.DB().SetMaxIdleConns(cfg.MaxIdleConns)
+	db.DB().SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	return db, nil
+}
+
+// openStore applies the settings shared by the server and the admin
+// commands, and connects to the configured database
+func openStore(cfg config.Config) (*gorm.DB, error) {
+	admins = cfg.Auth.Admins
+	defaultRole = cfg.Auth.DefaultRole
+	err := setEncryptionKeys(cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	if !validCurrency(defaultCurrency()) {
+		return nil, fmt.Errorf("invalid INVOICER_DEFAULT_CURRENCY %q, must be an ISO 4217 currency code", defaultCurrency())
+	}
+	err = setInvoiceNumberFormat(cfg.Invoices.NumberFormat)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openDB(cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect database: %s", err)
+	}
+	return db, nil
 }
 
 func main() {
+	command, args := commandOf(os.Args[1:])
+	if command != "serve" {
+		runAdminCommand(command, args)
+		return
+	}
 	var (
 		iv  invoicer
 		err error
 	)
-	var db *gorm.DB
-	if os.Getenv("INVOICER_USE_POSTGRES") != "" {
-		log.Println("Opening postgres connection")
-		db, err = gorm.Open("postgres", fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s",
-			os.Getenv("INVOICER_POSTGRES_USER"),
-			os.Getenv("INVOICER_POSTGRES_PASSWORD"),
-			os.Getenv("INVOICER_POSTGRES_HOST"),
-			os.Getenv("INVOICER_POSTGRES_DB"),
-			os.Getenv("INVOICER_POSTGRES_SSLMODE"),
-		))
-	} else {
-		log.Println("Opening sqlite connection")
-		db, err = gorm.Open("sqlite3", "invoicer.db")
+	cfg, migrate, reencrypt, err := loadConfig(args)
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
+	err = configureLogging(cfg.Logging, os.Stdout)
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
+	setCSRFKeys(cfg.CSRF)
+	setShareKeys(cfg.Share)
+	db, err := openStore(cfg)
+	if err != nil {
+		applog.fatalf("%s", err)
 	}
+	if migrate != "" {
+		err = runMigrateCommand(db, migrate)
+		db.Close()
+		if err != nil {
+			applog.fatalf("%s", err)
+		}
+		return
+	}
+	if reencrypt {
+		err = reencryptColumns(db)
+		db.Close()
+		if err != nil {
+			applog.fatalf("%s", err)
+		}
+		return
+	}
+	err = migrateUp(db)
 	if err != nil {
-		panic("failed to connect database")
+		applog.fatalf("%s", err)
 	}
 
+	tracer, err := newTracer()
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
+	iv.invoiceCache = newInvoiceCache(cfg.Invoices)
+	// the callbacks are registered once, on those gorm gives every handle
+	// it opens, so db and the handles of requests share them and they
+	// don't change while requests are served
+	if tracer != nil {
+		traceQueries(gorm.DefaultCallback)
+	}
+	if iv.invoiceCache != nil {
+		iv.invoiceCache.invalidateOnWrites(gorm.DefaultCallback)
+	}
+	if fieldKeys != nil {
+		encryptColumns(gorm.DefaultCallback, fieldKeys)
+	}
 	iv.db = db
-	iv.db.AutoMigrate(&Invoice{}, &Charge{})
+	iv.invoices = newGormInvoiceStore(db)
+	iv.maxCharges = cfg.Limits.MaxChargesPerInvoice
+	iv.graphql = iv.graphqlSchema()
+	iv.graphqlLimits = gqlLimits{MaxDepth: cfg.Limits.MaxGraphQLDepth, MaxComplexity: cfg.Limits.MaxGraphQLComplexity}
+	iv.invoiceTemplate, err = loadInvoiceTemplate(os.Getenv("INVOICER_INVOICE_TEMPLATE"))
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
+	iv.mailTemplates, err = loadMailTemplates(os.Getenv("INVOICER_MAIL_TEMPLATES"))
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
+	iv.webTemplates, err = loadWebTemplates(os.Getenv("INVOICER_WEB_TEMPLATES"))
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
+	iv.mailer = newMailer(cfg.SMTP)
+	iv.stripe = newStripeClient(cfg.Stripe)
+	iv.exchangeRates, err = newExchangeRateProvider()
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
+	iv.attachments = newAttachmentStore(cfg.Attachments)
+	days, _ := config.Days(cfg.Invoices.ReminderDays)
+	iv.notifyChannels = notifyChannels(cfg.Notify, cfg.SMTP)
+	iv.duplicateWindowDays, _ = config.Day(cfg.Invoices.DuplicateWindowDays)
+	iv.retention = newRetentionPolicy(cfg.Retention)
+	iv.jobWakeup = make(chan struct{}, 1)
+	iv.events = newEventHub(cfg.Server.WriteTimeout)
+	go iv.processJobs()
+	go iv.watchOverdueInvoices(envDuration("INVOICER_OVERDUE_CHECK_INTERVAL", defaultOverdueCheckInterval), days)
+	go iv.watchRecurringInvoices(envDuration("INVOICER_RECURRING_CHECK_INTERVAL", defaultRecurringCheckInterval))
+	if iv.retention.enabled() {
+		go iv.watchRetention(cfg.Retention.CheckInterval)
+	}
+	iv.webhookWakeup = make(chan struct{}, 1)
+	go iv.dispatchWebhooks()
 
 	// register routes
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
 	r.HandleFunc("/", iv.getIndex).Methods("GET")
 	r.HandleFunc("/__heartbeat__", getHeartbeat).Methods("GET")
+	r.HandleFunc("/__lbheartbeat__", iv.getLBHeartbeat).Methods("GET")
+	r.HandleFunc("/invoices", iv.getInvoices).Methods("GET")
+	r.HandleFunc("/invoices/export", iv.getInvoicesExport).Methods("GET")
+	r.HandleFunc(dueCalendarPath, iv.getInvoicesDueCalendar).Methods("GET")
+	r.HandleFunc("/graphql", iv.serveGraphQL).Methods("GET", "POST")
+	r.HandleFunc("/graphql/schema", iv.getGraphQLSchema).Methods("GET")
+	r.HandleFunc("/invoices/import", iv.postInvoicesImport).Methods("POST")
+	r.HandleFunc("/invoices/batch", iv.postInvoicesBatch).Methods("POST")
+	r.HandleFunc("/search", iv.getSearch).Methods("GET")
+	r.HandleFunc("/events/stream", iv.getEventStream).Methods("GET")
+	r.HandleFunc("/reports/totals", iv.getTotalsReport).Methods("GET")
+	r.HandleFunc("/reports/summary", iv.getSummaryReport).Methods("GET")
+	r.HandleFunc("/reports/aging", iv.getAgingReport).Methods("GET")
+	r.HandleFunc("/reports/revenue", iv.getRevenueReport).Methods("GET")
+	r.HandleFunc("/reports/tax", iv.getTaxReport).Methods("GET")
 	r.HandleFunc("/invoice/{id:[0-9]+}", iv.getInvoice).Methods("GET")
-	r.HandleFunc("/invoice", iv.postInvoice).Methods("POST")
+	r.HandleFunc("/invoice/number/{number:.+}", iv.getInvoiceByNumber).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/pdf", iv.getInvoicePDF).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/send", iv.postInvoiceSend).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/deliveries", iv.getInvoiceDeliveries).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/charges", iv.getInvoiceCharges).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/charges/bulk", iv.postBulkCharges).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/charge", iv.postInvoiceCharge).Methods("POST")
+	r.HandleFunc("/charge/{id:[0-9]+}", iv.putCharge).Methods("PUT")
+	r.HandleFunc("/charge/{id:[0-9]+}", iv.deleteCharge).Methods("DELETE")
+	r.HandleFunc("/invoice/{id:[0-9]+}/status", iv.postInvoiceStatus).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/history", iv.getInvoiceHistory).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/duplicates", iv.getInvoiceDuplicates).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/payments", iv.getInvoicePayments).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/payments", iv.postInvoicePayment).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/payment-link", iv.postInvoicePaymentLink).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/payment-links", iv.getInvoicePaymentLinks).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/share", iv.postInvoiceShare).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/share-links", iv.getInvoiceShareLinks).Methods("GET")
+	r.HandleFunc("/share-link/{id:[0-9]+}/revoke", iv.postShareLinkRevoke).Methods("POST")
+	r.HandleFunc("/shared/invoice/{id:[0-9]+}", iv.getSharedInvoice).Methods("GET")
+	r.HandleFunc("/shared/invoice/{id:[0-9]+}/pdf", iv.getSharedInvoicePDF).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/notes", iv.getInvoiceNotes).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/notes", iv.postInvoiceNote).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/credit-notes", iv.getInvoiceCreditNotes).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/credit-notes", iv.postInvoiceCreditNote).Methods("POST")
+	r.HandleFunc("/credit-note/{id:[0-9]+}", iv.getCreditNote).Methods("GET")
+	r.HandleFunc("/credit-note/{id:[0-9]+}/void", iv.postCreditNoteVoid).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/attachments", iv.getInvoiceAttachments).Methods("GET")
+	r.HandleFunc("/invoice/{id:[0-9]+}/attachments", iv.postInvoiceAttachments).Methods("POST")
+	r.HandleFunc("/attachment/{id:[0-9]+}", iv.getAttachment).Methods("GET")
+	r.HandleFunc("/attachment/{id:[0-9]+}", iv.deleteAttachment).Methods("DELETE")
+	r.HandleFunc("/webhooks/stripe", iv.postStripeWebhook).Methods("POST")
+	r.HandleFunc("/invoice", iv.idempotent(iv.postInvoice)).Methods("POST")
 	r.HandleFunc("/invoice/{id:[0-9]+}", iv.putInvoice).Methods("PUT")
+	r.HandleFunc("/invoice/{id:[0-9]+}", iv.patchInvoice).Methods("PATCH")
 	r.HandleFunc("/invoice/{id:[0-9]+}", iv.deleteInvoice).Methods("DELETE")
-	r.HandleFunc("/invoice/delete/{id:[0-9]+}", iv.deleteInvoice).Methods("GET")
+	r.HandleFunc("/invoices/deleted", iv.getDeletedInvoices).Methods("GET")
+	r.HandleFunc("/invoices/amount-drift", iv.getAmountDrift).Methods("GET")
+	r.HandleFunc("/invoices/amount-drift/fix", iv.postAmountDriftFix).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/restore", iv.postInvoiceRestore).Methods("POST")
+	r.HandleFunc("/invoice/{id:[0-9]+}/purge", iv.deleteInvoicePurge).Methods("DELETE")
+	r.HandleFunc("/customers", iv.getCustomers).Methods("GET")
+	r.HandleFunc("/customer", iv.postCustomer).Methods("POST")
+	r.HandleFunc("/customer/{id:[0-9]+}", iv.getCustomer).Methods("GET")
+	r.HandleFunc("/customer/{id:[0-9]+}", iv.putCustomer).Methods("PUT")
+	r.HandleFunc("/customer/{id:[0-9]+}", iv.deleteCustomer).Methods("DELETE")
+	r.HandleFunc("/customer/{id:[0-9]+}/invoices", iv.getCustomerInvoices).Methods("GET")
+	r.HandleFunc("/categories", iv.getCategories).Methods("GET")
+	r.HandleFunc("/category", iv.postCategory).Methods("POST")
+	r.HandleFunc("/category/{id:[0-9]+}", iv.getCategory).Methods("GET")
+	r.HandleFunc("/category/{id:[0-9]+}", iv.putCategory).Methods("PUT")
+	r.HandleFunc("/category/{id:[0-9]+}", iv.deleteCategory).Methods("DELETE")
+	r.HandleFunc("/tax-rates", iv.getTaxRates).Methods("GET")
+	r.HandleFunc("/tax-rate", iv.postTaxRate).Methods("POST")
+	r.HandleFunc("/tax-rate/{id:[0-9]+}", iv.getTaxRate).Methods("GET")
+	r.HandleFunc("/tax-rate/{id:[0-9]+}", iv.putTaxRate).Methods("PUT")
+	r.HandleFunc("/tax-rate/{id:[0-9]+}", iv.deleteTaxRate).Methods("DELETE")
+	r.HandleFunc("/projects", iv.getProjects).Methods("GET")
+	r.HandleFunc("/project", iv.postProject).Methods("POST")
+	r.HandleFunc("/project/{id:[0-9]+}", iv.getProject).Methods("GET")
+	r.HandleFunc("/project/{id:[0-9]+}", iv.putProject).Methods("PUT")
+	r.HandleFunc("/project/{id:[0-9]+}", iv.deleteProject).Methods("DELETE")
+	r.HandleFunc("/project/{id:[0-9]+}/time-entries", iv.getProjectTimeEntries).Methods("GET")
+	r.HandleFunc("/project/{id:[0-9]+}/invoice", iv.postProjectInvoice).Methods("POST")
+	r.HandleFunc("/time-entry", iv.postTimeEntry).Methods("POST")
+	r.HandleFunc("/time-entry/{id:[0-9]+}", iv.getTimeEntry).Methods("GET")
+	r.HandleFunc("/time-entry/{id:[0-9]+}", iv.putTimeEntry).Methods("PUT")
+	r.HandleFunc("/time-entry/{id:[0-9]+}", iv.deleteTimeEntry).Methods("DELETE")
+	r.HandleFunc("/project/{id:[0-9]+}/expenses", iv.getProjectExpenses).Methods("GET")
+	r.HandleFunc("/expense", iv.postExpense).Methods("POST")
+	r.HandleFunc("/expense/{id:[0-9]+}", iv.getExpense).Methods("GET")
+	r.HandleFunc("/expense/{id:[0-9]+}", iv.putExpense).Methods("PUT")
+	r.HandleFunc("/expense/{id:[0-9]+}", iv.deleteExpense).Methods("DELETE")
+	r.HandleFunc("/expense/{id:[0-9]+}/approve", iv.postExpenseApprove).Methods("POST")
+	r.HandleFunc("/expense/{id:[0-9]+}/reject", iv.postExpenseReject).Methods("POST")
+	r.HandleFunc("/expense/{id:[0-9]+}/receipt", iv.getExpenseReceipt).Methods("GET")
+	r.HandleFunc("/expense/{id:[0-9]+}/receipt", iv.putExpenseReceipt).Methods("PUT")
+	r.HandleFunc("/webhooks", iv.getWebhooks).Methods("GET")
+	r.HandleFunc("/webhook", iv.postWebhook).Methods("POST")
+	r.HandleFunc("/webhook/{id:[0-9]+}", iv.getWebhook).Methods("GET")
+	r.HandleFunc("/webhook/{id:[0-9]+}", iv.putWebhook).Methods("PUT")
+	r.HandleFunc("/webhook/{id:[0-9]+}", iv.deleteWebhook).Methods("DELETE")
+	r.HandleFunc("/webhook/{id:[0-9]+}/deliveries", iv.getWebhookDeliveries).Methods("GET")
+	r.HandleFunc("/recurring", iv.getRecurringInvoices).Methods("GET")
+	r.HandleFunc("/recurring", iv.postRecurringInvoice).Methods("POST")
+	r.HandleFunc("/recurring/{id:[0-9]+}", iv.getRecurringInvoice).Methods("GET")
+	r.HandleFunc("/recurring/{id:[0-9]+}", iv.putRecurringInvoice).Methods("PUT")
+	r.HandleFunc("/recurring/{id:[0-9]+}", iv.deleteRecurringInvoice).Methods("DELETE")
+	r.HandleFunc("/recurring/{id:[0-9]+}/run-now", iv.postRecurringInvoiceRun).Methods("POST")
+	r.HandleFunc("/api-keys", iv.getAPIKeys).Methods("GET")
+	r.HandleFunc("/admin/jobs", iv.getAdminJobs).Methods("GET")
+	r.HandleFunc("/admin/retention", iv.getAdminRetention).Methods("GET")
+	r.HandleFunc("/api-key", iv.postAPIKey).Methods("POST")
+	r.HandleFunc("/api-key/{id:[0-9]+}", iv.deleteAPIKey).Methods("DELETE")
+	r.HandleFunc("/admin/roles", iv.getAdminRoles).Methods("GET")
+	r.HandleFunc("/admin/roles/{user}", iv.putAdminRole).Methods("PUT")
+	r.HandleFunc("/admin/roles/{user}", iv.deleteAdminRole).Methods("DELETE")
+	r.HandleFunc("/login", iv.postLogin).Methods("POST")
+	r.HandleFunc("/logout", iv.postLogout).Methods("POST")
+	r.HandleFunc("/session", iv.getSession).Methods("GET")
+	r.HandleFunc("/csrf-token", getCSRFToken).Methods("GET")
+	r.HandleFunc("/timer", iv.getTimer).Methods("GET")
+	r.HandleFunc("/timer/start", iv.postTimerStart).Methods("POST")
+	r.HandleFunc("/timer/stop", iv.postTimerStop).Methods("POST")
+	r.HandleFunc("/ui/invoices", iv.getUIInvoices).Methods("GET")
+	r.HandleFunc("/ui/invoices", iv.postUIInvoices).Methods("POST")
+	r.HandleFunc("/ui/invoice/new", iv.getUINewInvoice).Methods("GET")
+	r.HandleFunc("/ui/invoice/{id:[0-9]+}", iv.getUIInvoice).Methods("GET")
+	r.HandleFunc("/ui/invoice/{id:[0-9]+}", iv.postUIInvoice).Methods("POST")
+	r.HandleFunc("/ui/invoice/{id:[0-9]+}/edit", iv.getUIEditInvoice).Methods("GET")
 	r.HandleFunc("/__version__", getVersion).Methods("GET")
+	r.HandleFunc("/__api__/openapi.json", getOpenAPISpec).Methods("GET")
+	r.HandleFunc("/__api__/", getSwaggerUI).Methods("GET")
 
 	// handle static files
 	r.Handle("/statics/{staticfile}",
 		http.StripPrefix("/statics/", http.FileServer(http.Dir("./statics"))),
 	).Methods("GET")
 
-	log.Fatal(http.ListenAndServe(":8080",
-		HandleMiddlewares(
-			r,
-			addRequestID(),
-			logRequest(),
-			setResponseHeaders(),
-		),
-	))
+	middlewares := []Middleware{
+		addRequestID(),
+		logRequest(),
+		recoverPanics(),
+		timeoutRequests(cfg.Server, "/events/stream"),
+		limitBodies(cfg.Limits),
+		traceRequests(tracer, r),
+		setResponseHeaders(),
+		cors(cfg.CORS),
+		iv.authenticateAPIKeys(publicPaths),
+	}
+	authenticator, err := newAuthenticator(cfg.Auth)
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
+	if authenticator != nil {
+		iv.enableSessions(db, authenticator, cfg.Auth, cfg.Server.TLSCert != "")
+		middlewares = append(middlewares, authenticator.Middleware())
+	}
+	middlewares = append(middlewares, identifyActor(), csrfProtect(), iv.authorize(publicPaths))
+	limiter, err := newRateLimiter()
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
+	if limiter != nil {
+		middlewares = append(middlewares, rateLimit(limiter, publicPaths))
+	}
+
+	err = serve(cfg.Server, HandleMiddlewares(r, middlewares...), HandleMiddlewares(iv.grpcHandler(), middlewares...), iv.events.close)
+	applog.infof("closing database connection")
+	if dberr := iv.db.Close(); dberr != nil {
+		applog.errorf("failed to close database connection: %s", dberr)
+	}
+	if err != nil {
+		applog.fatalf("%s", err)
+	}
 }
 
 type Invoice struct {
 	gorm.Model
-	IsPaid      bool      `json:"is_paid"`
-	Amount      int       `json:"amount"`
-	PaymentDate time.Time `json:"payment_date"`
-	DueDate     time.Time `json:"due_date"`
-	Charges     []Charge  `json:"charges"`
+	// InvoiceNumber is the sequential number shown to customers, assigned
+	// when the invoice is created
+	InvoiceNumber string `gorm:"unique_index" json:"invoice_number"`
+	CustomerID    uint   `gorm:"index" json:"customer_id"`
+	Status        string `gorm:"index" json:"status"`
+	IsPaid        bool   `json:"is_paid"`
+	Amount        int64  `json:"amount"`
+	// AmountOverride keeps the amount set by the client instead of the
+	// total of the charges
+	AmountOverride bool      `gorm:"not null;default:false" json:"amount_override"`
+	Currency       string    `json:"currency"`
+	PaymentDate    time.Time `json:"payment_date"`
+	DueDate        time.Time `json:"due_date"`
+	Version        int       `gorm:"not null;default:1" json:"version"`
+	Charges        []Charge  `json:"charges"`
+
+	ChargesSummary *chargesSummary `gorm:"-" json:"charges_summary,omitempty"`
+	Taxes          *invoiceTaxes   `gorm:"-" json:"taxes,omitempty"`
 }
 
 type Charge struct {
 	gorm.Model
-	InvoiceID   int     `gorm:"index"  json:"invoice_id"`
-	Type        string  `json:"type"`
-	Amount      float64 `json:"amount"`
-	Description string  `json:"description"`
+	InvoiceID   int    `gorm:"index"  json:"invoice_id"`
+	Type        string `json:"type"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	Description string `json:"description"`
+	CategoryID  uint   `gorm:"index" json:"category_id,omitempty"`
+	TaxRateID   uint   `gorm:"index" json:"tax_rate_id,omitempty"`
+	// Tax is computed from the tax rate when the charge is saved, and
+	// isn't affected by later changes of the rate
+	Tax int64 `json:"tax"`
 }
 
 func (iv *invoicer) getInvoice(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	log.Println("getting invoice id", vars["id"])
-	var i1 Invoice
-	id, _ := strconv.Atoi(vars["id"])
-	iv.db.First(&i1, id)
-	fmt.Printf("%+v\n", i1)
-	if i1.ID == 0 {
-		httpError(w, r, http.StatusNotFound, "No invoice id %s", vars["id"])
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	iv.serveInvoice(w, r, uint(id))
+}
+
+// serveInvoice responds with an invoice and its charges, from the cache
+// when possible. The `fields` and `include` parameters select a view of
+// the invoice, whose charges are only retrieved if the view shows them.
+func (iv *invoicer) serveInvoice(w http.ResponseWriter, r *http.Request, id uint) {
+	includeDeleted, err := parseIncludeDeleted(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	view, err := parseInvoiceView(r, "charges", "payments", "customer", "notes")
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	// only the full invoice is cached, the records related to it don't
+	// change its version
+	if !includeDeleted && view.full() {
+		if e, ok := iv.invoiceCache.get(id, time.Now()); ok {
+			writeInvoiceResponse(w, r, e)
+			al := appLog{Message: fmt.Sprintf("retrieved invoice %d from cache", id), Action: "get-invoice"}
+			al.log(r)
+			return
+		}
+	}
+	generation := iv.invoiceCache.currentGeneration()
+	i1, err := iv.findInvoice(r, id, includeDeleted)
+	if err != nil {
+		writeServiceError(w, r, err)
 		return
 	}
-	iv.db.Where("invoice_id = ?", i1.ID).Find(&i1.Charges)
-	for i := 0; i < len(i1.Charges); i++ {
-		i1.Charges[i].Type = html.EscapeString(i1.Charges[i].Type)
-		i1.Charges[i].Description = html.EscapeString(i1.Charges[i].Description)
+	if view.wantsCharges(true) {
+		err = iv.attachCharges(r, &i1)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "%s", err)
+			return
+		}
+	}
+	if view.wants("taxes") {
+		i1.Taxes, err = iv.invoiceTaxes(r, i1)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		if i1.Taxes != nil {
+			escapeTaxLines(i1.Taxes.Lines)
+		}
 	}
-	jsonInvoice, err := json.Marshal(i1)
+	related, err := iv.invoiceRelations(r, []Invoice{i1}, view)
 	if err != nil {
-		httpError(w, r, http.StatusInternalServerError, "failed to retrieve invoice id %d: %s", vars["id"], err)
+		httpError(w, r, http.StatusInternalServerError, "%s", err)
 		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonInvoice)
+	e := cachedInvoice{id: i1.ID, etag: invoiceETag(i1), lastModified: i1.UpdatedAt}
+	if view.include["notes"] {
+		notes, err := invoiceNotes(iv.dbFor(r), i1.ID)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "failed to retrieve notes of invoice id %d: %s", id, err)
+			return
+		}
+		escapeNotes(notes)
+		related[i1.ID]["notes"] = notes
+		if len(notes) > 0 && notes[len(notes)-1].CreatedAt.After(e.lastModified) {
+			e.lastModified = notes[len(notes)-1].CreatedAt
+		}
+	}
+	e.body, err = view.render(i1, related[i1.ID])
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve invoice id %d: %s", id, err)
+		return
+	}
+	if !view.full() {
+		e.etag = contentETag(e.body)
+	}
+	// invoices awaiting payment become overdue when read past their due
+	// date, which their cached response wouldn't show
+	if i1.Status == statusSent || i1.Status == statusPartiallyPaid {
+		e.expires = i1.DueDate
+	}
+	if i1.DeletedAt == nil && view.full() {
+		iv.invoiceCache.add(e, generation)
+	}
+	writeInvoiceResponse(w, r, e)
 	al := appLog{Message: fmt.Sprintf("retrieved invoice %d", i1.ID), Action: "get-invoice"}
 	al.log(r)
 }
 
-func (iv *invoicer) postInvoice(w http.ResponseWriter, r *http.Request) {
-	log.Println("posting new invoice")
-	body, err := ioutil.ReadAll(r.Body)
+// attachCharges retrieves the charges of an invoice. Invoices with very
+// large numbers of charges only carry a summary, the lines themselves are
+// paginated through /invoice/{id}/charges.
+func (iv *invoicer) attachCharges(r *http.Request, i *Invoice) error {
+	summary, err := iv.invoicesFor(r).SummarizeCharges(i.ID)
+	if err == nil && summary.Count > maxInlineCharges {
+		summary.Link = fmt.Sprintf("/invoice/%d/charges", i.ID)
+		i.ChargesSummary = &summary
+	} else if err == nil {
+		i.Charges, err = iv.invoicesFor(r).Charges(*i, 0, 0)
+		escapeCharges(i.Charges)
+	}
 	if err != nil {
-		httpError(w, r, http.StatusBadRequest, "failed to read request body: %s", err)
-		return
+		return fmt.Errorf("failed to retrieve charges of invoice id %d: %s", i.ID, err)
 	}
+	return nil
+}
+
+func (iv *invoicer) postInvoice(w http.ResponseWriter, r *http.Request) {
 	var i1 Invoice
-	err = json.Unmarshal(body, &i1)
-	if err != nil {
-		httpError(w, r, http.StatusBadRequest, "failed to parse request body: %s", err)
+	if !readJSONBody(w, r, &i1) {
 		return
 	}
-	// make sure the IDs are null before inserting
-	i1.ID = 0
-	for i := 0; i < len(i1.Charges); i++ {
-		i1.Charges[i].ID = 0
-		i1.Charges[i].InvoiceID = 0
+	i1, err := iv.createInvoice(r, i1)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
 	}
-	iv.db.Create(&i1)
-	iv.db.Last(&i1)
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fmt.Sprintf("created invoice %d", i1.ID)))
+	writeJSON(w, r, http.StatusCreated, createdInvoice{
+		ID:            i1.ID,
+		InvoiceNumber: i1.InvoiceNumber,
+		Message:       fmt.Sprintf("created invoice %d", i1.ID),
+		Warnings:      iv.duplicateWarnings(w, r, i1),
+	})
 	al := appLog{Message: fmt.Sprintf("created invoice %d", i1.ID), Action: "post-invoice"}
 	al.log(r)
 }
 
+// putInvoice replaces an invoice and its charges with the content of the
+// request body. Fields omitted from the body are reset to their zero value.
 func (iv *invoicer) putInvoice(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	log.Println("updating invoice", vars["id"])
-	var i1 Invoice
-	iv.db.First(&i1, vars["id"])
-	if i1.ID == 0 {
-		httpError(w, r, http.StatusNotFound, "No invoice id %s", vars["id"])
-		return
-	}
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		httpError(w, r, http.StatusBadRequest, "failed to read request body: %s", err)
+	var body Invoice
+	if !readJSONBody(w, r, &body) {
 		return
 	}
-	err = json.Unmarshal(body, &i1)
+	id, _ := strconv.Atoi(vars["id"])
+	i1, err := iv.updateInvoice(r, uint(id), invoiceUpdate{
+		Action:         "update",
+		IfMatch:        r.Header.Get("If-Match"),
+		ReplaceCharges: true,
+		AmountSet:      body.Amount != 0,
+		Apply: func(i *Invoice) error {
+			if body.Currency != "" && body.Currency != i.Currency {
+				var errs validationErrors
+				errs.add("currency", "cannot be changed from %s", i.Currency)
+				return newValidationError(errs)
+			}
+			*i = body
+			return nil
+		},
+	})
 	if err != nil {
-		httpError(w, r, http.StatusBadRequest, "failed to parse request body: %s", err)
+		writeServiceError(w, r, err)
 		return
 	}
-	iv.db.Save(&i1)
-	iv.db.First(&i1, vars["id"])
-	log.Printf("%+v\n", i1)
+	w.Header().Set("ETag", invoiceETag(i1))
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte(fmt.Sprintf("updated invoice %d", i1.ID)))
 	al := appLog{Message: fmt.Sprintf("updated invoice %d", i1.ID), Action: "put-invoice"}
 	al.log(r)
 }
 
-var CSRFKey []byte
-
-func checkCSRFToken(token string) bool {
-	mac := hmac.New(sha256.New, CSRFKey)
-	tokenParts := strings.Split(token, "$")
-	if len(tokenParts) != 2 {
-		return false
-	}
-	msg, _ := base64.StdEncoding.DecodeString(tokenParts[0])
-	messageMAC, _ := base64.StdEncoding.DecodeString(tokenParts[1])
-	mac.Write([]byte(msg))
-	expectedMAC := mac.Sum(nil)
-	return hmac.Equal(messageMAC, expectedMAC)
-}
-
-func (iv *invoicer) deleteInvoice(w http.ResponseWriter, r *http.Request) {
+// patchInvoice applies a JSON merge patch to an invoice: only the fields
+// present in the body are modified, and fields explicitly set to null are
+// cleared. When present, the list of charges replaces the existing one.
+func (iv *invoicer) patchInvoice(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	if !checkCSRFToken(r.Header.Get("X-CSRF-Token")) {
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte("Invalid CSRF Token"))
+	var patch map[string]json.RawMessage
+	if !readJSONBody(w, r, &patch) {
 		return
 	}
-	log.Println("deleting invoice", vars["id"])
-	var i1 Invoice
 	id, _ := strconv.Atoi(vars["id"])
-	iv.db.Where("invoice_id = ?", id).Delete(Charge{})
-	i1.ID = uint(id)
-	iv.db.Delete(&i1)
+	_, replaceCharges := patch["charges"]
+	_, amountSet := patch["amount"]
+	i1, err := iv.updateInvoice(r, uint(id), invoiceUpdate{
+		Action:         "patch",
+		IfMatch:        r.Header.Get("If-Match"),
+		ReplaceCharges: replaceCharges,
+		AmountSet:      amountSet,
+		Apply: func(i *Invoice) error {
+			if err := applyInvoicePatch(i, patch); err != nil {
+				return newServiceError(http.StatusBadRequest, "invalid patch: %s", err)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", invoiceETag(i1))
 	w.WriteHeader(http.StatusAccepted)
-	w.Write([]byte(fmt.Sprintf("deleted invoice %d", i1.ID)))
-	al := appLog{Message: fmt.Sprintf("deleted invoice %d", i1.ID), Action: "delete-invoice"}
+	w.Write([]byte(fmt.Sprintf("updated invoice %d", i1.ID)))
+	al := appLog{Message: fmt.Sprintf("patched invoice %d", i1.ID), Action: "patch-invoice"}
 	al.log(r)
 }
 
-func createCSRFToken() string {
-	msg := make([]byte, 32)
-	rand.Read(msg)
-	mac := hmac.New(sha256.New, CSRFKey)
-	mac.Write(msg)
-	return base64.StdEncoding.EncodeToString(msg) + `$` + base64.StdEncoding.EncodeToString(mac.Sum(nil))
-}
-const defaultUser string = "samantha"
-const defaultPass string = "1ns3cur3"
-
-func requestBasicAuth(w http.ResponseWriter) {
-	w.Header().Set("WWW-Authenticate", `Basic realm="invoicer"`)
-	w.WriteHeader(401)
-	w.Write([]byte(`please authenticate`))
-}
-
-func (iv *invoicer) getIndex(w http.ResponseWriter, r *http.Request) {
-	if len(r.Header.Get("Authorization")) < 8 || r.Header.Get("Authorization")[0:5] != `Basic` {
-		requestBasicAuth(w)
-		return
-	}
-	authbytes, err := base64.StdEncoding.DecodeString(r.Header.Get("Authorization")[6:])
+func (iv *invoicer) deleteInvoice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	_, err := iv.removeInvoice(r, uint(id), r.Header.Get("If-Match"))
 	if err != nil {
-		requestBasicAuth(w)
+		writeServiceError(w, r, err)
 		return
 	}
-	
-	authstr := fmt.Sprintf("%s", authbytes)
-	username := authstr[0:strings.Index(authstr, ":")]
-	password := authstr[strings.Index(authstr, ":")+1:]
-	if username != defaultUser && password != defaultPass {
-		requestBasicAuth(w)
-		return
-	}
-	w.Header().Add("Content-Security-Policy", "default-src 'self';")
-	w.Header().Add("X-Frame-Options", "SAMEORIGIN")
-	log.Println("serving index page")
-	w.Write([]byte(`
-<!DOCTYPE html>
-<html>
-    <head>
-        <title>Invoicer Web</title>
-        <script src="statics/jquery-1.12.4.min.js"></script>
-        <script src="statics/invoicer-cli.js"></script>
-        <link href="statics/style.css" rel="stylesheet">
-    </head>
-    <body>
-	<h1>Invoicer Web</h1>
-        <p class="desc-invoice"></p>
-        <div class="invoice-details">
-        </div>
-        <h3>Request an invoice by ID</h3>
-        <form id="invoiceGetter" method="GET">
-            <label>ID :</label>
-            <input id="invoiceid" type="text" />
-			<input type="hidden" name="CSRFToken" value="` + createCSRFToken() + `"/>
-            <input type="submit" />
-        </form>
-        <form id="invoiceDeleter" method="DELETE">
-            <label>Delete this invoice</label>
-            <input type="submit" />
-        </form>
-    </body>
-</html>`))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted invoice %d", id)))
+	al := appLog{Message: fmt.Sprintf("deleted invoice %d", id), Action: "delete-invoice"}
+	al.log(r)
+}
+
+func (iv *invoicer) getIndex(w http.ResponseWriter, r *http.Request) {
+	iv.render(w, r, http.StatusOK, "index", struct{ CSRFToken string }{createCSRFToken()})
 }
 
+// getHeartbeat is the liveness endpoint, it only tells that the process
+// is able to serve requests and does not check any dependency
 func getHeartbeat(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("I am alive"))
 }
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryInvoiceStore keeps invoices and charges in memory, to exercise the
+// invoice service without a database. It follows the semantics of the
+// database store, including soft deletion and versions.
+type memoryInvoiceStore struct {
+	mu            sync.Mutex
+	invoices      map[uint]Invoice
+	charges       []Charge
+	lastInvoiceID uint
+	lastChargeID  uint
+	counters      map[string]int64
+}
+
+func newMemoryInvoiceStore() *memoryInvoiceStore {
+	return &memoryInvoiceStore{invoices: make(map[uint]Invoice), counters: make(map[string]int64)}
+}
+
+// insertCharges stores charges of an invoice, setting their ids
+func (s *memoryInvoiceStore) insertCharges(invoiceID uint, charges []Charge, now time.Time) {
+	for n := range charges {
+		s.lastChargeID++
+		charges[n].ID = s.lastChargeID
+		charges[n].InvoiceID = int(invoiceID)
+		charges[n].CreatedAt, charges[n].UpdatedAt, charges[n].DeletedAt = now, now, nil
+		s.charges = append(s.charges, charges[n])
+	}
+}
+
+// deleteCharges soft deletes the charges of an invoice
+func (s *memoryInvoiceStore) deleteCharges(invoiceID uint, now time.Time) {
+	for n, c := range s.charges {
+		if c.InvoiceID == int(invoiceID) && c.DeletedAt == nil {
+			deletedAt := now
+			s.charges[n].DeletedAt = &deletedAt
+		}
+	}
+}
+
+func (s *memoryInvoiceStore) Create(i *Invoice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	s.lastInvoiceID++
+	i.ID, i.CreatedAt, i.UpdatedAt, i.DeletedAt = s.lastInvoiceID, now, now, nil
+	scope := numberingScope(invoiceNumberFormat, now)
+	s.counters[scope]++
+	i.InvoiceNumber = formatInvoiceNumber(invoiceNumberFormat, now.Year(), s.counters[scope])
+	if i.Version == 0 {
+		i.Version = 1
+	}
+	s.insertCharges(i.ID, i.Charges, now)
+	stored := *i
+	stored.Charges, stored.ChargesSummary = nil, nil
+	s.invoices[i.ID] = stored
+	return nil
+}
+
+func (s *memoryInvoiceStore) Get(id uint, includeDeleted bool) (Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.invoices[id]
+	if !ok || (i.DeletedAt != nil && !includeDeleted) {
+		return Invoice{}, errInvoiceNotFound
+	}
+	return i, nil
+}
+
+func (s *memoryInvoiceStore) GetByNumber(number string, includeDeleted bool) (Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, i := range s.invoices {
+		if i.InvoiceNumber == number && (i.DeletedAt == nil || includeDeleted) {
+			return i, nil
+		}
+	}
+	return Invoice{}, errInvoiceNotFound
+}
+
+func (s *memoryInvoiceStore) List(filters invoiceFilters, offset, limit int) ([]Invoice, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matches []Invoice
+	for _, i := range s.invoices {
+		if filters.match(i) {
+			matches = append(matches, i)
+		}
+	}
+	sort.Slice(matches, func(a, b int) bool { return matches[a].ID < matches[b].ID })
+	invoices := []Invoice{}
+	for n := offset; n < len(matches) && len(invoices) < limit; n++ {
+		invoices = append(invoices, matches[n])
+	}
+	return invoices, len(matches), nil
+}
+
+func (s *memoryInvoiceStore) Update(i *Invoice, replaceCharges bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.invoices[i.ID]
+	if !ok || current.DeletedAt != nil || current.Version != i.Version {
+		return errVersionConflict
+	}
+	now := time.Now().UTC()
+	i.Version++
+	i.CreatedAt, i.UpdatedAt, i.DeletedAt = current.CreatedAt, now, nil
+	if replaceCharges {
+		if i.Charges == nil {
+			i.Charges = []Charge{}
+		}
+		s.deleteCharges(i.ID, now)
+		s.insertCharges(i.ID, i.Charges, now)
+	} else {
+		i.Charges = nil
+	}
+	stored := *i
+	stored.Charges, stored.ChargesSummary = nil, nil
+	s.invoices[i.ID] = stored
+	return nil
+}
+
+func (s *memoryInvoiceStore) SetStatus(i *Invoice, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.invoices[i.ID]
+	if !ok {
+		return errInvoiceNotFound
+	}
+	stored.Status, stored.UpdatedAt = status, time.Now().UTC()
+	stored.Version++
+	s.invoices[i.ID] = stored
+	i.Status = status
+	i.Version++
+	return nil
+}
+
+func (s *memoryInvoiceStore) Delete(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.invoices[id]
+	if !ok || i.DeletedAt != nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	s.deleteCharges(id, now)
+	i.DeletedAt = &now
+	s.invoices[id] = i
+	return nil
+}
+
+func (s *memoryInvoiceStore) Restore(i Invoice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.invoices[i.ID]
+	if !ok || stored.DeletedAt == nil {
+		return nil
+	}
+	for n, c := range s.charges {
+		if c.InvoiceID == int(i.ID) && c.DeletedAt != nil && !c.DeletedAt.Before(stored.DeletedAt.Add(-time.Second)) {
+			s.charges[n].DeletedAt = nil
+		}
+	}
+	stored.DeletedAt = nil
+	s.invoices[i.ID] = stored
+	return nil
+}
+
+func (s *memoryInvoiceStore) Charges(i Invoice, after uint, limit int) ([]Charge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	charges := []Charge{}
+	for _, c := range s.charges {
+		if c.InvoiceID != int(i.ID) || c.ID <= after {
+			continue
+		}
+		if i.DeletedAt == nil && c.DeletedAt != nil ||
+			i.DeletedAt != nil && (c.DeletedAt == nil || c.DeletedAt.Before(i.DeletedAt.Add(-time.Second))) {
+			continue
+		}
+		charges = append(charges, c)
+		if limit > 0 && len(charges) == limit {
+			break
+		}
+	}
+	return charges, nil
+}
+
+func (s *memoryInvoiceStore) SummarizeCharges(invoiceID uint) (summary chargesSummary, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.charges {
+		if c.InvoiceID == int(invoiceID) && c.DeletedAt == nil {
+			summary.Count++
+			summary.Total += c.Amount + c.Tax
+		}
+	}
+	return summary, nil
+}
+
+func (s *memoryInvoiceStore) SummarizeTaxes(invoiceID uint) ([]taxLine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byRate := make(map[uint]*taxLine)
+	lines := []taxLine{}
+	for _, c := range s.charges {
+		if c.InvoiceID != int(invoiceID) || c.DeletedAt != nil {
+			continue
+		}
+		if byRate[c.TaxRateID] == nil {
+			byRate[c.TaxRateID] = &taxLine{TaxRateID: c.TaxRateID}
+		}
+		byRate[c.TaxRateID].Taxable += c.Amount
+		byRate[c.TaxRateID].Tax += c.Tax
+	}
+	for _, l := range byRate {
+		lines = append(lines, *l)
+	}
+	sort.Slice(lines, func(a, b int) bool { return lines[a].TaxRateID < lines[b].TaxRateID })
+	return lines, nil
+}
+
+// chargesTotal sums the charges of an invoice that aren't deleted
+func (s *memoryInvoiceStore) chargesTotal(invoiceID uint) (total int64) {
+	for _, c := range s.charges {
+		if c.InvoiceID == int(invoiceID) && c.DeletedAt == nil {
+			total += c.Amount + c.Tax
+		}
+	}
+	return
+}
+
+func (s *memoryInvoiceStore) GetCharge(id uint) (Charge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.charges {
+		if c.ID == id && c.DeletedAt == nil {
+			return c, nil
+		}
+	}
+	return Charge{}, errChargeNotFound
+}
+
+func (s *memoryInvoiceStore) SaveCharge(i *Invoice, c *Charge) error {
+	return s.changeCharges(i, func(now time.Time) {
+		if c.ID == 0 {
+			added := []Charge{*c}
+			s.insertCharges(i.ID, added, now)
+			*c = added[0]
+			return
+		}
+		for n, stored := range s.charges {
+			if stored.ID == c.ID && stored.DeletedAt == nil {
+				c.InvoiceID, c.CreatedAt, c.UpdatedAt = int(i.ID), stored.CreatedAt, now
+				s.charges[n] = *c
+			}
+		}
+	})
+}
+
+func (s *memoryInvoiceStore) AddCharges(i *Invoice, charges []Charge) error {
+	return s.changeCharges(i, func(now time.Time) {
+		added := make([]Charge, len(charges))
+		copy(added, charges)
+		s.insertCharges(i.ID, added, now)
+	})
+}
+
+func (s *memoryInvoiceStore) DeleteCharge(i *Invoice, chargeID uint) error {
+	return s.changeCharges(i, func(now time.Time) {
+		for n, c := range s.charges {
+			if c.ID == chargeID && c.InvoiceID == int(i.ID) && c.DeletedAt == nil {
+				deletedAt := now
+				s.charges[n].DeletedAt = &deletedAt
+			}
+		}
+	})
+}
+
+// changeCharges applies a change to the charges of an invoice and sets its
+// amount to their new total unless it is overridden
+func (s *memoryInvoiceStore) changeCharges(i *Invoice, change func(now time.Time)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.invoices[i.ID]
+	if !ok || stored.DeletedAt != nil || stored.Version != i.Version {
+		return errVersionConflict
+	}
+	now := time.Now().UTC()
+	change(now)
+	total := s.chargesTotal(i.ID)
+	if stored.AmountOverride {
+		total = stored.Amount
+	}
+	stored.Amount, stored.UpdatedAt = total, now
+	stored.Version++
+	s.invoices[i.ID] = stored
+	i.Amount, i.Version = total, stored.Version
+	return nil
+}
+
+func (s *memoryInvoiceStore) AmountDrift() ([]amountDrift, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	drifts := []amountDrift{}
+	for _, i := range s.invoices {
+		if i.DeletedAt != nil || i.AmountOverride {
+			continue
+		}
+		if total := s.chargesTotal(i.ID); total != i.Amount {
+			drifts = append(drifts, amountDrift{InvoiceID: i.ID, Currency: i.Currency, Amount: i.Amount, Total: total})
+		}
+	}
+	sort.Slice(drifts, func(a, b int) bool { return drifts[a].InvoiceID < drifts[b].InvoiceID })
+	return drifts, nil
+}
+
+func (s *memoryInvoiceStore) Duplicates(i Invoice, window time.Duration, limit int) ([]Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoices := []Invoice{}
+	for _, d := range s.invoices {
+		if d.DeletedAt != nil || d.ID == i.ID || d.Status == statusCancelled ||
+			(i.CustomerID != 0 && d.CustomerID != i.CustomerID) || d.Amount != i.Amount || d.Currency != i.Currency ||
+			d.DueDate.Before(i.DueDate.Add(-window)) || d.DueDate.After(i.DueDate.Add(window)) {
+			continue
+		}
+		invoices = append(invoices, d)
+	}
+	return closestDue(i, invoices, limit), nil
+}
+
+// Search only matches charges, the memory store doesn't keep customers
+func (s *memoryInvoiceStore) Search(q invoiceSearch, limit int) ([]searchMatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matches := []searchMatch{}
+	for _, c := range s.charges {
+		i, ok := s.invoices[uint(c.InvoiceID)]
+		if c.DeletedAt != nil || !ok || !q.matchInvoice(i) {
+			continue
+		}
+		for _, f := range []struct{ field, text string }{{"charge.type", c.Type}, {"charge.description", c.Description}} {
+			if containsFold(f.text, q.Query) && len(matches) < limit {
+				matches = append(matches, searchMatch{InvoiceID: i.ID, Field: f.field, ChargeID: c.ID, Text: f.text})
+			}
+		}
+	}
+	return matches, nil
+}
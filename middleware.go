@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"net/http"
+	"runtime/debug"
+	"time"
 )
 
 // Middleware wraps an http.Handler with additional
@@ -14,23 +16,102 @@ const (
 	ctxReqID = "reqID"
 )
 
+// logRequest puts a logger carrying the id, method and path of the request
+// in its context, and logs the request with its status, latency and actor
+// once it is served
 func logRequest() Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			h.ServeHTTP(w, r)
-			al := accessLog{
-				XForwardedFor: r.Header.Get("X-Forwarded-For"),
-				Method:        r.Method,
-				Proto:         r.Proto,
-				URL:           r.URL.String(),
-				UserAgent:     r.UserAgent(),
-				RequestID:     "-",
+			start := time.Now()
+			l := applog.with(logFields{
+				"request_id": requestID(r),
+				"method":     r.Method,
+				"path":       r.URL.Path,
+			})
+			al := &accessLog{}
+			r = addtoContext(r, ctxLogger, l)
+			r = addtoContext(r, ctxAccessLog, al)
+			h.ServeHTTP(statusRecorder{ResponseWriter: w, log: al}, r)
+			if al.status == 0 {
+				al.status = http.StatusOK
+			}
+			fields := logFields{
+				"status":     al.status,
+				"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+				"proto":      r.Proto,
+				"user_agent": r.UserAgent(),
+			}
+			if al.actor != "" {
+				fields["actor"] = al.actor
 			}
-			val := r.Context().Value(ctxReqID)
-			if val != nil {
-				al.RequestID = val.(string)
+			if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+				fields["x_forwarded_for"] = xff
 			}
-			log.Printf("%s", al.String())
+			l.log(levelInfo, "request", fields)
+		})
+	}
+}
+
+// handlerPanic is a panic recovered where it happened, to be raised again
+// in the goroutine serving the request with the stack it happened at
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// logPanic logs a panic with the stack it happened at and the id of the
+// request it interrupted
+func logPanic(r *http.Request, p interface{}) {
+	hp, ok := p.(handlerPanic)
+	if !ok {
+		hp = handlerPanic{value: p, stack: debug.Stack()}
+	}
+	requestLogger(r).log(levelError, "panic serving request", logFields{
+		"panic": fmt.Sprint(hp.value),
+		"stack": string(hp.stack),
+	})
+}
+
+// recoverPanics logs the panics of handlers and answers them with a 500,
+// instead of the empty reply the http server sends. Responses which already
+// started are aborted, since their status can't be changed anymore. It runs
+// after logRequest, so panics are logged with the request id and counted
+// in the access log.
+func recoverPanics() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				logPanic(r, p)
+				if al, ok := r.Context().Value(ctxAccessLog).(*accessLog); ok && al.status != 0 {
+					panic(http.ErrAbortHandler)
+				}
+				writeError(w, r, http.StatusInternalServerError, apiError{Code: errInternal, Message: "internal server error"})
+			}()
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// identifyActor adds the user or API key authenticated on a request to its
+// logger and to its access log. It runs after the authentication
+// middlewares.
+func identifyActor() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if actor := actorOf(r); actor != "" {
+				if al, ok := r.Context().Value(ctxAccessLog).(*accessLog); ok {
+					al.actor = actor
+				}
+				r = addtoContext(r, ctxLogger, requestLogger(r).with(logFields{"actor": actor}))
+			}
+			h.ServeHTTP(w, r)
 		})
 	}
 }
@@ -56,6 +137,7 @@ func addRequestID() Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			rid := newRequestID()
+			w.Header().Set("X-Request-ID", rid)
 			h.ServeHTTP(w, addtoContext(r, ctxReqID, rid))
 		})
 	}
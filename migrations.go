@@ -0,0 +1,878 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migration is a versioned change of the database schema or of its data.
+// Up and Down are SQL statements separated by semicolons, run in a
+// transaction along with the record of the migration. Migrations that need
+// more than SQL set UpFunc and DownFunc instead. A migration without a down
+// step, such as a data backfill, has nothing to undo.
+type migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	UpFunc   func(tx *gorm.DB) error
+	DownFunc func(tx *gorm.DB) error
+}
+
+// migrations lists the migrations of the invoicer in the order they are
+// applied. Applied migrations must never change, add a new one instead.
+var migrations = []migration{
+	{
+		Version:  1,
+		Name:     "initial_schema",
+		UpFunc:   createInitialSchema,
+		DownFunc: dropInitialSchema,
+	},
+	{
+		Version: 2,
+		Name:    "backfill_invoice_status",
+		Up: `UPDATE invoices SET status = 'paid' WHERE (status IS NULL OR status = '') AND is_paid;
+			UPDATE invoices SET status = 'sent' WHERE status IS NULL OR status = ''`,
+	},
+	{
+		Version: 3,
+		Name:    "amounts_in_minor_units",
+		UpFunc:  migrateMinorUnits,
+	},
+	{
+		Version:  4,
+		Name:     "payment_links",
+		UpFunc:   createTables(paymentLinkTable{}),
+		DownFunc: dropTables(paymentLinkTable{}),
+	},
+	{
+		Version:  5,
+		Name:     "idempotency_keys",
+		UpFunc:   createTables(idempotencyKeyTable{}),
+		DownFunc: dropTables(idempotencyKeyTable{}),
+	},
+	{
+		Version:  6,
+		Name:     "jobs",
+		UpFunc:   createTables(jobTable{}),
+		DownFunc: dropTables(jobTable{}),
+	},
+	{
+		Version:  7,
+		Name:     "sessions_and_roles",
+		UpFunc:   createTables(sessionTable{}, userRoleTable{}),
+		DownFunc: dropTables(sessionTable{}, userRoleTable{}),
+	},
+	{
+		Version:  8,
+		Name:     "attachments",
+		UpFunc:   createTables(attachmentTable{}),
+		DownFunc: dropTables(attachmentTable{}),
+	},
+	{
+		Version:  9,
+		Name:     "notes",
+		UpFunc:   createTables(noteTable{}),
+		DownFunc: dropTables(noteTable{}),
+	},
+	{
+		Version:  10,
+		Name:     "tax_rates",
+		UpFunc:   createTables(taxRateTable{}, chargeTaxTable{}, recurringChargeTaxTable{}),
+		DownFunc: dropTaxRates,
+	},
+	{
+		Version:  11,
+		Name:     "invoice_numbers",
+		UpFunc:   numberExistingInvoices,
+		DownFunc: dropInvoiceNumbers,
+	},
+	{
+		Version:  12,
+		Name:     "credit_notes",
+		UpFunc:   createTables(creditNoteTable{}, creditNoteLineTable{}),
+		DownFunc: dropTables(creditNoteTable{}, creditNoteLineTable{}),
+	},
+	{
+		Version:  13,
+		Name:     "share_links",
+		UpFunc:   createTables(shareLinkTable{}),
+		DownFunc: dropTables(shareLinkTable{}),
+	},
+	{
+		Version:  14,
+		Name:     "expense_receipts",
+		UpFunc:   createTables(expenseReceiptTable{}, attachmentExpenseTable{}),
+		DownFunc: dropExpenseReceipts,
+	},
+}
+
+// The initial* types freeze the tables as AutoMigrate created them before
+// migrations existed. The first migration creates them on new databases,
+// and adds the columns and indexes missing from databases created by older
+// versions of the invoicer.
+
+type initialInvoice struct {
+	gorm.Model
+	CustomerID     uint   `gorm:"index"`
+	Status         string `gorm:"index"`
+	IsPaid         bool
+	Amount         int64
+	AmountOverride bool `gorm:"not null;default:false"`
+	Currency       string
+	PaymentDate    time.Time
+	DueDate        time.Time
+	Version        int `gorm:"not null;default:1"`
+}
+
+func (initialInvoice) TableName() string { return "invoices" }
+
+type initialCharge struct {
+	gorm.Model
+	InvoiceID   int `gorm:"index"`
+	Type        string
+	Amount      int64
+	Currency    string
+	Description string
+	CategoryID  uint `gorm:"index"`
+}
+
+func (initialCharge) TableName() string { return "charges" }
+
+type initialCategory struct {
+	gorm.Model
+	Name     string
+	ParentID uint `gorm:"index"`
+}
+
+func (initialCategory) TableName() string { return "categories" }
+
+type initialProject struct {
+	gorm.Model
+	Name        string
+	Description string
+	DefaultRate float64
+}
+
+func (initialProject) TableName() string { return "projects" }
+
+type initialTimeEntry struct {
+	gorm.Model
+	ProjectID       uint   `gorm:"index"`
+	User            string `gorm:"column:user_name;index"`
+	StartedAt       time.Time
+	DurationMinutes int
+	Rate            float64
+	Billable        bool
+	Description     string
+	InvoiceID       uint `gorm:"index"`
+	Running         bool
+}
+
+func (initialTimeEntry) TableName() string { return "time_entries" }
+
+type initialExpense struct {
+	gorm.Model
+	ProjectID     uint   `gorm:"index"`
+	User          string `gorm:"column:user_name;index"`
+	IncurredAt    time.Time
+	Amount        float64
+	MarkupPercent float64
+	Description   string
+	Status        string
+	InvoiceID     uint `gorm:"index"`
+}
+
+func (initialExpense) TableName() string { return "expenses" }
+
+type initialCustomer struct {
+	gorm.Model
+	Name           string
+	Email          string
+	BillingAddress string
+	TaxID          string
+}
+
+func (initialCustomer) TableName() string { return "customers" }
+
+type initialPayment struct {
+	gorm.Model
+	InvoiceID uint `gorm:"index"`
+	Amount    int64
+	Currency  string
+	Method    string
+	Reference string
+	PaidAt    time.Time
+}
+
+func (initialPayment) TableName() string { return "payments" }
+
+type initialWebhook struct {
+	gorm.Model
+	URL    string
+	Secret string
+	Events string
+	Active bool
+}
+
+func (initialWebhook) TableName() string { return "webhooks" }
+
+type initialWebhookDelivery struct {
+	gorm.Model
+	WebhookID     uint `gorm:"index"`
+	Event         string
+	Payload       string `gorm:"type:text"`
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string
+}
+
+func (initialWebhookDelivery) TableName() string { return "webhook_deliveries" }
+
+type initialAPIKey struct {
+	gorm.Model
+	Name       string
+	Lookup     string `gorm:"unique_index"`
+	Hash       string
+	Scopes     string
+	CreatedBy  string
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (initialAPIKey) TableName() string { return "api_keys" }
+
+type initialAuditEvent struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+	Actor     string
+	APIKeyID  uint
+	RequestID string
+	Action    string
+	InvoiceID uint   `gorm:"index"`
+	Before    string `gorm:"type:text"`
+	After     string `gorm:"type:text"`
+	Changes   string `gorm:"type:text"`
+}
+
+func (initialAuditEvent) TableName() string { return "audit_events" }
+
+type initialRecurringInvoice struct {
+	gorm.Model
+	CustomerID      uint
+	Currency        string
+	Status          string
+	PaymentTermDays int
+	Interval        string
+	Every           int
+	StartAt         time.Time
+	EndAt           *time.Time
+	NextRunAt       time.Time `gorm:"index"`
+	Runs            int
+	LastInvoiceID   uint
+	Active          bool
+}
+
+func (initialRecurringInvoice) TableName() string { return "recurring_invoices" }
+
+type initialRecurringCharge struct {
+	gorm.Model
+	RecurringInvoiceID uint `gorm:"index"`
+	Type               string
+	Amount             int64
+	Description        string
+	CategoryID         uint
+}
+
+func (initialRecurringCharge) TableName() string { return "recurring_charges" }
+
+type initialDelivery struct {
+	gorm.Model
+	InvoiceID  uint `gorm:"index"`
+	Recipient  string
+	Subject    string
+	Attachment bool
+	Status     string
+	Error      string
+}
+
+func (initialDelivery) TableName() string { return "deliveries" }
+
+// initialSchema lists the initial tables in the order they are created
+var initialSchema = []interface{}{
+	&initialInvoice{}, &initialCharge{}, &initialCategory{}, &initialProject{},
+	&initialTimeEntry{}, &initialExpense{}, &initialCustomer{}, &initialPayment{},
+	&initialWebhook{}, &initialWebhookDelivery{}, &initialAPIKey{}, &initialAuditEvent{},
+	&initialRecurringInvoice{}, &initialRecurringCharge{}, &initialDelivery{},
+}
+
+// Tables added by later migrations are frozen the same way
+
+type paymentLinkTable struct {
+	gorm.Model
+	InvoiceID uint   `gorm:"index"`
+	SessionID string `gorm:"unique_index"`
+	URL       string
+	Amount    int64
+	Currency  string
+	Status    string
+	ExpiresAt time.Time
+	PaymentID uint
+}
+
+func (paymentLinkTable) TableName() string { return "payment_links" }
+
+type idempotencyKeyTable struct {
+	ID             uint `gorm:"primary_key"`
+	CreatedAt      time.Time
+	Actor          string `gorm:"unique_index:idx_idempotency_keys_scope"`
+	Method         string `gorm:"unique_index:idx_idempotency_keys_scope"`
+	Path           string `gorm:"unique_index:idx_idempotency_keys_scope"`
+	IdempotencyKey string `gorm:"unique_index:idx_idempotency_keys_scope"`
+	RequestHash    string
+	Status         int
+	ContentType    string
+	Body           string    `gorm:"type:text"`
+	ExpiresAt      time.Time `gorm:"index"`
+}
+
+func (idempotencyKeyTable) TableName() string { return "idempotency_keys" }
+
+type jobTable struct {
+	gorm.Model
+	Kind      string
+	InvoiceID uint `gorm:"index"`
+	DaysLate  int
+	UniqueKey string `gorm:"unique_index"`
+	Status    string `gorm:"index"`
+	Attempts  int
+	RunAt     time.Time `gorm:"index"`
+	LastError string    `gorm:"type:text"`
+}
+
+func (jobTable) TableName() string { return "jobs" }
+
+// sessionTable has the columns gormstore reads and writes
+type sessionTable struct {
+	ID        string `sql:"unique_index"`
+	Data      string `sql:"type:text"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	ExpiresAt time.Time `sql:"index"`
+}
+
+func (sessionTable) TableName() string { return "sessions" }
+
+type userRoleTable struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Username  string `gorm:"unique_index"`
+	Role      string
+	UpdatedBy string
+}
+
+func (userRoleTable) TableName() string { return "user_roles" }
+
+type attachmentTable struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	InvoiceID   uint `gorm:"index"`
+	Filename    string
+	ContentType string
+	Size        int64
+	SHA256      string `gorm:"column:sha256"`
+	StorageKey  string
+	UploadedBy  string
+}
+
+func (attachmentTable) TableName() string { return "attachments" }
+
+type noteTable struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	InvoiceID uint `gorm:"index"`
+	Author    string
+	Body      string `gorm:"type:text"`
+}
+
+func (noteTable) TableName() string { return "notes" }
+
+type taxRateTable struct {
+	gorm.Model
+	Name         string
+	Percentage   float64
+	Jurisdiction string
+}
+
+func (taxRateTable) TableName() string { return "tax_rates" }
+
+// chargeTaxTable and recurringChargeTaxTable only hold the columns added to
+// existing tables, which AutoMigrate adds without touching the others
+type chargeTaxTable struct {
+	TaxRateID uint  `gorm:"not null;default:0;index"`
+	Tax       int64 `gorm:"not null;default:0"`
+}
+
+func (chargeTaxTable) TableName() string { return "charges" }
+
+type recurringChargeTaxTable struct {
+	TaxRateID uint `gorm:"not null;default:0"`
+}
+
+func (recurringChargeTaxTable) TableName() string { return "recurring_charges" }
+
+// dropTaxRates drops the tax rates and the columns referencing them. The
+// SQLite versions the invoicer is built with can't drop columns, which are
+// left in place with no effect on older versions.
+func dropTaxRates(tx *gorm.DB) error {
+	err := dropTables(taxRateTable{})(tx)
+	if err != nil || tx.Dialect().GetName() == "sqlite3" {
+		return err
+	}
+	err = tx.Model(chargeTaxTable{}).RemoveIndex("idx_charges_tax_rate_id").Error
+	if err == nil {
+		err = tx.Model(chargeTaxTable{}).DropColumn("tax_rate_id").Error
+	}
+	if err == nil {
+		err = tx.Model(chargeTaxTable{}).DropColumn("tax").Error
+	}
+	if err == nil {
+		err = tx.Model(recurringChargeTaxTable{}).DropColumn("tax_rate_id").Error
+	}
+	return err
+}
+
+type invoiceCounterTable struct {
+	Scope      string `gorm:"primary_key;size:32"`
+	LastNumber int64
+}
+
+func (invoiceCounterTable) TableName() string { return "invoice_counters" }
+
+type invoiceNumberTable struct {
+	InvoiceNumber string
+}
+
+func (invoiceNumberTable) TableName() string { return "invoices" }
+
+// numberExistingInvoices adds the invoice numbers and their counters, and
+// numbers the existing invoices in the order they were created, deleted
+// ones included, with the format configured when the migration runs
+func numberExistingInvoices(tx *gorm.DB) error {
+	err := createTables(invoiceCounterTable{}, invoiceNumberTable{})(tx)
+	if err != nil {
+		return err
+	}
+	var invoices []struct {
+		ID        uint
+		CreatedAt time.Time
+	}
+	err = tx.Table("invoices").Select("id, created_at").Order("created_at asc, id asc").Scan(&invoices).Error
+	if err != nil {
+		return err
+	}
+	for _, i := range invoices {
+		number, err := nextInvoiceNumber(tx, i.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+		err = tx.Table("invoices").Where("id = ?", i.ID).UpdateColumn("invoice_number", number).Error
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Model(invoiceNumberTable{}).AddUniqueIndex("uix_invoices_invoice_number", "invoice_number").Error
+}
+
+// dropInvoiceNumbers drops the counters and, except on SQLite as for tax
+// rates, the numbers of invoices
+func dropInvoiceNumbers(tx *gorm.DB) error {
+	err := dropTables(invoiceCounterTable{})(tx)
+	if err == nil {
+		err = tx.Model(invoiceNumberTable{}).RemoveIndex("uix_invoices_invoice_number").Error
+	}
+	if err != nil || tx.Dialect().GetName() == "sqlite3" {
+		return err
+	}
+	return tx.Model(invoiceNumberTable{}).DropColumn("invoice_number").Error
+}
+
+type creditNoteTable struct {
+	gorm.Model
+	InvoiceID uint `gorm:"index"`
+	Status    string
+	Reason    string
+	Amount    int64
+	Currency  string
+	IssuedAt  time.Time
+	VoidedAt  *time.Time
+}
+
+func (creditNoteTable) TableName() string { return "credit_notes" }
+
+type creditNoteLineTable struct {
+	ID           uint `gorm:"primary_key"`
+	CreditNoteID uint `gorm:"index"`
+	Description  string
+	Amount       int64
+}
+
+func (creditNoteLineTable) TableName() string { return "credit_note_lines" }
+
+type shareLinkTable struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	InvoiceID uint `gorm:"index"`
+	CreatedBy string
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+	RevokedBy string
+}
+
+func (shareLinkTable) TableName() string { return "share_links" }
+
+// expenseReceiptTable and attachmentExpenseTable only hold the columns
+// added to existing tables, like chargeTaxTable
+type expenseReceiptTable struct {
+	CustomerID uint `gorm:"not null;default:0;index"`
+	ReceiptID  uint `gorm:"not null;default:0"`
+}
+
+func (expenseReceiptTable) TableName() string { return "expenses" }
+
+type attachmentExpenseTable struct {
+	ExpenseID uint `gorm:"not null;default:0;index"`
+}
+
+func (attachmentExpenseTable) TableName() string { return "attachments" }
+
+// dropExpenseReceipts drops the columns of expense receipts, except on
+// SQLite as for tax rates. Receipts are left in the blob store.
+func dropExpenseReceipts(tx *gorm.DB) error {
+	if tx.Dialect().GetName() == "sqlite3" {
+		return nil
+	}
+	err := tx.Model(attachmentExpenseTable{}).RemoveIndex("idx_attachments_expense_id").Error
+	if err == nil {
+		err = tx.Model(attachmentExpenseTable{}).DropColumn("expense_id").Error
+	}
+	if err == nil {
+		err = tx.Model(expenseReceiptTable{}).RemoveIndex("idx_expenses_customer_id").Error
+	}
+	if err == nil {
+		err = tx.Model(expenseReceiptTable{}).DropColumn("customer_id").Error
+	}
+	if err == nil {
+		err = tx.Model(expenseReceiptTable{}).DropColumn("receipt_id").Error
+	}
+	return err
+}
+
+// createTables returns the step of a migration creating tables
+func createTables(tables ...interface{}) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		return tx.AutoMigrate(tables...).Error
+	}
+}
+
+// dropTables returns the step of a migration dropping tables, in the
+// reverse order of their creation
+func dropTables(tables ...interface{}) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for n := len(tables) - 1; n >= 0; n-- {
+			err := tx.DropTableIfExists(tables[n]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func createInitialSchema(tx *gorm.DB) error {
+	return tx.AutoMigrate(initialSchema...).Error
+}
+
+func dropInitialSchema(tx *gorm.DB) error {
+	for n := len(initialSchema) - 1; n >= 0; n-- {
+		err := tx.DropTableIfExists(initialSchema[n]).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateMinorUnits converts the amounts of invoices, charges and payments
+// stored before currencies existed, which were in major units, to minor
+// units of the default currency
+func migrateMinorUnits(tx *gorm.DB) error {
+	currency := defaultCurrency()
+	scale := math.Pow10(currencyExponents[currency])
+	for _, table := range []string{"invoices", "charges", "payments"} {
+		err := tx.Exec(fmt.Sprintf("UPDATE %s SET amount = ROUND(amount * ?), currency = ? WHERE currency IS NULL OR currency = ''", table),
+			scale, currency).Error
+		if err != nil {
+			return fmt.Errorf("failed to convert amounts of %s to minor units: %s", table, err)
+		}
+	}
+	return nil
+}
+
+const (
+	// migrationLockTimeout bounds the time spent waiting for another
+	// instance to finish migrating the database
+	migrationLockTimeout = 5 * time.Minute
+	// migrationLockExpiry releases the lock of an instance that died while
+	// migrating the database
+	migrationLockExpiry = 15 * time.Minute
+)
+
+// prepareMigrations creates the tables recording applied migrations and
+// locking the database while it is migrated
+func prepareMigrations(db *gorm.DB) error {
+	err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY, name varchar(255) NOT NULL, applied_at timestamp NOT NULL)`).Error
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %s", err)
+	}
+	err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+		id integer PRIMARY KEY, locked_by varchar(255) NOT NULL, locked_at timestamp NOT NULL)`).Error
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations_lock: %s", err)
+	}
+	return nil
+}
+
+// lockMigrations takes the migration lock, so replicas starting together
+// don't apply the same migrations. The lock is a row that only one instance
+// can insert.
+func lockMigrations(db *gorm.DB) (unlock func(), err error) {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d", host, os.Getpid())
+	deadline := time.Now().Add(migrationLockTimeout)
+	for waited := false; ; waited = true {
+		now := time.Now().UTC()
+		err = db.Exec("DELETE FROM schema_migrations_lock WHERE locked_at < ?", now.Add(-migrationLockExpiry)).Error
+		if err == nil {
+			// failing to insert the lock is expected while another instance
+			// holds it, so don't let gorm log it
+			err = db.New().LogMode(false).Exec("INSERT INTO schema_migrations_lock (id, locked_by, locked_at) VALUES (1, ?, ?)",
+				owner, now).Error
+		}
+		if err == nil {
+			return func() {
+				err := db.Exec("DELETE FROM schema_migrations_lock WHERE id = 1 AND locked_by = ?", owner).Error
+				if err != nil {
+					applog.errorf("failed to release the migration lock: %s", err)
+				}
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for the migration lock: %s", err)
+		}
+		if !waited {
+			applog.infof("waiting for another instance to migrate the database")
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// appliedMigrations returns the versions of the applied migrations along
+// with the time they were applied at
+func appliedMigrations(db *gorm.DB) (map[int]time.Time, error) {
+	rows, err := db.Raw("SELECT version, applied_at FROM schema_migrations").Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %s", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %s", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// runMigrationStep runs the up or down step of a migration in a transaction
+// that records it or removes its record
+func runMigrationStep(db *gorm.DB, m migration, up bool) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	sql, fn := m.Up, m.UpFunc
+	if !up {
+		sql, fn = m.Down, m.DownFunc
+	}
+	var err error
+	if fn != nil {
+		err = fn(tx)
+	}
+	for _, stmt := range strings.Split(sql, ";") {
+		if err != nil || strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		err = tx.Exec(stmt).Error
+	}
+	if err == nil && up {
+		err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			m.Version, m.Name, time.Now().UTC()).Error
+	} else if err == nil {
+		err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d %s failed: %s", m.Version, m.Name, err)
+	}
+	return tx.Commit().Error
+}
+
+// migrateUp applies the pending migrations while holding the migration lock
+func migrateUp(db *gorm.DB) error {
+	err := prepareMigrations(db)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockMigrations(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err = runMigrationStep(db, m, true)
+		if err != nil {
+			return err
+		}
+		applog.infof("applied migration %d %s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// migrateDown reverts the last applied migration while holding the
+// migration lock
+func migrateDown(db *gorm.DB) error {
+	err := prepareMigrations(db)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockMigrations(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	last := 0
+	for version := range applied {
+		if version > last {
+			last = version
+		}
+	}
+	if last == 0 {
+		return fmt.Errorf("no migration to revert")
+	}
+	for _, m := range migrations {
+		if m.Version == last {
+			err = runMigrationStep(db, m, false)
+			if err != nil {
+				return err
+			}
+			applog.infof("reverted migration %d %s", m.Version, m.Name)
+			return nil
+		}
+	}
+	return fmt.Errorf("migration %d was applied by a newer version of the invoicer and cannot be reverted by this one", last)
+}
+
+// pendingMigrations lists the migrations that are not applied yet
+func pendingMigrations(db *gorm.DB) ([]migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// writeMigrationStatus lists the known and applied migrations
+func writeMigrationStatus(db *gorm.DB, w io.Writer) error {
+	err := prepareMigrations(db)
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	names := make(map[int]string)
+	for _, m := range migrations {
+		names[m.Version] = m.Name
+	}
+	var versions []int
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+	}
+	for version := range applied {
+		if _, ok := names[version]; !ok {
+			versions = append(versions, version)
+			names[version] = "(unknown to this version of the invoicer)"
+		}
+	}
+	sort.Ints(versions)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, version := range versions {
+		state := "pending"
+		if at, ok := applied[version]; ok {
+			state = at.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", version, names[version], state)
+	}
+	return tw.Flush()
+}
+
+// runMigrateCommand runs the migrate command of the binary, or its -migrate
+// flag
+func runMigrateCommand(db *gorm.DB, command string) error {
+	switch command {
+	case "up":
+		return migrateUp(db)
+	case "down":
+		return migrateDown(db)
+	case "status":
+		return writeMigrationStatus(db, os.Stdout)
+	}
+	return fmt.Errorf("unknown migrate command %q, must be up, down or status", command)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const maxNoteLength = 10000
+
+// Note is a comment left on an invoice by billing staff, such as the
+// outcome of a call or the context of a dispute. Notes are never edited,
+// they form the thread of the invoice.
+type Note struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	InvoiceID uint      `gorm:"index" json:"invoice_id"`
+	Author    string    `json:"author"`
+	Body      string    `gorm:"type:text" json:"body"`
+}
+
+func escapeNotes(notes []Note) {
+	for i := range notes {
+		notes[i].Author = html.EscapeString(notes[i].Author)
+		notes[i].Body = html.EscapeString(notes[i].Body)
+	}
+}
+
+// invoiceNotes returns the notes of an invoice, oldest first
+func invoiceNotes(db *gorm.DB, invoiceID uint) ([]Note, error) {
+	notes := []Note{}
+	err := db.Where("invoice_id = ?", invoiceID).Order("id asc").Find(&notes).Error
+	return notes, err
+}
+
+func validateNote(body string) validationErrors {
+	var errs validationErrors
+	if strings.TrimSpace(body) == "" {
+		errs.add("body", "must not be empty")
+	} else if len(body) > maxNoteLength {
+		errs.add("body", "must not exceed %d characters", maxNoteLength)
+	}
+	return errs
+}
+
+// parseInclude returns the related records requested in the include
+// parameter, a comma separated list of names among those allowed
+func parseInclude(r *http.Request, allowed ...string) (map[string]bool, error) {
+	include := make(map[string]bool)
+	if r.FormValue("include") == "" {
+		return include, nil
+	}
+	for _, name := range strings.Split(r.FormValue("include"), ",") {
+		name = strings.TrimSpace(name)
+		ok := false
+		for _, a := range allowed {
+			ok = ok || a == name
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid include parameter %q, must be one of %s", name, strings.Join(allowed, ", "))
+		}
+		include[name] = true
+	}
+	return include, nil
+}
+
+func (iv *invoicer) getInvoiceNotes(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	notes, err := invoiceNotes(iv.dbFor(r), i1.ID)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve notes of invoice %d: %s", i1.ID, err)
+		return
+	}
+	escapeNotes(notes)
+	writeJSON(w, r, http.StatusOK, notes)
+}
+
+// postInvoiceNote adds a note to an invoice, written by the user or API key
+// of the request
+func (iv *invoicer) postInvoiceNote(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Body string `json:"body"`
+	}
+	if !readJSONBody(w, r, &req) {
+		return
+	}
+	if errs := validateNote(req.Body); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	n := Note{InvoiceID: i1.ID, Author: actorOf(r), Body: req.Body}
+	if n.Author == "" {
+		// like in the history, when authentication is disabled
+		n.Author = "anonymous"
+	}
+	err := iv.dbFor(r).Create(&n).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to add note to invoice %d: %s", i1.ID, err)
+		return
+	}
+	al := appLog{Message: fmt.Sprintf("added note %d to invoice %d", n.ID, i1.ID), Action: "post-invoice-note"}
+	al.log(r)
+	notes := []Note{n}
+	escapeNotes(notes)
+	writeJSON(w, r, http.StatusCreated, notes[0])
+}
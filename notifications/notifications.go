@@ -0,0 +1,79 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package notifications alerts the people running the invoicer, rather than
+// customers, about invoices that need their attention. Notifications are
+// sent through channels such as a Slack channel, an email list or a generic
+// webhook, each implementing Notifier.
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// DefaultTimeout bounds the requests of notifiers created without an http
+// client
+const DefaultTimeout = 10 * time.Second
+
+// Notification is a message about an invoice
+type Notification struct {
+	// Event names what happened, such as invoice.overdue
+	Event string `json:"event"`
+	// Subject summarizes the notification on one line
+	Subject string `json:"subject"`
+	// Text details it, possibly on several lines
+	Text string `json:"text"`
+
+	InvoiceID     uint   `json:"invoice_id"`
+	InvoiceNumber string `json:"invoice_number"`
+	Customer      string `json:"customer,omitempty"`
+	// Amount is the balance of the invoice, formatted with its currency
+	Amount      string    `json:"amount"`
+	DueDate     time.Time `json:"due_date"`
+	DaysOverdue int       `json:"days_overdue"`
+}
+
+// Notifier sends notifications through a channel
+type Notifier interface {
+	// Name identifies the channel in logs and configuration
+	Name() string
+	// Notify sends a notification, giving up when ctx is done
+	Notify(ctx context.Context, n Notification) error
+}
+
+// postJSON sends a JSON body to url and fails on statuses other than 2xx
+func postJSON(ctx context.Context, client *http.Client, url string, body interface{}, headers map[string]string) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package notifications
+
+import (
+	"context"
+	"net/http"
+)
+
+// Slack posts notifications to a Slack incoming webhook
+type Slack struct {
+	// WebhookURL is the incoming webhook, which posts to the channel it was
+	// created for unless Channel is set
+	WebhookURL string
+	// Channel, such as #finance, overrides the channel of the webhook
+	Channel string
+	// Client sends the requests, a client with DefaultTimeout is used if
+	// it is nil
+	Client *http.Client
+}
+
+// Name implements Notifier
+func (s Slack) Name() string {
+	return "slack"
+}
+
+// Notify implements Notifier, posting the subject in bold above the text
+func (s Slack) Notify(ctx context.Context, n Notification) error {
+	msg := struct {
+		Channel string `json:"channel,omitempty"`
+		Text    string `json:"text"`
+	}{s.Channel, "*" + n.Subject + "*\n" + n.Text}
+	return postJSON(ctx, s.Client, s.WebhookURL, msg, nil)
+}
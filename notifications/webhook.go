@@ -0,0 +1,32 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package notifications
+
+import (
+	"context"
+	"net/http"
+)
+
+// Webhook posts notifications as JSON to any URL, such as an incident
+// management or chat tool that isn't supported directly
+type Webhook struct {
+	URL string
+	// Headers are added to the requests, to authenticate them for example
+	Headers map[string]string
+	// Client sends the requests, a client with DefaultTimeout is used if
+	// it is nil
+	Client *http.Client
+}
+
+// Name implements Notifier
+func (wh Webhook) Name() string {
+	return "webhook"
+}
+
+// Notify implements Notifier, the body of the request being the
+// notification
+func (wh Webhook) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, wh.Client, wh.URL, n, wh.Headers)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/Wolverinever1/invoicer-chapter2/notifications"
+)
+
+const (
+	// jobNotifyPrefix starts the kind of the jobs notifying a channel, which
+	// ends with the name of the channel
+	jobNotifyPrefix = "notify_"
+
+	eventInvoiceOverdue = "invoice.overdue"
+
+	notifyTimeout = 30 * time.Second
+)
+
+// notifyChannel is a notifier and the days past the due date at which it
+// is notified of overdue invoices
+type notifyChannel struct {
+	notifier notifications.Notifier
+	days     []int
+}
+
+// notifyChannels configures the channels notified of overdue invoices,
+// emails going through the SMTP relay of the mailer
+func notifyChannels(cfg config.Notify, relay config.SMTP) []notifyChannel {
+	var channels []notifyChannel
+	add := func(n notifications.Notifier, setting string) {
+		days, _ := config.Days(setting)
+		if len(days) > 0 {
+			channels = append(channels, notifyChannel{notifier: n, days: days})
+		}
+	}
+	if cfg.SlackURL != "" {
+		add(notifications.Slack{WebhookURL: cfg.SlackURL, Channel: cfg.SlackChannel}, cfg.SlackDays)
+	}
+	if len(cfg.EmailTo) > 0 {
+		add(notifications.SMTP{
+			Addr:     relay.Addr(),
+			Username: relay.Username,
+			Password: relay.Password,
+			From:     relay.From,
+			To:       cfg.EmailTo,
+		}, cfg.EmailDays)
+	}
+	if cfg.WebhookURL != "" {
+		wh := notifications.Webhook{URL: cfg.WebhookURL}
+		if cfg.WebhookAuthorization != "" {
+			wh.Headers = map[string]string{"Authorization": cfg.WebhookAuthorization}
+		}
+		add(wh, cfg.WebhookDays)
+	}
+	return channels
+}
+
+// scheduleNotifications queues a job per channel for the overdue invoices
+// that reached one of its days since their due date
+func (iv *invoicer) scheduleNotifications(now time.Time) (int, error) {
+	queued := 0
+	for _, ch := range iv.notifyChannels {
+		n, err := iv.scheduleOverdueJobs(now, ch.days, []string{jobNotifyPrefix + ch.notifier.Name()})
+		queued += n
+		if err != nil {
+			return queued, err
+		}
+	}
+	return queued, nil
+}
+
+// notifyOverdue runs the job notifying a channel of an overdue invoice
+func (iv *invoicer) notifyOverdue(j Job, i1 Invoice) error {
+	var notifier notifications.Notifier
+	for _, ch := range iv.notifyChannels {
+		if jobNotifyPrefix+ch.notifier.Name() == j.Kind {
+			notifier = ch.notifier
+		}
+	}
+	if notifier == nil {
+		return errSkipJob{fmt.Sprintf("channel %s is not configured", strings.TrimPrefix(j.Kind, jobNotifyPrefix))}
+	}
+	settled, err := settledAmount(iv.db, i1.ID)
+	if err != nil {
+		return err
+	}
+	n := notifications.Notification{
+		Event:         eventInvoiceOverdue,
+		InvoiceID:     i1.ID,
+		InvoiceNumber: i1.InvoiceNumber,
+		Amount:        formatMinorUnits(i1.Amount-settled, i1.Currency) + " " + i1.Currency,
+		DueDate:       i1.DueDate,
+		DaysOverdue:   int(time.Since(i1.DueDate) / (24 * time.Hour)),
+	}
+	if i1.CustomerID != 0 {
+		var customer Customer
+		if iv.db.First(&customer, i1.CustomerID).Error == nil {
+			n.Customer = customer.Name
+		}
+	}
+	n.Subject = fmt.Sprintf("Invoice %s is %d days overdue", n.InvoiceNumber, n.DaysOverdue)
+	n.Text = fmt.Sprintf("Invoice %s", n.InvoiceNumber)
+	if n.Customer != "" {
+		n.Text += " of " + n.Customer
+	}
+	n.Text += fmt.Sprintf(" was due on %s and has %s left to pay.", n.DueDate.Format("2006-01-02"), n.Amount)
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	err = notifier.Notify(ctx, n)
+	if err != nil {
+		return fmt.Errorf("failed to notify %s: %s", notifier.Name(), err)
+	}
+	applog.infof("notified %s of invoice %d, %d days overdue", notifier.Name(), i1.ID, n.DaysOverdue)
+	return nil
+}
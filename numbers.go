@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const defaultInvoiceNumberFormat = "INV-{year}-{seq:6}"
+
+var (
+	// invoiceNumberFormat lays out the numbers of new invoices, set from
+	// invoices.number_format at startup
+	invoiceNumberFormat = defaultInvoiceNumberFormat
+
+	// seqPlaceholder is replaced with the sequence number of an invoice,
+	// padded with zeros to the width it gives
+	seqPlaceholder = regexp.MustCompile(`\{seq(?::([0-9]+))?\}`)
+)
+
+// setInvoiceNumberFormat checks and sets the format of invoice numbers. It
+// contains the {seq} placeholder, optionally with a width as in {seq:6},
+// and may contain {year}, which restarts the sequence every year.
+func setInvoiceNumberFormat(format string) error {
+	if format == "" {
+		format = defaultInvoiceNumberFormat
+	}
+	if len(seqPlaceholder.FindAllString(format, -1)) != 1 {
+		return fmt.Errorf("invalid invoices.number_format %q, must contain {seq} once", format)
+	}
+	rest := strings.Replace(seqPlaceholder.ReplaceAllString(format, ""), "{year}", "", -1)
+	if strings.ContainsAny(rest, "{}") || strings.TrimSpace(format) != format {
+		return fmt.Errorf("invalid invoices.number_format %q, only {year} and {seq} can be used as placeholders", format)
+	}
+	invoiceNumberFormat = format
+	return nil
+}
+
+// formatInvoiceNumber returns the number of the seq-th invoice of year
+func formatInvoiceNumber(format string, year int, seq int64) string {
+	number := strings.Replace(format, "{year}", strconv.Itoa(year), -1)
+	return seqPlaceholder.ReplaceAllStringFunc(number, func(placeholder string) string {
+		width, _ := strconv.Atoi(seqPlaceholder.FindStringSubmatch(placeholder)[1])
+		return fmt.Sprintf("%0*d", width, seq)
+	})
+}
+
+// numberingScope names the counter the number of an invoice created at t is
+// drawn from: the year of t if numbers contain it, otherwise a single
+// counter for every invoice
+func numberingScope(format string, t time.Time) string {
+	if strings.Contains(format, "{year}") {
+		return strconv.Itoa(t.Year())
+	}
+	return "all"
+}
+
+// invoiceCounter is the last number given to an invoice in a scope
+type invoiceCounter struct {
+	Scope      string `gorm:"primary_key;size:32"`
+	LastNumber int64
+}
+
+func (invoiceCounter) TableName() string { return "invoice_counters" }
+
+// nextInvoiceNumber increments the counter of the scope of an invoice
+// created at t and returns its new number. It runs in the transaction
+// inserting the invoice, which holds the lock on the counter until it
+// commits, so numbers are sequential and a failed insert leaves no gap.
+func nextInvoiceNumber(tx *gorm.DB, t time.Time) (string, error) {
+	scope := numberingScope(invoiceNumberFormat, t)
+	increment := func() (bool, error) {
+		res := tx.Table("invoice_counters").Where("scope = ?", scope).
+			UpdateColumn("last_number", gorm.Expr("last_number + 1"))
+		return res.RowsAffected > 0, res.Error
+	}
+	incremented, err := increment()
+	if err != nil {
+		return "", err
+	}
+	if !incremented {
+		// first invoice of the scope
+		err = createInvoiceCounter(tx, scope)
+		if err != nil {
+			// another transaction inserted the counter in the meantime,
+			// the increment waits for it to commit
+			incremented, retryErr := increment()
+			if retryErr != nil || !incremented {
+				return "", err
+			}
+		}
+	}
+	var c invoiceCounter
+	err = tx.Where("scope = ?", scope).First(&c).Error
+	if err != nil {
+		return "", err
+	}
+	return formatInvoiceNumber(invoiceNumberFormat, t.Year(), c.LastNumber), nil
+}
+
+// createInvoiceCounter inserts the first counter of a scope. The insert
+// runs in a savepoint, so violating the primary key of a counter inserted
+// concurrently doesn't abort the transaction on postgres, and the expected
+// violation isn't logged.
+func createInvoiceCounter(tx *gorm.DB, scope string) error {
+	err := tx.Exec("SAVEPOINT invoice_counter").Error
+	if err != nil {
+		return err
+	}
+	err = tx.New().LogMode(false).Create(&invoiceCounter{Scope: scope, LastNumber: 1}).Error
+	if err != nil {
+		tx.Exec("ROLLBACK TO SAVEPOINT invoice_counter")
+		return err
+	}
+	return tx.Exec("RELEASE SAVEPOINT invoice_counter").Error
+}
+
+// assignInvoiceNumber numbers an invoice about to be inserted by tx
+func assignInvoiceNumber(tx *gorm.DB, i *Invoice) error {
+	number, err := nextInvoiceNumber(tx, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to number invoice: %s", err)
+	}
+	i.InvoiceNumber = number
+	return nil
+}
+
+// getInvoiceByNumber serves an invoice like getInvoice, found by the number
+// shown to customers
+func (iv *invoicer) getInvoiceByNumber(w http.ResponseWriter, r *http.Request) {
+	number := mux.Vars(r)["number"]
+	includeDeleted, err := parseIncludeDeleted(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	i1, err := iv.invoicesFor(r).GetByNumber(number, includeDeleted)
+	if err == errInvoiceNotFound {
+		httpError(w, r, http.StatusNotFound, "No invoice number %s", html.EscapeString(number))
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve invoice number %s: %s", html.EscapeString(number), err)
+		return
+	}
+	iv.serveInvoice(w, r, i1.ID)
+}
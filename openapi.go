@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// apiParam is a query parameter of an operation
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// apiOperation documents a route of the API. Request and Response are
+// values of the Go types of the JSON bodies, from which the schemas of the
+// specification are derived. Operations without a Response type answer
+// with a plain text message.
+type apiOperation struct {
+	Method      string
+	Path        string
+	Tag         string
+	Summary     string
+	Query       []apiParam
+	Request     interface{}
+	Response    interface{}
+	ContentType string
+	// RequestContentType documents request bodies that aren't JSON
+	RequestContentType string
+	Status             int
+}
+
+var invoiceFilterParams = []apiParam{
+	{"customer_id", "integer", "only invoices of this customer"},
+	{"status", "string", "only invoices with this status"},
+	{"is_paid", "boolean", "only paid or unpaid invoices"},
+	{"due_after", "string", "only invoices due on or after this date"},
+	{"due_before", "string", "only invoices due before this date"},
+	{"paid_after", "string", "only invoices paid on or after this date"},
+	{"paid_before", "string", "only invoices paid before this date"},
+	{"include_deleted", "boolean", "include deleted invoices"},
+}
+
+// viewParams select the fields and related records of listed invoices
+var viewParams = []apiParam{
+	{"fields", "string", "comma separated fields of the invoices to return"},
+	{"include", "string", "related records to include: charges, payments, customer"},
+}
+
+var pageParams = []apiParam{
+	{"page", "integer", "page to return, starting at 1"},
+	{"per_page", "integer", fmt.Sprintf("invoices per page, at most %d", maxInvoicesPerPage)},
+}
+
+var dateRangeParams = []apiParam{
+	{"from", "string", "only invoices created on or after this date"},
+	{"to", "string", "only invoices created before this date"},
+}
+
+func joinParams(lists ...[]apiParam) []apiParam {
+	var params []apiParam
+	for _, l := range lists {
+		params = append(params, l...)
+	}
+	return params
+}
+
+// apiOperations lists the documented routes of the invoicer
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/invoices", Tag: "invoices", Summary: "List invoices",
+		Query: joinParams(invoiceFilterParams, pageParams, viewParams), Response: invoicesPage{}},
+	{Method: "GET", Path: "/invoices/deleted", Tag: "invoices", Summary: "List deleted invoices",
+		Query: joinParams(invoiceFilterParams, pageParams, viewParams), Response: invoicesPage{}},
+	{Method: "GET", Path: "/invoices/amount-drift", Tag: "invoices", Summary: "List invoices whose amount differs from their charges",
+		Response: amountDriftReport{}},
+	{Method: "POST", Path: "/invoices/amount-drift/fix", Tag: "invoices", Summary: "Set drifting invoice amounts to the total of their charges",
+		Response: amountDriftReport{}},
+	{Method: "GET", Path: "/search", Tag: "invoices", Summary: "Search invoices by charge and customer",
+		Query: []apiParam{
+			{"q", "string", "text to find in charge types and descriptions and customer names"},
+			{"status", "string", "only return invoices with this status"},
+			{"min_amount", "integer", "minimum amount in minor units"},
+			{"max_amount", "integer", "maximum amount in minor units"},
+			{"limit", "integer", "maximum number of hits, 20 by default"},
+		}, Response: searchResults{}},
+	{Method: "GET", Path: "/events/stream", Tag: "invoices", Summary: "Stream invoice events as server-sent events",
+		Query: []apiParam{
+			{"status", "string", "comma separated statuses of the invoices to stream events of"},
+			{"customer_id", "integer", "only stream events of the invoices of this customer"},
+		}, ContentType: "text/event-stream"},
+	{Method: "GET", Path: "/invoices/export", Tag: "invoices", Summary: "Export invoices as CSV or XLSX",
+		Query: joinParams(invoiceFilterParams, dateRangeParams, []apiParam{
+			{"format", "string", "csv or xlsx"},
+			{"charges", "boolean", "one row per charge"},
+		}), ContentType: "text/csv"},
+	{Method: "GET", Path: "/invoices/due.ics", Tag: "invoices", Summary: "Subscribe to the due dates of unpaid invoices as an iCalendar feed",
+		Query: []apiParam{
+			{"customer_id", "integer", "only the invoices of a customer"},
+			{"token", "string", "API key, for calendar clients that cannot send an Authorization header"},
+		}, ContentType: "text/calendar"},
+	{Method: "POST", Path: "/invoices/import", Tag: "invoices", Summary: "Import invoices from a JSON array, or CSV sent as text/csv",
+		Request: []Invoice{}, Response: importReport{}, Status: http.StatusCreated},
+	{Method: "POST", Path: "/invoices/batch", Tag: "invoices", Summary: "Mark invoices paid, change their status or delete them in a batch",
+		Request: batchRequest{}, Response: batchReport{}},
+	{Method: "POST", Path: "/invoice", Tag: "invoices", Summary: "Create an invoice",
+		Request: Invoice{}, Response: createdInvoice{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/invoice/{id}", Tag: "invoices", Summary: "Get an invoice and its charges",
+		Query: []apiParam{
+			{"include_deleted", "boolean", "return the invoice even if it was deleted"},
+			{"fields", "string", "comma separated fields of the invoice to return"},
+			{"include", "string", "related records to include: charges, payments, customer, notes"},
+		}, Response: Invoice{}},
+	{Method: "GET", Path: "/invoice/number/{number}", Tag: "invoices", Summary: "Get an invoice and its charges by invoice number",
+		Query: []apiParam{
+			{"include_deleted", "boolean", "return the invoice even if it was deleted"},
+			{"fields", "string", "comma separated fields of the invoice to return"},
+			{"include", "string", "related records to include: charges, payments, customer, notes"},
+		}, Response: Invoice{}},
+	{Method: "PUT", Path: "/invoice/{id}", Tag: "invoices", Summary: "Replace an invoice and its charges",
+		Request: Invoice{}, Status: http.StatusAccepted},
+	{Method: "PATCH", Path: "/invoice/{id}", Tag: "invoices", Summary: "Update fields of an invoice with a JSON merge patch",
+		Request: map[string]interface{}{}, Status: http.StatusAccepted},
+	{Method: "DELETE", Path: "/invoice/{id}", Tag: "invoices", Summary: "Delete an invoice", Status: http.StatusAccepted},
+	{Method: "POST", Path: "/invoice/{id}/restore", Tag: "invoices", Summary: "Restore a deleted invoice", Status: http.StatusAccepted},
+	{Method: "DELETE", Path: "/invoice/{id}/purge", Tag: "invoices", Summary: "Permanently erase an invoice", Status: http.StatusAccepted},
+	{Method: "POST", Path: "/invoice/{id}/status", Tag: "invoices", Summary: "Move an invoice to another status",
+		Request: statusRequest{}, Status: http.StatusAccepted},
+	{Method: "GET", Path: "/invoice/{id}/history", Tag: "invoices", Summary: "List the changes made to an invoice",
+		Response: []auditEventView{}},
+	{Method: "GET", Path: "/invoice/{id}/duplicates", Tag: "invoices", Summary: "List the invoices likely to duplicate an invoice",
+		Query:    []apiParam{{"days", "integer", "days between the due dates of duplicates, 7 by default"}},
+		Response: duplicatesReport{}},
+	{Method: "GET", Path: "/invoice/{id}/pdf", Tag: "invoices", Summary: "Render an invoice as PDF", ContentType: "application/pdf"},
+	{Method: "POST", Path: "/invoice/{id}/send", Tag: "invoices", Summary: "Email an invoice",
+		Request: struct {
+			To        string `json:"to"`
+			AttachPDF bool   `json:"attach_pdf"`
+		}{}, Status: http.StatusAccepted},
+	{Method: "GET", Path: "/invoice/{id}/deliveries", Tag: "invoices", Summary: "List the emails of an invoice",
+		Response: []Delivery{}},
+	{Method: "GET", Path: "/invoice/{id}/payments", Tag: "payments", Summary: "List the payments of an invoice",
+		Response: invoicePayments{}},
+	{Method: "POST", Path: "/invoice/{id}/payments", Tag: "payments", Summary: "Record a payment on an invoice",
+		Request: Payment{}, Status: http.StatusCreated},
+	{Method: "POST", Path: "/invoice/{id}/payment-link", Tag: "payments", Summary: "Create a Stripe payment link for the balance of an invoice",
+		Response: PaymentLink{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/invoice/{id}/payment-links", Tag: "payments", Summary: "List the payment links of an invoice",
+		Response: []PaymentLink{}},
+	{Method: "POST", Path: "/invoice/{id}/share", Tag: "invoices", Summary: "Create a signed link letting the customer view an invoice without authenticating",
+		Request: shareRequest{}, Response: ShareLink{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/invoice/{id}/share-links", Tag: "invoices", Summary: "List the share links of an invoice",
+		Response: []ShareLink{}},
+	{Method: "POST", Path: "/share-link/{id}/revoke", Tag: "invoices", Summary: "Revoke a share link",
+		Response: ShareLink{}},
+	{Method: "GET", Path: "/invoice/{id}/notes", Tag: "notes", Summary: "List the notes of an invoice, oldest first",
+		Response: []Note{}},
+	{Method: "POST", Path: "/invoice/{id}/notes", Tag: "notes", Summary: "Add a note to an invoice",
+		Request: struct {
+			Body string `json:"body"`
+		}{}, Response: Note{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/invoice/{id}/credit-notes", Tag: "credit notes", Summary: "List the credit notes of an invoice, oldest first",
+		Response: []CreditNote{}},
+	{Method: "POST", Path: "/invoice/{id}/credit-notes", Tag: "credit notes", Summary: "Issue a credit note on an invoice",
+		Request: CreditNote{}, Response: CreditNote{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/credit-note/{id}", Tag: "credit notes", Summary: "Retrieve a credit note and its lines",
+		Response: CreditNote{}},
+	{Method: "POST", Path: "/credit-note/{id}/void", Tag: "credit notes", Summary: "Void a credit note",
+		Status: http.StatusAccepted},
+	{Method: "GET", Path: "/invoice/{id}/attachments", Tag: "attachments", Summary: "List the attachments of an invoice",
+		Response: []Attachment{}},
+	{Method: "POST", Path: "/invoice/{id}/attachments", Tag: "attachments", Summary: "Attach the files of a multipart upload to an invoice",
+		RequestContentType: "multipart/form-data", Response: []Attachment{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/attachment/{id}", Tag: "attachments", Summary: "Download an attachment",
+		ContentType: "application/octet-stream"},
+	{Method: "DELETE", Path: "/attachment/{id}", Tag: "attachments", Summary: "Delete an attachment",
+		Status: http.StatusAccepted},
+	{Method: "POST", Path: "/webhooks/stripe", Tag: "payments", Summary: "Receive signed Stripe events, recording the payments of payment links"},
+	{Method: "GET", Path: "/invoice/{id}/charges", Tag: "charges", Summary: "List the charges of an invoice",
+		Query: []apiParam{
+			{"after", "integer", "id of the last charge of the previous page"},
+			{"limit", "integer", "charges per page"},
+		}, Response: chargesPage{}},
+	{Method: "POST", Path: "/invoice/{id}/charges/bulk", Tag: "charges", Summary: "Append charges to an invoice",
+		Request: []Charge{}, Response: bulkChargesReport{}, Status: http.StatusCreated},
+	{Method: "POST", Path: "/invoice/{id}/charge", Tag: "charges", Summary: "Add a charge to an invoice and recalculate its amount",
+		Request: Charge{}, Status: http.StatusCreated},
+	{Method: "PUT", Path: "/charge/{id}", Tag: "charges", Summary: "Replace a charge and recalculate the amount of its invoice",
+		Request: Charge{}, Status: http.StatusAccepted},
+	{Method: "DELETE", Path: "/charge/{id}", Tag: "charges", Summary: "Delete a charge and recalculate the amount of its invoice",
+		Status: http.StatusAccepted},
+	{Method: "GET", Path: "/reports/totals", Tag: "reports", Summary: "Sum invoices per currency and convert the total",
+		Query:    joinParams(invoiceFilterParams, dateRangeParams, []apiParam{{"currency", "string", "currency of the total"}}),
+		Response: totalsReport{}},
+	{Method: "GET", Path: "/reports/summary", Tag: "reports", Summary: "Count and sum paid, unpaid and overdue invoices per currency",
+		Query: joinParams(invoiceFilterParams, dateRangeParams), Response: summaryReport{}},
+	{Method: "GET", Path: "/reports/aging", Tag: "reports", Summary: "Sort the balance of unpaid invoices into 30 day buckets past due",
+		Query:    joinParams(invoiceFilterParams, dateRangeParams, []apiParam{{"as_of", "string", "date the invoices are aged at, now by default"}}),
+		Response: agingReport{}},
+	{Method: "GET", Path: "/reports/revenue", Tag: "reports", Summary: "Sum paid invoices per period of their payment date",
+		Query: joinParams(invoiceFilterParams, []apiParam{
+			{"granularity", "string", "day, month (the default), quarter or year"},
+			{"from", "string", "only invoices paid on or after this date"},
+			{"to", "string", "only invoices paid before this date"},
+			{"group_by", "string", "category to also sum the charges per category, rolled up to their parents"},
+		}), Response: revenueReport{}},
+	{Method: "GET", Path: "/reports/tax", Tag: "reports", Summary: "Sum the tax collected on invoices paid in a period per tax rate",
+		Query: []apiParam{
+			{"period", "string", "year, quarter, month or day, such as 2016, 2016-Q2, 2016-05 or 2016-05-31"},
+			{"group_by", "string", "category to also sum the taxed charges per category, rolled up to their parents"},
+		}, Response: taxReport{}},
+	{Method: "GET", Path: "/tax-rates", Tag: "taxes", Summary: "List tax rates", Response: []TaxRate{}},
+	{Method: "POST", Path: "/tax-rate", Tag: "taxes", Summary: "Create a tax rate",
+		Request: TaxRate{}, Response: TaxRate{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/tax-rate/{id}", Tag: "taxes", Summary: "Get a tax rate", Response: TaxRate{}},
+	{Method: "PUT", Path: "/tax-rate/{id}", Tag: "taxes", Summary: "Update a tax rate, without changing the tax of existing charges",
+		Request: TaxRate{}, Response: TaxRate{}, Status: http.StatusAccepted},
+	{Method: "DELETE", Path: "/tax-rate/{id}", Tag: "taxes", Summary: "Delete a tax rate unused by charges",
+		Status: http.StatusAccepted},
+	{Method: "GET", Path: "/customers", Tag: "customers", Summary: "List customers", Response: []Customer{}},
+	{Method: "POST", Path: "/customer", Tag: "customers", Summary: "Create a customer",
+		Request: Customer{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/customer/{id}", Tag: "customers", Summary: "Get a customer", Response: Customer{}},
+	{Method: "PUT", Path: "/customer/{id}", Tag: "customers", Summary: "Update a customer",
+		Request: Customer{}, Status: http.StatusAccepted},
+	{Method: "DELETE", Path: "/customer/{id}", Tag: "customers", Summary: "Delete a customer without invoices",
+		Status: http.StatusAccepted},
+	{Method: "GET", Path: "/customer/{id}/invoices", Tag: "customers", Summary: "List the invoices of a customer",
+		Query: joinParams(invoiceFilterParams, pageParams, viewParams), Response: invoicesPage{}},
+	{Method: "POST", Path: "/graphql", Tag: "graphql", Summary: "Run a GraphQL query or mutation, within the depth and complexity limits",
+		Request: gqlRequest{}, Response: gqlResponse{}},
+	{Method: "GET", Path: "/graphql", Tag: "graphql", Summary: "Run a GraphQL query",
+		Query: []apiParam{
+			{"query", "string", "GraphQL document"},
+			{"operationName", "string", "operation of the document to run"},
+			{"variables", "string", "JSON object of the variables"},
+		}, Response: gqlResponse{}},
+	{Method: "GET", Path: "/graphql/schema", Tag: "graphql", Summary: "Get the GraphQL schema in SDL",
+		ContentType: "text/plain"},
+}
+
+// schemaBuilder derives JSON schemas from Go types, collecting named
+// structs as components referenced by the schemas using them
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.schema(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := t.Name()
+		if _, ok := b.components[name]; !ok {
+			// registered before the fields are built, for recursive types
+			b.components[name] = nil
+			b.components[name] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// object builds the schema of a struct from the fields encoding/json would
+// marshal, flattening embedded structs such as gorm.Model
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	b.addFields(props, t)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (b *schemaBuilder) addFields(props map[string]interface{}, t reflect.Type) {
+	for n := 0; n < t.NumField(); n++ {
+		f := t.Field(n)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			b.addFields(props, f.Type)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+	}
+}
+
+var muxVariable = regexp.MustCompile(`\{([a-z_]+)(:[^}]*)?\}`)
+
+// openAPISpec builds an OpenAPI 3 document of operations
+func openAPISpec(operations []apiOperation) map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+	errorSchema := b.schema(reflect.TypeOf(struct {
+		Error apiError `json:"error"`
+	}{}))
+	paths := make(map[string]interface{})
+	for _, op := range operations {
+		path := muxVariable.ReplaceAllString(op.Path, "{$1}")
+		var params []interface{}
+		for _, m := range muxVariable.FindAllStringSubmatch(op.Path, -1) {
+			// ids are integers, other path variables such as invoice
+			// numbers are strings
+			paramType := "string"
+			if m[1] == "id" {
+				paramType = "integer"
+			}
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": paramType},
+			})
+		}
+		for _, p := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name": p.Name, "in": "query", "description": p.Description,
+				"schema": map[string]interface{}{"type": p.Type},
+			})
+		}
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case op.Response != nil:
+			response["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Response))},
+			}
+		case op.ContentType != "":
+			response["content"] = map[string]interface{}{op.ContentType: map[string]interface{}{}}
+		default:
+			response["content"] = map[string]interface{}{
+				"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+		}
+		operation := map[string]interface{}{
+			"summary": op.Summary,
+			"tags":    []string{op.Tag},
+			"responses": map[string]interface{}{
+				fmt.Sprint(status): response,
+				"default": map[string]interface{}{
+					"description": "error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": errorSchema},
+					},
+				},
+			},
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		switch {
+		case op.RequestContentType != "":
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{op.RequestContentType: map[string]interface{}{}},
+			}
+		case op.Request != nil:
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Invoicer",
+			"version": version,
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": b.components},
+	}
+}
+
+func getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, openAPISpec(apiOperations))
+}
+
+// swaggerUIPage loads Swagger UI from a CDN to browse the specification
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Invoicer API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+window.onload = function() {
+	SwaggerUIBundle({url: "/__api__/openapi.json", dom_id: "#swagger-ui"});
+};
+</script>
+</body>
+</html>
+`
+
+func getSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(swaggerUIPage))
+}
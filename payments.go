@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Payment records money received against an invoice, in minor units of the
+// currency of the invoice. Invoices are paid once their payments and credit
+// notes cover their amount.
+type Payment struct {
+	gorm.Model
+	InvoiceID uint      `gorm:"index" json:"invoice_id"`
+	Amount    int64     `json:"amount"`
+	Currency  string    `json:"currency"`
+	Method    string    `json:"method"`
+	Reference string    `json:"reference" encrypted:"true"`
+	PaidAt    time.Time `json:"paid_at"`
+}
+
+type invoicePayments struct {
+	Payments []Payment `json:"payments"`
+	Currency string    `json:"currency"`
+	Paid     int64     `json:"paid"`
+	Credited int64     `json:"credited"`
+	Balance  int64     `json:"balance"`
+}
+
+func escapePayments(payments []Payment) {
+	for i := range payments {
+		payments[i].Method = html.EscapeString(payments[i].Method)
+		payments[i].Reference = html.EscapeString(payments[i].Reference)
+	}
+}
+
+// paidAmount returns the sum of the payments received on an invoice
+func paidAmount(db *gorm.DB, invoiceID uint) (int64, error) {
+	var paid struct{ Total int64 }
+	err := db.Model(&Payment{}).Select("COALESCE(SUM(amount), 0) AS total").
+		Where("invoice_id = ?", invoiceID).Scan(&paid).Error
+	return paid.Total, err
+}
+
+// lockInvoice reads an invoice within a transaction and locks its row
+// until the transaction ends, so concurrent payments and credit notes on it
+// are recorded one after the other against an up to date balance. sqlite
+// has no row locks: a no-op update takes the write lock of the database
+// instead.
+func lockInvoice(tx *gorm.DB, id uint, includeDeleted bool) (Invoice, error) {
+	var i Invoice
+	if includeDeleted {
+		tx = tx.Unscoped()
+	}
+	if tx.Dialect().GetName() == "sqlite3" {
+		err := tx.Exec("UPDATE invoices SET id = id WHERE id = ?", id).Error
+		if err != nil {
+			return i, err
+		}
+	} else {
+		tx = tx.Set("gorm:query_option", "FOR UPDATE")
+	}
+	res := tx.First(&i, id)
+	if res.RecordNotFound() {
+		return i, errInvoiceNotFound
+	}
+	return i, res.Error
+}
+
+// lockRequestInvoice locks the invoice of a request within a transaction,
+// which is rolled back and answered with an error if it fails
+func lockRequestInvoice(w http.ResponseWriter, r *http.Request, tx *gorm.DB, id uint) (Invoice, bool) {
+	i, err := lockInvoice(tx, id, false)
+	if err != nil {
+		tx.Rollback()
+		status := http.StatusInternalServerError
+		if err == errInvoiceNotFound {
+			status = http.StatusNotFound
+		}
+		httpError(w, r, status, "failed to lock invoice %d: %s", id, err)
+		return i, false
+	}
+	return i, true
+}
+
+// recordPayment inserts a payment within a transaction and moves its invoice
+// to partially paid, or to paid when the payment and the amount already
+// settled by payments and credit notes cover its amount
+func recordPayment(tx *gorm.DB, i *Invoice, p *Payment, settled int64) error {
+	err := tx.Create(p).Error
+	if err != nil {
+		return fmt.Errorf("failed to record payment: %s", err)
+	}
+	updates := map[string]interface{}{"status": statusPartiallyPaid, "version": nextVersion()}
+	if settled+p.Amount >= i.Amount {
+		updates = map[string]interface{}{"status": statusPaid, "is_paid": true, "payment_date": p.PaidAt, "version": nextVersion()}
+	}
+	err = tx.Model(i).Updates(updates).Error
+	if err != nil {
+		return fmt.Errorf("failed to update invoice %d: %s", i.ID, err)
+	}
+	return nil
+}
+
+func (iv *invoicer) getInvoicePayments(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	result := invoicePayments{Payments: []Payment{}, Currency: i1.Currency}
+	err := iv.dbFor(r).Where("invoice_id = ?", i1.ID).Order("paid_at asc").Find(&result.Payments).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve payments of invoice %d: %s", i1.ID, err)
+		return
+	}
+	for _, p := range result.Payments {
+		result.Paid += p.Amount
+	}
+	result.Credited, err = creditedAmount(iv.dbFor(r), i1.ID)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve credit notes of invoice %d: %s", i1.ID, err)
+		return
+	}
+	// negative once credit notes refund part of a paid invoice
+	result.Balance = i1.Amount - result.Paid - result.Credited
+	escapePayments(result.Payments)
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// postInvoicePayment records a payment on an invoice awaiting payment and
+// moves the invoice to partially paid, or to paid when its payments cover
+// its amount
+func (iv *invoicer) postInvoicePayment(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	if !canTransition(i1.Status, statusPaid) {
+		httpError(w, r, http.StatusConflict, "invoice %d is %s and cannot receive payments", i1.ID, i1.Status)
+		return
+	}
+	snapshot := iv.invoiceSnapshot(i1.ID)
+	var p Payment
+	if !readJSONBody(w, r, &p) {
+		return
+	}
+	p.ID = 0
+	p.InvoiceID = i1.ID
+	if p.Currency == "" {
+		p.Currency = i1.Currency
+	}
+	if p.PaidAt.IsZero() {
+		p.PaidAt = time.Now().UTC()
+	}
+
+	tx := iv.dbFor(r).Begin()
+	if tx.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to record payment: %s", tx.Error)
+		return
+	}
+	// the invoice may have been paid or changed since it was loaded
+	i1, ok = lockRequestInvoice(w, r, tx, i1.ID)
+	if !ok {
+		return
+	}
+	if !canTransition(i1.Status, statusPaid) {
+		tx.Rollback()
+		httpError(w, r, http.StatusConflict, "invoice %d is %s and cannot receive payments", i1.ID, i1.Status)
+		return
+	}
+	settled, err := settledAmount(tx, i1.ID)
+	if err != nil {
+		tx.Rollback()
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve balance of invoice %d: %s", i1.ID, err)
+		return
+	}
+	balance := i1.Amount - settled
+	var errs validationErrors
+	switch {
+	case p.Amount <= 0:
+		errs.add("amount", "must be a positive number")
+	case p.Amount > balance:
+		errs.add("amount", "must not exceed the balance of %s %s", formatMinorUnits(balance, i1.Currency), i1.Currency)
+	}
+	if p.Currency != i1.Currency {
+		errs.add("currency", "must match the currency of the invoice, %s", i1.Currency)
+	}
+	if strings.TrimSpace(p.Method) == "" {
+		errs.add("method", "must not be empty")
+	}
+	if len(errs) > 0 {
+		tx.Rollback()
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	before := i1
+	err = recordPayment(tx, &i1, &p, settled)
+	if err != nil {
+		tx.Rollback()
+		httpError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to record payment: %s", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("created payment %d", p.ID)))
+	al := appLog{Message: fmt.Sprintf("created payment %d of %s %s on invoice %d, now %s",
+		p.ID, formatMinorUnits(p.Amount, p.Currency), p.Currency, i1.ID, i1.Status), Action: "post-payment"}
+	al.log(r)
+	iv.audit(r, "payment", i1.ID, snapshot, iv.invoiceSnapshot(i1.ID))
+	iv.fireInvoiceUpdated(before, i1)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// defaultPaymentTermDays is the number of days given to pay invoices
+// generated without an explicit due date
+const defaultPaymentTermDays = 30
+
+// errAlreadyBilled is returned when time entries or expenses being invoiced
+// were billed on another invoice in the meantime
+var errAlreadyBilled = errors.New("time entries or expenses were billed concurrently")
+
+// Project groups the time tracked for a client engagement. Unbilled time
+// entries of a project are turned into invoice charges on demand.
+type Project struct {
+	gorm.Model
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	DefaultRate float64 `json:"default_rate"`
+}
+
+// TimeEntry records time spent by a user on a project. Entries that have
+// been billed carry the ID of their invoice and can no longer be modified.
+type TimeEntry struct {
+	gorm.Model
+	ProjectID       uint      `gorm:"index" json:"project_id"`
+	User            string    `gorm:"column:user_name;index" json:"user"`
+	StartedAt       time.Time `json:"started_at"`
+	DurationMinutes int       `json:"duration_minutes"`
+	Rate            float64   `json:"rate"`
+	Billable        bool      `json:"billable"`
+	Description     string    `json:"description"`
+	InvoiceID       uint      `gorm:"index" json:"invoice_id"`
+	Running         bool      `json:"running"`
+}
+
+// amount returns the value of the time entry in minor units of currency.
+// Rates are in major units per hour.
+func (te TimeEntry) amount(currency string) int64 {
+	return toMinorUnits(float64(te.DurationMinutes)/60*te.Rate, currency)
+}
+
+func validateProject(p Project) error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("project name must not be empty")
+	}
+	if p.DefaultRate < 0 {
+		return fmt.Errorf("default rate must not be negative")
+	}
+	return nil
+}
+
+func validateTimeEntry(te TimeEntry) error {
+	switch {
+	case strings.TrimSpace(te.User) == "":
+		return fmt.Errorf("user must not be empty")
+	case te.StartedAt.IsZero():
+		return fmt.Errorf("started_at must be set")
+	case te.DurationMinutes < 0:
+		return fmt.Errorf("duration must not be negative")
+	case te.Rate < 0:
+		return fmt.Errorf("rate must not be negative")
+	}
+	return nil
+}
+
+func escapeProject(p *Project) {
+	p.Name = html.EscapeString(p.Name)
+	p.Description = html.EscapeString(p.Description)
+}
+
+func escapeTimeEntries(entries []TimeEntry) {
+	for i := range entries {
+		entries[i].User = html.EscapeString(entries[i].User)
+		entries[i].Description = html.EscapeString(entries[i].Description)
+	}
+}
+
+func (iv *invoicer) getProjects(w http.ResponseWriter, r *http.Request) {
+	var projects []Project
+	err := iv.dbFor(r).Order("id asc").Find(&projects).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve projects: %s", err)
+		return
+	}
+	for i := range projects {
+		escapeProject(&projects[i])
+	}
+	writeJSON(w, r, http.StatusOK, projects)
+}
+
+func (iv *invoicer) getProject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var p Project
+	iv.dbFor(r).First(&p, vars["id"])
+	if p.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No project id %s", vars["id"])
+		return
+	}
+	escapeProject(&p)
+	writeJSON(w, r, http.StatusOK, p)
+}
+
+func (iv *invoicer) postProject(w http.ResponseWriter, r *http.Request) {
+	var p Project
+	if !readJSONBody(w, r, &p) {
+		return
+	}
+	p.ID = 0
+	err := validateProject(p)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid project: %s", err)
+		return
+	}
+	iv.dbFor(r).Create(&p)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("created project %d", p.ID)))
+	al := appLog{Message: fmt.Sprintf("created project %d", p.ID), Action: "post-project"}
+	al.log(r)
+}
+
+func (iv *invoicer) putProject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var p Project
+	iv.dbFor(r).First(&p, vars["id"])
+	if p.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No project id %s", vars["id"])
+		return
+	}
+	id := p.ID
+	if !readJSONBody(w, r, &p) {
+		return
+	}
+	p.ID = id
+	err := validateProject(p)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid project: %s", err)
+		return
+	}
+	iv.dbFor(r).Save(&p)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("updated project %d", p.ID)))
+	al := appLog{Message: fmt.Sprintf("updated project %d", p.ID), Action: "put-project"}
+	al.log(r)
+}
+
+func (iv *invoicer) deleteProject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var p Project
+	iv.dbFor(r).First(&p, vars["id"])
+	if p.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No project id %s", vars["id"])
+		return
+	}
+	iv.dbFor(r).Where("project_id = ? AND invoice_id = 0", p.ID).Delete(TimeEntry{})
+	iv.dbFor(r).Delete(&p)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted project %d", p.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted project %d", p.ID), Action: "delete-project"}
+	al.log(r)
+}
+
+// getProjectTimeEntries lists the time entries of a project. Passing
+// `?unbilled=true` restricts the list to entries not yet invoiced.
+func (iv *invoicer) getProjectTimeEntries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var p Project
+	iv.dbFor(r).First(&p, vars["id"])
+	if p.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No project id %s", vars["id"])
+		return
+	}
+	q := iv.dbFor(r).Where("project_id = ?", p.ID)
+	if r.FormValue("unbilled") == "true" {
+		q = q.Where("invoice_id = 0")
+	}
+	var entries []TimeEntry
+	err := q.Order("started_at asc").Find(&entries).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve time entries of project %d: %s", p.ID, err)
+		return
+	}
+	escapeTimeEntries(entries)
+	writeJSON(w, r, http.StatusOK, entries)
+}
+
+func (iv *invoicer) getTimeEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var te TimeEntry
+	iv.dbFor(r).First(&te, vars["id"])
+	if te.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No time entry id %s", vars["id"])
+		return
+	}
+	entries := []TimeEntry{te}
+	escapeTimeEntries(entries)
+	writeJSON(w, r, http.StatusOK, entries[0])
+}
+
+// postTimeEntry records time on a project. When no rate is given, the
+// default rate of the project applies.
+func (iv *invoicer) postTimeEntry(w http.ResponseWriter, r *http.Request) {
+	var te TimeEntry
+	if !readJSONBody(w, r, &te) {
+		return
+	}
+	te.ID = 0
+	te.InvoiceID = 0
+	te.Running = false
+	var p Project
+	iv.dbFor(r).First(&p, te.ProjectID)
+	if p.ID == 0 {
+		httpError(w, r, http.StatusBadRequest, "invalid time entry: project %d does not exist", te.ProjectID)
+		return
+	}
+	if te.Rate == 0 {
+		te.Rate = p.DefaultRate
+	}
+	err := validateTimeEntry(te)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid time entry: %s", err)
+		return
+	}
+	iv.dbFor(r).Create(&te)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("created time entry %d", te.ID)))
+	al := appLog{Message: fmt.Sprintf("created time entry %d on project %d", te.ID, p.ID), Action: "post-time-entry"}
+	al.log(r)
+}
+
+func (iv *invoicer) putTimeEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var te TimeEntry
+	iv.dbFor(r).First(&te, vars["id"])
+	if te.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No time entry id %s", vars["id"])
+		return
+	}
+	if te.InvoiceID != 0 {
+		httpError(w, r, http.StatusConflict, "time entry %d was billed on invoice %d and cannot be modified", te.ID, te.InvoiceID)
+		return
+	}
+	id, projectID, running := te.ID, te.ProjectID, te.Running
+	if !readJSONBody(w, r, &te) {
+		return
+	}
+	te.ID, te.ProjectID, te.InvoiceID, te.Running = id, projectID, 0, running
+	err := validateTimeEntry(te)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid time entry: %s", err)
+		return
+	}
+	iv.dbFor(r).Save(&te)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("updated time entry %d", te.ID)))
+	al := appLog{Message: fmt.Sprintf("updated time entry %d", te.ID), Action: "put-time-entry"}
+	al.log(r)
+}
+
+func (iv *invoicer) deleteTimeEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var te TimeEntry
+	iv.dbFor(r).First(&te, vars["id"])
+	if te.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No time entry id %s", vars["id"])
+		return
+	}
+	if te.InvoiceID != 0 {
+		httpError(w, r, http.StatusConflict, "time entry %d was billed on invoice %d and cannot be deleted", te.ID, te.InvoiceID)
+		return
+	}
+	iv.dbFor(r).Delete(&te)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted time entry %d", te.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted time entry %d", te.ID), Action: "delete-time-entry"}
+	al.log(r)
+}
+
+// billItems marks unbilled time entries or expenses as billed on an invoice,
+// and fails with errAlreadyBilled if any of them was billed in the meantime
+func billItems(tx *gorm.DB, model interface{}, ids []uint, invoiceID uint) error {
+	res := tx.Model(model).Where("id in (?) AND invoice_id = 0", ids).Update("invoice_id", invoiceID)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != int64(len(ids)) {
+		return errAlreadyBilled
+	}
+	return nil
+}
+
+// postProjectInvoice creates an invoice out of the unbilled, billable time
+// entries and the approved expenses of a project. Each of them becomes a
+// charge, and is marked as billed on the new invoice in the same transaction,
+// which also attaches the receipts of the expenses to the invoice.
+func (iv *invoicer) postProjectInvoice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var p Project
+	iv.dbFor(r).First(&p, vars["id"])
+	if p.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No project id %s", vars["id"])
+		return
+	}
+	var params struct {
+		DueDate time.Time `json:"due_date"`
+	}
+	if r.ContentLength != 0 && !readJSONBody(w, r, &params) {
+		return
+	}
+	var (
+		entries  []TimeEntry
+		expenses []Expense
+	)
+	iv.dbFor(r).Where("project_id = ? AND billable = ? AND running = ? AND invoice_id = 0", p.ID, true, false).
+		Order("started_at asc").Find(&entries)
+	iv.dbFor(r).Where("project_id = ? AND status = ? AND invoice_id = 0", p.ID, expenseApproved).
+		Order("incurred_at asc").Find(&expenses)
+	if len(entries) == 0 && len(expenses) == 0 {
+		httpError(w, r, http.StatusConflict, "project %d has no unbilled time or expenses", p.ID)
+		return
+	}
+	if params.DueDate.IsZero() {
+		params.DueDate = time.Now().UTC().AddDate(0, 0, defaultPaymentTermDays)
+	}
+	// rates and expenses are in major units of the default currency
+	currency := defaultCurrency()
+	i1 := Invoice{Status: statusDraft, DueDate: params.DueDate, Currency: currency}
+	// the invoice bills the customer of the expenses when they all name the
+	// same one
+	for n, e := range expenses {
+		if n == 0 || e.CustomerID == i1.CustomerID {
+			i1.CustomerID = e.CustomerID
+			continue
+		}
+		i1.CustomerID = 0
+		break
+	}
+	for _, te := range entries {
+		i1.Charges = append(i1.Charges, Charge{
+			Type:     "time",
+			Amount:   te.amount(currency),
+			Currency: currency,
+			Description: fmt.Sprintf("%s: %s on %s, %d minutes at %.2f/h",
+				p.Name, te.User, te.StartedAt.Format("2006-01-02"), te.DurationMinutes, te.Rate),
+		})
+		i1.Amount += te.amount(currency)
+	}
+	for _, e := range expenses {
+		i1.Charges = append(i1.Charges, Charge{
+			Type:     "expense",
+			Amount:   e.rebilledAmount(currency),
+			Currency: currency,
+			Description: fmt.Sprintf("%s: %s on %s, %.2f plus %g%% markup",
+				p.Name, e.Description, e.IncurredAt.Format("2006-01-02"), e.Amount, e.MarkupPercent),
+		})
+		i1.Amount += e.rebilledAmount(currency)
+	}
+
+	tx := iv.dbFor(r).Begin()
+	err := assignInvoiceNumber(tx, &i1)
+	if err == nil {
+		err = tx.Create(&i1).Error
+	}
+	if err == nil && len(entries) > 0 {
+		ids := make([]uint, len(entries))
+		for i, te := range entries {
+			ids[i] = te.ID
+		}
+		err = billItems(tx, &TimeEntry{}, ids, i1.ID)
+	}
+	if err == nil && len(expenses) > 0 {
+		ids := make([]uint, len(expenses))
+		for i, e := range expenses {
+			ids[i] = e.ID
+		}
+		err = billItems(tx, &Expense{}, ids, i1.ID)
+	}
+	if err == errAlreadyBilled {
+		tx.Rollback()
+		httpError(w, r, http.StatusConflict, "time entries or expenses of project %d were invoiced concurrently, retry", p.ID)
+		return
+	}
+	var receipts []string
+	if err == nil {
+		receipts, err = iv.copyReceipts(tx, expenses, i1.ID)
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		for _, key := range receipts {
+			iv.attachments.blobs.Delete(key)
+		}
+		httpError(w, r, http.StatusInternalServerError, "failed to invoice project %d: %s", p.ID, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("created invoice %d", i1.ID)))
+	al := appLog{Message: fmt.Sprintf("created invoice %d from %d time entries and %d expenses of project %d",
+		i1.ID, len(entries), len(expenses), p.ID), Action: "post-project-invoice"}
+	al.log(r)
+	iv.audit(r, "create", i1.ID, nil, iv.invoiceSnapshot(i1.ID))
+	iv.fireWebhooks(eventInvoiceCreated, i1)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/auth"
+)
+
+// rateLimiter hands out tokens from per client buckets that refill at a
+// fixed rate up to a maximum burst
+type rateLimiter interface {
+	// Allow takes a token from the bucket of key. If the bucket is empty,
+	// it returns false and how long until a token is available.
+	Allow(key string) (bool, time.Duration, error)
+}
+
+// newRateLimiter configures rate limiting from the environment:
+//   - INVOICER_RATE_LIMIT: requests per second allowed per client
+//   - INVOICER_RATE_LIMIT_BURST: requests a client can make at once,
+//     twice the rate by default
+//   - INVOICER_REDIS_URL: redis://[:password@]host:port[/db] of a redis
+//     server sharing the buckets between instances of the invoicer
+//
+// It returns a nil limiter if INVOICER_RATE_LIMIT is not set.
+func newRateLimiter() (rateLimiter, error) {
+	if os.Getenv("INVOICER_RATE_LIMIT") == "" {
+		return nil, nil
+	}
+	rate, err := strconv.ParseFloat(os.Getenv("INVOICER_RATE_LIMIT"), 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("invalid INVOICER_RATE_LIMIT %q, must be a positive number", os.Getenv("INVOICER_RATE_LIMIT"))
+	}
+	burst := int(math.Ceil(rate * 2))
+	if os.Getenv("INVOICER_RATE_LIMIT_BURST") != "" {
+		burst, err = strconv.Atoi(os.Getenv("INVOICER_RATE_LIMIT_BURST"))
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid INVOICER_RATE_LIMIT_BURST %q, must be a positive integer", os.Getenv("INVOICER_RATE_LIMIT_BURST"))
+		}
+	}
+	if os.Getenv("INVOICER_REDIS_URL") != "" {
+		client, err := newRedisClient(os.Getenv("INVOICER_REDIS_URL"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid INVOICER_REDIS_URL: %s", err)
+		}
+		applog.infof("rate limiting to %g requests per second with bursts of %d, shared in redis", rate, burst)
+		return &redisLimiter{client: client, rate: rate, burst: burst}, nil
+	}
+	applog.infof("rate limiting to %g requests per second with bursts of %d", rate, burst)
+	return newMemoryLimiter(rate, burst), nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryLimiter keeps the buckets of a single instance of the invoicer
+type memoryLimiter struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newMemoryLimiter(rate float64, burst int) *memoryLimiter {
+	return &memoryLimiter{rate: rate, burst: burst, buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// Allow implements rateLimiter
+func (m *memoryLimiter) Allow(key string) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.sweep(now)
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(m.burst), last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(m.burst), b.tokens+now.Sub(b.last).Seconds()*m.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / m.rate * float64(time.Second)), nil
+}
+
+// sweep forgets the buckets that are full again, at most once a minute, so
+// clients that went away don't accumulate in memory
+func (m *memoryLimiter) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*m.rate >= float64(m.burst) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey identifies the client of a request by its authenticated
+// user, which is the API key or account it uses, or else by its address.
+// The address is read from the last entry of X-Forwarded-For when
+// INVOICER_TRUST_FORWARDED_FOR is set, for instances behind a load balancer.
+func rateLimitKey(r *http.Request) string {
+	if user, ok := auth.UserFromContext(r.Context()); ok {
+		return "user:" + user
+	}
+	if os.Getenv("INVOICER_TRUST_FORWARDED_FOR") != "" && r.Header.Get("X-Forwarded-For") != "" {
+		hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		return "ip:" + strings.TrimSpace(hops[len(hops)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimit rejects the requests of clients that exceed their rate with a
+// 429. Requests are let through if the limiter fails, so an outage of redis
+// doesn't take the invoicer down with it.
+func rateLimit(l rateLimiter, exempt []string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range exempt {
+				if r.URL.Path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p)) {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+			key := rateLimitKey(r)
+			allowed, wait, err := l.Allow(key)
+			if err != nil {
+				applog.warnf("rate limiter failed, letting request through: %s", err)
+				h.ServeHTTP(w, r)
+				return
+			}
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				httpError(w, r, http.StatusTooManyRequests, "rate limit exceeded for %s, retry in %s", key, wait.Round(time.Millisecond))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
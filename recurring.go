@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	intervalDaily   = "daily"
+	intervalWeekly  = "weekly"
+	intervalMonthly = "monthly"
+	intervalYearly  = "yearly"
+
+	defaultRecurringCheckInterval = time.Minute
+
+	// maxRecurringCatchUp bounds the invoices created for a schedule in one
+	// pass of the scheduler, after a long downtime
+	maxRecurringCatchUp = 12
+)
+
+var recurringIntervals = []string{intervalDaily, intervalWeekly, intervalMonthly, intervalYearly}
+
+// RecurringInvoice is a schedule creating an invoice out of its template
+// charges every interval, starting at StartAt and until EndAt if set.
+// Occurrences are computed from StartAt and the number of runs so far, so
+// monthly schedules starting on the 31st stay at the end of the month.
+type RecurringInvoice struct {
+	gorm.Model
+	CustomerID      uint              `json:"customer_id"`
+	Currency        string            `json:"currency"`
+	Status          string            `json:"status"`
+	PaymentTermDays int               `json:"payment_term_days"`
+	Interval        string            `json:"interval"`
+	Every           int               `json:"every"`
+	StartAt         time.Time         `json:"start_at"`
+	EndAt           *time.Time        `json:"end_at"`
+	NextRunAt       time.Time         `gorm:"index" json:"next_run_at"`
+	Runs            int               `json:"runs"`
+	LastInvoiceID   uint              `json:"last_invoice_id"`
+	Active          bool              `json:"active"`
+	Charges         []RecurringCharge `json:"charges"`
+}
+
+// RecurringCharge is a charge copied onto every invoice of a schedule
+type RecurringCharge struct {
+	gorm.Model
+	RecurringInvoiceID uint   `gorm:"index" json:"recurring_invoice_id"`
+	Type               string `json:"type"`
+	Amount             int64  `json:"amount"`
+	Description        string `json:"description"`
+	CategoryID         uint   `json:"category_id,omitempty"`
+	TaxRateID          uint   `json:"tax_rate_id,omitempty"`
+}
+
+// occurrence returns the date of the nth run of a schedule. Months are
+// added without overflowing into the next one.
+func (ri RecurringInvoice) occurrence(n int) time.Time {
+	switch ri.Interval {
+	case intervalDaily:
+		return ri.StartAt.AddDate(0, 0, n*ri.Every)
+	case intervalWeekly:
+		return ri.StartAt.AddDate(0, 0, 7*n*ri.Every)
+	case intervalYearly:
+		return addMonths(ri.StartAt, 12*n*ri.Every)
+	}
+	return addMonths(ri.StartAt, n*ri.Every)
+}
+
+// addMonths adds months to t, clamping the day to the last day of the
+// resulting month
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// ended returns true once the next run of a schedule is past its end date
+func (ri RecurringInvoice) ended() bool {
+	return ri.EndAt != nil && ri.NextRunAt.After(*ri.EndAt)
+}
+
+// skipPast moves the next run of a schedule to its first occurrence at or
+// after now, so new or rescheduled schedules don't bill past periods
+func (ri *RecurringInvoice) skipPast(now time.Time) {
+	ri.Runs = 0
+	for ri.occurrence(ri.Runs).Before(now) {
+		ri.Runs++
+	}
+	ri.NextRunAt = ri.occurrence(ri.Runs)
+}
+
+// invoice builds the invoice of the next run of a schedule
+func (ri RecurringInvoice) invoice() Invoice {
+	i := Invoice{
+		CustomerID: ri.CustomerID,
+		Status:     ri.Status,
+		Currency:   ri.Currency,
+		DueDate:    ri.NextRunAt.AddDate(0, 0, ri.PaymentTermDays),
+	}
+	for _, rc := range ri.Charges {
+		i.Charges = append(i.Charges, Charge{
+			Type:        rc.Type,
+			Amount:      rc.Amount,
+			Currency:    ri.Currency,
+			Description: rc.Description,
+			CategoryID:  rc.CategoryID,
+			TaxRateID:   rc.TaxRateID,
+		})
+	}
+	return i
+}
+
+// validateRecurringInvoice checks a schedule and its template charges. The
+// error is set if the customer, categories or tax rates couldn't be
+// retrieved.
+func (iv *invoicer) validateRecurringInvoice(ri RecurringInvoice) (validationErrors, error) {
+	var errs validationErrors
+	known := false
+	for _, interval := range recurringIntervals {
+		known = known || ri.Interval == interval
+	}
+	if !known {
+		errs.add("interval", "must be one of %s", strings.Join(recurringIntervals, ", "))
+	}
+	if ri.Every < 1 {
+		errs.add("every", "must be at least 1")
+	}
+	if ri.Status != statusDraft && ri.Status != statusSent {
+		errs.add("status", "must be %s or %s", statusDraft, statusSent)
+	}
+	if ri.PaymentTermDays < 0 {
+		errs.add("payment_term_days", "must not be negative")
+	}
+	if ri.EndAt != nil && ri.EndAt.Before(ri.StartAt) {
+		errs.add("end_at", "must not be before start_at")
+	}
+	if !validCurrency(ri.Currency) {
+		errs.add("currency", "unknown ISO 4217 currency %q", ri.Currency)
+	}
+	if len(ri.Charges) == 0 {
+		errs.add("charges", "must contain at least one charge")
+	}
+	exists, err := iv.customerExists(ri.CustomerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve customer %d: %s", ri.CustomerID, err)
+	}
+	if !exists {
+		errs.add("customer_id", "customer %d does not exist", ri.CustomerID)
+	}
+	categories, err := iv.loadCategories()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve categories: %s", err)
+	}
+	taxRates, err := iv.loadTaxRates()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve tax rates: %s", err)
+	}
+	for n, c := range ri.invoice().Charges {
+		validateCharge(&errs, fmt.Sprintf("charges[%d].", n), c, ri.Currency, categories, taxRates)
+	}
+	return errs, nil
+}
+
+// readRecurringInvoice parses a schedule from a request body, defaulting
+// its optional fields
+func readRecurringInvoice(w http.ResponseWriter, r *http.Request) (ri RecurringInvoice, ok bool) {
+	ri = RecurringInvoice{Status: statusDraft, Every: 1, PaymentTermDays: defaultPaymentTermDays, Active: true}
+	if !readJSONBody(w, r, &ri) {
+		return ri, false
+	}
+	ri.ID, ri.Runs, ri.LastInvoiceID = 0, 0, 0
+	if ri.Currency == "" {
+		ri.Currency = defaultCurrency()
+	}
+	ri.Currency = strings.ToUpper(ri.Currency)
+	if ri.StartAt.IsZero() {
+		ri.StartAt = time.Now().UTC()
+	}
+	for n := range ri.Charges {
+		ri.Charges[n].ID = 0
+	}
+	return ri, true
+}
+
+func escapeRecurringInvoice(ri *RecurringInvoice) {
+	for n := range ri.Charges {
+		ri.Charges[n].Type = html.EscapeString(ri.Charges[n].Type)
+		ri.Charges[n].Description = html.EscapeString(ri.Charges[n].Description)
+	}
+}
+
+func (iv *invoicer) getRecurringInvoices(w http.ResponseWriter, r *http.Request) {
+	var schedules []RecurringInvoice
+	err := iv.dbFor(r).Preload("Charges").Order("id asc").Find(&schedules).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve recurring invoices: %s", err)
+		return
+	}
+	for n := range schedules {
+		escapeRecurringInvoice(&schedules[n])
+	}
+	writeJSON(w, r, http.StatusOK, schedules)
+}
+
+func (iv *invoicer) getRecurringInvoice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var ri RecurringInvoice
+	iv.dbFor(r).Preload("Charges").First(&ri, vars["id"])
+	if ri.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No recurring invoice id %s", vars["id"])
+		return
+	}
+	escapeRecurringInvoice(&ri)
+	writeJSON(w, r, http.StatusOK, ri)
+}
+
+func (iv *invoicer) postRecurringInvoice(w http.ResponseWriter, r *http.Request) {
+	ri, ok := readRecurringInvoice(w, r)
+	if !ok {
+		return
+	}
+	errs, err := iv.validateRecurringInvoice(ri)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to validate recurring invoice: %s", err)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	ri.skipPast(time.Now().UTC())
+	err = iv.dbFor(r).Create(&ri).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to create recurring invoice: %s", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("created recurring invoice %d", ri.ID)))
+	al := appLog{Message: fmt.Sprintf("created recurring invoice %d, next run at %s", ri.ID, ri.NextRunAt.Format(time.RFC3339)),
+		Action: "post-recurring-invoice"}
+	al.log(r)
+}
+
+// putRecurringInvoice replaces a schedule and its template charges. The
+// schedule restarts from its start date if its timing changed, otherwise
+// its next run is kept.
+func (iv *invoicer) putRecurringInvoice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var current RecurringInvoice
+	iv.dbFor(r).First(&current, vars["id"])
+	if current.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No recurring invoice id %s", vars["id"])
+		return
+	}
+	ri, ok := readRecurringInvoice(w, r)
+	if !ok {
+		return
+	}
+	errs, err := iv.validateRecurringInvoice(ri)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to validate recurring invoice %d: %s", current.ID, err)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	ri.ID, ri.CreatedAt, ri.LastInvoiceID = current.ID, current.CreatedAt, current.LastInvoiceID
+	if ri.Interval == current.Interval && ri.Every == current.Every && ri.StartAt.Equal(current.StartAt) {
+		ri.Runs, ri.NextRunAt = current.Runs, current.NextRunAt
+	} else {
+		ri.skipPast(time.Now().UTC())
+	}
+	tx := iv.dbFor(r).Begin()
+	err = tx.Where("recurring_invoice_id = ?", ri.ID).Delete(&RecurringCharge{}).Error
+	if err == nil {
+		err = tx.Save(&ri).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		httpError(w, r, http.StatusInternalServerError, "failed to update recurring invoice %d: %s", ri.ID, err)
+		return
+	}
+	tx.Commit()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("updated recurring invoice %d", ri.ID)))
+	al := appLog{Message: fmt.Sprintf("updated recurring invoice %d, next run at %s", ri.ID, ri.NextRunAt.Format(time.RFC3339)),
+		Action: "put-recurring-invoice"}
+	al.log(r)
+}
+
+func (iv *invoicer) deleteRecurringInvoice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var ri RecurringInvoice
+	iv.dbFor(r).First(&ri, vars["id"])
+	if ri.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No recurring invoice id %s", vars["id"])
+		return
+	}
+	iv.dbFor(r).Where("recurring_invoice_id = ?", ri.ID).Delete(&RecurringCharge{})
+	iv.dbFor(r).Delete(&ri)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted recurring invoice %d", ri.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted recurring invoice %d", ri.ID), Action: "delete-recurring-invoice"}
+	al.log(r)
+}
+
+// postRecurringInvoiceRun creates the invoice of the next run of a schedule
+// immediately, and advances the schedule to the run after it
+func (iv *invoicer) postRecurringInvoiceRun(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var ri RecurringInvoice
+	iv.dbFor(r).Preload("Charges").First(&ri, vars["id"])
+	if ri.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No recurring invoice id %s", vars["id"])
+		return
+	}
+	if ri.ended() {
+		httpError(w, r, http.StatusConflict, "recurring invoice %d ended on %s", ri.ID, ri.EndAt.Format(time.RFC3339))
+		return
+	}
+	i1, err := iv.runRecurringInvoice(r, ri)
+	if err != nil {
+		if errs, ok := err.(validationErrors); ok {
+			writeValidationErrors(w, r, errs)
+			return
+		}
+		httpError(w, r, http.StatusConflict, "failed to run recurring invoice %d: %s", ri.ID, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("created invoice %d", i1.ID)))
+	al := appLog{Message: fmt.Sprintf("created invoice %d from recurring invoice %d", i1.ID, ri.ID), Action: "post-recurring-invoice-run"}
+	al.log(r)
+}
+
+// runRecurringInvoice creates the invoice of the next run of a schedule
+// and advances the schedule in the same transaction. The schedule is only
+// advanced if its next run is still the one the invoice was built for, so
+// instances of the invoicer running the scheduler concurrently don't bill
+// the same run twice. r is nil when the scheduler runs the schedule.
+func (iv *invoicer) runRecurringInvoice(r *http.Request, ri RecurringInvoice) (Invoice, error) {
+	// runs caught up after a downtime can be due in the past
+	i1 := ri.invoice()
+	errs, err := iv.validateInvoice(i1, false)
+	if err != nil {
+		return i1, err
+	}
+	if len(errs) > 0 {
+		return i1, errs
+	}
+	if err := iv.taxCharges(i1.Charges); err != nil {
+		return i1, err
+	}
+	i1.Amount = sumCharges(i1.Charges)
+	tx := iv.dbFor(r).Begin()
+	res := tx.Model(&RecurringInvoice{}).Where("id = ? AND runs = ?", ri.ID, ri.Runs).
+		Updates(map[string]interface{}{"runs": ri.Runs + 1, "next_run_at": ri.occurrence(ri.Runs + 1)})
+	if res.Error == nil && res.RowsAffected == 0 {
+		tx.Rollback()
+		return i1, fmt.Errorf("run %d was already invoiced", ri.Runs+1)
+	}
+	err = res.Error
+	if err == nil {
+		err = assignInvoiceNumber(tx, &i1)
+	}
+	if err == nil {
+		err = tx.Create(&i1).Error
+	}
+	if err == nil {
+		err = tx.Model(&RecurringInvoice{}).Where("id = ?", ri.ID).UpdateColumn("last_invoice_id", i1.ID).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return i1, err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return i1, err
+	}
+	iv.audit(r, "create", i1.ID, nil, iv.invoiceSnapshot(i1.ID))
+	iv.fireWebhooks(eventInvoiceCreated, i1)
+	return i1, nil
+}
+
+// runDueRecurringInvoices creates the invoices of the schedules due at
+// now, catching up on the runs missed while the invoicer was down
+func (iv *invoicer) runDueRecurringInvoices(now time.Time) (created int, err error) {
+	var due []RecurringInvoice
+	err = iv.db.Preload("Charges").Where("active = ? AND next_run_at <= ? AND (end_at IS NULL OR next_run_at <= end_at)", true, now).Find(&due).Error
+	if err != nil {
+		return 0, err
+	}
+	for _, ri := range due {
+		for n := 0; n < maxRecurringCatchUp && !ri.NextRunAt.After(now) && !ri.ended(); n++ {
+			i1, err := iv.runRecurringInvoice(nil, ri)
+			if err != nil {
+				applog.errorf("failed to run recurring invoice %d: %s", ri.ID, err)
+				break
+			}
+			applog.infof("created invoice %d from recurring invoice %d", i1.ID, ri.ID)
+			created++
+			ri.Runs++
+			ri.NextRunAt = ri.occurrence(ri.Runs)
+		}
+	}
+	return created, nil
+}
+
+// watchRecurringInvoices runs the due schedules at startup, then at every
+// interval
+func (iv *invoicer) watchRecurringInvoices(interval time.Duration) {
+	for {
+		_, err := iv.runDueRecurringInvoices(time.Now().UTC())
+		if err != nil {
+			applog.errorf("failed to run recurring invoices: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const exchangeRatesCacheTTL = time.Hour
+
+// exchangeRateProvider returns how many units of one currency a unit of
+// another is worth
+type exchangeRateProvider interface {
+	Rate(from, to string) (float64, error)
+}
+
+// staticRates are exchange rates set in the configuration
+type staticRates map[string]float64
+
+// parseStaticRates reads rates of the form EUR:USD=1.08,GBP:USD=1.27
+func parseStaticRates(s string) (staticRates, error) {
+	rates := make(staticRates)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		pair := strings.SplitN(strings.ToUpper(kv[0]), ":", 2)
+		if len(kv) != 2 || len(pair) != 2 || !validCurrency(pair[0]) || !validCurrency(pair[1]) {
+			return nil, fmt.Errorf("invalid exchange rate %q, expected FROM:TO=rate", entry)
+		}
+		rate, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid exchange rate %q, must be a positive number", entry)
+		}
+		rates[pair[0]+":"+pair[1]] = rate
+	}
+	return rates, nil
+}
+
+// Rate implements exchangeRateProvider. The inverse of a configured rate is
+// used if only the opposite direction is set.
+func (s staticRates) Rate(from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	if rate, ok := s[from+":"+to]; ok {
+		return rate, nil
+	}
+	if rate, ok := s[to+":"+from]; ok {
+		return 1 / rate, nil
+	}
+	return 0, fmt.Errorf("no exchange rate from %s to %s", from, to)
+}
+
+// httpRates fetches rates from a service that returns
+// {"base": "USD", "rates": {"EUR": 0.92, ...}} for GET <url>?base=USD, and
+// caches them for an hour
+type httpRates struct {
+	url    string
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedRates
+}
+
+type cachedRates struct {
+	rates   map[string]float64
+	fetched time.Time
+}
+
+// Rate implements exchangeRateProvider
+func (h *httpRates) Rate(from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.cache[from]
+	if !ok || time.Since(c.fetched) > exchangeRatesCacheTTL {
+		rates, err := h.fetch(from)
+		if err != nil {
+			return 0, err
+		}
+		c = cachedRates{rates: rates, fetched: time.Now()}
+		h.cache[from] = c
+	}
+	rate, ok := c.rates[to]
+	if !ok || rate <= 0 {
+		return 0, fmt.Errorf("no exchange rate from %s to %s", from, to)
+	}
+	return rate, nil
+}
+
+func (h *httpRates) fetch(base string) (map[string]float64, error) {
+	resp, err := h.client.Get(h.url + "?base=" + base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch exchange rates of %s: %s", base, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch exchange rates of %s: status %d", base, resp.StatusCode)
+	}
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse exchange rates of %s: %s", base, err)
+	}
+	return body.Rates, nil
+}
+
+// newExchangeRateProvider configures exchange rates from the environment,
+// either fetched from INVOICER_EXCHANGE_RATES_URL or set statically in
+// INVOICER_EXCHANGE_RATES
+func newExchangeRateProvider() (exchangeRateProvider, error) {
+	if u := os.Getenv("INVOICER_EXCHANGE_RATES_URL"); u != "" {
+		return &httpRates{url: u, client: &http.Client{Timeout: 10 * time.Second}, cache: make(map[string]cachedRates)}, nil
+	}
+	rates, err := parseStaticRates(os.Getenv("INVOICER_EXCHANGE_RATES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid INVOICER_EXCHANGE_RATES: %s", err)
+	}
+	return rates, nil
+}
+
+// parseReportFilters reads the filters of the list endpoint and the `from`
+// and `to` dates bounding reports
+func parseReportFilters(r *http.Request) (filters invoiceFilters, from, to time.Time, err error) {
+	filters, err = parseInvoiceFilters(r)
+	if err != nil {
+		return
+	}
+	from, err = parseDateParam("from", r.FormValue("from"))
+	if err != nil {
+		return
+	}
+	to, err = parseDateParam("to", r.FormValue("to"))
+	return
+}
+
+// inDateRange restricts a query to rows whose column is between from,
+// included, and to, excluded, either bound being optional
+func inDateRange(q *gorm.DB, column string, from, to time.Time) *gorm.DB {
+	if !from.IsZero() {
+		q = q.Where(column+" >= ?", from)
+	}
+	if !to.IsZero() {
+		q = q.Where(column+" < ?", to)
+	}
+	return q
+}
+
+type currencyTotal struct {
+	Currency string  `json:"currency"`
+	Count    int     `json:"count"`
+	Amount   int64   `json:"amount"`
+	Rate     float64 `json:"rate,omitempty"`
+}
+
+type totalsReport struct {
+	Currency   string          `json:"currency"`
+	Total      int64           `json:"total"`
+	Currencies []currencyTotal `json:"currencies"`
+}
+
+// getTotalsReport sums the amounts of the invoices matching the filters of
+// the list endpoint, created between `from` and `to`, per currency and
+// converted to `currency`, which defaults to the default currency
+func (iv *invoicer) getTotalsReport(w http.ResponseWriter, r *http.Request) {
+	filters, from, to, err := parseReportFilters(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	target := strings.ToUpper(r.FormValue("currency"))
+	if target == "" {
+		target = defaultCurrency()
+	}
+	if !validCurrency(target) {
+		httpError(w, r, http.StatusBadRequest, "invalid currency %q in parameter currency", r.FormValue("currency"))
+		return
+	}
+	q := inDateRange(filters.apply(iv.dbFor(r).Model(&Invoice{})), "created_at", from, to)
+	report := totalsReport{Currency: target, Currencies: []currencyTotal{}}
+	err = q.Select("currency, count(*) as count, coalesce(sum(amount), 0) as amount").
+		Group("currency").Order("currency asc").Scan(&report.Currencies).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to compute invoice totals: %s", err)
+		return
+	}
+	var total float64
+	for n, t := range report.Currencies {
+		rate, err := iv.exchangeRates.Rate(t.Currency, target)
+		if err != nil {
+			httpError(w, r, http.StatusServiceUnavailable, "failed to convert totals to %s: %s", target, err)
+			return
+		}
+		report.Currencies[n].Rate = rate
+		total += toMajorUnits(t.Amount, t.Currency) * rate
+	}
+	report.Total = toMinorUnits(total, target)
+	writeJSON(w, r, http.StatusOK, report)
+	al := appLog{Message: fmt.Sprintf("reported totals of %d currencies in %s", len(report.Currencies), target), Action: "get-totals-report"}
+	al.log(r)
+}
+
+// receivableStatuses are the statuses of invoices issued and awaiting
+// payment, whose balance is owed by customers
+var receivableStatuses = []string{statusSent, statusPartiallyPaid, statusOverdue, statusDisputed}
+
+// withBalance joins the payments and credit notes of invoices, so queries
+// can sum the balance left to pay with balanceColumn
+func withBalance(q *gorm.DB) *gorm.DB {
+	return q.Joins("LEFT JOIN (SELECT invoice_id, SUM(amount) AS paid FROM payments WHERE deleted_at IS NULL GROUP BY invoice_id) payments_total " +
+		"ON payments_total.invoice_id = invoices.id").
+		Joins("LEFT JOIN (SELECT invoice_id, SUM(amount) AS credited FROM credit_notes WHERE deleted_at IS NULL AND status = '" + creditNoteIssued + "' GROUP BY invoice_id) credit_notes_total " +
+			"ON credit_notes_total.invoice_id = invoices.id")
+}
+
+const balanceColumn = "(amount - COALESCE(payments_total.paid, 0) - COALESCE(credit_notes_total.credited, 0))"
+
+// statusCondition returns an SQL condition on the status of invoices and
+// its arguments
+func statusCondition(statuses ...string) (string, []interface{}) {
+	placeholders := make([]string, len(statuses))
+	args := make([]interface{}, len(statuses))
+	for n, s := range statuses {
+		placeholders[n], args[n] = "?", s
+	}
+	return "status IN (" + strings.Join(placeholders, ", ") + ")", args
+}
+
+type summaryTotal struct {
+	Count  int   `json:"count"`
+	Amount int64 `json:"amount"`
+}
+
+// currencySummary counts the invoices of a currency. Paid invoices are
+// summed by amount, unpaid and overdue ones by the balance left to pay.
+type currencySummary struct {
+	Currency string       `json:"currency"`
+	Paid     summaryTotal `json:"paid"`
+	Unpaid   summaryTotal `json:"unpaid"`
+	Overdue  summaryTotal `json:"overdue"`
+}
+
+type summaryReport struct {
+	Currencies []currencySummary `json:"currencies"`
+}
+
+// getSummaryReport counts and sums paid, unpaid and overdue invoices per
+// currency, filtered like the totals report. Unpaid invoices are those
+// awaiting payment, overdue ones included.
+func (iv *invoicer) getSummaryReport(w http.ResponseWriter, r *http.Request) {
+	filters, from, to, err := parseReportFilters(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	unpaid, unpaidArgs := statusCondition(receivableStatuses...)
+	var args []interface{}
+	args = append(args, statusPaid, statusPaid)
+	args = append(args, unpaidArgs...)
+	args = append(args, unpaidArgs...)
+	args = append(args, statusOverdue, statusOverdue)
+	var rows []struct {
+		Currency       string
+		PaidCount      int
+		PaidAmount     int64
+		UnpaidCount    int
+		UnpaidBalance  int64
+		OverdueCount   int
+		OverdueBalance int64
+	}
+	q := inDateRange(filters.apply(withBalance(iv.dbFor(r).Model(&Invoice{}))), "invoices.created_at", from, to)
+	err = q.Select("currency, "+
+		"SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS paid_count, "+
+		"COALESCE(SUM(CASE WHEN status = ? THEN amount ELSE 0 END), 0) AS paid_amount, "+
+		"SUM(CASE WHEN "+unpaid+" THEN 1 ELSE 0 END) AS unpaid_count, "+
+		"COALESCE(SUM(CASE WHEN "+unpaid+" THEN "+balanceColumn+" ELSE 0 END), 0) AS unpaid_balance, "+
+		"SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS overdue_count, "+
+		"COALESCE(SUM(CASE WHEN status = ? THEN "+balanceColumn+" ELSE 0 END), 0) AS overdue_balance", args...).
+		Group("currency").Order("currency asc").Scan(&rows).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to summarize invoices: %s", err)
+		return
+	}
+	report := summaryReport{Currencies: []currencySummary{}}
+	for _, row := range rows {
+		report.Currencies = append(report.Currencies, currencySummary{
+			Currency: row.Currency,
+			Paid:     summaryTotal{row.PaidCount, row.PaidAmount},
+			Unpaid:   summaryTotal{row.UnpaidCount, row.UnpaidBalance},
+			Overdue:  summaryTotal{row.OverdueCount, row.OverdueBalance},
+		})
+	}
+	writeJSON(w, r, http.StatusOK, report)
+	al := appLog{Message: fmt.Sprintf("summarized invoices of %d currencies", len(report.Currencies)), Action: "get-summary-report"}
+	al.log(r)
+}
+
+// agingBuckets are the buckets of the aging report, by days past due.
+// Receivables not yet due are current.
+var agingBuckets = []struct {
+	Name string
+	Days int
+}{{"current", 0}, {"1-30", 30}, {"31-60", 60}, {"61-90", 90}, {"90+", -1}}
+
+type agingBucket struct {
+	Bucket  string `json:"bucket"`
+	Count   int    `json:"count"`
+	Balance int64  `json:"balance"`
+}
+
+type currencyAging struct {
+	Currency string        `json:"currency"`
+	Balance  int64         `json:"balance"`
+	Buckets  []agingBucket `json:"buckets"`
+}
+
+type agingReport struct {
+	AsOf       time.Time       `json:"as_of"`
+	Currencies []currencyAging `json:"currencies"`
+}
+
+// getAgingReport sorts the balance of invoices awaiting payment per
+// currency into buckets of 30 days past their due date, as of the `as_of`
+// date or now
+func (iv *invoicer) getAgingReport(w http.ResponseWriter, r *http.Request) {
+	filters, from, to, err := parseReportFilters(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	asOf, err := parseDateParam("as_of", r.FormValue("as_of"))
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if asOf.IsZero() {
+		asOf = time.Now().UTC()
+	}
+	// the bucket of an invoice is computed by comparing its due date to
+	// the start of each bucket, which works the same in every database
+	bucket := "CASE"
+	var args []interface{}
+	for _, b := range agingBuckets {
+		if b.Days < 0 {
+			bucket += " ELSE ? END"
+			args = append(args, b.Name)
+			break
+		}
+		bucket += " WHEN due_date >= ? THEN ?"
+		args = append(args, asOf.Add(-time.Duration(b.Days)*24*time.Hour), b.Name)
+	}
+	var rows []struct {
+		Currency string
+		Bucket   string
+		Count    int
+		Balance  int64
+	}
+	receivable, statusArgs := statusCondition(receivableStatuses...)
+	q := inDateRange(filters.apply(withBalance(iv.dbFor(r).Model(&Invoice{}))), "invoices.created_at", from, to)
+	err = q.Where(receivable, statusArgs...).
+		Select("currency, "+bucket+" AS bucket, COUNT(*) AS count, COALESCE(SUM("+balanceColumn+"), 0) AS balance", args...).
+		Group("currency, bucket").Order("currency asc").Scan(&rows).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to compute aging of receivables: %s", err)
+		return
+	}
+	report := agingReport{AsOf: asOf, Currencies: []currencyAging{}}
+	for _, row := range rows {
+		n := len(report.Currencies) - 1
+		if n < 0 || report.Currencies[n].Currency != row.Currency {
+			c := currencyAging{Currency: row.Currency}
+			for _, b := range agingBuckets {
+				c.Buckets = append(c.Buckets, agingBucket{Bucket: b.Name})
+			}
+			report.Currencies = append(report.Currencies, c)
+			n++
+		}
+		c := &report.Currencies[n]
+		for k := range c.Buckets {
+			if c.Buckets[k].Bucket == row.Bucket {
+				c.Buckets[k].Count, c.Buckets[k].Balance = row.Count, row.Balance
+			}
+		}
+		c.Balance += row.Balance
+	}
+	writeJSON(w, r, http.StatusOK, report)
+	al := appLog{Message: fmt.Sprintf("reported aging of receivables in %d currencies", len(report.Currencies)), Action: "get-aging-report"}
+	al.log(r)
+}
+
+// revenueGranularities are the periods revenue can be grouped by
+var revenueGranularities = []string{"day", "month", "quarter", "year"}
+
+// periodExpression returns the SQL expression formatting a date column as
+// the period of granularity it falls in, such as 2016-05 or 2016-Q2
+func periodExpression(dialect, granularity, column string) string {
+	switch {
+	case dialect == "postgres":
+		format := map[string]string{"day": "YYYY-MM-DD", "month": "YYYY-MM", "quarter": `YYYY-"Q"Q`, "year": "YYYY"}[granularity]
+		return fmt.Sprintf("to_char(%s, '%s')", column, format)
+	case dialect == "mysql" && granularity == "quarter":
+		return fmt.Sprintf("CONCAT(YEAR(%s), '-Q', QUARTER(%s))", column, column)
+	case dialect == "mysql":
+		format := map[string]string{"day": "%Y-%m-%d", "month": "%Y-%m", "year": "%Y"}[granularity]
+		return fmt.Sprintf("DATE_FORMAT(%s, '%s')", column, format)
+	}
+	if granularity == "quarter" {
+		return fmt.Sprintf("strftime('%%Y', %s) || '-Q' || ((CAST(strftime('%%m', %s) AS INTEGER) + 2) / 3)", column, column)
+	}
+	format := map[string]string{"day": "%Y-%m-%d", "month": "%Y-%m", "year": "%Y"}[granularity]
+	return fmt.Sprintf("strftime('%s', %s)", format, column)
+}
+
+type revenuePeriod struct {
+	Period   string `json:"period"`
+	Currency string `json:"currency"`
+	Count    int    `json:"count"`
+	Amount   int64  `json:"amount"`
+}
+
+type revenueReport struct {
+	Granularity string          `json:"granularity"`
+	Periods     []revenuePeriod `json:"periods"`
+	Categories  []categoryTotal `json:"categories,omitempty"`
+}
+
+// getRevenueReport sums the amounts of paid invoices per currency and per
+// period of their payment date, of the `granularity` given. The `from` and
+// `to` dates bound the payment date. With `group_by=category`, the charges
+// of these invoices are also summed per category, and rolled up to the
+// categories above them.
+func (iv *invoicer) getRevenueReport(w http.ResponseWriter, r *http.Request) {
+	filters, from, to, err := parseReportFilters(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	granularity := r.FormValue("granularity")
+	if granularity == "" {
+		granularity = "month"
+	}
+	known := false
+	for _, g := range revenueGranularities {
+		known = known || g == granularity
+	}
+	if !known {
+		httpError(w, r, http.StatusBadRequest, "invalid granularity %q, must be one of %s", granularity, strings.Join(revenueGranularities, ", "))
+		return
+	}
+	byCategory, err := parseGroupBy(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	db := iv.dbFor(r)
+	period := periodExpression(db.Dialect().GetName(), granularity, "payment_date")
+	report := revenueReport{Granularity: granularity, Periods: []revenuePeriod{}}
+	q := inDateRange(filters.apply(db.Model(&Invoice{})), "payment_date", from, to)
+	err = q.Where("status = ?", statusPaid).
+		Select(period + " AS period, currency, COUNT(*) AS count, COALESCE(SUM(amount), 0) AS amount").
+		Group("period, currency").Order("period asc, currency asc").Scan(&report.Periods).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to compute revenue: %s", err)
+		return
+	}
+	if byCategory {
+		// the filters name columns of invoices that charges may share
+		paid := inDateRange(filters.apply(db.Model(&Invoice{})), "payment_date", from, to).
+			Where("status = ?", statusPaid).Select("id")
+		q = db.Table("charges").Joins("JOIN invoices ON invoices.id = charges.invoice_id").
+			Where("charges.deleted_at IS NULL AND charges.invoice_id IN (?)", paid.QueryExpr())
+		report.Categories, err = iv.categoryTotals(q.Select(periodExpression(db.Dialect().GetName(), granularity, "invoices.payment_date") + " AS period, " +
+			"invoices.currency, charges.category_id, COALESCE(SUM(charges.amount), 0) AS amount, COALESCE(SUM(charges.tax), 0) AS tax").
+			Group("period, invoices.currency, charges.category_id"))
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "failed to compute revenue per category: %s", err)
+			return
+		}
+	}
+	writeJSON(w, r, http.StatusOK, report)
+	al := appLog{Message: fmt.Sprintf("reported revenue of %d periods by %s", len(report.Periods), granularity), Action: "get-revenue-report"}
+	al.log(r)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+)
+
+const (
+	jobRetention = "retention"
+	// maxRetentionPerRun is the number of invoices each rule handles in a
+	// run, the others being left for the next runs
+	maxRetentionPerRun = 1000
+	// retentionArchiveBatch is the number of invoices per archive
+	retentionArchiveBatch = 100
+)
+
+// retentionPolicy holds the rules of the retention subsystem, in days, 0
+// disabling a rule
+type retentionPolicy struct {
+	// PurgeDeletedDays is the number of days soft deleted invoices are kept
+	// before being erased
+	PurgeDeletedDays int
+	// ArchivePaidDays is the age in days past which paid invoices are moved
+	// from the database to an archive in the blob store
+	ArchivePaidDays int
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.PurgeDeletedDays > 0 || p.ArchivePaidDays > 0
+}
+
+// newRetentionPolicy configures the retention rules, both disabled by
+// default
+func newRetentionPolicy(cfg config.Retention) retentionPolicy {
+	var p retentionPolicy
+	p.PurgeDeletedDays, _ = config.Day(cfg.PurgeDeletedDays)
+	p.ArchivePaidDays, _ = config.Day(cfg.ArchivePaidDays)
+	return p
+}
+
+// retentionRule reports what a rule applies to in the next run
+type retentionRule struct {
+	Days int `json:"days"`
+	// Before is the time before which invoices are deleted, for the purge,
+	// or created, for the archive
+	Before *time.Time `json:"before,omitempty"`
+	// Count is the number of invoices the rule applies to, of which the
+	// next run handles InvoiceIDs
+	Count      int    `json:"count"`
+	InvoiceIDs []uint `json:"invoice_ids"`
+}
+
+type retentionReport struct {
+	PurgeDeleted retentionRule `json:"purge_deleted"`
+	ArchivePaid  retentionRule `json:"archive_paid"`
+}
+
+// planRetention finds the invoices the rules of the policy apply to at now
+func (iv *invoicer) planRetention(r *http.Request, now time.Time) (retentionReport, error) {
+	p := iv.retention
+	report := retentionReport{
+		PurgeDeleted: retentionRule{Days: p.PurgeDeletedDays, InvoiceIDs: []uint{}},
+		ArchivePaid:  retentionRule{Days: p.ArchivePaidDays, InvoiceIDs: []uint{}},
+	}
+	if p.PurgeDeletedDays > 0 {
+		before := now.Add(-time.Duration(p.PurgeDeletedDays) * 24 * time.Hour)
+		report.PurgeDeleted.Before = &before
+		query := iv.dbFor(r).Unscoped().Model(&Invoice{}).Where("deleted_at IS NOT NULL AND deleted_at < ?", before)
+		err := query.Count(&report.PurgeDeleted.Count).Error
+		if err == nil {
+			err = query.Order("id asc").Limit(maxRetentionPerRun).Pluck("id", &report.PurgeDeleted.InvoiceIDs).Error
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to find deleted invoices to purge: %s", err)
+		}
+	}
+	if p.ArchivePaidDays > 0 {
+		before := now.Add(-time.Duration(p.ArchivePaidDays) * 24 * time.Hour)
+		report.ArchivePaid.Before = &before
+		query := iv.dbFor(r).Model(&Invoice{}).Where("status = ? AND created_at < ?", statusPaid, before)
+		err := query.Count(&report.ArchivePaid.Count).Error
+		if err == nil {
+			err = query.Order("id asc").Limit(maxRetentionPerRun).Pluck("id", &report.ArchivePaid.InvoiceIDs).Error
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to find paid invoices to archive: %s", err)
+		}
+	}
+	return report, nil
+}
+
+// archivedInvoice is an invoice in an archive, along with every record
+// attached to it. The contents of attachments stay in the blob store.
+type archivedInvoice struct {
+	Invoice     Invoice      `json:"invoice"`
+	Payments    []Payment    `json:"payments"`
+	CreditNotes []CreditNote `json:"credit_notes"`
+	Notes       []Note       `json:"notes"`
+	Deliveries  []Delivery   `json:"deliveries"`
+	Attachments []Attachment `json:"attachments"`
+	History     []AuditEvent `json:"history"`
+}
+
+type invoiceArchive struct {
+	ArchivedAt time.Time         `json:"archived_at"`
+	Invoices   []archivedInvoice `json:"invoices"`
+}
+
+// archiveInvoice gathers an invoice and its records for an archive. The
+// encrypted columns of the records are archived as stored, so archives
+// don't hold their plaintext.
+func (iv *invoicer) archiveInvoice(id uint) (archivedInvoice, error) {
+	var a archivedInvoice
+	var err error
+	a.Invoice, err = iv.invoices.Get(id, false)
+	if err != nil {
+		return a, err
+	}
+	a.Invoice.Charges, err = iv.invoices.Charges(a.Invoice, 0, 0)
+	if err != nil {
+		return a, err
+	}
+	a.CreditNotes, err = invoiceCreditNotes(iv.db, id)
+	if err != nil {
+		return a, err
+	}
+	for _, records := range []interface{}{&a.Payments, &a.Notes, &a.Deliveries, &a.Attachments, &a.History} {
+		err = withCiphertext(iv.db).Where("invoice_id = ?", id).Order("id asc").Find(records).Error
+		if err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+// applyRetention runs the rules of the policy: it erases the soft deleted
+// invoices past their retention, then moves the old paid invoices to
+// gzipped JSON archives in the blob store of attachments, under archives/.
+// Each invoice archived is erased once its archive is stored, only its
+// history keeping the key of the archive.
+func (iv *invoicer) applyRetention(now time.Time) error {
+	plan, err := iv.planRetention(nil, now)
+	if err != nil {
+		return err
+	}
+	purged := 0
+	for _, id := range plan.PurgeDeleted.InvoiceIDs {
+		var i1 Invoice
+		i1.ID = id
+		err = iv.purgeInvoice(nil, i1, true)
+		if err != nil {
+			return fmt.Errorf("failed to purge invoice %d: %s", id, err)
+		}
+		iv.audit(nil, "purge", id, nil, nil)
+		purged++
+	}
+	if purged > 0 {
+		applog.infof("purged %d invoices deleted more than %d days ago", purged, plan.PurgeDeleted.Days)
+	}
+	archived := 0
+	ids := plan.ArchivePaid.InvoiceIDs
+	for start := 0; start < len(ids); start += retentionArchiveBatch {
+		end := start + retentionArchiveBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		archive := invoiceArchive{ArchivedAt: now}
+		for _, id := range ids[start:end] {
+			a, err := iv.archiveInvoice(id)
+			if err == errInvoiceNotFound {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to gather invoice %d for its archive: %s", id, err)
+			}
+			archive.Invoices = append(archive.Invoices, a)
+		}
+		if len(archive.Invoices) == 0 {
+			continue
+		}
+		key := fmt.Sprintf("archives/invoices-%s-%d-%d.json.gz", now.Format("20060102T150405Z"),
+			archive.Invoices[0].Invoice.ID, archive.Invoices[len(archive.Invoices)-1].Invoice.ID)
+		err = iv.storeArchive(key, archive)
+		if err != nil {
+			return fmt.Errorf("failed to store archive %s: %s", key, err)
+		}
+		for _, a := range archive.Invoices {
+			// the attachments are referenced by the archive
+			err = iv.purgeInvoice(nil, a.Invoice, false)
+			if err != nil {
+				return fmt.Errorf("failed to erase invoice %d stored in archive %s: %s", a.Invoice.ID, key, err)
+			}
+			iv.audit(nil, "archive", a.Invoice.ID, nil, map[string]interface{}{"archive": key})
+			archived++
+		}
+		applog.infof("archived %d paid invoices to %s", len(archive.Invoices), key)
+	}
+	if archived > 0 {
+		applog.infof("archived %d paid invoices older than %d days", archived, plan.ArchivePaid.Days)
+	}
+	return nil
+}
+
+// storeArchive writes an archive as gzipped JSON to the blob store
+func (iv *invoicer) storeArchive(key string, archive invoiceArchive) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	err := json.NewEncoder(gz).Encode(archive)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return iv.attachments.blobs.Put(key, "application/gzip", buf.Bytes())
+}
+
+// watchRetention queues the retention job once a day, so a single instance
+// of the invoicer runs it and failed runs are retried like other jobs
+func (iv *invoicer) watchRetention(interval time.Duration) {
+	for {
+		now := time.Now().UTC()
+		ok, err := iv.enqueueJob(Job{Kind: jobRetention, UniqueKey: jobRetention + ":" + now.Format("2006-01-02")})
+		if err != nil {
+			applog.errorf("failed to schedule retention: %s", err)
+		} else if ok {
+			applog.infof("queued retention job")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// getAdminRetention reports what the next run of the retention policy
+// would purge and archive, without changing anything
+func (iv *invoicer) getAdminRetention(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	report, err := iv.planRetention(r, time.Now().UTC())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, report)
+	al := appLog{Message: fmt.Sprintf("next retention run would purge %d invoices and archive %d",
+		len(report.PurgeDeleted.InvoiceIDs), len(report.ArchivePaid.InvoiceIDs)), Action: "get-admin-retention"}
+	al.log(r)
+}
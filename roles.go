@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/auth"
+	"github.com/gorilla/mux"
+)
+
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+
+	// permissions are named like the scopes of API keys, which grant them
+	permRead   = scopeRead
+	permWrite  = scopeWrite
+	permDelete = scopeDelete
+	permAdmin  = "admin"
+
+	ctxPermissions = "permissions"
+)
+
+var (
+	roles = []string{roleViewer, roleEditor, roleAdmin}
+
+	rolePermissions = map[string][]string{
+		roleViewer: {permRead},
+		roleEditor: {permRead, permWrite},
+		roleAdmin:  {permRead, permWrite, permDelete, permAdmin},
+	}
+	anonymousPermissions = []string{permRead, permWrite, permDelete}
+
+	// admins always have the admin role, set from auth.admins at startup
+	admins []string
+	// defaultRole is the role of users who weren't given one, set from
+	// auth.default_role at startup
+	defaultRole = roleEditor
+)
+
+// routePermission requires a permission for the requests matching a method
+// and a path
+type routePermission struct {
+	method     string
+	path       *regexp.Regexp
+	permission string
+}
+
+// routePermissions lists the routes that need another permission than
+// reading for safe methods, deleting for DELETE and writing for the
+// others. The gRPC methods and GraphQL operations are all called with POST,
+// GraphQL mutations checking their own permissions. An empty permission
+// lets anyone in.
+var routePermissions = []routePermission{
+	{"POST", regexp.MustCompile(`^/log(in|out)$`), ""},
+	{"GET", regexp.MustCompile(`^/shared/`), ""},
+	{"DELETE", regexp.MustCompile(`^/invoice/[0-9]+/purge$`), permAdmin},
+	{"POST", regexp.MustCompile(`^/invoices/amount-drift/fix$`), permAdmin},
+	{"POST", regexp.MustCompile(`^/invoicer\.Invoicer/(GetInvoice|ListInvoices)$`), permRead},
+	{"POST", regexp.MustCompile(`^/invoicer\.Invoicer/DeleteInvoice$`), permDelete},
+	{"POST", regexp.MustCompile(`^/graphql$`), permRead},
+	{"", regexp.MustCompile(`^/api-keys?(/|$)`), permAdmin},
+	{"", regexp.MustCompile(`^/admin/`), permAdmin},
+}
+
+// requiredPermission returns the permission a request needs
+func requiredPermission(r *http.Request) string {
+	for _, rp := range routePermissions {
+		if (rp.method == "" || rp.method == r.Method) && rp.path.MatchString(r.URL.Path) {
+			return rp.permission
+		}
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return permRead
+	case "DELETE":
+		return permDelete
+	}
+	return permWrite
+}
+
+// UserRole is the role given to a user by an administrator
+type UserRole struct {
+	ID        uint      `gorm:"primary_key" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Username  string    `gorm:"unique_index" json:"username"`
+	Role      string    `json:"role"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+func isAdminUser(user string) bool {
+	for _, admin := range admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// roleOf returns the role of a user: admin for those listed in
+// auth.admins, the role given to them otherwise, or the default role
+func (iv *invoicer) roleOf(r *http.Request, user string) (string, error) {
+	if isAdminUser(user) {
+		return roleAdmin, nil
+	}
+	var ur UserRole
+	res := iv.dbFor(r).Where("username = ?", user).First(&ur)
+	if res.RecordNotFound() {
+		return defaultRole, nil
+	}
+	return ur.Role, res.Error
+}
+
+// authorize checks that the user or API key of every request has the
+// permission its route requires, and denies it with a 403 naming the
+// missing permission otherwise. Users get the permissions of their role
+// and API keys those of their scopes, but never the admin permission, so a
+// leaked key cannot be used to issue more keys. Requests made while
+// authentication is disabled get every permission but admin. It runs after
+// the authentication middlewares.
+func (iv *invoicer) authorize(public []string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range public {
+				if r.URL.Path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p)) {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+			permissions := anonymousPermissions
+			if scopes, ok := r.Context().Value(ctxAPIKeyScopes).([]string); ok {
+				permissions = scopes
+			} else if user, ok := auth.UserFromContext(r.Context()); ok {
+				role, err := iv.roleOf(r, user)
+				if err != nil {
+					httpError(w, r, http.StatusInternalServerError, "failed to retrieve role of %s: %s", user, err)
+					return
+				}
+				permissions = rolePermissions[role]
+			}
+			r = addtoContext(r, ctxPermissions, permissions)
+			need := requiredPermission(r)
+			if need != "" && !hasPermission(r, need) {
+				denyPermission(w, r, need)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hasPermission returns true if the user or API key of a request was
+// granted permission by authorize
+func hasPermission(r *http.Request, permission string) bool {
+	permissions, _ := r.Context().Value(ctxPermissions).([]string)
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func denyPermission(w http.ResponseWriter, r *http.Request, permission string) {
+	al := appLog{ErrorCode: http.StatusForbidden, Message: fmt.Sprintf("%s lacks the %s permission for %s %s", actorOf(r), permission, r.Method, r.URL.Path)}
+	al.log(r)
+	msg := fmt.Sprintf("%s %s requires the %s permission", r.Method, r.URL.Path, permission)
+	if id, ok := apiKeyFromContext(r); ok && permission != permAdmin {
+		msg = fmt.Sprintf("API key %d lacks the %s scope", id, permission)
+	} else if ok {
+		msg = fmt.Sprintf("%s %s requires the admin permission, which API keys never have", r.Method, r.URL.Path)
+	}
+	writeError(w, r, http.StatusForbidden, apiError{Code: errForbidden, Message: msg, Permission: permission})
+}
+
+// isAdmin returns true if the user of a request has the admin role
+func isAdmin(r *http.Request) bool {
+	return hasPermission(r, permAdmin)
+}
+
+// requireAdmin denies requests of users who aren't administrators. The
+// admin routes are listed in routePermissions, but their handlers check
+// again in case they are mounted elsewhere.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !isAdmin(r) {
+		denyPermission(w, r, permAdmin)
+		return false
+	}
+	return true
+}
+
+func (iv *invoicer) getAdminRoles(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	userRoles := []UserRole{}
+	err := iv.dbFor(r).Order("username asc").Find(&userRoles).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve roles: %s", err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		Admins      []string   `json:"admins"`
+		DefaultRole string     `json:"default_role"`
+		Users       []UserRole `json:"users"`
+	}{admins, defaultRole, userRoles})
+}
+
+// putAdminRole gives a role to a user. Users listed in auth.admins are
+// administrators whatever their role.
+func (iv *invoicer) putAdminRole(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	user := mux.Vars(r)["user"]
+	var req struct {
+		Role string `json:"role"`
+	}
+	if !readJSONBody(w, r, &req) {
+		return
+	}
+	if _, ok := rolePermissions[req.Role]; !ok {
+		var errs validationErrors
+		errs.add("role", "unknown role %q, must be one of %s", req.Role, strings.Join(roles, ", "))
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	ur := UserRole{Username: user}
+	err := iv.dbFor(r).Where(UserRole{Username: user}).FirstOrInit(&ur).Error
+	if err == nil {
+		ur.Role, ur.UpdatedBy = req.Role, actorOf(r)
+		err = iv.dbFor(r).Save(&ur).Error
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to store role of %s: %s", user, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, ur)
+	al := appLog{Message: fmt.Sprintf("gave role %s to %s", ur.Role, user), Action: "put-admin-role"}
+	al.log(r)
+}
+
+// deleteAdminRole takes the role of a user back, leaving them with the
+// default role
+func (iv *invoicer) deleteAdminRole(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	user := mux.Vars(r)["user"]
+	res := iv.dbFor(r).Where("username = ?", user).Delete(UserRole{})
+	if res.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to delete role of %s: %s", user, res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		httpError(w, r, http.StatusNotFound, "%s has no role", user)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted role of %s", user)))
+	al := appLog{Message: fmt.Sprintf("deleted role of %s", user), Action: "delete-admin-role"}
+	al.log(r)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	// maxSearchMatches bounds the matching rows ranked by a search
+	maxSearchMatches = 1000
+	// searchSnippetContext is the number of characters kept around the
+	// match in snippets
+	searchSnippetContext = 40
+)
+
+// invoiceSearch is a search for invoices through the descriptions and types
+// of their charges and the names of their customers
+type invoiceSearch struct {
+	Query     string
+	Status    string
+	MinAmount *int64
+	MaxAmount *int64
+}
+
+// matchInvoice returns true if an invoice passes the filters of a search
+func (q invoiceSearch) matchInvoice(i Invoice) bool {
+	if i.DeletedAt != nil || (q.Status != "" && i.Status != q.Status) {
+		return false
+	}
+	if q.MinAmount != nil && i.Amount < *q.MinAmount {
+		return false
+	}
+	return q.MaxAmount == nil || i.Amount <= *q.MaxAmount
+}
+
+// searchMatch is a field of an invoice, of one of its charges or of its
+// customer, matching a search
+type searchMatch struct {
+	InvoiceID uint   `json:"-"`
+	Field     string `json:"field"`
+	ChargeID  uint   `json:"charge_id,omitempty"`
+	Text      string `json:"-"`
+	Snippet   string `json:"snippet"`
+}
+
+// searchFieldWeights ranks invoices by the fields they match, customer names
+// weighing more than charge types, and charge types more than descriptions
+var searchFieldWeights = map[string]int{
+	"customer.name":      3,
+	"charge.type":        2,
+	"charge.description": 1,
+}
+
+type searchHit struct {
+	Invoice Invoice       `json:"invoice"`
+	Score   int           `json:"score"`
+	Matches []searchMatch `json:"matches"`
+}
+
+type searchResults struct {
+	Query string      `json:"query"`
+	Total int         `json:"total"`
+	Hits  []searchHit `json:"hits"`
+}
+
+// likeEscape escapes the wildcards of LIKE patterns. Backslashes escape
+// the closing quote of ESCAPE '\' on mysql, so a character that isn't
+// special in string literals of any dialect is used instead.
+const likeEscape = "!"
+
+// likePattern turns a search query into a LIKE pattern matching it anywhere
+// in a field, escaping the wildcards it contains with likeEscape
+func likePattern(query string) string {
+	r := strings.NewReplacer(likeEscape, likeEscape+likeEscape, `%`, likeEscape+`%`, `_`, likeEscape+`_`)
+	return "%" + r.Replace(query) + "%"
+}
+
+// highlight returns an HTML escaped snippet of text around the first
+// occurrence of query, wrapped in a mark element
+func highlight(text, query string) string {
+	start := -1
+	for i := 0; i+len(query) <= len(text); i++ {
+		if isRuneStart(text[i]) && strings.EqualFold(text[i:i+len(query)], query) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return html.EscapeString(text)
+	}
+	end := start + len(query)
+	from, to := start-searchSnippetContext, end+searchSnippetContext
+	prefix, suffix := "", ""
+	if from > 0 {
+		prefix = "…"
+	} else {
+		from = 0
+	}
+	if to < len(text) {
+		suffix = "…"
+	} else {
+		to = len(text)
+	}
+	// don't cut multibyte characters in half
+	for from > 0 && !isRuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !isRuneStart(text[to]) {
+		to++
+	}
+	return prefix + html.EscapeString(text[from:start]) + "<mark>" + html.EscapeString(text[start:end]) + "</mark>" +
+		html.EscapeString(text[end:to]) + suffix
+}
+
+// containsFold reports whether query is within text, ignoring case
+func containsFold(text, query string) bool {
+	return strings.Contains(strings.ToLower(text), strings.ToLower(query))
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// searchInvoices ranks the invoices matching a search by the weight of the
+// fields they match, most recent first among equals, and returns up to
+// limit of them along with the total number of matching invoices
+func (iv *invoicer) searchInvoices(r *http.Request, q invoiceSearch, limit int) (searchResults, error) {
+	results := searchResults{Query: q.Query, Hits: []searchHit{}}
+	matches, err := iv.invoicesFor(r).Search(q, maxSearchMatches)
+	if err != nil {
+		return results, fmt.Errorf("failed to search invoices: %s", err)
+	}
+	hits := make(map[uint]*searchHit)
+	var ids []uint
+	for _, m := range matches {
+		hit, ok := hits[m.InvoiceID]
+		if !ok {
+			hit = &searchHit{Matches: []searchMatch{}}
+			hits[m.InvoiceID] = hit
+			ids = append(ids, m.InvoiceID)
+		}
+		m.Snippet = highlight(m.Text, q.Query)
+		hit.Score += searchFieldWeights[m.Field]
+		hit.Matches = append(hit.Matches, m)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		if hits[ids[a]].Score != hits[ids[b]].Score {
+			return hits[ids[a]].Score > hits[ids[b]].Score
+		}
+		return ids[a] > ids[b]
+	})
+	results.Total = len(ids)
+	for _, id := range ids {
+		if len(results.Hits) == limit {
+			break
+		}
+		hit := hits[id]
+		hit.Invoice, err = iv.invoicesFor(r).Get(id, false)
+		if err == errInvoiceNotFound {
+			// deleted since it matched
+			continue
+		}
+		if err != nil {
+			return results, fmt.Errorf("failed to retrieve invoice %d: %s", id, err)
+		}
+		results.Hits = append(results.Hits, *hit)
+	}
+	return results, nil
+}
+
+// parseAmountParam parses an optional amount in minor units
+func parseAmountParam(r *http.Request, name string) (*int64, error) {
+	if r.FormValue(name) == "" {
+		return nil, nil
+	}
+	amount, err := strconv.ParseInt(r.FormValue(name), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount %q in parameter %s", r.FormValue(name), name)
+	}
+	return &amount, nil
+}
+
+// getSearch searches invoices with the `q` parameter, filtered by the
+// `status`, `min_amount` and `max_amount` parameters
+func (iv *invoicer) getSearch(w http.ResponseWriter, r *http.Request) {
+	q := invoiceSearch{Query: strings.TrimSpace(r.FormValue("q"))}
+	if q.Query == "" {
+		httpError(w, r, http.StatusBadRequest, "missing search query in parameter q")
+		return
+	}
+	if r.FormValue("status") != "" {
+		if !validInvoiceStatus(r.FormValue("status")) {
+			httpError(w, r, http.StatusBadRequest, "invalid status %q in parameter status", r.FormValue("status"))
+			return
+		}
+		q.Status = r.FormValue("status")
+	}
+	var err error
+	amounts := []struct {
+		name string
+		dst  **int64
+	}{
+		{"min_amount", &q.MinAmount},
+		{"max_amount", &q.MaxAmount},
+	}
+	for _, a := range amounts {
+		*a.dst, err = parseAmountParam(r, a.name)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+	limit := defaultSearchLimit
+	if r.FormValue("limit") != "" {
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			httpError(w, r, http.StatusBadRequest, "limit must be between 1 and %d", maxSearchLimit)
+			return
+		}
+	}
+	results, err := iv.searchInvoices(r, q, limit)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, results)
+	al := appLog{Message: fmt.Sprintf("found %d invoices matching %q", results.Total, q.Query), Action: "get-search"}
+	al.log(r)
+}
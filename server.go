@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+)
+
+// envDuration returns the duration set in an environment variable, or def
+// if the variable is not set or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	if os.Getenv(name) == "" {
+		return def
+	}
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		applog.warnf("ignoring invalid duration %q in %s, using %s", os.Getenv(name), name, def)
+		return def
+	}
+	return d
+}
+
+// configFlag registers the -config flag naming the configuration file
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", os.Getenv("INVOICER_CONFIG"),
+		"path to a TOML configuration file (INVOICER_CONFIG)")
+}
+
+// loadConfig loads the configuration file named by the -config flag, or
+// INVOICER_CONFIG, and overrides its server settings with the flags of the
+// serve command. It also returns the migration command to run, if any, and
+// whether to re-encrypt the database.
+func loadConfig(args []string) (cfg config.Config, migrate string, reencrypt bool, err error) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: invoicer [serve] [flags]\n\nserve the API, the default command\n\nflags:\n")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output())
+		writeCommandList(fs.Output())
+	}
+	var (
+		configFile = configFlag(fs)
+		srv        config.Server
+	)
+	fs.StringVar(&srv.ListenAddr, "listen", "",
+		"address to listen on (server.listen_addr, INVOICER_LISTEN_ADDR)")
+	fs.StringVar(&srv.GRPCListenAddr, "grpc-listen", "",
+		"address to serve the gRPC API on, requires TLS (server.grpc_listen_addr, INVOICER_GRPC_LISTEN_ADDR)")
+	fs.StringVar(&srv.TLSCert, "tls-cert", "",
+		"path to a TLS certificate, enables HTTPS (server.tls_cert, INVOICER_TLS_CERT)")
+	fs.StringVar(&srv.TLSKey, "tls-key", "",
+		"path to the private key of the TLS certificate (server.tls_key, INVOICER_TLS_KEY)")
+	fs.DurationVar(&srv.ReadTimeout, "read-timeout", 0,
+		"maximum duration for reading a request (server.read_timeout, INVOICER_READ_TIMEOUT)")
+	fs.DurationVar(&srv.WriteTimeout, "write-timeout", 0,
+		"maximum duration for writing a response (server.write_timeout, INVOICER_WRITE_TIMEOUT)")
+	fs.DurationVar(&srv.IdleTimeout, "idle-timeout", 0,
+		"maximum duration of idle keep-alive connections (server.idle_timeout, INVOICER_IDLE_TIMEOUT)")
+	fs.DurationVar(&srv.ShutdownTimeout, "shutdown-timeout", 0,
+		"maximum duration to wait for in-flight requests on shutdown (server.shutdown_timeout, INVOICER_SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&srv.RequestTimeout, "request-timeout", 0,
+		"maximum duration of a request and its database queries (server.request_timeout, INVOICER_REQUEST_TIMEOUT)")
+	fs.StringVar(&migrate, "migrate", "",
+		"migrate the database up, down by one migration, or show the migration status, then exit, like the migrate command")
+	fs.BoolVar(&reencrypt, "reencrypt", false,
+		"re-encrypt the encrypted columns of the database with the first of encryption.keys, then exit")
+	fs.Parse(args)
+	switch migrate {
+	case "", "up", "down", "status":
+	default:
+		return cfg, migrate, reencrypt, fmt.Errorf("invalid -migrate %q, must be up, down or status", migrate)
+	}
+	cfg, err = config.Load(*configFile)
+	if err != nil {
+		return cfg, migrate, reencrypt, err
+	}
+	// flags override the file and the environment
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Server.ListenAddr = srv.ListenAddr
+		case "grpc-listen":
+			cfg.Server.GRPCListenAddr = srv.GRPCListenAddr
+		case "tls-cert":
+			cfg.Server.TLSCert = srv.TLSCert
+		case "tls-key":
+			cfg.Server.TLSKey = srv.TLSKey
+		case "read-timeout":
+			cfg.Server.ReadTimeout = srv.ReadTimeout
+		case "write-timeout":
+			cfg.Server.WriteTimeout = srv.WriteTimeout
+		case "idle-timeout":
+			cfg.Server.IdleTimeout = srv.IdleTimeout
+		case "shutdown-timeout":
+			cfg.Server.ShutdownTimeout = srv.ShutdownTimeout
+		case "request-timeout":
+			cfg.Server.RequestTimeout = srv.RequestTimeout
+		}
+	})
+	return cfg, migrate, reencrypt, cfg.Validate()
+}
+
+// serve runs an http server, and the gRPC server if an address is set for
+// it, until it receives SIGTERM or SIGINT, at which point they stop
+// accepting connections and wait for in-flight requests to complete
+// before returning. onShutdown ends the long-lived requests, which would
+// otherwise never complete.
+func serve(cfg config.Server, handler, grpcHandler http.Handler, onShutdown func()) error {
+	srv := &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	srv.RegisterOnShutdown(onShutdown)
+	var grpcSrv *http.Server
+	grpcErr := make(chan error, 1)
+	if cfg.GRPCListenAddr != "" {
+		grpcSrv = &http.Server{
+			Addr:         cfg.GRPCListenAddr,
+			Handler:      grpcHandler,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+		}
+		go func() {
+			applog.infof("serving gRPC on %s with TLS", cfg.GRPCListenAddr)
+			err := grpcSrv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+			if err != http.ErrServerClosed {
+				// don't keep serving half of the API
+				grpcErr <- fmt.Errorf("gRPC server failed: %s", err)
+				srv.Close()
+			}
+		}()
+	}
+	shutdownDone := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		s := <-sig
+		applog.infof("received %s, draining in-flight requests", s)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if grpcSrv != nil {
+			if err := grpcSrv.Shutdown(ctx); err != nil {
+				applog.errorf("failed to drain gRPC requests: %s", err)
+			}
+		}
+		shutdownDone <- srv.Shutdown(ctx)
+	}()
+
+	var err error
+	if cfg.TLSCert != "" {
+		applog.infof("listening on %s with TLS", cfg.ListenAddr)
+		err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		applog.infof("listening on %s", cfg.ListenAddr)
+		err = srv.ListenAndServe()
+	}
+	select {
+	case err := <-grpcErr:
+		return err
+	default:
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdownDone
+}
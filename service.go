@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// serviceError is an error of the invoice service carrying the http status
+// it maps to, so the REST and gRPC APIs report failures the same way
+type serviceError struct {
+	Status  int
+	Message string
+	Fields  validationErrors
+}
+
+func (e serviceError) Error() string {
+	if len(e.Fields) > 0 {
+		return fmt.Sprintf("%s: %s", e.Message, e.Fields)
+	}
+	return e.Message
+}
+
+func newServiceError(status int, format string, args ...interface{}) error {
+	return serviceError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+func newValidationError(errs validationErrors) error {
+	return serviceError{Status: http.StatusUnprocessableEntity, Message: "validation failed", Fields: errs}
+}
+
+// writeServiceError sends an error returned by the invoice service to a
+// REST client
+func writeServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	se, ok := err.(serviceError)
+	if !ok {
+		httpError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if len(se.Fields) > 0 {
+		writeValidationErrors(w, r, se.Fields)
+		return
+	}
+	httpError(w, r, se.Status, "%s", se.Message)
+}
+
+// loadInvoice retrieves the invoice of the `id` route variable without its
+// charges, or responds with an error and returns false
+func (iv *invoicer) loadInvoice(w http.ResponseWriter, r *http.Request) (Invoice, bool) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	i1, err := iv.invoicesFor(r).Get(uint(id), false)
+	if err == errInvoiceNotFound {
+		httpError(w, r, http.StatusNotFound, "No invoice id %s", vars["id"])
+		return i1, false
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve invoice id %s: %s", vars["id"], err)
+		return i1, false
+	}
+	return i1, true
+}
+
+// findInvoice retrieves an invoice without its charges, reporting it as
+// overdue if it became so since the last overdue check
+func (iv *invoicer) findInvoice(r *http.Request, id uint, includeDeleted bool) (Invoice, error) {
+	i1, err := iv.invoicesFor(r).Get(id, includeDeleted)
+	if err == errInvoiceNotFound {
+		return i1, newServiceError(http.StatusNotFound, "No invoice id %d", id)
+	}
+	if err != nil {
+		return i1, fmt.Errorf("failed to retrieve invoice %d: %s", id, err)
+	}
+	if i1.DeletedAt == nil && i1.isOverdue(time.Now().UTC()) {
+		err = iv.invoicesFor(r).SetStatus(&i1, statusOverdue)
+		if err != nil {
+			return i1, fmt.Errorf("failed to mark invoice %d as overdue: %s", id, err)
+		}
+	}
+	return i1, nil
+}
+
+// findInvoices returns a page of the invoices matching filters, ordered by
+// id, along with the total number of matching invoices
+func (iv *invoicer) findInvoices(r *http.Request, filters invoiceFilters, offset, limit int) ([]Invoice, int, error) {
+	invoices, total, err := iv.invoicesFor(r).List(filters, offset, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list invoices: %s", err)
+	}
+	return invoices, total, nil
+}
+
+// createInvoice validates and inserts a new invoice with its charges
+func (iv *invoicer) createInvoice(r *http.Request, i1 Invoice) (Invoice, error) {
+	setInvoiceCurrency(&i1, defaultCurrency())
+	if err := initInvoiceStatus(&i1); err != nil {
+		var errs validationErrors
+		errs.add("status", "%s", err)
+		return i1, newValidationError(errs)
+	}
+	if err := iv.taxCharges(i1.Charges); err != nil {
+		return i1, err
+	}
+	if errs := setInvoiceAmount(&i1, i1.Amount != 0, sumCharges(i1.Charges)); len(errs) > 0 {
+		return i1, newValidationError(errs)
+	}
+	errs, err := iv.validateInvoice(i1, true)
+	if err != nil {
+		return i1, err
+	}
+	if len(errs) > 0 {
+		return i1, newValidationError(errs)
+	}
+	// make sure the IDs are null before inserting
+	i1.ID = 0
+	for i := 0; i < len(i1.Charges); i++ {
+		i1.Charges[i].ID = 0
+		i1.Charges[i].InvoiceID = 0
+	}
+	err = iv.invoicesFor(r).Create(&i1)
+	if err != nil {
+		return i1, fmt.Errorf("failed to create invoice: %s", err)
+	}
+	iv.audit(r, "create", i1.ID, nil, iv.invoiceSnapshot(i1.ID))
+	iv.fireWebhooks(eventInvoiceCreated, i1)
+	if i1.IsPaid {
+		iv.fireWebhooks(eventInvoicePaid, i1)
+	}
+	return i1, nil
+}
+
+// invoiceUpdate describes a change made to an invoice by updateInvoice
+type invoiceUpdate struct {
+	// Action is recorded in the history of the invoice
+	Action string
+	// IfMatch only applies the change to the version of the invoice it
+	// names, when set
+	IfMatch string
+	// ReplaceCharges replaces the stored charges with those of the
+	// invoice, otherwise they are left untouched
+	ReplaceCharges bool
+	// AmountSet is true when the change sets the amount, which must then
+	// match the total of the charges unless it is overridden
+	AmountSet bool
+	// Apply makes the change to the stored invoice
+	Apply func(i *Invoice) error
+}
+
+// updateInvoice applies a change to an invoice and saves it
+func (iv *invoicer) updateInvoice(r *http.Request, id uint, u invoiceUpdate) (Invoice, error) {
+	current, err := iv.invoicesFor(r).Get(id, false)
+	if err == errInvoiceNotFound {
+		return current, newServiceError(http.StatusNotFound, "No invoice id %d", id)
+	}
+	if err != nil {
+		return current, fmt.Errorf("failed to retrieve invoice %d: %s", id, err)
+	}
+	if err := checkInvoicePrecondition(current, u.IfMatch); err != nil {
+		return current, err
+	}
+	before := iv.invoiceSnapshot(current.ID)
+	i1 := current
+	if err := u.Apply(&i1); err != nil {
+		return current, err
+	}
+	i1.Model, i1.Version, i1.InvoiceNumber = current.Model, current.Version, current.InvoiceNumber
+	setInvoiceCurrency(&i1, current.Currency)
+	if err := updateInvoiceStatus(current, &i1); err != nil {
+		return current, newServiceError(http.StatusConflict, "%s", err)
+	}
+	if u.ReplaceCharges {
+		if err := iv.taxCharges(i1.Charges); err != nil {
+			return current, err
+		}
+	}
+	total := sumCharges(i1.Charges)
+	if !u.ReplaceCharges {
+		summary, err := iv.invoicesFor(r).SummarizeCharges(i1.ID)
+		if err != nil {
+			return current, fmt.Errorf("failed to total the charges of invoice %d: %s", i1.ID, err)
+		}
+		total = summary.Total
+	}
+	if errs := setInvoiceAmount(&i1, u.AmountSet, total); len(errs) > 0 {
+		return current, newValidationError(errs)
+	}
+	errs, err := iv.validateInvoice(i1, false)
+	if err != nil {
+		return current, err
+	}
+	if len(errs) > 0 {
+		return current, newValidationError(errs)
+	}
+	err = iv.invoicesFor(r).Update(&i1, u.ReplaceCharges)
+	if err == errVersionConflict {
+		return current, newServiceError(http.StatusPreconditionFailed, "invoice %d was modified while being updated", i1.ID)
+	}
+	if err != nil {
+		return current, fmt.Errorf("failed to update invoice %d: %s", i1.ID, err)
+	}
+	iv.audit(r, u.Action, i1.ID, before, iv.invoiceSnapshot(i1.ID))
+	iv.fireInvoiceUpdated(current, i1)
+	return i1, nil
+}
+
+// removeInvoice soft deletes an invoice, if it is at the version named in
+// the ifMatch header when set. Deleting a missing invoice is not an error,
+// but existed is false.
+func (iv *invoicer) removeInvoice(r *http.Request, id uint, ifMatch string) (existed bool, err error) {
+	i1, err := iv.invoicesFor(r).Get(id, false)
+	if err != nil && err != errInvoiceNotFound {
+		return false, fmt.Errorf("failed to retrieve invoice %d: %s", id, err)
+	}
+	if err := checkInvoicePrecondition(i1, ifMatch); err != nil {
+		return false, err
+	}
+	existed, before := i1.ID != 0, iv.invoiceSnapshot(id)
+	i1.ID = id
+	err = iv.invoicesFor(r).Delete(i1.ID)
+	if err != nil {
+		return existed, fmt.Errorf("failed to delete invoice %d: %s", i1.ID, err)
+	}
+	if existed {
+		iv.audit(r, "delete", i1.ID, before, nil)
+		iv.fireWebhooks(eventInvoiceDeleted, i1)
+	}
+	return existed, nil
+}
+
+// changeCharge applies a change to the charges of an invoice through the
+// store, if it is at the version named in the ifMatch header when set.
+// Charges of paid and cancelled invoices cannot change. The action is
+// recorded in the history of the invoice.
+func (iv *invoicer) changeCharge(r *http.Request, i1 Invoice, ifMatch, action string,
+	change func(i *Invoice) error) (Invoice, error) {
+	if err := checkInvoicePrecondition(i1, ifMatch); err != nil {
+		return i1, err
+	}
+	if i1.Status == statusPaid || i1.Status == statusCancelled {
+		return i1, newServiceError(http.StatusConflict, "invoice %d is %s and its charges cannot change", i1.ID, i1.Status)
+	}
+	current, before := i1, iv.invoiceSnapshot(i1.ID)
+	err := change(&i1)
+	if err == errVersionConflict {
+		return current, newServiceError(http.StatusPreconditionFailed, "invoice %d was modified while changing its charges", i1.ID)
+	}
+	if err != nil {
+		return current, fmt.Errorf("failed to change charges of invoice %d: %s", i1.ID, err)
+	}
+	iv.audit(r, action, i1.ID, before, iv.invoiceSnapshot(i1.ID))
+	iv.fireInvoiceUpdated(current, i1)
+	return i1, nil
+}
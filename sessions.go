@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/auth"
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/gorilla/context"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jinzhu/gorm"
+	"github.com/wader/gormstore"
+)
+
+const (
+	sessionCookieName = "invoicer_session"
+	sessionUserKey    = "user"
+
+	sessionCleanupInterval = time.Hour
+)
+
+// sessionProvider authenticates the requests carrying the cookie of a
+// session opened by POST /login
+type sessionProvider struct {
+	store *gormstore.Store
+}
+
+// Authenticate implements auth.Provider
+func (p sessionProvider) Authenticate(r *http.Request) (string, error) {
+	if _, err := r.Cookie(sessionCookieName); err != nil {
+		return "", auth.ErrNoCredentials
+	}
+	// the store keeps the session of the request in a global map until
+	// it is cleared
+	defer context.Clear(r)
+	session, err := p.store.New(r, sessionCookieName)
+	if err != nil {
+		return "", err
+	}
+	user, ok := session.Values[sessionUserKey].(string)
+	if !ok || user == "" {
+		return "", fmt.Errorf("%v: unknown or expired session", auth.ErrInvalidCredentials)
+	}
+	return user, nil
+}
+
+// Challenge implements auth.Provider. Clients log in with POST /login
+// rather than answering a challenge.
+func (p sessionProvider) Challenge(realm string) string {
+	return ""
+}
+
+// enableSessions lets the users of the password providers of an
+// authenticator log in and authenticate with a session cookie. Sessions
+// are stored in the sessions table and expire after auth.session_max_age.
+func (iv *invoicer) enableSessions(db *gorm.DB, a *auth.Authenticator, cfg config.Auth, secure bool) {
+	hasPasswords := false
+	for _, p := range a.Providers {
+		if _, ok := p.(auth.PasswordChecker); ok {
+			hasPasswords = true
+		}
+	}
+	if !hasPasswords {
+		return
+	}
+	secret := []byte(cfg.SessionSecret)
+	if len(secret) == 0 {
+		applog.warnf("auth.session_secret is not set, using a random secret that logs users out on restarts")
+		secret = securecookie.GenerateRandomKey(32)
+	}
+	iv.store = gormstore.NewOptions(db, gormstore.Options{TableName: "sessions", SkipCreateTable: true}, secret)
+	iv.store.MaxAge(int(cfg.SessionMaxAge / time.Second))
+	iv.store.SessionOpts.HttpOnly = true
+	iv.store.SessionOpts.Secure = secure
+	go iv.store.PeriodicCleanup(sessionCleanupInterval, nil)
+
+	iv.authenticator = a
+	a.Providers = append(a.Providers, sessionProvider{iv.store})
+	// copy the public paths rather than append to publicPaths, which
+	// /login must not join since it is rate limited
+	a.PublicPaths = append(append([]string{}, a.PublicPaths...), "/login")
+}
+
+type sessionResponse struct {
+	User        string   `json:"user"`
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+func (iv *invoicer) writeSession(w http.ResponseWriter, r *http.Request, user string) {
+	role, err := iv.roleOf(r, user)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve role of %s: %s", user, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, sessionResponse{user, role, rolePermissions[role]})
+}
+
+func (iv *invoicer) requireSessions(w http.ResponseWriter, r *http.Request) bool {
+	if iv.store == nil {
+		httpError(w, r, http.StatusNotFound, "sessions are disabled, no password authentication is configured")
+		return false
+	}
+	return true
+}
+
+// postLogin checks the password of a user and opens a session, whose
+// cookie authenticates the following requests
+func (iv *invoicer) postLogin(w http.ResponseWriter, r *http.Request) {
+	if !iv.requireSessions(w, r) {
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !readJSONBody(w, r, &req) {
+		return
+	}
+	if err := iv.authenticator.Login(req.Username, req.Password); err != nil {
+		al := appLog{ErrorCode: http.StatusUnauthorized, Message: fmt.Sprintf("login of %q failed: %s", req.Username, err)}
+		al.log(r)
+		writeError(w, r, http.StatusUnauthorized, apiError{Code: errUnauthorized, Message: "invalid username or password"})
+		return
+	}
+	// always open a new session so a session ID planted before the login
+	// can't be reused
+	session := sessions.NewSession(iv.store, sessionCookieName)
+	opts := *iv.store.SessionOpts
+	session.Options = &opts
+	session.Values[sessionUserKey] = req.Username
+	err := iv.store.Save(r, w, session)
+	context.Clear(r)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to store session: %s", err)
+		return
+	}
+	r = r.WithContext(auth.NewContext(r.Context(), req.Username))
+	al := appLog{Message: fmt.Sprintf("%s logged in", req.Username), Action: "login"}
+	al.log(r)
+	iv.writeSession(w, r, req.Username)
+}
+
+// postLogout closes the session of a request
+func (iv *invoicer) postLogout(w http.ResponseWriter, r *http.Request) {
+	if !iv.requireSessions(w, r) {
+		return
+	}
+	defer context.Clear(r)
+	session, err := iv.store.New(r, sessionCookieName)
+	if err == nil {
+		session.Options.MaxAge = -1
+		err = iv.store.Save(r, w, session)
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to delete session: %s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	al := appLog{Message: "logged out", Action: "logout"}
+	al.log(r)
+}
+
+// getSession returns the user of a request with their role
+func (iv *invoicer) getSession(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		httpError(w, r, http.StatusNotFound, "authentication is disabled")
+		return
+	}
+	if _, ok := apiKeyFromContext(r); ok {
+		writeJSON(w, r, http.StatusOK, sessionResponse{User: user, Permissions: r.Context().Value(ctxAPIKeyScopes).([]string)})
+		return
+	}
+	iv.writeSession(w, r, user)
+}
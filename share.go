@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"github.com/jinzhu/gorm"
+)
+
+// sharedPathPrefix starts the pages share links open, which are reached
+// without authentication
+const sharedPathPrefix = "/shared/"
+
+var (
+	// shareKeys sign share links, the first one signing new links, set
+	// from share.keys at startup
+	shareKeys [][]byte
+	// shareConfig holds the lifetimes and base URL of share links
+	shareConfig = config.Share{DefaultTTL: 30 * 24 * time.Hour, MaxTTL: 365 * 24 * time.Hour}
+)
+
+// setShareKeys configures the keys and lifetimes of share links. A random
+// key is used when none is set, which invalidates the links given out
+// before a restart, and those of other instances.
+func setShareKeys(cfg config.Share) {
+	shareKeys = nil
+	for _, key := range cfg.Keys {
+		shareKeys = append(shareKeys, []byte(key))
+	}
+	if len(shareKeys) == 0 {
+		applog.warnf("share.keys is not set, using a random key that invalidates share links on restarts")
+		shareKeys = [][]byte{securecookie.GenerateRandomKey(32)}
+	}
+	shareConfig = cfg
+}
+
+// ShareLink lets the customer of an invoice view it and download its PDF
+// without authenticating, until the link expires or is revoked. Its URL is
+// signed with an HMAC over the invoice, the link and the expiration, so
+// only revocations need a lookup.
+type ShareLink struct {
+	ID        uint       `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	InvoiceID uint       `gorm:"index" json:"invoice_id"`
+	CreatedBy string     `json:"created_by"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy string     `json:"revoked_by,omitempty"`
+	// URL is signed again when links are read, and left out once they
+	// expire or are revoked
+	URL string `gorm:"-" json:"url,omitempty"`
+}
+
+type shareRequest struct {
+	// ExpiresAt defaults to share.default_ttl from now
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func shareMAC(key []byte, invoiceID, linkID uint, expires int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d:%d:%d", invoiceID, linkID, expires)
+	return mac.Sum(nil)
+}
+
+// setURL signs the URL of a link with the first key, if it is still valid
+func (l *ShareLink) setURL(r *http.Request) {
+	l.URL = ""
+	if l.RevokedAt != nil || !time.Now().Before(l.ExpiresAt) {
+		return
+	}
+	base := strings.TrimSuffix(shareConfig.BaseURL, "/")
+	if base == "" {
+		base = "http://" + r.Host
+		if r.TLS != nil {
+			base = "https://" + r.Host
+		}
+	}
+	q := url.Values{}
+	q.Set("link", strconv.FormatUint(uint64(l.ID), 10))
+	q.Set("expires", strconv.FormatInt(l.ExpiresAt.Unix(), 10))
+	q.Set("signature", base64.RawURLEncoding.EncodeToString(shareMAC(shareKeys[0], l.InvoiceID, l.ID, l.ExpiresAt.Unix())))
+	l.URL = fmt.Sprintf("%s%sinvoice/%d?%s", base, sharedPathPrefix, l.InvoiceID, q.Encode())
+}
+
+// checkShareLink returns the link of a request to a shared page if its
+// signature is valid with any of the keys, it hasn't expired and it wasn't
+// revoked. Otherwise it renders an error page for the customer and returns
+// false.
+func (iv *invoicer) checkShareLink(w http.ResponseWriter, r *http.Request) (ShareLink, bool) {
+	var l ShareLink
+	invoiceID, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	linkID, err := strconv.ParseUint(r.FormValue("link"), 10, 64)
+	expires, experr := strconv.ParseInt(r.FormValue("expires"), 10, 64)
+	signature, sigerr := base64.RawURLEncoding.DecodeString(r.FormValue("signature"))
+	if err != nil || experr != nil || sigerr != nil {
+		iv.renderError(w, r, http.StatusForbidden, "this link is invalid")
+		return l, false
+	}
+	valid := false
+	for _, key := range shareKeys {
+		valid = valid || hmac.Equal(signature, shareMAC(key, uint(invoiceID), uint(linkID), expires))
+	}
+	if !valid {
+		iv.renderError(w, r, http.StatusForbidden, "this link is invalid")
+		return l, false
+	}
+	if time.Now().Unix() >= expires {
+		iv.renderError(w, r, http.StatusForbidden, "this link expired on %s", time.Unix(expires, 0).UTC().Format("2006-01-02"))
+		return l, false
+	}
+	err = iv.dbFor(r).First(&l, linkID).Error
+	if err == gorm.ErrRecordNotFound || (err == nil && l.InvoiceID != uint(invoiceID)) || l.RevokedAt != nil {
+		iv.renderError(w, r, http.StatusForbidden, "this link was revoked")
+		return l, false
+	}
+	if err != nil {
+		iv.renderError(w, r, http.StatusInternalServerError, "failed to retrieve share link %d: %s", linkID, err)
+		return l, false
+	}
+	// keep the signature out of the Referer of the links the page opens,
+	// and out of shared caches
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "private, no-store")
+	return l, true
+}
+
+// postInvoiceShare creates a link letting the customer of an invoice view
+// it without authenticating, valid until expires_at or for the default
+// lifetime of share links
+func (iv *invoicer) postInvoiceShare(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	var req shareRequest
+	// the body is optional
+	err := decodeJSONBody(r, &req)
+	if err != nil && err != io.EOF {
+		writeBodyError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	l := ShareLink{InvoiceID: i1.ID, CreatedBy: actorOf(r), ExpiresAt: now.Add(shareConfig.DefaultTTL)}
+	if req.ExpiresAt != nil {
+		var errs validationErrors
+		if !req.ExpiresAt.After(now) {
+			errs.add("expires_at", "must be in the future")
+		} else if req.ExpiresAt.After(now.Add(shareConfig.MaxTTL)) {
+			errs.add("expires_at", "must be within %d days", int(shareConfig.MaxTTL/(24*time.Hour)))
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, r, errs)
+			return
+		}
+		l.ExpiresAt = req.ExpiresAt.UTC()
+	}
+	// links expire on the second signed in their URL
+	l.ExpiresAt = l.ExpiresAt.Truncate(time.Second)
+	if l.CreatedBy == "" {
+		l.CreatedBy = "anonymous"
+	}
+	err = iv.dbFor(r).Create(&l).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to create share link: %s", err)
+		return
+	}
+	l.setURL(r)
+	writeJSON(w, r, http.StatusCreated, l)
+	al := appLog{Message: fmt.Sprintf("created share link %d for invoice %d, expiring %s", l.ID, i1.ID, l.ExpiresAt.Format(time.RFC3339)), Action: "post-invoice-share"}
+	al.log(r)
+	iv.audit(r, "share", i1.ID, nil, map[string]interface{}{"share_link_id": l.ID, "expires_at": l.ExpiresAt})
+}
+
+func (iv *invoicer) getInvoiceShareLinks(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	links := []ShareLink{}
+	err := iv.dbFor(r).Where("invoice_id = ?", i1.ID).Order("id asc").Find(&links).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve share links of invoice %d: %s", i1.ID, err)
+		return
+	}
+	for n := range links {
+		links[n].setURL(r)
+	}
+	writeJSON(w, r, http.StatusOK, links)
+}
+
+// postShareLinkRevoke revokes a share link, which stops opening the
+// invoice right away
+func (iv *invoicer) postShareLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	var l ShareLink
+	err := iv.dbFor(r).First(&l, mux.Vars(r)["id"]).Error
+	if err == gorm.ErrRecordNotFound {
+		httpError(w, r, http.StatusNotFound, "No share link id %s", mux.Vars(r)["id"])
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve share link: %s", err)
+		return
+	}
+	now := time.Now().UTC()
+	by := actorOf(r)
+	if by == "" {
+		by = "anonymous"
+	}
+	res := iv.dbFor(r).Model(&l).Where("revoked_at IS NULL").
+		Updates(map[string]interface{}{"revoked_at": now, "revoked_by": by})
+	if res.Error != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to revoke share link %d: %s", l.ID, res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		httpError(w, r, http.StatusConflict, "share link %d is already revoked", l.ID)
+		return
+	}
+	l.RevokedAt, l.RevokedBy = &now, by
+	l.setURL(r)
+	writeJSON(w, r, http.StatusOK, l)
+	al := appLog{Message: fmt.Sprintf("revoked share link %d of invoice %d", l.ID, l.InvoiceID), Action: "post-share-link-revoke"}
+	al.log(r)
+	iv.audit(r, "revoke-share", l.InvoiceID, map[string]interface{}{"share_link_id": l.ID}, nil)
+}
+
+// getSharedInvoice renders the invoice of a share link for its customer
+func (iv *invoicer) getSharedInvoice(w http.ResponseWriter, r *http.Request) {
+	l, ok := iv.checkShareLink(w, r)
+	if !ok {
+		return
+	}
+	i1, err := iv.findInvoice(r, l.InvoiceID, false)
+	if err != nil {
+		iv.renderServiceError(w, r, err)
+		return
+	}
+	// customers are shown every charge they are billed, however many
+	charges, err := iv.invoicesFor(r).Charges(i1, 0, 0)
+	if err != nil {
+		iv.renderError(w, r, http.StatusInternalServerError, "failed to retrieve charges of invoice %d: %s", i1.ID, err)
+		return
+	}
+	i1.Taxes, err = iv.invoiceTaxes(r, i1)
+	if err != nil {
+		iv.renderError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	var customer *Customer
+	if i1.CustomerID != 0 {
+		customer = new(Customer)
+		if iv.dbFor(r).First(customer, i1.CustomerID).Error != nil {
+			customer = nil
+		}
+	}
+	iv.render(w, r, http.StatusOK, "shared_invoice", struct {
+		Invoice  Invoice
+		Charges  []Charge
+		Customer *Customer
+		PDFURL   string
+	}{i1, charges, customer, fmt.Sprintf("%sinvoice/%d/pdf?%s", sharedPathPrefix, i1.ID, r.URL.RawQuery)})
+	al := appLog{Message: fmt.Sprintf("opened invoice %d through share link %d", i1.ID, l.ID), Action: "get-shared-invoice"}
+	al.log(r)
+}
+
+// getSharedInvoicePDF sends the PDF of the invoice of a share link
+func (iv *invoicer) getSharedInvoicePDF(w http.ResponseWriter, r *http.Request) {
+	l, ok := iv.checkShareLink(w, r)
+	if !ok {
+		return
+	}
+	i1, err := iv.findInvoice(r, l.InvoiceID, false)
+	if err != nil {
+		iv.renderServiceError(w, r, err)
+		return
+	}
+	iv.writeInvoicePDF(w, r, i1)
+	al := appLog{Message: fmt.Sprintf("downloaded invoice %d to pdf through share link %d", i1.ID, l.ID), Action: "get-shared-invoice-pdf"}
+	al.log(r)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	statusDraft         = "draft"
+	statusSent          = "sent"
+	statusOverdue       = "overdue"
+	statusPartiallyPaid = "partially_paid"
+	statusPaid          = "paid"
+	statusDisputed      = "disputed"
+	statusCancelled     = "cancelled"
+
+	defaultOverdueCheckInterval = time.Hour
+)
+
+// invoiceTransitions lists the statuses an invoice can move to from each
+// status. Paid and cancelled invoices are final.
+var invoiceTransitions = map[string][]string{
+	statusDraft:         {statusSent, statusCancelled},
+	statusSent:          {statusPartiallyPaid, statusPaid, statusOverdue, statusDisputed, statusCancelled},
+	statusOverdue:       {statusPartiallyPaid, statusPaid, statusDisputed, statusCancelled},
+	statusPartiallyPaid: {statusPaid, statusOverdue, statusDisputed},
+	statusDisputed:      {statusSent, statusPartiallyPaid, statusPaid, statusCancelled},
+	statusPaid:          {},
+	statusCancelled:     {},
+}
+
+// invoiceStatuses lists the statuses in the order invoices usually go
+// through them
+var invoiceStatuses = []string{statusDraft, statusSent, statusOverdue, statusPartiallyPaid, statusPaid, statusDisputed, statusCancelled}
+
+func validInvoiceStatus(status string) bool {
+	_, ok := invoiceTransitions[status]
+	return ok
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range invoiceTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// isOverdue returns true if an invoice awaiting payment is past its due date
+func (i Invoice) isOverdue(now time.Time) bool {
+	return (i.Status == statusSent || i.Status == statusPartiallyPaid) &&
+		!i.DueDate.IsZero() && i.DueDate.Before(now)
+}
+
+// initInvoiceStatus sets the status of a new invoice, which is created as a
+// draft unless it is already paid or sent
+func initInvoiceStatus(i *Invoice) error {
+	if i.Status == "" {
+		i.Status = statusDraft
+		if i.IsPaid {
+			i.Status = statusPaid
+		}
+	}
+	switch i.Status {
+	case statusDraft, statusSent, statusPaid:
+	default:
+		return fmt.Errorf("invoices cannot be created with status %q", i.Status)
+	}
+	i.IsPaid = i.Status == statusPaid
+	return nil
+}
+
+// updateInvoiceStatus enforces the status transition between the stored
+// version of an invoice and its update. An update that doesn't carry a
+// status keeps the current one, and setting is_paid moves it to paid.
+func updateInvoiceStatus(current Invoice, next *Invoice) error {
+	if next.Status == "" {
+		next.Status = current.Status
+	}
+	if !validInvoiceStatus(next.Status) {
+		// reported by validateInvoice
+		return nil
+	}
+	if next.Status == current.Status && next.IsPaid != current.IsPaid {
+		if !next.IsPaid {
+			return fmt.Errorf("invoice %d is paid and cannot be marked unpaid", current.ID)
+		}
+		next.Status = statusPaid
+	}
+	if next.Status != current.Status && !canTransition(current.Status, next.Status) {
+		return fmt.Errorf("invoice %d cannot go from %s to %s", current.ID, current.Status, next.Status)
+	}
+	next.IsPaid = next.Status == statusPaid
+	return nil
+}
+
+type statusRequest struct {
+	Status      string    `json:"status"`
+	PaymentDate time.Time `json:"payment_date"`
+}
+
+// postInvoiceStatus moves an invoice to a new status. Invoices marked as
+// paid without a payment date are considered paid now.
+func (iv *invoicer) postInvoiceStatus(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	var req statusRequest
+	if !readJSONBody(w, r, &req) {
+		return
+	}
+	if !validInvoiceStatus(req.Status) {
+		var errs validationErrors
+		errs.add("status", "unknown status %q", req.Status)
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	from, before, snapshot := i1.Status, i1, iv.invoiceSnapshot(i1.ID)
+	if !canTransition(from, req.Status) {
+		httpError(w, r, http.StatusConflict, "invoice %d cannot go from %s to %s", i1.ID, from, req.Status)
+		return
+	}
+	i1.Status, i1.IsPaid = req.Status, req.Status == statusPaid
+	if req.Status == statusPaid {
+		if req.PaymentDate.IsZero() {
+			req.PaymentDate = time.Now().UTC()
+		}
+		i1.PaymentDate = req.PaymentDate
+	}
+	err := iv.invoicesFor(r).Update(&i1, false)
+	if err == errVersionConflict {
+		httpError(w, r, http.StatusConflict, "invoice %d was modified while changing its status", i1.ID)
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to update status of invoice %d: %s", i1.ID, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("invoice %d is %s", i1.ID, req.Status)))
+	al := appLog{Message: fmt.Sprintf("moved invoice %d from %s to %s", i1.ID, from, req.Status), Action: "post-invoice-status"}
+	al.log(r)
+	iv.audit(r, "status", i1.ID, snapshot, iv.invoiceSnapshot(i1.ID))
+	iv.fireInvoiceUpdated(before, i1)
+}
+
+// markOverdueInvoices moves invoices awaiting payment past their due date
+// to the overdue status and returns how many were updated
+func (iv *invoicer) markOverdueInvoices(now time.Time) (int64, error) {
+	res := iv.db.Model(&Invoice{}).
+		Where("status IN (?) AND due_date < ?", []string{statusSent, statusPartiallyPaid}, now).
+		Updates(map[string]interface{}{"status": statusOverdue, "version": nextVersion()})
+	return res.RowsAffected, res.Error
+}
+
+// watchOverdueInvoices checks for overdue invoices at startup, then at
+// every interval, and schedules reminders for those late by one of the
+// reminder days and notifications for those late by one of the days of the
+// notification channels
+func (iv *invoicer) watchOverdueInvoices(interval time.Duration, reminderDays []int) {
+	for {
+		now := time.Now().UTC()
+		n, err := iv.markOverdueInvoices(now)
+		if err != nil {
+			applog.errorf("failed to mark overdue invoices: %s", err)
+		} else if n > 0 {
+			applog.infof("marked %d invoices as overdue", n)
+		}
+		queued, err := iv.scheduleReminders(now, reminderDays)
+		if err != nil {
+			applog.errorf("failed to schedule reminders: %s", err)
+		} else if queued > 0 {
+			applog.infof("queued %d reminder jobs", queued)
+		}
+		queued, err = iv.scheduleNotifications(now)
+		if err != nil {
+			applog.errorf("failed to schedule notifications: %s", err)
+		} else if queued > 0 {
+			applog.infof("queued %d notification jobs", queued)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// errInvoiceNotFound is returned by stores for invoices that don't exist
+	errInvoiceNotFound = errors.New("invoice not found")
+	// errChargeNotFound is returned by stores for charges that don't exist
+	errChargeNotFound = errors.New("charge not found")
+)
+
+// InvoiceStore persists invoices and their charges. The invoice service,
+// and through it the REST and gRPC handlers, only access invoices through
+// this interface: gormInvoiceStore backs it with the database, and
+// memoryInvoiceStore keeps invoices in memory for tests.
+type InvoiceStore interface {
+	// Create inserts an invoice and its charges, setting their ids and the
+	// number of the invoice
+	Create(i *Invoice) error
+	// Get returns an invoice without its charges, or errInvoiceNotFound.
+	// Soft deleted invoices are only returned if includeDeleted is set.
+	Get(id uint, includeDeleted bool) (Invoice, error)
+	// GetByNumber returns an invoice by its number, like Get
+	GetByNumber(number string, includeDeleted bool) (Invoice, error)
+	// List returns the invoices matching filters ordered by id, starting
+	// at offset, along with the total number of matching invoices
+	List(filters invoiceFilters, offset, limit int) ([]Invoice, int, error)
+	// Update saves an invoice and increments its version, or returns
+	// errVersionConflict if it was saved since it was read. The charges of
+	// the invoice replace the stored ones if replaceCharges is set,
+	// otherwise stored charges are left untouched.
+	Update(i *Invoice, replaceCharges bool) error
+	// SetStatus changes the status of an invoice whatever its version,
+	// and increments it
+	SetStatus(i *Invoice, status string) error
+	// Delete soft deletes an invoice and its charges at the same time, so
+	// they can be restored together
+	Delete(id uint) error
+	// Restore undeletes a soft deleted invoice and the charges deleted
+	// along with it
+	Restore(i Invoice) error
+	// Charges returns up to limit charges of an invoice with an id greater
+	// than after, ordered by id, or all of them if limit is 0. The charges
+	// of a deleted invoice are those deleted along with it.
+	Charges(i Invoice, after uint, limit int) ([]Charge, error)
+	// SummarizeCharges counts and sums the charges of an invoice
+	SummarizeCharges(invoiceID uint) (chargesSummary, error)
+	// SummarizeTaxes sums the amounts and taxes of the charges of an
+	// invoice per tax rate, ordered by tax rate id, untaxed charges having
+	// a tax rate id of 0
+	SummarizeTaxes(invoiceID uint) ([]taxLine, error)
+	// GetCharge returns a charge of an invoice that isn't deleted, or
+	// errChargeNotFound
+	GetCharge(id uint) (Charge, error)
+	// SaveCharge inserts a charge into an invoice, or updates it if it has
+	// an id, and sets the amount of the invoice to the total of its
+	// charges unless it is overridden. Like Update, it increments the
+	// version of the invoice or returns errVersionConflict.
+	SaveCharge(i *Invoice, c *Charge) error
+	// AddCharges appends charges to an invoice, like SaveCharge
+	AddCharges(i *Invoice, charges []Charge) error
+	// DeleteCharge deletes a charge of an invoice, like SaveCharge
+	DeleteCharge(i *Invoice, chargeID uint) error
+	// Search returns up to limit fields of invoices that aren't deleted
+	// matching a search: the types and descriptions of their charges, and
+	// the names of their customers
+	Search(q invoiceSearch, limit int) ([]searchMatch, error)
+	// AmountDrift lists the invoices whose amount isn't overridden but
+	// differs from the total of their charges
+	AmountDrift() ([]amountDrift, error)
+	// Duplicates returns up to limit invoices other than i that bill its
+	// customer the same amount in the same currency, due within window of
+	// it, the closest due first. Invoices without a customer match those of
+	// any customer. Deleted and cancelled invoices are left out.
+	Duplicates(i Invoice, window time.Duration, limit int) ([]Invoice, error)
+}
+
+// gormInvoiceStore stores invoices in the database
+type gormInvoiceStore struct {
+	db *gorm.DB
+}
+
+func newGormInvoiceStore(db *gorm.DB) *gormInvoiceStore {
+	return &gormInvoiceStore{db: db}
+}
+
+// Create numbers the invoice in the transaction inserting it, which is the
+// transaction of the store if it was opened on one
+func (s *gormInvoiceStore) Create(i *Invoice) error {
+	err := inTransaction(s.db, func(tx *gorm.DB) error {
+		err := assignInvoiceNumber(tx, i)
+		if err != nil {
+			return err
+		}
+		return tx.Create(i).Error
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.Last(i).Error
+}
+
+// inTransaction runs fn in a transaction committed if it returns no error.
+// If db already is a transaction, fn runs in it and its caller commits.
+func inTransaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	if _, ok := db.CommonDB().(*sql.Tx); ok {
+		return fn(db)
+	}
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	err := fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *gormInvoiceStore) Get(id uint, includeDeleted bool) (Invoice, error) {
+	db := s.db
+	if includeDeleted {
+		db = db.Unscoped()
+	}
+	var i Invoice
+	res := db.First(&i, id)
+	if res.RecordNotFound() {
+		return i, errInvoiceNotFound
+	}
+	return i, res.Error
+}
+
+func (s *gormInvoiceStore) GetByNumber(number string, includeDeleted bool) (Invoice, error) {
+	db := s.db
+	if includeDeleted {
+		db = db.Unscoped()
+	}
+	var i Invoice
+	res := db.Where("invoice_number = ?", number).First(&i)
+	if res.RecordNotFound() {
+		return i, errInvoiceNotFound
+	}
+	return i, res.Error
+}
+
+func (s *gormInvoiceStore) List(filters invoiceFilters, offset, limit int) (invoices []Invoice, total int, err error) {
+	invoices = []Invoice{}
+	err = filters.apply(s.db.Model(&Invoice{})).Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	err = filters.apply(s.db).Order("id asc").Offset(offset).Limit(limit).Find(&invoices).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return invoices, total, nil
+}
+
+func (s *gormInvoiceStore) Update(i *Invoice, replaceCharges bool) error {
+	return inTransaction(s.db, func(tx *gorm.DB) error {
+		err := bumpVersion(tx, i)
+		if err != nil {
+			return err
+		}
+		if replaceCharges {
+			err := tx.Where("invoice_id = ?", i.ID).Delete(Charge{}).Error
+			if err != nil {
+				return err
+			}
+			if i.Charges == nil {
+				i.Charges = []Charge{}
+			}
+			for n := range i.Charges {
+				i.Charges[n].ID = 0
+				i.Charges[n].InvoiceID = int(i.ID)
+			}
+		} else {
+			i.Charges = nil
+		}
+		return tx.Save(i).Error
+	})
+}
+
+// bumpVersion increments the version of an invoice within a transaction,
+// or returns errVersionConflict if it was saved since it was read. The
+// version only moves forward if nobody saved the invoice in between,
+// otherwise their changes would be overwritten.
+func bumpVersion(tx *gorm.DB, i *Invoice) error {
+	res := tx.Model(&Invoice{}).Where("id = ? AND version = ?", i.ID, i.Version).UpdateColumn("version", i.Version+1)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errVersionConflict
+	}
+	i.Version++
+	return nil
+}
+
+func (s *gormInvoiceStore) SetStatus(i *Invoice, status string) error {
+	err := s.db.Model(i).Updates(map[string]interface{}{"status": status, "version": nextVersion()}).Error
+	if err != nil {
+		return err
+	}
+	i.Status = status
+	i.Version++
+	return nil
+}
+
+func (s *gormInvoiceStore) Delete(id uint) error {
+	now := time.Now().UTC()
+	return inTransaction(s.db, func(tx *gorm.DB) error {
+		err := tx.Model(&Charge{}).Where("invoice_id = ?", id).UpdateColumn("deleted_at", now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Invoice{}).Where("id = ?", id).UpdateColumn("deleted_at", now).Error
+	})
+}
+
+func (s *gormInvoiceStore) Restore(i Invoice) error {
+	if i.DeletedAt == nil {
+		return nil
+	}
+	tx := s.db.Begin()
+	err := tx.Unscoped().Model(&Charge{}).Where("invoice_id = ? AND deleted_at >= ?", i.ID, i.DeletedAt.Add(-time.Second)).
+		UpdateColumn("deleted_at", nil).Error
+	if err == nil {
+		err = tx.Unscoped().Model(&Invoice{}).Where("id = ?", i.ID).UpdateColumn("deleted_at", nil).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Charges of deleted invoices are those deleted at most a second before
+// them: invoices deleted before charges shared their deletion time had
+// their charges deleted just before them.
+func (s *gormInvoiceStore) Charges(i Invoice, after uint, limit int) ([]Charge, error) {
+	db := s.db.Where("invoice_id = ?", i.ID)
+	if i.DeletedAt != nil {
+		db = s.db.Unscoped().Where("invoice_id = ? AND deleted_at >= ?", i.ID, i.DeletedAt.Add(-time.Second))
+	}
+	if after > 0 {
+		db = db.Where("id > ?", after)
+	}
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+	charges := []Charge{}
+	err := db.Order("id asc").Find(&charges).Error
+	return charges, err
+}
+
+// SummarizeCharges counts and sums charges without loading them in memory
+func (s *gormInvoiceStore) SummarizeCharges(invoiceID uint) (summary chargesSummary, err error) {
+	row := s.db.Model(&Charge{}).Where("invoice_id = ?", invoiceID).
+		Select("COUNT(*), COALESCE(SUM(amount + tax), 0)").Row()
+	err = row.Scan(&summary.Count, &summary.Total)
+	return
+}
+
+func (s *gormInvoiceStore) SummarizeTaxes(invoiceID uint) ([]taxLine, error) {
+	lines := []taxLine{}
+	err := s.db.Model(&Charge{}).Where("invoice_id = ?", invoiceID).
+		Select("tax_rate_id, COALESCE(SUM(amount), 0) AS taxable, COALESCE(SUM(tax), 0) AS tax").
+		Group("tax_rate_id").Order("tax_rate_id asc").Scan(&lines).Error
+	return lines, err
+}
+
+func (s *gormInvoiceStore) GetCharge(id uint) (Charge, error) {
+	var c Charge
+	res := s.db.First(&c, id)
+	if res.RecordNotFound() {
+		return c, errChargeNotFound
+	}
+	return c, res.Error
+}
+
+func (s *gormInvoiceStore) SaveCharge(i *Invoice, c *Charge) error {
+	return s.changeCharges(i, func(tx *gorm.DB) error {
+		c.InvoiceID = int(i.ID)
+		return tx.Save(c).Error
+	})
+}
+
+// AddCharges inserts charges using multi-rows inserts of
+// bulkInsertBatchSize rows
+func (s *gormInvoiceStore) AddCharges(i *Invoice, charges []Charge) error {
+	return s.changeCharges(i, func(tx *gorm.DB) error {
+		now := time.Now()
+		for start := 0; start < len(charges); start += bulkInsertBatchSize {
+			end := start + bulkInsertBatchSize
+			if end > len(charges) {
+				end = len(charges)
+			}
+			var (
+				placeholders []string
+				values       []interface{}
+			)
+			for _, c := range charges[start:end] {
+				placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+				values = append(values, now, now, i.ID, c.Type, c.Amount, c.Currency, c.Description, c.CategoryID, c.TaxRateID, c.Tax)
+			}
+			err := tx.Exec("INSERT INTO charges (created_at, updated_at, invoice_id, type, amount, currency, description, category_id, tax_rate_id, tax) VALUES "+
+				strings.Join(placeholders, ", "), values...).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *gormInvoiceStore) DeleteCharge(i *Invoice, chargeID uint) error {
+	return s.changeCharges(i, func(tx *gorm.DB) error {
+		return tx.Where("id = ? AND invoice_id = ?", chargeID, i.ID).Delete(&Charge{}).Error
+	})
+}
+
+// changeCharges applies a change to the charges of an invoice and sets its
+// amount to their new total unless it is overridden, in a transaction that
+// increments its version
+func (s *gormInvoiceStore) changeCharges(i *Invoice, change func(tx *gorm.DB) error) error {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	version := i.Version
+	err := bumpVersion(tx, i)
+	if err == nil {
+		err = change(tx)
+	}
+	total := i.Amount
+	if err == nil && !i.AmountOverride {
+		err = tx.Model(&Charge{}).Where("invoice_id = ?", i.ID).
+			Select("COALESCE(SUM(amount + tax), 0)").Row().Scan(&total)
+	}
+	if err == nil {
+		err = tx.Model(&Invoice{}).Where("id = ?", i.ID).
+			UpdateColumns(map[string]interface{}{"amount": total, "updated_at": time.Now()}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		i.Version = version
+		return err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		i.Version = version
+		return err
+	}
+	i.Amount = total
+	return nil
+}
+
+func (s *gormInvoiceStore) AmountDrift() ([]amountDrift, error) {
+	rows, err := s.db.Raw(`SELECT invoices.id, invoices.currency, invoices.amount, COALESCE(SUM(charges.amount + charges.tax), 0)
+		FROM invoices LEFT JOIN charges ON charges.invoice_id = invoices.id AND charges.deleted_at IS NULL
+		WHERE invoices.deleted_at IS NULL AND invoices.amount_override = ?
+		GROUP BY invoices.id, invoices.currency, invoices.amount
+		HAVING invoices.amount <> COALESCE(SUM(charges.amount + charges.tax), 0)
+		ORDER BY invoices.id`, false).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	drifts := []amountDrift{}
+	for rows.Next() {
+		var d amountDrift
+		err = rows.Scan(&d.InvoiceID, &d.Currency, &d.Amount, &d.Total)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, d)
+	}
+	return drifts, rows.Err()
+}
+
+func (s *gormInvoiceStore) Duplicates(i Invoice, window time.Duration, limit int) ([]Invoice, error) {
+	invoices := []Invoice{}
+	db := s.db.Where("amount = ? AND currency = ? AND id <> ? AND status <> ?", i.Amount, i.Currency, i.ID, statusCancelled).
+		Where("due_date BETWEEN ? AND ?", i.DueDate.Add(-window), i.DueDate.Add(window))
+	if i.CustomerID != 0 {
+		db = db.Where("customer_id = ?", i.CustomerID)
+	}
+	err := db.Find(&invoices).Error
+	if err != nil {
+		return nil, err
+	}
+	return closestDue(i, invoices, limit), nil
+}
+
+// closestDue sorts invoices by the distance of their due date to that of i,
+// then by id, and keeps the first limit of them
+func closestDue(i Invoice, invoices []Invoice, limit int) []Invoice {
+	distance := func(d time.Time) time.Duration {
+		if d.Before(i.DueDate) {
+			return i.DueDate.Sub(d)
+		}
+		return d.Sub(i.DueDate)
+	}
+	sort.Slice(invoices, func(a, b int) bool {
+		da, db := distance(invoices[a].DueDate), distance(invoices[b].DueDate)
+		if da != db {
+			return da < db
+		}
+		return invoices[a].ID < invoices[b].ID
+	})
+	if len(invoices) > limit {
+		invoices = invoices[:limit]
+	}
+	return invoices
+}
+
+// Search matches fields case insensitively, with ILIKE on postgres and LIKE,
+// which ignores the case of ASCII letters on sqlite and of every letter
+// with the default collations of mysql
+func (s *gormInvoiceStore) Search(q invoiceSearch, limit int) ([]searchMatch, error) {
+	like := "LIKE"
+	if s.db.Dialect().GetName() == "postgres" {
+		like = "ILIKE"
+	}
+	pattern := likePattern(q.Query)
+	filter := func(db *gorm.DB) *gorm.DB {
+		db = db.Where("invoices.deleted_at IS NULL")
+		if q.Status != "" {
+			db = db.Where("invoices.status = ?", q.Status)
+		}
+		if q.MinAmount != nil {
+			db = db.Where("invoices.amount >= ?", *q.MinAmount)
+		}
+		if q.MaxAmount != nil {
+			db = db.Where("invoices.amount <= ?", *q.MaxAmount)
+		}
+		return db
+	}
+	matches := []searchMatch{}
+	rows, err := filter(s.db.Table("charges").
+		Select("charges.invoice_id, charges.id, charges.type, charges.description").
+		Joins("JOIN invoices ON invoices.id = charges.invoice_id").
+		Where("charges.deleted_at IS NULL").
+		Where(fmt.Sprintf(`charges.type %[1]s ? ESCAPE '!' OR charges.description %[1]s ? ESCAPE '!'`, like), pattern, pattern)).
+		Order("charges.invoice_id desc, charges.id").Limit(limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			invoiceID, chargeID uint
+			typ, description    string
+		)
+		err = rows.Scan(&invoiceID, &chargeID, &typ, &description)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range []struct{ field, text string }{{"charge.type", typ}, {"charge.description", description}} {
+			if containsFold(f.text, q.Query) {
+				matches = append(matches, searchMatch{InvoiceID: invoiceID, Field: f.field, ChargeID: chargeID, Text: f.text})
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = filter(s.db.Table("invoices").
+		Select("invoices.id, customers.name").
+		Joins("JOIN customers ON customers.id = invoices.customer_id AND customers.deleted_at IS NULL").
+		Where(fmt.Sprintf(`customers.name %s ? ESCAPE '!'`, like), pattern)).
+		Order("invoices.id desc").Limit(limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := searchMatch{Field: "customer.name"}
+		err = rows.Scan(&m.InvoiceID, &m.Text)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
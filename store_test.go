@@ -0,0 +1,343 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// openTestDB opens a migrated sqlite database in a temporary directory,
+// removed by the returned function
+func openTestDB(t *testing.T) (*gorm.DB, func()) {
+	dir, err := ioutil.TempDir("", "invoicer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "invoicer.db"))
+	if err == nil {
+		err = migrateUp(db)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testInvoiceStores runs a test against the memory store and the database
+// store, so the memory store keeps the semantics the service relies on
+func testInvoiceStores(t *testing.T, test func(t *testing.T, s InvoiceStore)) {
+	applog = newLogger(ioutil.Discard, logFormatJSON, levelError)
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryInvoiceStore())
+	})
+	t.Run("gorm", func(t *testing.T) {
+		db, closeDB := openTestDB(t)
+		defer closeDB()
+		test(t, newGormInvoiceStore(db))
+	})
+}
+
+func newTestInvoice(amounts ...int64) Invoice {
+	i := Invoice{Status: statusDraft, Currency: "USD", DueDate: time.Date(2030, 1, 15, 0, 0, 0, 0, time.UTC)}
+	for _, amount := range amounts {
+		i.Charges = append(i.Charges, Charge{Type: "service", Amount: amount, Currency: "USD", Description: "work"})
+		i.Amount += amount
+	}
+	return i
+}
+
+func createTestInvoice(t *testing.T, s InvoiceStore, i Invoice) Invoice {
+	err := s.Create(&i)
+	if err != nil {
+		t.Fatalf("failed to create invoice: %s", err)
+	}
+	return i
+}
+
+func TestInvoiceStoreCreate(t *testing.T) {
+	testInvoiceStores(t, func(t *testing.T, s InvoiceStore) {
+		first := createTestInvoice(t, s, newTestInvoice(1000, 250))
+		second := createTestInvoice(t, s, newTestInvoice(500))
+		if first.ID == 0 || second.ID <= first.ID {
+			t.Fatalf("expected increasing ids, got %d and %d", first.ID, second.ID)
+		}
+		year := time.Now().UTC().Year()
+		if want := formatInvoiceNumber(invoiceNumberFormat, year, 1); first.InvoiceNumber != want {
+			t.Errorf("expected number %s, got %s", want, first.InvoiceNumber)
+		}
+		if want := formatInvoiceNumber(invoiceNumberFormat, year, 2); second.InvoiceNumber != want {
+			t.Errorf("expected number %s, got %s", want, second.InvoiceNumber)
+		}
+		if first.Version != 1 {
+			t.Errorf("expected version 1, got %d", first.Version)
+		}
+		i1, err := s.Get(first.ID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i1.Amount != 1250 || len(i1.Charges) != 0 {
+			t.Errorf("expected an amount of 1250 without charges, got %d with %d charges", i1.Amount, len(i1.Charges))
+		}
+		i1, err = s.GetByNumber(second.InvoiceNumber, false)
+		if err != nil || i1.ID != second.ID {
+			t.Errorf("expected invoice %d by number, got %d, %v", second.ID, i1.ID, err)
+		}
+		_, err = s.Get(second.ID+1, false)
+		if err != errInvoiceNotFound {
+			t.Errorf("expected errInvoiceNotFound, got %v", err)
+		}
+	})
+}
+
+func TestInvoiceStoreUpdate(t *testing.T) {
+	testInvoiceStores(t, func(t *testing.T, s InvoiceStore) {
+		i1 := createTestInvoice(t, s, newTestInvoice(1000, 250))
+		stale := i1
+		i1.Status = statusSent
+		err := s.Update(&i1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i1.Version != 2 {
+			t.Errorf("expected version 2, got %d", i1.Version)
+		}
+		stale.Status = statusCancelled
+		err = s.Update(&stale, false)
+		if err != errVersionConflict {
+			t.Errorf("expected errVersionConflict updating a stale invoice, got %v", err)
+		}
+		charges, err := s.Charges(i1, 0, 0)
+		if err != nil || len(charges) != 2 {
+			t.Fatalf("expected the charges to be kept, got %d, %v", len(charges), err)
+		}
+		i1.Charges = []Charge{{Type: "product", Amount: 300, Currency: "USD"}}
+		i1.Amount = 300
+		err = s.Update(&i1, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		charges, err = s.Charges(i1, 0, 0)
+		if err != nil || len(charges) != 1 || charges[0].Type != "product" {
+			t.Fatalf("expected the charges to be replaced, got %+v, %v", charges, err)
+		}
+		stored, err := s.Get(i1.ID, false)
+		if err != nil || stored.Status != statusSent || stored.Amount != 300 || stored.Version != 3 {
+			t.Errorf("expected a sent invoice of 300 at version 3, got %s %d at version %d, %v",
+				stored.Status, stored.Amount, stored.Version, err)
+		}
+	})
+}
+
+func TestInvoiceStoreCharges(t *testing.T) {
+	testInvoiceStores(t, func(t *testing.T, s InvoiceStore) {
+		i1 := createTestInvoice(t, s, newTestInvoice(100, 200, 300, 400, 500))
+		page, err := s.Charges(i1, 0, 2)
+		if err != nil || len(page) != 2 {
+			t.Fatalf("expected a page of 2 charges, got %d, %v", len(page), err)
+		}
+		next, err := s.Charges(i1, page[1].ID, 2)
+		if err != nil || len(next) != 2 || next[0].ID <= page[1].ID || next[0].Amount != 300 {
+			t.Fatalf("expected the next page to start with the third charge, got %+v, %v", next, err)
+		}
+
+		c := Charge{Type: "fee", Amount: 50, Currency: "USD", Tax: 10}
+		err = s.SaveCharge(&i1, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ID == 0 || i1.Amount != 1560 || i1.Version != 2 {
+			t.Errorf("expected an amount of 1560 at version 2, got %d at version %d", i1.Amount, i1.Version)
+		}
+		err = s.AddCharges(&i1, []Charge{{Type: "fee", Amount: 40, Currency: "USD"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.DeleteCharge(&i1, page[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i1.Amount != 1500 || i1.Version != 4 {
+			t.Errorf("expected an amount of 1500 at version 4, got %d at version %d", i1.Amount, i1.Version)
+		}
+		summary, err := s.SummarizeCharges(i1.ID)
+		if err != nil || summary.Count != 6 || summary.Total != 1500 {
+			t.Errorf("expected 6 charges totalling 1500, got %+v, %v", summary, err)
+		}
+		_, err = s.GetCharge(page[0].ID)
+		if err != errChargeNotFound {
+			t.Errorf("expected errChargeNotFound for a deleted charge, got %v", err)
+		}
+
+		stale := i1
+		stale.Version--
+		err = s.AddCharges(&stale, []Charge{{Type: "fee", Amount: 1, Currency: "USD"}})
+		if err != errVersionConflict {
+			t.Errorf("expected errVersionConflict changing the charges of a stale invoice, got %v", err)
+		}
+	})
+}
+
+func TestInvoiceStoreAmountOverride(t *testing.T) {
+	testInvoiceStores(t, func(t *testing.T, s InvoiceStore) {
+		i := newTestInvoice(100)
+		i.Amount, i.AmountOverride = 5000, true
+		i1 := createTestInvoice(t, s, i)
+		err := s.AddCharges(&i1, []Charge{{Type: "fee", Amount: 40, Currency: "USD"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i1.Amount != 5000 {
+			t.Errorf("expected the overridden amount to be kept, got %d", i1.Amount)
+		}
+		drifts, err := s.AmountDrift()
+		if err != nil || len(drifts) != 0 {
+			t.Errorf("expected overridden amounts not to drift, got %+v, %v", drifts, err)
+		}
+	})
+}
+
+func TestInvoiceStoreDeleteRestore(t *testing.T) {
+	testInvoiceStores(t, func(t *testing.T, s InvoiceStore) {
+		i1 := createTestInvoice(t, s, newTestInvoice(100, 200))
+		// a charge deleted over a second before the invoice stays deleted
+		// when it is restored
+		charges, err := s.Charges(i1, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.DeleteCharge(&i1, charges[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(1100 * time.Millisecond)
+		err = s.Delete(i1.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Get(i1.ID, false)
+		if err != errInvoiceNotFound {
+			t.Errorf("expected a deleted invoice not to be found, got %v", err)
+		}
+		deleted, err := s.Get(i1.ID, true)
+		if err != nil || deleted.DeletedAt == nil {
+			t.Fatalf("expected the deleted invoice to be found with includeDeleted, got %v", err)
+		}
+		charges, err = s.Charges(deleted, 0, 0)
+		if err != nil || len(charges) != 1 || charges[0].Amount != 200 {
+			t.Errorf("expected the charge deleted along with the invoice, got %+v, %v", charges, err)
+		}
+		err = s.Restore(deleted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := s.Get(i1.ID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		charges, err = s.Charges(restored, 0, 0)
+		if err != nil || len(charges) != 1 || charges[0].Amount != 200 {
+			t.Errorf("expected only the charge deleted along with the invoice to be restored, got %+v, %v", charges, err)
+		}
+	})
+}
+
+func TestInvoiceStoreList(t *testing.T) {
+	testInvoiceStores(t, func(t *testing.T, s InvoiceStore) {
+		var ids []uint
+		for n := 0; n < 5; n++ {
+			i := newTestInvoice(100)
+			if n%2 == 1 {
+				i.Status = statusSent
+			}
+			ids = append(ids, createTestInvoice(t, s, i).ID)
+		}
+		err := s.Delete(ids[4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		invoices, total, err := s.List(invoiceFilters{}, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 4 || len(invoices) != 2 || invoices[0].ID != ids[1] || invoices[1].ID != ids[2] {
+			t.Errorf("expected invoices %d and %d of 4, got %d invoices of %d", ids[1], ids[2], len(invoices), total)
+		}
+		invoices, total, err = s.List(invoiceFilters{Status: statusSent}, 0, 10)
+		if err != nil || total != 2 || len(invoices) != 2 {
+			t.Errorf("expected 2 sent invoices, got %d of %d, %v", len(invoices), total, err)
+		}
+		_, total, err = s.List(invoiceFilters{OnlyDeleted: true}, 0, 10)
+		if err != nil || total != 1 {
+			t.Errorf("expected 1 deleted invoice, got %d, %v", total, err)
+		}
+	})
+}
+
+func TestInvoiceStoreDuplicates(t *testing.T) {
+	testInvoiceStores(t, func(t *testing.T, s InvoiceStore) {
+		i1 := createTestInvoice(t, s, newTestInvoice(100))
+		near := newTestInvoice(100)
+		near.DueDate = i1.DueDate.AddDate(0, 0, 2)
+		near1 := createTestInvoice(t, s, near)
+		far := newTestInvoice(100)
+		far.DueDate = i1.DueDate.AddDate(0, 0, 30)
+		createTestInvoice(t, s, far)
+		createTestInvoice(t, s, newTestInvoice(999))
+		cancelled := newTestInvoice(100)
+		cancelled.Status = statusCancelled
+		createTestInvoice(t, s, cancelled)
+
+		duplicates, err := s.Duplicates(i1, 7*24*time.Hour, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(duplicates) != 1 || duplicates[0].ID != near1.ID {
+			t.Errorf("expected invoice %d as the only duplicate, got %+v", near1.ID, duplicates)
+		}
+
+		// invoices of a customer only duplicate invoices of that customer,
+		// while invoices without one match those of any customer
+		billed := newTestInvoice(100)
+		billed.CustomerID = 7
+		billed1 := createTestInvoice(t, s, billed)
+		other := newTestInvoice(100)
+		other.CustomerID = 8
+		createTestInvoice(t, s, other)
+		duplicates, err = s.Duplicates(billed1, 7*24*time.Hour, 10)
+		if err != nil || len(duplicates) != 0 {
+			t.Errorf("expected no duplicates billing customer 7, got %+v, %v", duplicates, err)
+		}
+		duplicates, err = s.Duplicates(i1, 7*24*time.Hour, 10)
+		if err != nil || len(duplicates) != 3 || duplicates[0].ID != billed1.ID {
+			t.Errorf("expected 3 duplicates of an invoice without customer, got %+v, %v", duplicates, err)
+		}
+	})
+}
+
+func TestInvoiceStoreSearch(t *testing.T) {
+	testInvoiceStores(t, func(t *testing.T, s InvoiceStore) {
+		i := newTestInvoice(100, 200)
+		i.Charges[0].Description = "50% off_season! discount"
+		i.Charges[1].Description = "500 offseason discount"
+		i1 := createTestInvoice(t, s, i)
+		// the wildcards and the escape character of LIKE patterns match
+		// themselves
+		for _, query := range []string{"50% off_", "season! d", "OFF_SEASON"} {
+			matches, err := s.Search(invoiceSearch{Query: query}, 10)
+			if err != nil {
+				t.Fatalf("failed to search %q: %s", query, err)
+			}
+			if len(matches) != 1 || matches[0].InvoiceID != i1.ID || matches[0].Text != i.Charges[0].Description {
+				t.Errorf("expected %q to only match the first charge, got %+v", query, matches)
+			}
+		}
+	})
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	stripeAPIURL = "https://api.stripe.com"
+	// stripeSignatureTolerance is how old the timestamp of a signed
+	// webhook event can be, to keep captured events from being replayed
+	stripeSignatureTolerance = 5 * time.Minute
+	// maxStripeEventSize bounds the body of webhook events
+	maxStripeEventSize   = 1 << 20
+	stripeRequestTimeout = 10 * time.Second
+)
+
+// statuses of payment links
+const (
+	paymentLinkOpen      = "open"
+	paymentLinkCompleted = "completed"
+	paymentLinkExpired   = "expired"
+)
+
+// PaymentLink is a Stripe Checkout session created to let the customer of
+// an invoice pay its balance online. The invoice is paid when Stripe reports
+// the session as completed.
+type PaymentLink struct {
+	gorm.Model
+	InvoiceID uint      `gorm:"index" json:"invoice_id"`
+	SessionID string    `gorm:"unique_index" json:"session_id"`
+	URL       string    `json:"url"`
+	Amount    int64     `json:"amount"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+	PaymentID uint      `json:"payment_id,omitempty"`
+}
+
+// stripeClient creates Checkout sessions and verifies the webhook events of
+// a Stripe account
+type stripeClient struct {
+	apiURL        string
+	secretKey     string
+	webhookSecret string
+	successURL    string
+	cancelURL     string
+	client        *http.Client
+}
+
+// newStripeClient configures the Stripe integration, returning a nil
+// client if stripe.secret_key is not set
+func newStripeClient(cfg config.Stripe) *stripeClient {
+	if cfg.SecretKey == "" {
+		return nil
+	}
+	return &stripeClient{
+		apiURL:        strings.TrimSuffix(cfg.APIURL, "/"),
+		secretKey:     cfg.SecretKey,
+		webhookSecret: cfg.WebhookSecret,
+		successURL:    cfg.SuccessURL,
+		cancelURL:     cfg.CancelURL,
+		client:        &http.Client{Timeout: stripeRequestTimeout},
+	}
+}
+
+// stripeSession is a Checkout session, as returned by the API and sent in
+// webhook events
+type stripeSession struct {
+	ID            string `json:"id"`
+	URL           string `json:"url"`
+	ExpiresAt     int64  `json:"expires_at"`
+	PaymentStatus string `json:"payment_status"`
+	AmountTotal   int64  `json:"amount_total"`
+	Currency      string `json:"currency"`
+	PaymentIntent string `json:"payment_intent"`
+}
+
+// createCheckoutSession asks Stripe for a hosted payment page of amount, in
+// minor units of the currency of the invoice, which Stripe also uses
+func (s *stripeClient) createCheckoutSession(i Invoice, amount int64) (stripeSession, error) {
+	var session stripeSession
+	form := url.Values{
+		"mode":                                   {"payment"},
+		"success_url":                            {s.successURL},
+		"cancel_url":                             {s.cancelURL},
+		"client_reference_id":                    {strconv.Itoa(int(i.ID))},
+		"metadata[invoice_id]":                   {strconv.Itoa(int(i.ID))},
+		"line_items[0][quantity]":                {"1"},
+		"line_items[0][price_data][currency]":    {strings.ToLower(i.Currency)},
+		"line_items[0][price_data][unit_amount]": {strconv.FormatInt(amount, 10)},
+		"line_items[0][price_data][product_data][name]": {fmt.Sprintf("Invoice %d", i.ID)},
+	}
+	req, err := http.NewRequest("POST", s.apiURL+"/v1/checkout/sessions", strings.NewReader(form.Encode()))
+	if err != nil {
+		return session, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.secretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return session, fmt.Errorf("failed to reach stripe: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxStripeEventSize))
+	if err != nil {
+		return session, fmt.Errorf("failed to read stripe response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(body, &apiErr)
+		return session, fmt.Errorf("stripe returned %s: %s", resp.Status, apiErr.Error.Message)
+	}
+	err = json.Unmarshal(body, &session)
+	if err != nil || session.ID == "" || session.URL == "" {
+		return session, fmt.Errorf("failed to parse stripe checkout session: %v", err)
+	}
+	return session, nil
+}
+
+// verifySignature checks the Stripe-Signature header of a webhook event,
+// which carries the time it was signed and HMAC-SHA256 signatures of that
+// time and the payload, one per active signing secret
+func (s *stripeClient) verifySignature(header string, payload []byte, now time.Time) error {
+	var (
+		timestamp  string
+		signatures []string
+	)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return fmt.Errorf("missing or malformed Stripe-Signature header")
+	}
+	if age := now.Sub(time.Unix(t, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return fmt.Errorf("event signed at %s is outside of the tolerance of %s", time.Unix(t, 0).UTC(), stripeSignatureTolerance)
+	}
+	expected, _ := hex.DecodeString(signWebhookPayload(s.webhookSecret, timestamp+"."+string(payload)))
+	for _, sig := range signatures {
+		decoded, err := hex.DecodeString(sig)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid signature in Stripe-Signature header")
+}
+
+// postInvoicePaymentLink creates a Stripe Checkout session for the balance
+// of an invoice awaiting payment and returns its URL
+func (iv *invoicer) postInvoicePaymentLink(w http.ResponseWriter, r *http.Request) {
+	if iv.stripe == nil {
+		httpError(w, r, http.StatusServiceUnavailable, "payment links require stripe.secret_key to be configured")
+		return
+	}
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	if !canTransition(i1.Status, statusPaid) {
+		httpError(w, r, http.StatusConflict, "invoice %d is %s and cannot receive payments", i1.ID, i1.Status)
+		return
+	}
+	settled, err := settledAmount(iv.dbFor(r), i1.ID)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve balance of invoice %d: %s", i1.ID, err)
+		return
+	}
+	balance := i1.Amount - settled
+	if balance <= 0 {
+		httpError(w, r, http.StatusConflict, "invoice %d has no balance left to pay", i1.ID)
+		return
+	}
+	session, err := iv.stripe.createCheckoutSession(i1, balance)
+	if err != nil {
+		httpError(w, r, http.StatusBadGateway, "failed to create payment link for invoice %d: %s", i1.ID, err)
+		return
+	}
+	link := PaymentLink{
+		InvoiceID: i1.ID,
+		SessionID: session.ID,
+		URL:       session.URL,
+		Amount:    balance,
+		Currency:  i1.Currency,
+		Status:    paymentLinkOpen,
+		ExpiresAt: time.Unix(session.ExpiresAt, 0).UTC(),
+	}
+	err = iv.dbFor(r).Create(&link).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to store payment link: %s", err)
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, link)
+	al := appLog{Message: fmt.Sprintf("created payment link %d of %s %s for invoice %d with stripe session %s",
+		link.ID, formatMinorUnits(balance, link.Currency), link.Currency, i1.ID, session.ID), Action: "post-payment-link"}
+	al.log(r)
+}
+
+func (iv *invoicer) getInvoicePaymentLinks(w http.ResponseWriter, r *http.Request) {
+	i1, ok := iv.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	links := []PaymentLink{}
+	err := iv.dbFor(r).Where("invoice_id = ?", i1.ID).Order("id asc").Find(&links).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve payment links of invoice %d: %s", i1.ID, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, links)
+}
+
+// postStripeWebhook receives the events of the Stripe account. Completed
+// and paid Checkout sessions record a payment on their invoice, expired ones
+// close their payment link, and other events are acknowledged and ignored.
+// Stripe retries events until it gets a 2xx, so events that were already
+// processed are acknowledged again.
+func (iv *invoicer) postStripeWebhook(w http.ResponseWriter, r *http.Request) {
+	if iv.stripe == nil {
+		httpError(w, r, http.StatusServiceUnavailable, "stripe webhooks require stripe.secret_key to be configured")
+		return
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxStripeEventSize))
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "failed to read stripe event: %s", err)
+		return
+	}
+	err = iv.stripe.verifySignature(r.Header.Get("Stripe-Signature"), payload, time.Now())
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid stripe event signature: %s", err)
+		return
+	}
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object stripeSession `json:"object"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "failed to parse stripe event: %s", err)
+		return
+	}
+	session := event.Data.Object
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+		if session.PaymentStatus != "paid" {
+			// delayed payment methods complete the session before the
+			// money arrives, and send async_payment_succeeded once it does
+			break
+		}
+		err = iv.completePaymentLink(r, session)
+	case "checkout.session.expired", "checkout.session.async_payment_failed":
+		err = iv.dbFor(r).Model(&PaymentLink{}).Where("session_id = ? AND status = ?", session.ID, paymentLinkOpen).
+			Update("status", paymentLinkExpired).Error
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to process stripe event %s: %s", event.ID, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]bool{"received": true})
+	al := appLog{Message: fmt.Sprintf("received stripe event %s of type %s", event.ID, event.Type), Action: "post-stripe-webhook"}
+	al.log(r)
+}
+
+// completePaymentLink records the payment of a completed Checkout session on
+// its invoice, once
+func (iv *invoicer) completePaymentLink(r *http.Request, session stripeSession) error {
+	var link PaymentLink
+	res := iv.dbFor(r).Where("session_id = ?", session.ID).First(&link)
+	if res.RecordNotFound() {
+		applog.warnf("ignoring completed stripe session %s, which isn't a payment link of the invoicer", session.ID)
+		return nil
+	}
+	if err := res.Error; err != nil {
+		return fmt.Errorf("failed to retrieve payment link of session %s: %s", session.ID, err)
+	}
+	if link.Status == paymentLinkCompleted {
+		return nil
+	}
+	snapshot := iv.invoiceSnapshot(link.InvoiceID)
+	tx := iv.dbFor(r).Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	// retried and concurrent deliveries of the event wait for the lock of the
+	// invoice, then find the link completed
+	i1, err := lockInvoice(tx, link.InvoiceID, true)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to lock invoice %d: %s", link.InvoiceID, err)
+	}
+	err = tx.First(&link, link.ID).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to retrieve payment link %d: %s", link.ID, err)
+	}
+	if link.Status == paymentLinkCompleted {
+		tx.Rollback()
+		return nil
+	}
+	before := i1
+	p := Payment{
+		InvoiceID: i1.ID,
+		Amount:    session.AmountTotal,
+		Currency:  strings.ToUpper(session.Currency),
+		Method:    "stripe",
+		Reference: session.PaymentIntent,
+		PaidAt:    time.Now().UTC(),
+	}
+	if p.Reference == "" {
+		p.Reference = session.ID
+	}
+	if canTransition(i1.Status, statusPaid) && i1.DeletedAt == nil {
+		settled, err := settledAmount(tx, i1.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = recordPayment(tx, &i1, &p, settled)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	} else {
+		// the money was received, the invoice must be refunded by hand
+		applog.errorf("stripe session %s paid %s %s on invoice %d, which is %s and cannot receive payments",
+			session.ID, formatMinorUnits(p.Amount, p.Currency), p.Currency, i1.ID, i1.Status)
+	}
+	res = tx.Model(&link).Where("status <> ?", paymentLinkCompleted).
+		Updates(map[string]interface{}{"status": paymentLinkCompleted, "payment_id": p.ID})
+	if res.Error != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to complete payment link %d: %s", link.ID, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return nil
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+	if p.ID == 0 {
+		return nil
+	}
+	al := appLog{Message: fmt.Sprintf("created payment %d of %s %s on invoice %d from stripe session %s, now %s",
+		p.ID, formatMinorUnits(p.Amount, p.Currency), p.Currency, i1.ID, session.ID, i1.Status), Action: "post-payment"}
+	al.log(r)
+	iv.audit(r, "payment", i1.ID, snapshot, iv.invoiceSnapshot(i1.ID))
+	iv.fireInvoiceUpdated(before, i1)
+	return nil
+}
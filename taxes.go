@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// TaxRate is a tax charged on top of the charges that reference it, such
+// as a sales tax or a VAT rate, in percent of their amount
+type TaxRate struct {
+	gorm.Model
+	Name         string  `json:"name"`
+	Percentage   float64 `json:"percentage"`
+	Jurisdiction string  `json:"jurisdiction"`
+}
+
+func escapeTaxRate(t *TaxRate) {
+	t.Name = html.EscapeString(t.Name)
+	t.Jurisdiction = html.EscapeString(t.Jurisdiction)
+}
+
+// loadTaxRates returns all tax rates indexed by ID
+func (iv *invoicer) loadTaxRates() (map[uint]*TaxRate, error) {
+	var rates []TaxRate
+	err := iv.db.Find(&rates).Error
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*TaxRate, len(rates))
+	for i := range rates {
+		byID[rates[i].ID] = &rates[i]
+	}
+	return byID, nil
+}
+
+// applyTax sets the tax of a charge from its tax rate, rounded to the
+// nearest minor unit. Charges without a known rate aren't taxed.
+func applyTax(c *Charge, taxRates map[uint]*TaxRate) {
+	c.Tax = 0
+	if rate, ok := taxRates[c.TaxRateID]; ok {
+		c.Tax = int64(math.Floor(float64(c.Amount)*rate.Percentage/100 + 0.5))
+	}
+}
+
+func applyTaxes(charges []Charge, taxRates map[uint]*TaxRate) {
+	for n := range charges {
+		applyTax(&charges[n], taxRates)
+	}
+}
+
+// taxCharges computes the taxes of charges before they are stored, the
+// tax sent by clients being ignored
+func (iv *invoicer) taxCharges(charges []Charge) error {
+	if len(charges) == 0 {
+		return nil
+	}
+	taxRates, err := iv.loadTaxRates()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve tax rates: %s", err)
+	}
+	applyTaxes(charges, taxRates)
+	return nil
+}
+
+// validateTaxRate checks that a tax rate has a name and a percentage
+// between 0 and 100
+func validateTaxRate(t TaxRate) validationErrors {
+	var errs validationErrors
+	if strings.TrimSpace(t.Name) == "" {
+		errs.add("name", "must not be empty")
+	}
+	if t.Percentage < 0 || t.Percentage > 100 {
+		errs.add("percentage", "must be between 0 and 100")
+	}
+	return errs
+}
+
+// taxLine is the tax of the charges of an invoice at one rate
+type taxLine struct {
+	TaxRateID    uint    `json:"tax_rate_id"`
+	Name         string  `json:"name"`
+	Jurisdiction string  `json:"jurisdiction"`
+	Percentage   float64 `json:"percentage"`
+	Taxable      int64   `json:"taxable"`
+	Tax          int64   `json:"tax"`
+}
+
+// invoiceTaxes breaks the total of the charges of an invoice down into
+// their subtotal before taxes and the tax of each rate
+type invoiceTaxes struct {
+	Subtotal   int64     `json:"subtotal"`
+	Lines      []taxLine `json:"lines"`
+	Tax        int64     `json:"tax"`
+	GrandTotal int64     `json:"grand_total"`
+}
+
+func escapeTaxLines(lines []taxLine) {
+	for n := range lines {
+		lines[n].Name = html.EscapeString(lines[n].Name)
+		lines[n].Jurisdiction = html.EscapeString(lines[n].Jurisdiction)
+	}
+}
+
+// invoiceTaxes computes the tax lines of an invoice, or returns nil if
+// none of its charges is taxed. Deleted tax rates keep their name on the
+// invoices that used them.
+func (iv *invoicer) invoiceTaxes(r *http.Request, i Invoice) (*invoiceTaxes, error) {
+	lines, err := iv.invoicesFor(r).SummarizeTaxes(i.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to total the taxes of invoice %d: %s", i.ID, err)
+	}
+	taxes := &invoiceTaxes{Lines: []taxLine{}}
+	var ids []uint
+	for _, l := range lines {
+		taxes.Subtotal += l.Taxable
+		taxes.Tax += l.Tax
+		if l.TaxRateID != 0 {
+			taxes.Lines = append(taxes.Lines, l)
+			ids = append(ids, l.TaxRateID)
+		}
+	}
+	if len(taxes.Lines) == 0 {
+		return nil, nil
+	}
+	taxes.GrandTotal = taxes.Subtotal + taxes.Tax
+	var rates []TaxRate
+	err = iv.dbFor(r).Unscoped().Where("id IN (?)", ids).Find(&rates).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve tax rates: %s", err)
+	}
+	for n := range taxes.Lines {
+		for _, rate := range rates {
+			if rate.ID == taxes.Lines[n].TaxRateID {
+				taxes.Lines[n].Name, taxes.Lines[n].Jurisdiction, taxes.Lines[n].Percentage = rate.Name, rate.Jurisdiction, rate.Percentage
+			}
+		}
+	}
+	return taxes, nil
+}
+
+func (iv *invoicer) getTaxRates(w http.ResponseWriter, r *http.Request) {
+	rates := []TaxRate{}
+	err := iv.dbFor(r).Order("jurisdiction asc, name asc").Find(&rates).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve tax rates: %s", err)
+		return
+	}
+	for n := range rates {
+		escapeTaxRate(&rates[n])
+	}
+	writeJSON(w, r, http.StatusOK, rates)
+}
+
+func (iv *invoicer) getTaxRate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var t TaxRate
+	iv.dbFor(r).First(&t, vars["id"])
+	if t.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No tax rate id %s", vars["id"])
+		return
+	}
+	escapeTaxRate(&t)
+	writeJSON(w, r, http.StatusOK, t)
+}
+
+func (iv *invoicer) postTaxRate(w http.ResponseWriter, r *http.Request) {
+	var t TaxRate
+	if !readJSONBody(w, r, &t) {
+		return
+	}
+	t.ID = 0
+	if errs := validateTaxRate(t); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	err := iv.dbFor(r).Create(&t).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to create tax rate: %s", err)
+		return
+	}
+	escapeTaxRate(&t)
+	writeJSON(w, r, http.StatusCreated, t)
+	al := appLog{Message: fmt.Sprintf("created tax rate %d", t.ID), Action: "post-tax-rate"}
+	al.log(r)
+}
+
+// putTaxRate updates a tax rate. Charges keep the tax computed when they
+// were saved, only charges saved afterwards use the new percentage.
+func (iv *invoicer) putTaxRate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var t TaxRate
+	iv.dbFor(r).First(&t, vars["id"])
+	if t.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No tax rate id %s", vars["id"])
+		return
+	}
+	model := t.Model
+	if !readJSONBody(w, r, &t) {
+		return
+	}
+	t.Model = model
+	if errs := validateTaxRate(t); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	err := iv.dbFor(r).Save(&t).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to update tax rate %d: %s", t.ID, err)
+		return
+	}
+	// cached invoices show the name and percentage of their tax rates
+	iv.invoiceCache.invalidate(0)
+	escapeTaxRate(&t)
+	writeJSON(w, r, http.StatusAccepted, t)
+	al := appLog{Message: fmt.Sprintf("updated tax rate %d", t.ID), Action: "put-tax-rate"}
+	al.log(r)
+}
+
+// deleteTaxRate removes a tax rate that isn't used by any charge or
+// recurring charge
+func (iv *invoicer) deleteTaxRate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var t TaxRate
+	iv.dbFor(r).First(&t, vars["id"])
+	if t.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No tax rate id %s", vars["id"])
+		return
+	}
+	var charges, recurring int
+	iv.dbFor(r).Model(&Charge{}).Where("tax_rate_id = ?", t.ID).Count(&charges)
+	iv.dbFor(r).Model(&RecurringCharge{}).Where("tax_rate_id = ?", t.ID).Count(&recurring)
+	if charges > 0 || recurring > 0 {
+		httpError(w, r, http.StatusConflict, "tax rate %d is used by %d charges and %d recurring charges", t.ID, charges, recurring)
+		return
+	}
+	iv.dbFor(r).Delete(&t)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted tax rate %d", t.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted tax rate %d", t.ID), Action: "delete-tax-rate"}
+	al.log(r)
+}
+
+// parseTaxPeriod returns the bounds of a filing period: a year such as
+// 2016, a quarter such as 2016-Q2, a month such as 2016-05 or a day
+func parseTaxPeriod(period string) (from, to time.Time, err error) {
+	if t, err := time.Parse("2006", period); err == nil {
+		return t, t.AddDate(1, 0, 0), nil
+	}
+	if t, err := time.Parse("2006-01", period); err == nil {
+		return t, t.AddDate(0, 1, 0), nil
+	}
+	if t, err := time.Parse("2006-01-02", period); err == nil {
+		return t, t.AddDate(0, 0, 1), nil
+	}
+	var year, quarter int
+	if _, err := fmt.Sscanf(period, "%4d-Q%1d", &year, &quarter); err == nil && len(period) == 7 && quarter >= 1 && quarter <= 4 {
+		from = time.Date(year, time.Month(3*quarter-2), 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(0, 3, 0), nil
+	}
+	return from, to, fmt.Errorf("invalid period %q, expected a year, quarter, month or day such as 2016, 2016-Q2, 2016-05 or 2016-05-31", period)
+}
+
+type taxReportRate struct {
+	TaxRateID    uint    `json:"tax_rate_id"`
+	Name         string  `json:"name"`
+	Jurisdiction string  `json:"jurisdiction"`
+	Percentage   float64 `json:"percentage"`
+	Currency     string  `json:"currency"`
+	Invoices     int     `json:"invoices"`
+	Taxable      int64   `json:"taxable"`
+	Tax          int64   `json:"tax"`
+}
+
+type taxReport struct {
+	Period     string          `json:"period"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Rates      []taxReportRate `json:"rates"`
+	Categories []categoryTotal `json:"categories,omitempty"`
+}
+
+// getTaxReport sums the tax collected in a `period` per tax rate and
+// currency, for filing. Tax is collected when an invoice is paid, so the
+// report covers the charges of the invoices paid during the period, with
+// the tax computed when they were saved. The percentage is the current
+// one of the rate. With `group_by=category`, the taxed charges are also
+// summed per category and rolled up to the categories above them.
+func (iv *invoicer) getTaxReport(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("period") == "" {
+		httpError(w, r, http.StatusBadRequest, "missing period, such as 2016, 2016-Q2, 2016-05 or 2016-05-31")
+		return
+	}
+	from, to, err := parseTaxPeriod(r.FormValue("period"))
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	byCategory, err := parseGroupBy(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	db := iv.dbFor(r)
+	report := taxReport{Period: r.FormValue("period"), From: from, To: to, Rates: []taxReportRate{}}
+	q := db.Table("charges").Joins("JOIN invoices ON invoices.id = charges.invoice_id").
+		Where("charges.deleted_at IS NULL AND invoices.deleted_at IS NULL").
+		Where("charges.tax_rate_id <> 0 AND invoices.status = ?", statusPaid)
+	q = inDateRange(q, "invoices.payment_date", from, to)
+	err = q.Select("charges.tax_rate_id, invoices.currency, COUNT(DISTINCT invoices.id) AS invoices, " +
+		"COALESCE(SUM(charges.amount), 0) AS taxable, COALESCE(SUM(charges.tax), 0) AS tax").
+		Group("charges.tax_rate_id, invoices.currency").
+		Order("charges.tax_rate_id asc, invoices.currency asc").Scan(&report.Rates).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to compute taxes: %s", err)
+		return
+	}
+	if byCategory {
+		report.Categories, err = iv.categoryTotals(q.Select("invoices.currency, charges.category_id, " +
+			"COALESCE(SUM(charges.amount), 0) AS amount, COALESCE(SUM(charges.tax), 0) AS tax").
+			Group("invoices.currency, charges.category_id"))
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "failed to compute taxes per category: %s", err)
+			return
+		}
+	}
+	var rates []TaxRate
+	err = db.Unscoped().Find(&rates).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve tax rates: %s", err)
+		return
+	}
+	for n := range report.Rates {
+		for _, rate := range rates {
+			if rate.ID == report.Rates[n].TaxRateID {
+				escapeTaxRate(&rate)
+				report.Rates[n].Name, report.Rates[n].Jurisdiction, report.Rates[n].Percentage = rate.Name, rate.Jurisdiction, rate.Percentage
+			}
+		}
+	}
+	writeJSON(w, r, http.StatusOK, report)
+	al := appLog{Message: fmt.Sprintf("reported taxes of %d rates for %s", len(report.Rates), report.Period), Action: "get-tax-report"}
+	al.log(r)
+}
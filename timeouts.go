@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Wolverinever1/invoicer-chapter2/config"
+	"github.com/jinzhu/gorm"
+)
+
+const ctxDB = "db"
+
+// contextConn is a connection to the database running queries with the
+// context of a request, so they are cancelled when the client goes away or
+// the deadline of the request passes. gorm doesn't pass contexts to the
+// database, requests query through a handle opened on a contextConn.
+type contextConn struct {
+	db  *sql.DB
+	ctx context.Context
+}
+
+func (c contextConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, args...)
+}
+
+func (c contextConn) Prepare(query string) (*sql.Stmt, error) {
+	return c.db.PrepareContext(c.ctx, query)
+}
+
+func (c contextConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, args...)
+}
+
+func (c contextConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
+}
+
+// Begin starts a transaction which is rolled back if the context ends
+// before it commits
+func (c contextConn) Begin() (*sql.Tx, error) {
+	return c.db.BeginTx(c.ctx, nil)
+}
+
+// requestDB is the database handle of a request, opened when the request
+// first queries the database
+type requestDB struct {
+	once sync.Once
+	db   *gorm.DB
+}
+
+// withContext opens a handle on the database of the invoicer which runs
+// its queries with ctx. Handles opened by gorm share the callbacks
+// registered at startup, which are never registered again per request.
+func (iv *invoicer) withContext(ctx context.Context) *gorm.DB {
+	db, err := gorm.Open(iv.db.Dialect().GetName(), contextConn{db: iv.db.DB(), ctx: ctx})
+	if err != nil {
+		// only sources that aren't connections can fail to open
+		applog.errorf("failed to bind database to request context: %s", err)
+		return iv.db
+	}
+	return db
+}
+
+// routeTimeout overrides the deadline of the requests to a route
+type routeTimeout struct {
+	method  string
+	path    string
+	timeout time.Duration
+}
+
+// matches returns true if the route covers a request, which it does when
+// their paths are equal or the route is a path ending with / under which
+// the request is
+func (rt routeTimeout) matches(r *http.Request) bool {
+	if rt.method != "" && rt.method != r.Method {
+		return false
+	}
+	return r.URL.Path == rt.path || (strings.HasSuffix(rt.path, "/") && strings.HasPrefix(r.URL.Path, rt.path))
+}
+
+// requestTimeout returns the timeout of the most specific route covering
+// a request, with the longest path and a method, or def if none does
+func requestTimeout(routes []routeTimeout, def time.Duration, r *http.Request) time.Duration {
+	var best *routeTimeout
+	for i, rt := range routes {
+		if !rt.matches(r) {
+			continue
+		}
+		if best == nil || len(rt.path) > len(best.path) ||
+			(len(rt.path) == len(best.path) && best.method == "" && rt.method != "") {
+			best = &routes[i]
+		}
+	}
+	if best == nil {
+		return def
+	}
+	return best.timeout
+}
+
+// timeoutRequests sets a deadline on the context of requests, which their
+// database queries are cancelled at, and answers requests still running at
+// their deadline with a 504 like http.TimeoutHandler does. Requests which
+// already sent their headers, such as streamed exports, are left to
+// complete. The long-lived streams served on streamPaths have no deadline,
+// and gRPC calls, which answer with trailers, are only given the deadline.
+func timeoutRequests(cfg config.Server, streamPaths ...string) Middleware {
+	var routes []routeTimeout
+	for _, entry := range cfg.RouteTimeouts {
+		// entries were checked by cfg.Validate
+		method, path, timeout, _ := config.RouteTimeout(entry)
+		routes = append(routes, routeTimeout{method: method, path: path, timeout: timeout})
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range streamPaths {
+				if r.URL.Path == p {
+					h.ServeHTTP(w, addtoContext(r, ctxDB, new(requestDB)))
+					return
+				}
+			}
+			timeout := requestTimeout(routes, cfg.RequestTimeout, r)
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = addtoContext(r.WithContext(ctx), ctxDB, new(requestDB))
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+				h.ServeHTTP(w, r)
+				return
+			}
+			tw := &timeoutWriter{w: w, h: make(http.Header)}
+			done := make(chan struct{})
+			go func() {
+				defer func() {
+					p := recover()
+					if p != nil && p != http.ErrAbortHandler {
+						p = handlerPanic{value: p, stack: debug.Stack()}
+					}
+					tw.mu.Lock()
+					tw.done, tw.panic = true, p
+					abandoned := tw.timedOut
+					tw.mu.Unlock()
+					if p != nil && abandoned {
+						logPanic(r, p)
+					}
+					close(done)
+				}()
+				h.ServeHTTP(tw, r)
+			}()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				tw.mu.Lock()
+				if !tw.done && !tw.wroteHeader && ctx.Err() == context.DeadlineExceeded {
+					tw.timedOut = true
+					tw.mu.Unlock()
+					al := appLog{ErrorCode: http.StatusGatewayTimeout,
+						Message: fmt.Sprintf("request timed out after %s", timeout)}
+					al.log(r)
+					writeError(w, r, http.StatusGatewayTimeout, apiError{Code: errTimeout, Message: al.Message})
+					return
+				}
+				tw.mu.Unlock()
+				<-done
+			}
+			if tw.panic != nil {
+				panic(tw.panic)
+			}
+			if !tw.wroteHeader {
+				copyHeader(w.Header(), tw.h)
+			}
+		})
+	}
+}
+
+// timeoutWriter is the response writer of a request served by
+// timeoutRequests. Handlers set their headers in a map of their own until
+// they write them, so the timeout response can be sent while they run, and
+// their writes fail with http.ErrHandlerTimeout once it was sent.
+type timeoutWriter struct {
+	w           http.ResponseWriter
+	h           http.Header
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	done        bool
+	panic       interface{}
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader {
+		// headers set after the response started are trailers
+		return tw.w.Header()
+	}
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(status)
+}
+
+func (tw *timeoutWriter) writeHeader(status int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	copyHeader(tw.w.Header(), tw.h)
+	tw.w.WriteHeader(status)
+	tw.wroteHeader = true
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeader(http.StatusOK)
+	return tw.w.Write(b)
+}
+
+// Flush lets handlers stream their responses
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeader(http.StatusOK)
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+// timedOut returns true if the deadline of a request passed, in which case
+// its errors are reported as timeouts
+func timedOut(r *http.Request) bool {
+	return r.Context().Err() == context.DeadlineExceeded
+}
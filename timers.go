@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timersMu serializes timer starts and stops so a user never ends up
+// with two running timers
+var timersMu sync.Mutex
+
+type timerRequest struct {
+	User        string `json:"user"`
+	ProjectID   uint   `json:"project_id"`
+	Description string `json:"description"`
+	Billable    bool   `json:"billable"`
+}
+
+// runningTimer returns the running time entry of a user, or an entry with
+// a zero ID if the user has no running timer
+func (iv *invoicer) runningTimer(user string) (te TimeEntry) {
+	iv.db.Where("user_name = ? AND running = ?", user, true).First(&te)
+	return
+}
+
+// getTimer returns the running timer of the user given in the `user` parameter
+func (iv *invoicer) getTimer(w http.ResponseWriter, r *http.Request) {
+	user := r.FormValue("user")
+	te := iv.runningTimer(user)
+	if te.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No running timer for user %q", user)
+		return
+	}
+	entries := []TimeEntry{te}
+	escapeTimeEntries(entries)
+	writeJSON(w, r, http.StatusOK, entries[0])
+}
+
+// postTimerStart starts a timer for a user on a project by creating a running
+// time entry. Users can only have one running timer at a time.
+func (iv *invoicer) postTimerStart(w http.ResponseWriter, r *http.Request) {
+	var tr timerRequest
+	if !readJSONBody(w, r, &tr) {
+		return
+	}
+	if strings.TrimSpace(tr.User) == "" {
+		httpError(w, r, http.StatusBadRequest, "user must not be empty")
+		return
+	}
+	var p Project
+	iv.dbFor(r).First(&p, tr.ProjectID)
+	if p.ID == 0 {
+		httpError(w, r, http.StatusBadRequest, "project %d does not exist", tr.ProjectID)
+		return
+	}
+	timersMu.Lock()
+	defer timersMu.Unlock()
+	if running := iv.runningTimer(tr.User); running.ID != 0 {
+		httpError(w, r, http.StatusConflict, "user %q already has a running timer in time entry %d", tr.User, running.ID)
+		return
+	}
+	te := TimeEntry{
+		ProjectID:   p.ID,
+		User:        tr.User,
+		StartedAt:   time.Now().UTC(),
+		Rate:        p.DefaultRate,
+		Billable:    tr.Billable,
+		Description: tr.Description,
+		Running:     true,
+	}
+	iv.dbFor(r).Create(&te)
+	entries := []TimeEntry{te}
+	escapeTimeEntries(entries)
+	writeJSON(w, r, http.StatusCreated, entries[0])
+	al := appLog{Message: fmt.Sprintf("started timer in time entry %d on project %d", te.ID, p.ID), Action: "post-timer-start"}
+	al.log(r)
+}
+
+// postTimerStop stops the running timer of a user and records its duration,
+// rounded up to the minute. Stopping is idempotent: when no timer is running,
+// the last time entry of the user is returned unchanged.
+func (iv *invoicer) postTimerStop(w http.ResponseWriter, r *http.Request) {
+	var tr timerRequest
+	if !readJSONBody(w, r, &tr) {
+		return
+	}
+	timersMu.Lock()
+	defer timersMu.Unlock()
+	te := iv.runningTimer(tr.User)
+	if te.ID == 0 {
+		iv.dbFor(r).Where("user_name = ?", tr.User).Order("started_at desc").First(&te)
+		if te.ID == 0 {
+			httpError(w, r, http.StatusNotFound, "No timer for user %q", tr.User)
+			return
+		}
+		entries := []TimeEntry{te}
+		escapeTimeEntries(entries)
+		writeJSON(w, r, http.StatusOK, entries[0])
+		return
+	}
+	te.DurationMinutes = int(math.Ceil(time.Since(te.StartedAt).Minutes()))
+	te.Running = false
+	iv.dbFor(r).Save(&te)
+	entries := []TimeEntry{te}
+	escapeTimeEntries(entries)
+	writeJSON(w, r, http.StatusOK, entries[0])
+	al := appLog{Message: fmt.Sprintf("stopped timer in time entry %d after %d minutes", te.ID, te.DurationMinutes), Action: "post-timer-stop"}
+	al.log(r)
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ctxSpan = "span"
+
+	// gormSpanKey carries the span of a request in the database handles
+	// used to serve it, and gormQuerySpanKey the span of a query in its
+	// scope
+	gormSpanKey      = "tracing:span"
+	gormQuerySpanKey = "tracing:query_span"
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+
+	// spans are exported in batches of up to spanBatchSize, at least every
+	// spanExportInterval, and dropped when spanQueueSize of them are waiting
+	spanBatchSize      = 512
+	spanExportInterval = 5 * time.Second
+	spanQueueSize      = 4096
+)
+
+// tracer records the spans of requests and of the database queries made to
+// serve them, and exports them to an OpenTelemetry collector with OTLP over
+// HTTP, in its JSON encoding
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	// ratio of the traces started by the invoicer that are sampled,
+	// traces continued from a traceparent header follow its decision
+	ratio  float64
+	client *http.Client
+	queue  chan *span
+}
+
+// newTracer configures tracing from the standard OpenTelemetry variables:
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT,
+// OTEL_EXPORTER_OTLP_HEADERS, OTEL_SERVICE_NAME and OTEL_TRACES_SAMPLER_ARG.
+// Tracing is disabled when no endpoint is set.
+func newTracer() (*tracer, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		endpoint = strings.TrimSuffix(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	t := &tracer{
+		endpoint: endpoint,
+		headers:  make(map[string]string),
+		service:  os.Getenv("OTEL_SERVICE_NAME"),
+		ratio:    1,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, spanQueueSize),
+	}
+	if t.service == "" {
+		t.service = "invoicer"
+	}
+	for _, h := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if strings.TrimSpace(h) == "" {
+			continue
+		}
+		kv := strings.SplitN(h, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q, must be key=value", h)
+		}
+		t.headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if arg := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); arg != "" {
+		ratio, err := strconv.ParseFloat(arg, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q, must be a ratio between 0 and 1", arg)
+		}
+		t.ratio = ratio
+	}
+	go t.export()
+	return t, nil
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// span is an operation of a trace. Spans that aren't sampled are still
+// created, so their ids propagate, but never exported.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttribute
+	failed   bool
+	message  string
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+// startRequestSpan starts the span of a request, continuing the trace of its
+// traceparent header if it has a valid one
+func (t *tracer) startRequestSpan(r *http.Request, name string) *span {
+	s := &span{tracer: t, name: name, kind: spanKindServer, start: time.Now()}
+	randomBytes(s.spanID[:])
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+		return s
+	}
+	randomBytes(s.traceID[:])
+	// the low bytes of trace ids are random, so comparing them to the ratio
+	// samples the same traces in every instance
+	s.sampled = float64(binary.BigEndian.Uint64(s.traceID[8:])>>11)/(1<<53) < t.ratio
+	return s
+}
+
+// parseTraceparent reads a W3C traceparent header, such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return
+	}
+	if _, err = hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err = hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// traceparent formats the W3C traceparent header making s the parent of
+// the spans of another service
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", s.traceID, s.spanID, flags)
+}
+
+// child starts a span of the same trace with s as parent
+func (s *span) child(name string, kind int) *span {
+	c := &span{tracer: s.tracer, traceID: s.traceID, parentID: s.spanID, sampled: s.sampled,
+		name: name, kind: kind, start: time.Now()}
+	randomBytes(c.spanID[:])
+	return c
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	s.attrs = append(s.attrs, spanAttribute{key, value})
+}
+
+func (s *span) setError(format string, args ...interface{}) {
+	s.failed, s.message = true, fmt.Sprintf(format, args...)
+}
+
+// finish ends the span and queues it for export if it is sampled
+func (s *span) finish() {
+	s.end = time.Now()
+	if !s.sampled {
+		return
+	}
+	select {
+	case s.tracer.queue <- s:
+	default:
+		applog.warnf("dropped span %s, the export queue is full", s.name)
+	}
+}
+
+// export sends the queued spans to the collector in batches
+func (t *tracer) export() {
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.send(batch); err != nil {
+			applog.warnf("failed to export %d spans: %s", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// otlpValue is an attribute value of the OTLP JSON encoding, whose 64 bit
+// integers are strings
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case bool:
+		a.Value.BoolValue = &v
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// send posts spans to the collector as an OTLP ExportTraceServiceRequest
+func (t *tracer) send(batch []*span) error {
+	spans := make([]otlpSpan, len(batch))
+	for n, s := range batch {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			o.Attributes = append(o.Attributes, newOTLPAttribute(a.key, a.value))
+		}
+		if s.failed {
+			o.Status.Code, o.Status.Message = spanStatusError, s.message
+		}
+		spans[n] = o
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{
+					newOTLPAttribute("service.name", t.service),
+					newOTLPAttribute("service.version", version),
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "invoicer"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		hreq.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// traceRequests starts a span for every request, named after the route it
+// matches, and continues the trace of clients sending a traceparent header.
+// It runs after logRequest, so the span records the status and actor of the
+// access log, and adds the trace id to the logger of the request.
+func traceRequests(t *tracer, router *mux.Router) Middleware {
+	return func(h http.Handler) http.Handler {
+		if t == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := r.URL.Path
+			var match mux.RouteMatch
+			if router.Match(r, &match) && match.Route != nil {
+				if tpl, err := match.Route.GetPathTemplate(); err == nil {
+					route = tpl
+				}
+			}
+			s := t.startRequestSpan(r, r.Method+" "+route)
+			s.setAttribute("http.request.method", r.Method)
+			s.setAttribute("http.route", route)
+			s.setAttribute("url.path", r.URL.Path)
+			s.setAttribute("user_agent.original", r.UserAgent())
+			s.setAttribute("invoicer.request_id", requestID(r))
+			r = addtoContext(r, ctxSpan, s)
+			r = addtoContext(r, ctxLogger, requestLogger(r).with(logFields{"trace_id": hex.EncodeToString(s.traceID[:])}))
+			h.ServeHTTP(w, r)
+			if al, ok := r.Context().Value(ctxAccessLog).(*accessLog); ok {
+				status := al.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				s.setAttribute("http.response.status_code", status)
+				if status >= http.StatusInternalServerError {
+					s.setError("%s", http.StatusText(status))
+				}
+				if al.actor != "" {
+					s.setAttribute("enduser.id", al.actor)
+				}
+			}
+			s.finish()
+		})
+	}
+}
+
+// traceQueries registers gorm callbacks starting a span around every query
+// made with a database handle carrying the span of a request, as returned
+// by dbFor
+func traceQueries(callbacks *gorm.Callback) {
+	for _, c := range []struct {
+		processor *gorm.CallbackProcessor
+		op        string
+		name      string
+	}{
+		{callbacks.Create().Before("gorm:create"), "gorm:create", "INSERT"},
+		{callbacks.Query().Before("gorm:query"), "gorm:query", "SELECT"},
+		{callbacks.RowQuery().Before("gorm:row_query"), "gorm:row_query", "SELECT"},
+		{callbacks.Update().Before("gorm:update"), "gorm:update", "UPDATE"},
+		{callbacks.Delete().Before("gorm:delete"), "gorm:delete", "DELETE"},
+	} {
+		name := c.name
+		c.processor.Register("tracing:before_"+c.op[len("gorm:"):], func(scope *gorm.Scope) {
+			parent, ok := scope.Get(gormSpanKey)
+			if !ok {
+				return
+			}
+			scope.Set(gormQuerySpanKey, parent.(*span).child(name+" "+scope.TableName(), spanKindInternal))
+		})
+	}
+	for _, c := range []struct {
+		processor *gorm.CallbackProcessor
+		op        string
+	}{
+		{callbacks.Create().After("gorm:create"), "create"},
+		{callbacks.Query().After("gorm:query"), "query"},
+		{callbacks.RowQuery().After("gorm:row_query"), "row_query"},
+		{callbacks.Update().After("gorm:update"), "update"},
+		{callbacks.Delete().After("gorm:delete"), "delete"},
+	} {
+		c.processor.Register("tracing:after_"+c.op, finishQuerySpan)
+	}
+}
+
+func finishQuerySpan(scope *gorm.Scope) {
+	v, ok := scope.Get(gormQuerySpanKey)
+	if !ok {
+		return
+	}
+	s := v.(*span)
+	s.setAttribute("db.system", scope.Dialect().GetName())
+	s.setAttribute("db.sql.table", scope.TableName())
+	s.setAttribute("db.statement", scope.SQL)
+	s.setAttribute("db.rows_affected", scope.DB().RowsAffected)
+	if scope.HasError() && !scope.DB().RecordNotFound() {
+		s.setError("%s", scope.DB().Error)
+	}
+	s.finish()
+}
+
+// dbFor returns the database handle to use while serving r, which runs
+// queries with the context of the request and traces them as children of
+// its span. Background tasks, which have no request, get iv.db.
+func (iv *invoicer) dbFor(r *http.Request) *gorm.DB {
+	db := iv.db
+	if r == nil {
+		return db
+	}
+	if rdb, ok := r.Context().Value(ctxDB).(*requestDB); ok {
+		rdb.once.Do(func() { rdb.db = iv.withContext(r.Context()) })
+		db = rdb.db
+	}
+	if s, ok := r.Context().Value(ctxSpan).(*span); ok {
+		return db.Set(gormSpanKey, s)
+	}
+	return db
+}
+
+// invoicesFor returns the invoice store to use while serving r, which
+// queries like dbFor
+func (iv *invoicer) invoicesFor(r *http.Request) InvoiceStore {
+	if _, ok := iv.invoices.(*gormInvoiceStore); ok {
+		return newGormInvoiceStore(iv.dbFor(r))
+	}
+	return iv.invoices
+}
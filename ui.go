@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultWebTemplatesDir = "templates"
+	uiInvoicesPerPage      = 20
+	// uiBlankCharges is the number of empty charge rows added to invoice
+	// forms, a charge being added by filling one of them
+	uiBlankCharges = 3
+)
+
+// webPages lists the pages of the web interface, each rendered from its
+// template executed within layout.html
+var webPages = []string{"index", "invoices", "invoice", "invoice_form", "error", "shared_invoice"}
+
+var webFuncs = template.FuncMap{
+	"money": formatMinorUnits,
+	"date":  formatDate,
+}
+
+// formatDate formats a date as YYYY-MM-DD, leaving unset dates empty
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// webTemplates are the parsed pages of the web interface, by name
+type webTemplates map[string]*template.Template
+
+// loadWebTemplates parses the pages of the web interface from the
+// templates directory, or from dir when set
+func loadWebTemplates(dir string) (webTemplates, error) {
+	if dir == "" {
+		dir = defaultWebTemplatesDir
+	}
+	t := make(webTemplates)
+	for _, page := range webPages {
+		tmpl, err := template.New(page).Funcs(webFuncs).ParseFiles(
+			filepath.Join(dir, "layout.html"), filepath.Join(dir, page+".html"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse web template %s: %s", page, err)
+		}
+		t[page] = tmpl
+	}
+	return t, nil
+}
+
+// render sends a page of the web interface. Pages are rendered into a
+// buffer first so a failing template doesn't send half a page.
+func (iv *invoicer) render(w http.ResponseWriter, r *http.Request, status int, page string, data interface{}) {
+	var buf bytes.Buffer
+	err := iv.webTemplates[page].ExecuteTemplate(&buf, "layout", data)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to render %s page: %s", page, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self';")
+	w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// renderError logs an error like httpError, but responds with a page of
+// the web interface
+func (iv *invoicer) renderError(w http.ResponseWriter, r *http.Request, status int, format string, args ...interface{}) {
+	al := appLog{ErrorCode: status, Message: fmt.Sprintf(format, args...)}
+	al.log(r)
+	iv.render(w, r, status, "error", struct {
+		Status  string
+		Message string
+	}{fmt.Sprintf("%d %s", status, http.StatusText(status)), al.Message})
+}
+
+func (iv *invoicer) renderServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	if se, ok := err.(serviceError); ok {
+		iv.renderError(w, r, se.Status, "%s", se.Error())
+		return
+	}
+	iv.renderError(w, r, http.StatusInternalServerError, "%s", err)
+}
+
+type uiInvoicesPage struct {
+	Invoices []Invoice
+	Status   string
+	Statuses []string
+	Page     int
+	Pages    int
+	Total    int
+	Next     string
+	Prev     string
+}
+
+// getUIInvoices renders a page of the invoices matching the filters of
+// GET /invoices
+func (iv *invoicer) getUIInvoices(w http.ResponseWriter, r *http.Request) {
+	filters, err := parseInvoiceFilters(r)
+	if err != nil {
+		iv.renderError(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	page := 1
+	if r.FormValue("page") != "" {
+		page, err = strconv.Atoi(r.FormValue("page"))
+		if err != nil || page < 1 {
+			iv.renderError(w, r, http.StatusBadRequest, "invalid page parameter %q", r.FormValue("page"))
+			return
+		}
+	}
+	data := uiInvoicesPage{Status: filters.Status, Statuses: invoiceStatuses, Page: page}
+	data.Invoices, data.Total, err = iv.findInvoices(r, filters, (page-1)*uiInvoicesPerPage, uiInvoicesPerPage)
+	if err != nil {
+		iv.renderError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	data.Pages = (data.Total + uiInvoicesPerPage - 1) / uiInvoicesPerPage
+	if data.Pages == 0 {
+		data.Pages = 1
+	}
+	if page*uiInvoicesPerPage < data.Total {
+		data.Next = pageLink(r, page+1, uiInvoicesPerPage)
+	}
+	if page > 1 {
+		data.Prev = pageLink(r, page-1, uiInvoicesPerPage)
+	}
+	iv.render(w, r, http.StatusOK, "invoices", data)
+}
+
+// getUIInvoice renders an invoice with its charges
+func (iv *invoicer) getUIInvoice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	i1, err := iv.findInvoice(r, uint(id), false)
+	if err != nil {
+		iv.renderServiceError(w, r, err)
+		return
+	}
+	charges, err := iv.invoicesFor(r).Charges(i1, 0, maxChargesPageSize)
+	if err != nil {
+		iv.renderError(w, r, http.StatusInternalServerError, "failed to retrieve charges of invoice %d: %s", i1.ID, err)
+		return
+	}
+	i1.Taxes, err = iv.invoiceTaxes(r, i1)
+	if err != nil {
+		iv.renderError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	var duplicates []Invoice
+	if iv.duplicateWindowDays > 0 {
+		duplicates, err = iv.findDuplicates(r, i1, iv.duplicateWindowDays)
+		if err != nil {
+			applog.warnf("failed to look for duplicates of invoice %d: %s", i1.ID, err)
+		}
+	}
+	iv.render(w, r, http.StatusOK, "invoice", struct {
+		Invoice    Invoice
+		Charges    []Charge
+		Duplicates []Invoice
+	}{i1, charges, duplicates})
+}
+
+type chargeForm struct {
+	Type        string
+	Description string
+	Amount      string
+	CategoryID  uint
+	TaxRateID   uint
+}
+
+// invoiceForm holds the fields of the invoice form as they are displayed,
+// so invalid values are shown back to the user along with the errors
+type invoiceForm struct {
+	ID         uint
+	IfMatch    string
+	CustomerID string
+	Status     string
+	Currency   string
+	DueDate    string
+	Charges    []chargeForm
+
+	Statuses  []string
+	TaxRates  []TaxRate
+	Errors    validationErrors
+	CSRFToken string
+}
+
+// newInvoiceForm returns the form editing an invoice and its charges
+func newInvoiceForm(i Invoice, charges []Charge) invoiceForm {
+	f := invoiceForm{ID: i.ID, Status: i.Status, Currency: i.Currency, DueDate: formatDate(i.DueDate)}
+	if i.ID != 0 {
+		f.IfMatch = invoiceETag(i)
+		f.Statuses = append([]string{i.Status}, invoiceTransitions[i.Status]...)
+	}
+	if i.CustomerID != 0 {
+		f.CustomerID = strconv.FormatUint(uint64(i.CustomerID), 10)
+	}
+	for _, c := range charges {
+		f.Charges = append(f.Charges, chargeForm{c.Type, c.Description, formatMinorUnits(c.Amount, c.Currency), c.CategoryID, c.TaxRateID})
+	}
+	return f
+}
+
+// readInvoiceForm reads the fields of a submitted invoice form. Charges are
+// submitted as rows of charge_type, charge_description, charge_amount,
+// charge_category_id and charge_tax_rate_id fields.
+func readInvoiceForm(r *http.Request) invoiceForm {
+	f := invoiceForm{
+		IfMatch:    r.PostFormValue("if_match"),
+		CustomerID: strings.TrimSpace(r.PostFormValue("customer_id")),
+		Status:     r.PostFormValue("status"),
+		Currency:   strings.ToUpper(strings.TrimSpace(r.PostFormValue("currency"))),
+		DueDate:    strings.TrimSpace(r.PostFormValue("due_date")),
+	}
+	row := func(name string, n int) string {
+		if values := r.PostForm[name]; n < len(values) {
+			return strings.TrimSpace(values[n])
+		}
+		return ""
+	}
+	for n := range r.PostForm["charge_type"] {
+		c := chargeForm{Type: row("charge_type", n), Description: row("charge_description", n), Amount: row("charge_amount", n)}
+		categoryID, _ := strconv.ParseUint(row("charge_category_id", n), 10, 32)
+		c.CategoryID = uint(categoryID)
+		taxRateID, _ := strconv.ParseUint(row("charge_tax_rate_id", n), 10, 32)
+		c.TaxRateID = uint(taxRateID)
+		if c.Type != "" || c.Description != "" || c.Amount != "" {
+			f.Charges = append(f.Charges, c)
+		}
+	}
+	return f
+}
+
+// invoice converts the fields of the form to an invoice in currency,
+// reporting those that can't be parsed. Amounts of charges are entered in
+// major units. Invoices marked as paid are considered paid now.
+func (f invoiceForm) invoice(currency string) (i Invoice, errs validationErrors) {
+	i.Status, i.Currency = f.Status, currency
+	if f.CustomerID != "" {
+		customerID, err := strconv.ParseUint(f.CustomerID, 10, 32)
+		if err != nil {
+			errs.add("customer_id", "invalid customer id %q", f.CustomerID)
+		}
+		i.CustomerID = uint(customerID)
+	}
+	if f.DueDate != "" {
+		dueDate, err := time.Parse("2006-01-02", f.DueDate)
+		if err != nil {
+			errs.add("due_date", "invalid date %q, must be formatted as YYYY-MM-DD", f.DueDate)
+		}
+		i.DueDate = dueDate
+	}
+	if i.Status == statusPaid {
+		i.PaymentDate = time.Now().UTC()
+	}
+	for n, c := range f.Charges {
+		amount, err := strconv.ParseFloat(c.Amount, 64)
+		if err != nil {
+			errs.add(fmt.Sprintf("charges[%d].amount", n), "invalid amount %q", c.Amount)
+		}
+		i.Charges = append(i.Charges, Charge{
+			Type:        c.Type,
+			Description: c.Description,
+			Amount:      toMinorUnits(amount, currency),
+			Currency:    currency,
+			CategoryID:  c.CategoryID,
+			TaxRateID:   c.TaxRateID,
+		})
+	}
+	return i, errs
+}
+
+// formErrors returns the errors of the invoice service that are shown on
+// forms: invalid fields and changes conflicting with the stored invoice
+func formErrors(err error) (validationErrors, bool) {
+	se, ok := err.(serviceError)
+	if !ok {
+		return nil, false
+	}
+	if len(se.Fields) > 0 {
+		return se.Fields, true
+	}
+	if se.Status == http.StatusConflict || se.Status == http.StatusPreconditionFailed {
+		return validationErrors{{Message: se.Message}}, true
+	}
+	return nil, false
+}
+
+// renderInvoiceForm renders an invoice form with a fresh CSRF token and
+// empty charge rows to add charges
+func (iv *invoicer) renderInvoiceForm(w http.ResponseWriter, r *http.Request, status int, f invoiceForm) {
+	if f.Statuses == nil {
+		f.Statuses = []string{statusDraft, statusSent, statusPaid}
+	}
+	for n := 0; n < uiBlankCharges; n++ {
+		f.Charges = append(f.Charges, chargeForm{})
+	}
+	err := iv.dbFor(r).Order("jurisdiction asc, name asc").Find(&f.TaxRates).Error
+	if err != nil {
+		iv.renderError(w, r, http.StatusInternalServerError, "failed to retrieve tax rates: %s", err)
+		return
+	}
+	f.CSRFToken = createCSRFToken()
+	iv.render(w, r, status, "invoice_form", f)
+}
+
+func (iv *invoicer) getUINewInvoice(w http.ResponseWriter, r *http.Request) {
+	iv.renderInvoiceForm(w, r, http.StatusOK, invoiceForm{Status: statusDraft, Currency: defaultCurrency()})
+}
+
+// postUIInvoices creates an invoice from the new invoice form, and
+// redirects to it
+func (iv *invoicer) postUIInvoices(w http.ResponseWriter, r *http.Request) {
+	f := readInvoiceForm(r)
+	if f.Currency == "" {
+		f.Currency = defaultCurrency()
+	}
+	i1, errs := f.invoice(f.Currency)
+	if len(errs) == 0 {
+		var err error
+		i1, err = iv.createInvoice(r, i1)
+		if err != nil {
+			var ok bool
+			if errs, ok = formErrors(err); !ok {
+				iv.renderServiceError(w, r, err)
+				return
+			}
+		}
+	}
+	if len(errs) > 0 {
+		f.Errors = errs
+		iv.renderInvoiceForm(w, r, http.StatusUnprocessableEntity, f)
+		return
+	}
+	al := appLog{Message: fmt.Sprintf("created invoice %d", i1.ID), Action: "post-ui-invoices"}
+	al.log(r)
+	http.Redirect(w, r, fmt.Sprintf("/ui/invoice/%d", i1.ID), http.StatusSeeOther)
+}
+
+// getUIEditInvoice renders the form editing an invoice, which carries the
+// version of the invoice so concurrent changes are not overwritten
+func (iv *invoicer) getUIEditInvoice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	i1, err := iv.findInvoice(r, uint(id), false)
+	if err != nil {
+		iv.renderServiceError(w, r, err)
+		return
+	}
+	charges, err := iv.invoicesFor(r).Charges(i1, 0, maxChargesPageSize)
+	if err != nil {
+		iv.renderError(w, r, http.StatusInternalServerError, "failed to retrieve charges of invoice %d: %s", i1.ID, err)
+		return
+	}
+	iv.renderInvoiceForm(w, r, http.StatusOK, newInvoiceForm(i1, charges))
+}
+
+// postUIInvoice updates an invoice from its edit form, replacing its
+// charges, and redirects to it
+func (iv *invoicer) postUIInvoice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	current, err := iv.findInvoice(r, uint(id), false)
+	if err != nil {
+		iv.renderServiceError(w, r, err)
+		return
+	}
+	f := readInvoiceForm(r)
+	f.ID, f.Currency = current.ID, current.Currency
+	f.Statuses = append([]string{current.Status}, invoiceTransitions[current.Status]...)
+	next, errs := f.invoice(current.Currency)
+	if len(errs) == 0 {
+		_, err = iv.updateInvoice(r, current.ID, invoiceUpdate{
+			Action:         "update",
+			IfMatch:        f.IfMatch,
+			ReplaceCharges: true,
+			Apply: func(i *Invoice) error {
+				i.CustomerID, i.Status, i.DueDate, i.Charges = next.CustomerID, next.Status, next.DueDate, next.Charges
+				if i.PaymentDate.IsZero() {
+					i.PaymentDate = next.PaymentDate
+				}
+				return nil
+			},
+		})
+		if err != nil {
+			var ok bool
+			if errs, ok = formErrors(err); !ok {
+				iv.renderServiceError(w, r, err)
+				return
+			}
+		}
+	}
+	if len(errs) > 0 {
+		f.Errors = errs
+		iv.renderInvoiceForm(w, r, http.StatusUnprocessableEntity, f)
+		return
+	}
+	al := appLog{Message: fmt.Sprintf("updated invoice %d", current.ID), Action: "post-ui-invoice"}
+	al.log(r)
+	http.Redirect(w, r, fmt.Sprintf("/ui/invoice/%d", current.ID), http.StatusSeeOther)
+}
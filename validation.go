@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxChargeDescriptionLength = 1024
+
+// fieldError describes why the value of a field of a request body is invalid
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors lists every invalid field of a request body
+type validationErrors []fieldError
+
+func (v validationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, fe := range v {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, ", ")
+}
+
+func (v *validationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// writeValidationErrors responds with a 422 listing the invalid fields
+func writeValidationErrors(w http.ResponseWriter, r *http.Request, errs validationErrors) {
+	al := appLog{ErrorCode: http.StatusUnprocessableEntity, Message: fmt.Sprintf("validation failed: %s", errs)}
+	al.log(r)
+	writeError(w, r, http.StatusUnprocessableEntity, apiError{Code: errValidation, Message: "validation failed", Fields: errs})
+}
+
+// validateCharge checks the fields of a charge of an invoice in currency,
+// reporting them under prefix
+func validateCharge(errs *validationErrors, prefix string, c Charge, currency string, categories map[uint]*Category, taxRates map[uint]*TaxRate) {
+	if strings.TrimSpace(c.Type) == "" {
+		errs.add(prefix+"type", "must not be empty")
+	}
+	if c.Amount < 0 {
+		errs.add(prefix+"amount", "must not be negative")
+	}
+	if c.Currency != currency {
+		errs.add(prefix+"currency", "must match the currency of the invoice, %s", currency)
+	}
+	if len(c.Description) > maxChargeDescriptionLength {
+		errs.add(prefix+"description", "must not exceed %d characters", maxChargeDescriptionLength)
+	}
+	if c.CategoryID != 0 && categories[c.CategoryID] == nil {
+		errs.add(prefix+"category_id", "category %d does not exist", c.CategoryID)
+	}
+	if c.TaxRateID != 0 && taxRates[c.TaxRateID] == nil {
+		errs.add(prefix+"tax_rate_id", "tax rate %d does not exist", c.TaxRateID)
+	}
+}
+
+// validateInvoice checks the fields of an invoice and its charges before
+// they are stored. New invoices cannot be due in the past. The error is
+// set if the customer, categories or tax rates couldn't be retrieved, the
+// invoice not being checked.
+func (iv *invoicer) validateInvoice(i Invoice, isNew bool) (validationErrors, error) {
+	var errs validationErrors
+	if !validInvoiceStatus(i.Status) {
+		errs.add("status", "unknown status %q", i.Status)
+	}
+	if i.Amount < 0 {
+		errs.add("amount", "must not be negative")
+	}
+	if !validCurrency(i.Currency) {
+		errs.add("currency", "unknown ISO 4217 currency %q", i.Currency)
+	}
+	if i.DueDate.IsZero() {
+		errs.add("due_date", "must be set")
+	} else if isNew && i.DueDate.Before(time.Now().UTC().Truncate(24*time.Hour)) {
+		errs.add("due_date", "must not be in the past")
+	}
+	if i.IsPaid && i.PaymentDate.IsZero() {
+		errs.add("payment_date", "must be set on paid invoices")
+	}
+	exists, err := iv.customerExists(i.CustomerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve customer %d: %s", i.CustomerID, err)
+	}
+	if !exists {
+		errs.add("customer_id", "customer %d does not exist", i.CustomerID)
+	}
+	if len(i.Charges) > iv.maxCharges {
+		errs.add("charges", "must not exceed %d charges", iv.maxCharges)
+		return errs, nil
+	}
+	if len(i.Charges) > 0 {
+		categories, err := iv.loadCategories()
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve categories: %s", err)
+		}
+		taxRates, err := iv.loadTaxRates()
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve tax rates: %s", err)
+		}
+		for n, c := range i.Charges {
+			validateCharge(&errs, fmt.Sprintf("charges[%d].", n), c, i.Currency, categories, taxRates)
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	eventInvoiceCreated  = "invoice.created"
+	eventInvoiceUpdated  = "invoice.updated"
+	eventInvoicePaid     = "invoice.paid"
+	eventInvoiceDeleted  = "invoice.deleted"
+	eventInvoiceRestored = "invoice.restored"
+	eventInvoiceReminder = "invoice.reminder"
+
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	minWebhookSecretLength = 16
+
+	// deliveries are retried with an exponential backoff starting at
+	// webhookRetryDelay, and abandoned after maxWebhookAttempts
+	maxWebhookAttempts     = 8
+	webhookRetryDelay      = 30 * time.Second
+	webhookPollInterval    = 5 * time.Second
+	webhookDeliveryTimeout = 10 * time.Second
+	webhookDeliveryBatch   = 100
+)
+
+var webhookEvents = []string{eventInvoiceCreated, eventInvoiceUpdated, eventInvoicePaid, eventInvoiceDeleted, eventInvoiceRestored,
+	eventInvoiceReminder}
+
+// Webhook is a subscriber notified of invoice lifecycle events. Payloads
+// are signed with the secret of the subscriber. Events is a comma
+// separated list of the events sent to the subscriber, all by default.
+type Webhook struct {
+	gorm.Model
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	Events string `json:"events"`
+	Active bool   `json:"active"`
+}
+
+// WebhookDelivery is a notification queued for a subscriber. Deliveries
+// are stored so they are retried across restarts of the invoicer.
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookID     uint      `gorm:"index" json:"webhook_id"`
+	Event         string    `json:"event"`
+	Payload       string    `gorm:"type:text" json:"payload"`
+	Status        string    `gorm:"index" json:"status"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `gorm:"index" json:"next_attempt_at"`
+	LastError     string    `json:"last_error"`
+}
+
+// subscribed returns true if the webhook wants to receive event
+func (wh Webhook) subscribed(event string) bool {
+	if !wh.Active {
+		return false
+	}
+	if strings.TrimSpace(wh.Events) == "" {
+		return true
+	}
+	for _, e := range strings.Split(wh.Events, ",") {
+		if strings.TrimSpace(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWebhook(wh Webhook) error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https url")
+	}
+	if len(wh.Secret) < minWebhookSecretLength {
+		return fmt.Errorf("secret must be at least %d characters long", minWebhookSecretLength)
+	}
+	if strings.TrimSpace(wh.Events) != "" {
+		for _, e := range strings.Split(wh.Events, ",") {
+			known := false
+			for _, we := range webhookEvents {
+				if strings.TrimSpace(e) == we {
+					known = true
+				}
+			}
+			if !known {
+				return fmt.Errorf("unknown event %q, use one of %s", strings.TrimSpace(e), strings.Join(webhookEvents, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// escapeWebhook hides the secret of a webhook before it is returned
+func escapeWebhook(wh *Webhook) {
+	wh.URL = html.EscapeString(wh.URL)
+	wh.Events = html.EscapeString(wh.Events)
+	wh.Secret = ""
+}
+
+func (iv *invoicer) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	var webhooks []Webhook
+	err := iv.dbFor(r).Order("id asc").Find(&webhooks).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve webhooks: %s", err)
+		return
+	}
+	for i := range webhooks {
+		escapeWebhook(&webhooks[i])
+	}
+	writeJSON(w, r, http.StatusOK, webhooks)
+}
+
+func (iv *invoicer) getWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var wh Webhook
+	iv.dbFor(r).First(&wh, vars["id"])
+	if wh.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No webhook id %s", vars["id"])
+		return
+	}
+	escapeWebhook(&wh)
+	writeJSON(w, r, http.StatusOK, wh)
+}
+
+func (iv *invoicer) postWebhook(w http.ResponseWriter, r *http.Request) {
+	wh := Webhook{Active: true}
+	if !readJSONBody(w, r, &wh) {
+		return
+	}
+	wh.ID = 0
+	err := validateWebhook(wh)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid webhook: %s", err)
+		return
+	}
+	iv.dbFor(r).Create(&wh)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("created webhook %d", wh.ID)))
+	al := appLog{Message: fmt.Sprintf("created webhook %d", wh.ID), Action: "post-webhook"}
+	al.log(r)
+}
+
+// putWebhook updates a webhook. The secret is kept if the update doesn't
+// provide a new one.
+func (iv *invoicer) putWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var wh Webhook
+	iv.dbFor(r).First(&wh, vars["id"])
+	if wh.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No webhook id %s", vars["id"])
+		return
+	}
+	id, secret := wh.ID, wh.Secret
+	wh.Secret = ""
+	if !readJSONBody(w, r, &wh) {
+		return
+	}
+	wh.ID = id
+	if wh.Secret == "" {
+		wh.Secret = secret
+	}
+	err := validateWebhook(wh)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid webhook: %s", err)
+		return
+	}
+	iv.dbFor(r).Save(&wh)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("updated webhook %d", wh.ID)))
+	al := appLog{Message: fmt.Sprintf("updated webhook %d", wh.ID), Action: "put-webhook"}
+	al.log(r)
+}
+
+func (iv *invoicer) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var wh Webhook
+	iv.dbFor(r).First(&wh, vars["id"])
+	if wh.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No webhook id %s", vars["id"])
+		return
+	}
+	iv.dbFor(r).Delete(&wh)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("deleted webhook %d", wh.ID)))
+	al := appLog{Message: fmt.Sprintf("deleted webhook %d", wh.ID), Action: "delete-webhook"}
+	al.log(r)
+}
+
+// getWebhookDeliveries lists the last deliveries of a webhook, to debug
+// subscribers that fail to receive notifications
+func (iv *invoicer) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var wh Webhook
+	iv.dbFor(r).First(&wh, vars["id"])
+	if wh.ID == 0 {
+		httpError(w, r, http.StatusNotFound, "No webhook id %s", vars["id"])
+		return
+	}
+	deliveries := []WebhookDelivery{}
+	err := iv.dbFor(r).Where("webhook_id = ?", wh.ID).Order("id desc").Limit(webhookDeliveryBatch).Find(&deliveries).Error
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to retrieve deliveries of webhook %d: %s", wh.ID, err)
+		return
+	}
+	for i := range deliveries {
+		deliveries[i].LastError = html.EscapeString(deliveries[i].LastError)
+	}
+	writeJSON(w, r, http.StatusOK, deliveries)
+}
+
+type webhookPayload struct {
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Invoice   Invoice   `json:"invoice"`
+	// DaysLate is set in reminders of overdue invoices
+	DaysLate int `json:"days_late,omitempty"`
+}
+
+// fireWebhooks queues a delivery of event to every subscriber of the event,
+// and publishes it to the event streams. Charges are not part of the
+// payload, subscribers retrieve them from the API if they need them.
+func (iv *invoicer) fireWebhooks(event string, i Invoice) {
+	p := webhookPayload{Event: event, CreatedAt: time.Now().UTC(), Invoice: i}
+	iv.events.publish(p)
+	iv.queueWebhooks(p)
+}
+
+// queueWebhooks queues a delivery of a payload to every subscriber of its
+// event
+func (iv *invoicer) queueWebhooks(p webhookPayload) {
+	event, i := p.Event, p.Invoice
+	var webhooks []Webhook
+	err := iv.db.Where("active = ?", true).Find(&webhooks).Error
+	if err != nil {
+		applog.errorf("failed to retrieve webhooks for %s of invoice %d: %s", event, i.ID, err)
+		return
+	}
+	p.Invoice.Charges = nil
+	p.Invoice.ChargesSummary = nil
+	payload, err := json.Marshal(p)
+	if err != nil {
+		applog.errorf("failed to marshal %s of invoice %d: %s", event, i.ID, err)
+		return
+	}
+	queued := false
+	for _, wh := range webhooks {
+		if !wh.subscribed(event) {
+			continue
+		}
+		err = iv.db.Create(&WebhookDelivery{
+			WebhookID:     wh.ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        deliveryPending,
+			NextAttemptAt: time.Now().UTC(),
+		}).Error
+		if err != nil {
+			applog.errorf("failed to queue %s of invoice %d for webhook %d: %s", event, i.ID, wh.ID, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		// wake up the dispatcher without blocking if it is already busy
+		select {
+		case iv.webhookWakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// fireInvoiceUpdated notifies subscribers of an update to an invoice, and
+// of its payment if the update paid it
+func (iv *invoicer) fireInvoiceUpdated(before, after Invoice) {
+	iv.fireWebhooks(eventInvoiceUpdated, after)
+	if after.IsPaid && !before.IsPaid {
+		iv.fireWebhooks(eventInvoicePaid, after)
+	}
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 of a payload
+func signWebhookPayload(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// dispatchWebhooks sends pending deliveries whenever fireWebhooks queues
+// new ones, and regularly to retry failed ones
+func (iv *invoicer) dispatchWebhooks() {
+	client := &http.Client{Timeout: webhookDeliveryTimeout}
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-iv.webhookWakeup:
+		case <-ticker.C:
+		}
+		var deliveries []WebhookDelivery
+		err := iv.db.Where("status = ? AND next_attempt_at <= ?", deliveryPending, time.Now().UTC()).
+			Order("id asc").Limit(webhookDeliveryBatch).Find(&deliveries).Error
+		if err != nil {
+			applog.errorf("failed to retrieve pending webhook deliveries: %s", err)
+			continue
+		}
+		for _, d := range deliveries {
+			iv.deliverWebhook(client, d)
+		}
+	}
+}
+
+// deliverWebhook makes one attempt at sending a delivery and records its
+// outcome, scheduling a retry on failure
+func (iv *invoicer) deliverWebhook(client *http.Client, d WebhookDelivery) {
+	var wh Webhook
+	iv.db.First(&wh, d.WebhookID)
+	if wh.ID == 0 || !wh.Active {
+		iv.db.Model(&d).Updates(map[string]interface{}{"status": deliveryFailed, "last_error": "webhook deleted or inactive"})
+		return
+	}
+	err := postWebhook(client, wh, d)
+	d.Attempts++
+	if err == nil {
+		iv.db.Model(&d).Updates(map[string]interface{}{"status": deliveryDelivered, "attempts": d.Attempts, "last_error": ""})
+		return
+	}
+	updates := map[string]interface{}{"attempts": d.Attempts, "last_error": err.Error()}
+	if d.Attempts >= maxWebhookAttempts {
+		updates["status"] = deliveryFailed
+		applog.errorf("giving up on delivery %d of %s to webhook %d after %d attempts: %s", d.ID, d.Event, wh.ID, d.Attempts, err)
+	} else {
+		updates["next_attempt_at"] = time.Now().UTC().Add(webhookRetryDelay << uint(d.Attempts-1))
+	}
+	iv.db.Model(&d).Updates(updates)
+}
+
+func postWebhook(client *http.Client, wh Webhook, d WebhookDelivery) error {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "invoicer-webhooks")
+	req.Header.Set("X-Invoicer-Event", d.Event)
+	req.Header.Set("X-Invoicer-Delivery", fmt.Sprintf("%d", d.ID))
+	req.Header.Set("X-Invoicer-Signature", "sha256="+signWebhookPayload(wh.Secret, d.Payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("subscriber returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// xlsxWriter streams rows into a single sheet Excel workbook. Strings are
+// stored inline so the workbook doesn't need a shared strings table, and
+// rows are written as they come so large exports aren't held in memory.
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet io.Writer
+	err   error
+}
+
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+func newXLSXWriter(w io.Writer, sheetName string) (*xlsxWriter, error) {
+	x := &xlsxWriter{zw: zip.NewWriter(w)}
+	for _, part := range xlsxParts {
+		f, err := x.zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(f, part.content)
+	}
+	f, err := x.zw.Create("xl/workbook.xml")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" `+
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">`+
+		`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`, xlsxEscape(sheetName))
+	x.sheet, err = x.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(x.sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return x, nil
+}
+
+// WriteRow appends a row to the sheet. Numbers are stored as numeric cells,
+// everything else as text.
+func (x *xlsxWriter) WriteRow(cells []interface{}) error {
+	if x.err != nil {
+		return x.err
+	}
+	var b strings.Builder
+	b.WriteString("<row>")
+	for _, cell := range cells {
+		switch v := cell.(type) {
+		case int, uint, float64:
+			fmt.Fprintf(&b, "<c><v>%v</v></c>", v)
+		default:
+			fmt.Fprintf(&b, `<c t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, xlsxEscape(fmt.Sprint(v)))
+		}
+	}
+	b.WriteString("</row>")
+	_, x.err = io.WriteString(x.sheet, b.String())
+	return x.err
+}
+
+// Close terminates the sheet and the archive
+func (x *xlsxWriter) Close() error {
+	if x.err != nil {
+		return x.err
+	}
+	io.WriteString(x.sheet, "</sheetData></worksheet>")
+	return x.zw.Close()
+}
+
+// xlsxEscape escapes text for XML, dropping the control characters XML
+// cannot represent
+func xlsxEscape(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 32 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, s)
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}